@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With -min-age, versions published more recently than the given duration
+// (according to the time reported by the module proxy) are never selected as
+// the target of an upgrade, as a guard against upgrading to a release that
+// may soon be retracted. When looking for the highest version, the highest
+// one that's old enough is selected instead.
+
+// ageFlag is a duration flag that, unlike flag.Duration, also accepts a
+// number of days (e.g. 14d), since release ages are usually given in days
+type ageFlag time.Duration
+
+func (a *ageFlag) String() string {
+	if *a == 0 {
+		return ""
+	}
+	d := time.Duration(*a)
+	if d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+	return d.String()
+}
+
+func (a *ageFlag) Set(value string) error {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid number of days: %s", value)
+		}
+		*a = ageFlag(time.Duration(n) * 24 * time.Hour)
+		return nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if d < 0 {
+		return fmt.Errorf("negative duration: %s", value)
+	}
+	*a = ageFlag(d)
+	return nil
+}
+
+// oldEnough reports whether the given version of a module was published at
+// least -min-age ago (always true without -min-age)
+func oldEnough(ctx context.Context, path, version string) (bool, error) {
+	if minAge == 0 {
+		return true, nil
+	}
+	published, err := publishTime(ctx, path, version)
+	if err != nil {
+		return false, fmt.Errorf("error getting publish time of %s@%s: %s", path, version, err)
+	}
+	return checkAge(path, version, published), nil
+}
+
+// checkAge reports whether a version published at the given time is at least
+// -min-age old
+func checkAge(path, version string, published time.Time) bool {
+	age := time.Since(published)
+	if minAge == 0 || age >= time.Duration(minAge) {
+		return true
+	}
+	if *verbose {
+		fmt.Printf("%s@%s: published %s ago, less than -min-age %s\n", path, version, age.Round(time.Hour), minAge.String())
+	}
+	return false
+}
+
+// publishedSuffix returns the date the given version of a module was
+// published, formatted to follow the version in output (e.g. " (published
+// 2024-05-01)"), or an empty string if it can't be found
+func publishedSuffix(ctx context.Context, path, version string) string {
+	published, err := publishTime(ctx, path, version)
+	if err != nil || published.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf(" (published %s)", formatDate(published))
+}
+
+// formatDate formats a publish time as a date (in UTC), or returns an empty
+// string for the zero time
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.DateOnly)
+}
+
+// publishTime returns the time the given version of a module was published,
+// according to the module proxy (or version control, for modules fetched
+// directly)
+func publishTime(ctx context.Context, path, version string) (time.Time, error) {
+	body, err := proxyFetch(ctx, path, "@v/"+escapeVersion(version)+".info")
+	if errors.Is(err, errDirect) {
+		results, err := listModules(ctx, fmt.Sprintf("%s@%s", path, version))
+		if err != nil {
+			return time.Time{}, err
+		}
+		if len(results) == 0 || results[0].Error != nil || results[0].Time == nil {
+			return time.Time{}, fmt.Errorf("no module info returned for %s@%s", path, version)
+		}
+		return *results[0].Time, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	info, err := decodeInfo(body)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error decoding module info: %s", err)
+	}
+	return info.Time, nil
+}
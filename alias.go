@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/tools/go/packages"
+)
+
+// When an import's path is rewritten, the name of the package it refers to can
+// change with it (e.g. when moving to a fork that's named differently, or to a
+// new major version whose package is named after it, like barv2), which would
+// break every reference to the package. Imports without an explicit name are
+// given the package's old name, so that the references keep compiling:
+//
+//	import "example.com/bar"
+//
+// becomes:
+//
+//	import bar "example.com/bar/v2"
+type packageNamer struct {
+	ctx     context.Context
+	modFile *modfile.File // The updated go.mod file
+	dir     string        // The module directory
+
+	names   map[string]string // Package names, keyed by directory
+	modules map[string]string // Directories of downloaded modules, keyed by path@version
+}
+
+func newPackageNamer(ctx context.Context, modFile *modfile.File, dir string) *packageNamer {
+	return &packageNamer{
+		ctx:     ctx,
+		modFile: modFile,
+		dir:     dir,
+		names:   map[string]string{},
+		modules: map[string]string{},
+	}
+}
+
+// keepName gives the import (whose path was rewritten from oldPath) the name
+// of the package it used to refer to, if it doesn't have a name and the
+// package at its new path is named differently. Returns the name, or an empty
+// string if the import was left alone.
+func (n *packageNamer) keepName(pkg *packages.Package, spec *ast.ImportSpec, oldPath string, upgrade upgrade) string {
+	if spec.Name != nil {
+		return ""
+	}
+	newPath := strings.Trim(spec.Path.Value, "\"")
+
+	// The old name is the one the package was loaded with, if it was (which
+	// it isn't for files excluded from the build, or when loading failed)
+	var oldName string
+	if imported, ok := pkg.Imports[oldPath]; ok && imported.Name != "" {
+		oldName = imported.Name
+	} else if upgrade.oldVersion != "" {
+		rel := strings.TrimPrefix(strings.TrimPrefix(oldPath, upgrade.oldPath), "/")
+		oldName = n.moduleName(upgrade.oldSource(), upgrade.oldVersion, rel)
+	}
+	newName := n.newName(newPath)
+	if oldName == "" || newName == "" || oldName == newName {
+		return ""
+	}
+
+	spec.Name = ast.NewIdent(oldName)
+	// NOTE: The name has to be positioned before the path, or the printer
+	// puts it after
+	spec.Name.NamePos = spec.Path.Pos()
+	return oldName
+}
+
+// newName returns the name of the package at the given import path, according
+// to the updated go.mod file, or an empty string if it can't be found
+func (n *packageNamer) newName(importPath string) string {
+	modulePaths := []string{n.modFile.Module.Mod.Path}
+	for _, require := range n.modFile.Require {
+		modulePaths = append(modulePaths, require.Mod.Path)
+	}
+	modulePath := matchModule(importPath, modulePaths)
+	if modulePath == "" {
+		return ""
+	}
+	rel := strings.TrimPrefix(strings.TrimPrefix(importPath, modulePath), "/")
+	if modulePath == n.modFile.Module.Mod.Path {
+		return n.dirName(filepath.Join(n.dir, filepath.FromSlash(rel)))
+	}
+
+	var version string
+	for _, require := range n.modFile.Require {
+		if require.Mod.Path == modulePath {
+			version = require.Mod.Version
+		}
+	}
+	for _, replace := range n.modFile.Replace {
+		if replace.Old.Path != modulePath || (replace.Old.Version != "" && replace.Old.Version != version) {
+			continue
+		}
+		// Directory replacements have no version
+		if replace.New.Version == "" {
+			dir := replace.New.Path
+			if !filepath.IsAbs(dir) {
+				dir = filepath.Join(n.dir, dir)
+			}
+			return n.dirName(filepath.Join(dir, filepath.FromSlash(rel)))
+		}
+		return n.moduleName(replace.New.Path, replace.New.Version, rel)
+	}
+	return n.moduleName(modulePath, version, rel)
+}
+
+// moduleName returns the name of the package in the given directory (relative
+// to the module root) of the given module version, or an empty string if it
+// can't be found
+func (n *packageNamer) moduleName(path, version, rel string) string {
+	key := path + "@" + version
+	moduleDir, ok := n.modules[key]
+	if !ok {
+		downloaded, err := downloadModule(n.ctx, path, version)
+		if err != nil {
+			if *verbose {
+				fmt.Printf("Error getting package names of %s: %s\n", key, err)
+			}
+		} else {
+			moduleDir = downloaded.Dir
+		}
+		n.modules[key] = moduleDir
+	}
+	if moduleDir == "" {
+		return ""
+	}
+	return n.dirName(filepath.Join(moduleDir, filepath.FromSlash(rel)))
+}
+
+// dirName returns the name of the package in the given directory (the one
+// that builds with the default build context), or an empty string if there
+// isn't one
+func (n *packageNamer) dirName(dir string) string {
+	name, ok := n.names[dir]
+	if !ok {
+		// NOTE: The package's name is returned even if it has errors
+		pkg, _ := build.Default.ImportDir(dir, 0)
+		if pkg != nil {
+			name = pkg.Name
+		}
+		n.names[dir] = name
+	}
+	return name
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/nicheinc/upgrade/analyzer"
+	"golang.org/x/tools/go/analysis/unitchecker"
+)
+
+// The tool can also be run by 'go vet' (with 'go vet -vettool=$(which
+// upgrade) ./...'), as the analyzer of the analyzer package, so that upgrades
+// are surfaced in editors and CI without running the tool itself. Versions
+// are then looked up like the tool does, and the Renovate and Dependabot
+// ignore rules of the module are applied, like -bot-rules.
+
+// isVetTool reports whether the tool was run by 'go vet -vettool', which
+// queries its version and flags, and then runs it with the path of a JSON
+// config file for each package (as its last argument, after the analysis
+// flags, e.g. -json).
+// NOTE: Arguments of the tool's own flags can end in .cfg too (e.g.
+// -text-file 'conf/*.cfg'), so the config file has to exist, and none of the
+// other arguments can be one of the tool's flags.
+func isVetTool(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	if len(args) == 1 && (args[0] == "-V=full" || args[0] == "-flags") {
+		return true
+	}
+	cfg := args[len(args)-1]
+	if !strings.HasSuffix(cfg, ".cfg") {
+		return false
+	}
+	for _, arg := range args[:len(args)-1] {
+		name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || flag.Lookup(name) != nil {
+			return false
+		}
+	}
+	info, err := os.Stat(cfg)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// runVetTool runs the analyzer as requested by 'go vet', and exits
+func runVetTool() {
+	// NOTE: The analyzer's flags are defined on the command line's flag set,
+	// so the tool's own flags (which keep their defaults) are set aside
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	analyzer.LatestMajor = latestMajor
+	unitchecker.Main(analyzer.Analyzer)
+}
+
+// latestMajor is the analyzer's LatestMajor, when run by the tool
+func latestMajor(ctx context.Context, dir, modulePath string) (string, string, error) {
+	if dir != botPoliciesDir {
+		policies = nil
+		if entries, err := loadBotPolicies(dir); err == nil {
+			policies = entries
+		}
+		botPoliciesDir = dir
+	}
+	if denied(modulePath) {
+		return "", "", nil
+	}
+
+	version, err := getUpgradeVersion(ctx, modulePath)
+	if err != nil || version == "" {
+		return "", "", err
+	}
+	newPath, err := upgradePath(modulePath, version)
+	if err != nil {
+		return "", "", err
+	}
+	return newPath, version, nil
+}
+
+// The module directory whose Renovate and Dependabot ignore rules were loaded
+// by latestMajor
+var botPoliciesDir string
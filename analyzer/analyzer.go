@@ -0,0 +1,222 @@
+// Package analyzer provides the "outdated" analyzer of the upgrade tool, which
+// reports the imports of dependencies that have a newer major version, with a
+// suggested fix that rewrites the import. The tool runs it when run by 'go vet
+// -vettool=$(which upgrade)', and it can be added to a multichecker (or any
+// other analysis driver) like any other analyzer.
+package analyzer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/tools/go/analysis"
+)
+
+// Analyzer reports the imports of dependencies that have a newer major
+// version. The go.mod file still has to be upgraded separately (e.g. by
+// running the upgrade tool).
+var Analyzer = &analysis.Analyzer{
+	Name: "outdated",
+	Doc:  "report imports of dependencies that have a newer major version",
+	URL:  "https://github.com/nicheinc/upgrade",
+	Run:  run,
+}
+
+// LatestMajor returns the path and version of the latest major version of a
+// dependency (given its path) of the module in the given directory, or empty
+// strings if it's already at its latest major version, or shouldn't be
+// upgraded. By default, the successive major versions of the dependency are
+// queried with the go command, in the module's directory; the upgrade tool
+// replaces it with its own lookup, which caches versions and applies the
+// module's Renovate and Dependabot ignore rules.
+var LatestMajor = queryLatestMajor
+
+func run(pass *analysis.Pass) (any, error) {
+	if len(pass.Files) == 0 {
+		return nil, nil
+	}
+	// NOTE: 'go vet' runs the analyzer once per package, so the go.mod file
+	// is found from the package's files
+	root, ok := findModuleRoot(filepath.Dir(pass.Fset.File(pass.Files[0].Pos()).Name()))
+	if !ok {
+		return nil, nil
+	}
+	b, err := os.ReadFile(filepath.Join(root, "go.mod"))
+	if err != nil {
+		return nil, fmt.Errorf("error reading module file: %s", err)
+	}
+	file, err := modfile.Parse(filepath.Join(root, "go.mod"), b, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing module file: %s", err)
+	}
+
+	var modulePaths []string
+	for _, require := range file.Require {
+		modulePaths = append(modulePaths, require.Mod.Path)
+	}
+
+	type latestMajor struct{ path, version string }
+	ctx := context.Background()
+	latest := map[string]latestMajor{} // Keyed by module path
+	for _, f := range pass.Files {
+		for _, spec := range f.Imports {
+			importPath, err := strconv.Unquote(spec.Path.Value)
+			if err != nil {
+				continue
+			}
+			modulePath := matchModule(importPath, modulePaths)
+			if modulePath == "" {
+				continue
+			}
+
+			major, ok := latest[modulePath]
+			if !ok {
+				if major.path, major.version, err = LatestMajor(ctx, root, modulePath); err != nil {
+					return nil, fmt.Errorf("error getting upgrade version for %s: %s", modulePath, err)
+				}
+				latest[modulePath] = major
+			}
+			if major.version == "" {
+				continue
+			}
+
+			newImportPath := major.path + strings.TrimPrefix(importPath, modulePath)
+			pass.Report(analysis.Diagnostic{
+				Pos:     spec.Path.Pos(),
+				End:     spec.Path.End(),
+				Message: fmt.Sprintf("%s has a newer major version: %s %s (upgrade with 'upgrade %s')", modulePath, major.path, major.version, modulePath),
+				SuggestedFixes: []analysis.SuggestedFix{{
+					Message: fmt.Sprintf("Import %s", newImportPath),
+					TextEdits: []analysis.TextEdit{{
+						Pos:     spec.Path.Pos(),
+						End:     spec.Path.End(),
+						NewText: []byte(strconv.Quote(newImportPath)),
+					}},
+				}},
+			})
+		}
+	}
+	return nil, nil
+}
+
+// queryLatestMajor is the default LatestMajor: it queries the latest version
+// of each major version after the dependency's with 'go list -m', until one
+// doesn't exist
+func queryLatestMajor(ctx context.Context, dir, modulePath string) (string, string, error) {
+	var newPath, version string
+	for path, ok := nextMajorPath(modulePath); ok; path, ok = nextMajorPath(path) {
+		latest, err := queryLatest(ctx, dir, path)
+		if err != nil {
+			return "", "", err
+		}
+		if latest == "" {
+			break
+		}
+		newPath, version = path, latest
+	}
+	return newPath, version, nil
+}
+
+// queryLatest returns the latest version of the module with the given path,
+// or an empty string if there's none
+func queryLatest(ctx context.Context, dir, path string) (string, error) {
+	// NOTE: Queries are resolved like the module's own (e.g. with its
+	// GOPROXY), except that vendoring doesn't allow them
+	cmd := exec.CommandContext(ctx, "go", "list", "-m", "-e", "-json", "-mod=mod", path+"@latest")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("error executing 'go list' command: %s: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("error executing 'go list' command: %s", err)
+	}
+	var result struct {
+		Version string
+		Error   *struct{ Err string }
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return "", fmt.Errorf("error parsing results of 'go list' command: %s", err)
+	}
+	// NOTE: With -e, modules (or major versions) that don't exist are
+	// reported as errors in the results
+	if result.Error != nil {
+		return "", nil
+	}
+	return result.Version, nil
+}
+
+// nextMajorPath returns the path of the next major version of the module with
+// the given path (e.g. example.com/lib/v3, given example.com/lib/v2, or
+// gopkg.in/yaml.v3, given gopkg.in/yaml.v2), or false if the path is invalid.
+// NOTE: v0 and v1 share a path (except for gopkg.in modules), so the next
+// major version of a path without one is v2.
+func nextMajorPath(path string) (string, bool) {
+	prefix, pathMajor, ok := module.SplitPathVersion(path)
+	if !ok {
+		return "", false
+	}
+	num := 1
+	if pathMajor != "" {
+		var err error
+		if num, err = strconv.Atoi(strings.TrimPrefix(module.PathMajorPrefix(pathMajor), "v")); err != nil {
+			return "", false
+		}
+	}
+	if strings.HasPrefix(prefix, "gopkg.in/") {
+		return fmt.Sprintf("%s.v%d%s", prefix, num+1, strings.TrimPrefix(pathMajor, "."+module.PathMajorPrefix(pathMajor))), true
+	}
+	return fmt.Sprintf("%s/v%d", prefix, num+1), true
+}
+
+// matchModule returns the longest of the given module paths that contains the
+// import path, or an empty string if there isn't one. A path whose next
+// element is a major version suffix (e.g. dep/v3, given dep) belongs to a
+// different major version of the module, not to a subdirectory.
+func matchModule(importPath string, modulePaths []string) string {
+	var match string
+	for _, modulePath := range modulePaths {
+		if len(modulePath) <= len(match) {
+			continue
+		}
+		if importPath == modulePath {
+			match = modulePath
+			continue
+		}
+		rest, ok := strings.CutPrefix(importPath, modulePath+"/")
+		if !ok {
+			continue
+		}
+		elem, _, _ := strings.Cut(rest, "/")
+		if _, pathMajor, ok := module.SplitPathVersion(modulePath + "/" + elem); ok && pathMajor != "" {
+			continue
+		}
+		match = modulePath
+	}
+	return match
+}
+
+// findModuleRoot returns the closest directory, going up from the given one,
+// that contains a go.mod file, or false if there isn't one
+func findModuleRoot(dir string) (string, bool) {
+	for {
+		if info, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil && !info.IsDir() {
+			return dir, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,41 @@
+package analyzer
+
+import "testing"
+
+func TestNextMajorPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "example.com/lib", want: "example.com/lib/v2"},
+		{path: "example.com/lib/v2", want: "example.com/lib/v3"},
+		{path: "example.com/lib/v9", want: "example.com/lib/v10"},
+		{path: "example.com/v2x", want: "example.com/v2x/v2"},
+		{path: "gopkg.in/yaml.v2", want: "gopkg.in/yaml.v3"},
+		{path: "gopkg.in/x.v2-unstable", want: "gopkg.in/x.v3-unstable"},
+	}
+	for _, test := range tests {
+		if got, ok := nextMajorPath(test.path); !ok || got != test.want {
+			t.Errorf("nextMajorPath(%q) = %q, %t; want %q", test.path, got, ok, test.want)
+		}
+	}
+}
+
+func TestMatchModule(t *testing.T) {
+	modulePaths := []string{"example.com/dep", "example.com/dep/sub", "example.com/other"}
+	tests := []struct {
+		importPath string
+		want       string
+	}{
+		{importPath: "example.com/dep", want: "example.com/dep"},
+		{importPath: "example.com/dep/pkg", want: "example.com/dep"},
+		{importPath: "example.com/dep/sub/pkg", want: "example.com/dep/sub"},
+		{importPath: "example.com/dep/v3", want: ""},
+		{importPath: "example.com/depot", want: ""},
+	}
+	for _, test := range tests {
+		if got := matchModule(test.importPath, modulePaths); got != test.want {
+			t.Errorf("matchModule(%q) = %q, want %q", test.importPath, got, test.want)
+		}
+	}
+}
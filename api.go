@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// apiUsage is a use of an exported symbol of an upgraded module
+type apiUsage struct {
+	upgrade upgrade
+	pkgPath string // Import path of the symbol's package, in the old module
+	pkgName string
+	symbol  string // E.g. "Func", or "Type.Method"
+	pos     token.Position
+}
+
+// collectAPIUsages returns the uses of the upgraded modules' exported symbols
+// in the given file: package-level declarations, and methods (fields aren't
+// checked, since there's no reliable way of telling which type declared them
+// without type checking the new version of the module).
+func collectAPIUsages(pkg *packages.Package, f file, upgradeMap map[string]upgrade) []apiUsage {
+	if pkg.TypesInfo == nil {
+		return nil
+	}
+	var oldPaths []string
+	for oldPath := range upgradeMap {
+		oldPaths = append(oldPaths, oldPath)
+	}
+
+	var usages []apiUsage
+	ast.Inspect(f.ast, func(node ast.Node) bool {
+		ident, ok := node.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		obj := pkg.TypesInfo.Uses[ident]
+		if obj == nil || obj.Pkg() == nil || !obj.Exported() {
+			return true
+		}
+		// The current module's own packages (when it's upgraded or renamed)
+		// have no version to check against
+		upgrade, ok := upgradeMap[matchModule(obj.Pkg().Path(), oldPaths)]
+		if !ok || upgrade.newVersion == "" {
+			return true
+		}
+
+		var symbol string
+		switch {
+		case obj.Parent() == obj.Pkg().Scope():
+			symbol = obj.Name()
+		case isMethod(obj):
+			recv := obj.Type().(*types.Signature).Recv().Type()
+			if ptr, ok := recv.(*types.Pointer); ok {
+				recv = ptr.Elem()
+			}
+			named, ok := recv.(*types.Named)
+			if !ok || named.Obj().Pkg() != obj.Pkg() {
+				return true
+			}
+			symbol = named.Obj().Name() + "." + obj.Name()
+		default:
+			return true
+		}
+
+		usages = append(usages, apiUsage{
+			upgrade: upgrade,
+			pkgPath: obj.Pkg().Path(),
+			pkgName: obj.Pkg().Name(),
+			symbol:  symbol,
+			pos:     f.fset.Position(ident.Pos()),
+		})
+		return true
+	})
+	return usages
+}
+
+func isMethod(obj types.Object) bool {
+	fn, ok := obj.(*types.Func)
+	return ok && fn.Type().(*types.Signature).Recv() != nil
+}
+
+// Compatibility statuses of the symbols used from an upgraded module
+const (
+	compatOK      = "ok"
+	compatMissing = "missing" // Removed or renamed
+	compatChanged = "changed" // Declared with a different signature or type
+	compatUnknown = "unknown" // The new version's API couldn't be read
+)
+
+// symbolCompat is the compatibility of a symbol used from an upgraded module
+// with the module's new version
+type symbolCompat struct {
+	symbol string // E.g. "pkg.Func", or "pkg.Type.Method"
+	status string
+	uses   int
+	oldSig string
+	newSig string
+
+	pkgMissing bool // The symbol's whole package is missing
+}
+
+// checkAPIUsages warns about each usage of a symbol that's missing from the
+// new version of its module (i.e. that was removed or renamed), or whose
+// signature (or type) changed, which likely won't compile after the upgrade,
+// and prints the compatibility of every symbol used. Both versions of the
+// modules are downloaded to the module cache, and their exported symbols are
+// read from source.
+func checkAPIUsages(ctx context.Context, usages []apiUsage) {
+	apis := map[string]*packageAPI{} // Keyed by module and package path
+	loadAPI := func(path, version, rel string) *packageAPI {
+		key := path + "@" + version + "/" + rel
+		api, ok := apis[key]
+		if !ok {
+			var err error
+			api, err = loadPackageAPI(ctx, path, version, rel)
+			if err != nil {
+				warnf("error reading API of %s in %s %s: %s", strings.TrimSuffix(path+"/"+rel, "/"), path, version, err)
+			}
+			apis[key] = api
+		}
+		return api
+	}
+
+	var (
+		compats = map[string]*symbolCompat{}
+		warned  = map[string]bool{}
+	)
+	for _, usage := range usages {
+		rel := strings.TrimPrefix(strings.TrimPrefix(usage.pkgPath, usage.upgrade.oldPath), "/")
+		newPkgPath := usage.upgrade.newPath
+		if rel != "" {
+			newPkgPath += "/" + rel
+		}
+
+		key := newPkgPath + "." + usage.symbol
+		compat, ok := compats[key]
+		if !ok {
+			compat = &symbolCompat{symbol: usage.pkgName + "." + usage.symbol, status: compatUnknown}
+			compats[key] = compat
+			if api := loadAPI(usage.upgrade.newSource(), usage.upgrade.newVersion, rel); api != nil {
+				compat.status, compat.newSig = api.check(usage.symbol)
+				compat.pkgMissing = !api.exists
+			}
+			if compat.status == compatOK {
+				if oldAPI := loadAPI(usage.upgrade.oldSource(), usage.upgrade.oldVersion, rel); oldAPI != nil {
+					compat.oldSig = oldAPI.symbols[usage.symbol]
+				}
+				if compat.oldSig != "" && compat.newSig != "" && compat.oldSig != compat.newSig {
+					compat.status = compatChanged
+				}
+			}
+		}
+		compat.uses++
+
+		var msg string
+		switch {
+		case compat.pkgMissing:
+			msg = fmt.Sprintf("package %s does not exist in %s %s", newPkgPath, usage.upgrade.newSource(), usage.upgrade.newVersion)
+		case compat.status == compatMissing:
+			msg = fmt.Sprintf("%s does not exist in %s %s", compat.symbol, usage.upgrade.newSource(), usage.upgrade.newVersion)
+		case compat.status == compatChanged:
+			msg = fmt.Sprintf("%s changed from %s to %s in %s %s", compat.symbol, compat.oldSig, compat.newSig, usage.upgrade.newSource(), usage.upgrade.newVersion)
+		default:
+			continue
+		}
+
+		key = fmt.Sprintf("%s:%d:%s", usage.pos.Filename, usage.pos.Line, msg)
+		if !warned[key] {
+			warned[key] = true
+			warnfAt(usage.pos.Filename, usage.pos.Line, "%s", msg)
+		}
+	}
+
+	printCompatTable(compats)
+}
+
+// printCompatTable prints the compatibility of each symbol used from the
+// upgraded modules, incompatible ones first
+func printCompatTable(compats map[string]*symbolCompat) {
+	if len(compats) == 0 {
+		return
+	}
+
+	var sorted []*symbolCompat
+	for _, compat := range compats {
+		sorted = append(sorted, compat)
+	}
+	order := map[string]int{compatMissing: 0, compatChanged: 1, compatUnknown: 2, compatOK: 3}
+	sort.Slice(sorted, func(i, j int) bool {
+		if order[sorted[i].status] != order[sorted[j].status] {
+			return order[sorted[i].status] < order[sorted[j].status]
+		}
+		return sorted[i].symbol < sorted[j].symbol
+	})
+
+	var table strings.Builder
+	w := tabwriter.NewWriter(&table, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SYMBOL\tSTATUS\tUSES\tSIGNATURE")
+	for _, compat := range sorted {
+		sig := compat.newSig
+		switch {
+		case compat.status == compatChanged:
+			sig = compat.oldSig + " -> " + compat.newSig
+		case sig == "":
+			sig = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", compat.symbol, compat.status, compat.uses, sig)
+	}
+	w.Flush()
+
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(table.String(), "\n") {
+		if line != "" {
+			b.WriteString("\t" + line)
+		}
+	}
+	noticef("API compatibility", "%s", b.String())
+}
+
+// packageAPI is the exported API of a package, as declared in its source
+type packageAPI struct {
+	exists bool
+	// Signatures of functions and methods, and types of variables and
+	// constants (if declared), by symbol (e.g. "Func", or "Type.Method").
+	// Types have an empty signature.
+	symbols map[string]string
+	// Types whose full method sets can't be determined from their
+	// declarations alone (because they embed other types, or are aliases)
+	opaque map[string]bool
+}
+
+// check returns the compatibility status of a symbol with the package, and
+// its signature. Methods of types whose method sets are unknown are assumed to
+// exist.
+func (a *packageAPI) check(symbol string) (string, string) {
+	if !a.exists {
+		return compatMissing, ""
+	}
+	if sig, ok := a.symbols[symbol]; ok {
+		return compatOK, sig
+	}
+	if typeName, _, ok := strings.Cut(symbol, "."); ok && a.opaque[typeName] {
+		if _, ok := a.symbols[typeName]; ok {
+			return compatOK, ""
+		}
+	}
+	return compatMissing, ""
+}
+
+// loadPackageAPI reads the exported API of the package in the given directory
+// (relative to the module root) of the given module version. All of the
+// package's non-test files are parsed, regardless of build constraints.
+func loadPackageAPI(ctx context.Context, path, version, rel string) (*packageAPI, error) {
+	downloaded, err := downloadModule(ctx, path, version)
+	if err != nil {
+		return nil, err
+	}
+
+	api := &packageAPI{symbols: map[string]string{}, opaque: map[string]bool{}}
+	dir := filepath.Join(downloaded.Dir, filepath.FromSlash(rel))
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return api, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Type().IsRegular() && strings.HasSuffix(name, ".go") && !strings.HasSuffix(name, "_test.go") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	fset := token.NewFileSet()
+	for _, name := range names {
+		fileAST, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, parser.SkipObjectResolution)
+		if err != nil {
+			return nil, err
+		}
+		if fileAST.Name.Name == "main" || strings.HasSuffix(fileAST.Name.Name, "_test") {
+			continue
+		}
+		api.exists = true
+		api.addDecls(fset, fileAST)
+	}
+	return api, nil
+}
+
+func (a *packageAPI) addDecls(fset *token.FileSet, fileAST *ast.File) {
+	for _, decl := range fileAST.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if decl.Recv == nil {
+				a.symbols[decl.Name.Name] = funcSignature(fset, decl.Type)
+			} else if len(decl.Recv.List) > 0 {
+				if typeName := receiverTypeName(decl.Recv.List[0].Type); typeName != "" {
+					a.symbols[typeName+"."+decl.Name.Name] = funcSignature(fset, decl.Type)
+				}
+			}
+		case *ast.GenDecl:
+			for _, spec := range decl.Specs {
+				switch spec := spec.(type) {
+				case *ast.ValueSpec:
+					for _, name := range spec.Names {
+						// NOTE: The type of an untyped declaration isn't known
+						// without type checking
+						a.symbols[name.Name] = exprString(fset, spec.Type)
+					}
+				case *ast.TypeSpec:
+					a.symbols[spec.Name.Name] = ""
+					a.addTypeMembers(fset, spec)
+				}
+			}
+		}
+	}
+}
+
+func (a *packageAPI) addTypeMembers(fset *token.FileSet, spec *ast.TypeSpec) {
+	typeName := spec.Name.Name
+	if spec.Assign.IsValid() {
+		a.opaque[typeName] = true
+		return
+	}
+	switch t := spec.Type.(type) {
+	case *ast.StructType:
+		for _, field := range t.Fields.List {
+			if len(field.Names) == 0 {
+				a.opaque[typeName] = true // Embedded field, whose methods are promoted
+			}
+		}
+	case *ast.InterfaceType:
+		for _, method := range t.Methods.List {
+			if len(method.Names) == 0 {
+				a.opaque[typeName] = true // Embedded interface
+			}
+			funcType, _ := method.Type.(*ast.FuncType)
+			for _, name := range method.Names {
+				a.symbols[typeName+"."+name.Name] = funcSignature(fset, funcType)
+			}
+		}
+	}
+}
+
+// funcSignature formats the parameter and result types of a function, without
+// their names (which don't affect compatibility), e.g. "func(string, ...int)
+// (T, error)"
+func funcSignature(fset *token.FileSet, funcType *ast.FuncType) string {
+	if funcType == nil {
+		return ""
+	}
+	fieldTypes := func(fields *ast.FieldList) []string {
+		var types []string
+		if fields == nil {
+			return nil
+		}
+		for _, field := range fields.List {
+			n := max(len(field.Names), 1)
+			for range n {
+				types = append(types, exprString(fset, field.Type))
+			}
+		}
+		return types
+	}
+
+	sig := "func(" + strings.Join(fieldTypes(funcType.Params), ", ") + ")"
+	switch results := fieldTypes(funcType.Results); len(results) {
+	case 0:
+	case 1:
+		sig += " " + results[0]
+	default:
+		sig += " (" + strings.Join(results, ", ") + ")"
+	}
+	return sig
+}
+
+func exprString(fset *token.FileSet, expr ast.Expr) string {
+	if expr == nil {
+		return ""
+	}
+	var b strings.Builder
+	if err := printer.Fprint(&b, fset, expr); err != nil {
+		return ""
+	}
+	return b.String()
+}
+
+// receiverTypeName returns the name of the type of a method receiver, e.g. T
+// for *T, or T[K]
+func receiverTypeName(expr ast.Expr) string {
+	for {
+		switch e := expr.(type) {
+		case *ast.StarExpr:
+			expr = e.X
+		case *ast.ParenExpr:
+			expr = e.X
+		case *ast.IndexExpr:
+			expr = e.X
+		case *ast.IndexListExpr:
+			expr = e.X
+		case *ast.Ident:
+			return e.Name
+		default:
+			return ""
+		}
+	}
+}
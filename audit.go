@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With -audit, every change the run makes (files written, including go.mod
+// files, and the go, git, gh and hook commands it runs that can change
+// things) is recorded in an append-only log file, one JSON object per line,
+// e.g.:
+//
+//	{"time":"2024-05-01T12:00:00Z","action":"write","path":"/src/app/main.go","oldSha256":"...","newSha256":"..."}
+//	{"time":"2024-05-01T12:00:01Z","action":"go","dir":"/src/app","command":"go list -mod=mod ./..."}
+//	{"time":"2024-05-01T12:00:01Z","action":"write","path":"/src/app/go.sum","oldSha256":"...","newSha256":"...","by":"go list -mod=mod ./..."}
+//
+// The hashes are the SHA-256 hashes of the file's contents before and after
+// (empty if it didn't exist). Runs started by this one (with -batch or -f)
+// append to the same log. Changes made in a staging directory (with -o)
+// aren't recorded, since the module isn't modified.
+type auditLog struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+type auditEvent struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"` // write, go, git, gh or hook
+	Path    string    `json:"path,omitempty"`
+	Dir     string    `json:"dir,omitempty"`
+	Command string    `json:"command,omitempty"`
+	OldHash string    `json:"oldSha256,omitempty"`
+	NewHash string    `json:"newSha256,omitempty"`
+	By      string    `json:"by,omitempty"` // Command that wrote the file, if any
+	Error   string    `json:"error,omitempty"`
+}
+
+// auditor records the changes made by the run, if -audit was given
+var auditor *auditLog
+
+// openAuditLog opens the named audit log for appending, creating it if it
+// doesn't exist yet
+func openAuditLog(filename string) (*auditLog, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: f}, nil
+}
+
+// record appends the event to the log. Failing to do so is fatal, since the
+// log is meant to be a complete record.
+func (a *auditLog) record(event auditEvent) {
+	if a == nil || stage != nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	event.Time = time.Now().UTC()
+	b, err := json.Marshal(event)
+	if err != nil {
+		log.Fatalf("Error encoding audit log event: %s", err)
+	}
+	// NOTE: Each event is written with a single write, so that events
+	// appended concurrently by runs started by this one don't interleave
+	if _, err := a.file.Write(append(b, '\n')); err != nil {
+		log.Fatalf("Error writing audit log: %s", err)
+	}
+}
+
+// recordWrite records that the named file was written, given the hash of its
+// previous contents
+func (a *auditLog) recordWrite(name, oldHash, by string) {
+	if a == nil {
+		return
+	}
+	a.record(auditEvent{
+		Action:  "write",
+		Path:    absPath(name),
+		OldHash: oldHash,
+		NewHash: fileHash(name),
+		By:      by,
+	})
+}
+
+// recordCommand records that a command was run in the given directory, and
+// returns a function to call once it's done, which records its error (if
+// any) and the named files (e.g. go.mod and go.sum) that it changed
+func (a *auditLog) recordCommand(action, dir string, args []string, files ...string) func(err error) {
+	if a == nil {
+		return func(error) {}
+	}
+	command := strings.Join(args, " ")
+	hashes := make([]string, len(files))
+	for i, name := range files {
+		hashes[i] = fileHash(name)
+	}
+	return func(err error) {
+		event := auditEvent{Action: action, Dir: absPath(dir), Command: command}
+		if err != nil {
+			event.Error = err.Error()
+		}
+		a.record(event)
+		for i, name := range files {
+			if fileHash(name) != hashes[i] {
+				a.recordWrite(name, hashes[i], command)
+			}
+		}
+	}
+}
+
+// fileHash returns the hex-encoded SHA-256 hash of the named file's
+// contents, or an empty string if it can't be read
+func fileHash(name string) string {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// batchResult is the outcome of applying one upgrade on its own branch
+type batchResult struct {
+	upgrade upgrade
+	branch  string
+	pr      string // URL of the pull request, if one was opened
+	err     error
+	resumed bool // Whether the branch was created before resuming
+}
+
+// runBatch applies each of the given upgrades separately, on its own branch
+// (created from HEAD, in a temporary git worktree), and commits it. With -pr,
+// each branch is also pushed and a pull request is opened for it with the
+// GitHub CLI (gh). The upgrades are applied by running this tool again in the
+// worktree with the same flags, so that each branch has its own isolated
+// go.mod and import changes. Failing to apply one upgrade doesn't stop the
+// others.
+func runBatch(ctx context.Context, dir string, upgrades []upgrade, j *journal) error {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	root := gitRoot(absDir)
+	if root == "" {
+		return fmt.Errorf("%s is not in a git repository", dir)
+	}
+	rel, err := filepath.Rel(root, absDir)
+	if err != nil {
+		return err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error finding executable: %s", err)
+	}
+
+	var results []batchResult
+	for _, upgrade := range upgrades {
+		if err := ctx.Err(); err != nil {
+			return context.Cause(ctx)
+		}
+		result := batchResult{upgrade: upgrade, branch: "upgrade/" + upgrade.newPath}
+		// When resuming, the branches created before the interruption are
+		// skipped
+		if j.done(result.branch) {
+			fmt.Printf("Skipping branch %s, created before resuming\n", result.branch)
+			result.resumed = true
+			results = append(results, result)
+			continue
+		}
+		result.pr, result.err = applyOnBranch(ctx, self, root, rel, result.branch, upgrade)
+		if result.err != nil {
+			warnf("error upgrading %s on branch %s: %s", upgrade.oldPath, result.branch, result.err)
+		} else {
+			j.recordDone(result.branch)
+		}
+		results = append(results, result)
+	}
+
+	var b strings.Builder
+	for _, result := range results {
+		switch {
+		case result.err != nil:
+			fmt.Fprintf(&b, "\t%s: failed\n", result.branch)
+		case result.resumed:
+			fmt.Fprintf(&b, "\t%s (created before resuming)\n", result.branch)
+		case result.pr != "":
+			fmt.Fprintf(&b, "\t%s: %s\n", result.branch, result.pr)
+		default:
+			fmt.Fprintf(&b, "\t%s\n", result.branch)
+		}
+	}
+	noticef("Branches", "%s", b.String())
+	return nil
+}
+
+// applyOnBranch applies an upgrade on a new branch, in a temporary worktree of
+// the repository at root, and commits it (and, with -pr, pushes it and opens a
+// pull request, whose URL is returned)
+func applyOnBranch(ctx context.Context, self, root, rel, branch string, upgrade upgrade) (string, error) {
+	worktree, err := os.MkdirTemp("", "upgrade-batch-*")
+	if err != nil {
+		return "", fmt.Errorf("error creating worktree directory: %s", err)
+	}
+	defer os.RemoveAll(worktree)
+
+	fmt.Printf("Creating branch %s\n", branch)
+	if err := runGit(ctx, root, "worktree", "add", "-q", "-b", branch, worktree, "HEAD"); err != nil {
+		return "", err
+	}
+	defer runGit(context.Background(), root, "worktree", "remove", "--force", worktree)
+
+	// Apply the upgrade with the same flags as this run
+	args := []string{"-d", filepath.Join(worktree, rel)}
+	args = append(args, forwardedFlags("d", "batch", "pr", "commit-template", "pr-template")...)
+	args = append(args, upgrade.oldPath, upgrade.newVersion)
+
+	cmd := exec.CommandContext(ctx, self, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// NOTE: The run doesn't keep a journal of its own, since this one's
+	// records which branches are done
+	cmd.Env = append(os.Environ(), noJournalEnv+"=1")
+
+	// With -vet, the run writes its new findings to a file, for the pull
+	// request description
+	var vetFile string
+	if *vet {
+		f, err := os.CreateTemp("", "upgrade-vet-*")
+		if err != nil {
+			return "", fmt.Errorf("error creating vet findings file: %s", err)
+		}
+		f.Close()
+		vetFile = f.Name()
+		defer os.Remove(vetFile)
+		cmd.Env = append(cmd.Env, vetFindingsEnv+"="+vetFile)
+	}
+	modFilePath := filepath.Join(worktree, rel, "go.mod")
+	modBefore, err := os.ReadFile(modFilePath)
+	if err != nil {
+		return "", fmt.Errorf("error reading module file: %s", err)
+	}
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("error applying upgrade: %s", err)
+	}
+	modAfter, err := os.ReadFile(modFilePath)
+	if err != nil {
+		return "", fmt.Errorf("error reading module file: %s", err)
+	}
+	var vetFindings []string
+	if vetFile != "" {
+		b, err := os.ReadFile(vetFile)
+		if err != nil {
+			return "", fmt.Errorf("error reading vet findings: %s", err)
+		}
+		vetFindings = strings.FieldsFunc(string(b), func(r rune) bool { return r == '\n' })
+	}
+
+	if err := runGit(ctx, worktree, "add", "-A"); err != nil {
+		return "", err
+	}
+	cmd = exec.CommandContext(ctx, "git", "diff", "--cached", "--name-only")
+	cmd.Dir = worktree
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("error listing changed files: %s", err)
+	}
+
+	data := templateData{
+		ctx:          ctx,
+		upgrade:      upgrade,
+		Module:       upgrade.oldPath,
+		NewModule:    upgrade.newPath,
+		OldVersion:   upgrade.oldVersion,
+		NewVersion:   upgrade.newVersion,
+		Branch:       branch,
+		FilesChanged: strings.Fields(string(out)),
+		VetFindings:  vetFindings,
+		ModChanges:   parseModFileChanges(modBefore, modAfter),
+	}
+	message, err := executeTemplate(commitTemplate, data)
+	if err != nil {
+		return "", err
+	}
+	if err := runGit(ctx, worktree, "commit", "-q", "--cleanup=whitespace", "-m", message); err != nil {
+		return "", err
+	}
+
+	if !*pullRequests {
+		return "", nil
+	}
+	body, err := executeTemplate(prTemplate, data)
+	if err != nil {
+		return "", err
+	}
+	// The pull request's title is the commit message's subject
+	title, _, _ := strings.Cut(strings.TrimSpace(message), "\n")
+	if err := runGit(ctx, worktree, "push", "-q", "-u", "origin", branch); err != nil {
+		return "", err
+	}
+	cmd = exec.CommandContext(ctx, "gh", "pr", "create", "--head", branch, "--title", title, "--body", body)
+	cmd.Dir = worktree
+	cmd.Stderr = os.Stderr
+	done := auditor.recordCommand("gh", worktree, cmd.Args)
+	out, err = cmd.Output()
+	done(err)
+	if err != nil {
+		return "", fmt.Errorf("error opening pull request: %s", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func runGit(ctx context.Context, dir string, args ...string) error {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	done := auditor.recordCommand("git", dir, cmd.Args)
+	out, err := cmd.CombinedOutput()
+	done(err)
+	if err != nil {
+		return fmt.Errorf("error executing 'git %s' command: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
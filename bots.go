@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Teams that already use Renovate or Dependabot have usually configured which
+// dependencies they shouldn't update. Their ignore rules are turned into
+// policy entries (see policy.go), which come after the -policy file's, so that
+// the all target, serve and report respect the same exclusions, without
+// maintaining a parallel policy:
+//
+//   - Renovate: ignoreDeps, and packageRules matching Go modules by name,
+//     prefix or pattern, that are disabled (for all or major updates) or that
+//     restrict allowedVersions to below a major version (e.g. "<3.0.0")
+//   - Dependabot: the gomod updates of the module's directory, whose ignore
+//     entries either ignore every update (or major updates), or versions from
+//     a major version on (e.g. ">= 3"), and whose allow entries, if there are
+//     any, exempt every other dependency
+//
+// Other rules (e.g. schedules, or rules on minor updates) don't concern major
+// upgrades, and are ignored.
+
+// Renovate configuration files, in the order Renovate looks for them
+var renovateFiles = []string{
+	"renovate.json",
+	".github/renovate.json",
+	".gitlab/renovate.json",
+	".renovaterc",
+	".renovaterc.json",
+}
+
+var dependabotFiles = []string{
+	".github/dependabot.yml",
+	".github/dependabot.yaml",
+}
+
+// loadBotPolicies returns the policy entries corresponding to the ignore
+// rules of the Renovate and Dependabot configurations of the module in the
+// given directory (which are looked up in the module directory, and at the
+// root of its git repository)
+func loadBotPolicies(dir string) ([]modulePolicy, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	bases := []string{absDir}
+	if root := gitRoot(absDir); root != "" && root != absDir {
+		bases = append(bases, root)
+	}
+
+	var entries []modulePolicy
+	for _, base := range bases {
+		for _, name := range renovateFiles {
+			b, err := os.ReadFile(filepath.Join(base, name))
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("error reading %s: %s", name, err)
+			}
+			renovate, err := renovatePolicies(name, b)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, renovate...)
+			break
+		}
+		for _, name := range dependabotFiles {
+			b, err := os.ReadFile(filepath.Join(base, name))
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("error reading %s: %s", name, err)
+			}
+			// Dependabot's directories are relative to the repository root
+			rel, err := filepath.Rel(base, absDir)
+			if err != nil {
+				return nil, err
+			}
+			dependabot, err := dependabotPolicies(name, b, "/"+strings.TrimPrefix(filepath.ToSlash(rel), "."))
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, dependabot...)
+			break
+		}
+	}
+	return entries, nil
+}
+
+type renovateConfig struct {
+	IgnoreDeps   []string              `json:"ignoreDeps"`
+	PackageRules []renovatePackageRule `json:"packageRules"`
+}
+
+type renovatePackageRule struct {
+	MatchManagers        []string `json:"matchManagers"`
+	MatchDatasources     []string `json:"matchDatasources"`
+	MatchPackageNames    []string `json:"matchPackageNames"`
+	MatchPackagePrefixes []string `json:"matchPackagePrefixes"`
+	MatchPackagePatterns []string `json:"matchPackagePatterns"`
+	MatchUpdateTypes     []string `json:"matchUpdateTypes"`
+	Enabled              *bool    `json:"enabled"`
+	AllowedVersions      string   `json:"allowedVersions"`
+}
+
+func renovatePolicies(name string, b []byte) ([]modulePolicy, error) {
+	var config renovateConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", name, err)
+	}
+
+	var entries []modulePolicy
+	for _, dep := range config.IgnoreDeps {
+		entries = append(entries, modulePolicy{Path: dep, Deny: true, Reason: "ignored by " + name})
+	}
+	for _, rule := range config.PackageRules {
+		if !matchesAny(rule.MatchManagers, "gomod") || !matchesAny(rule.MatchDatasources, "go") {
+			continue
+		}
+		var entry modulePolicy
+		switch {
+		case rule.Enabled != nil && !*rule.Enabled && matchesAny(rule.MatchUpdateTypes, "major"):
+			entry.Deny = true
+			entry.Reason = "disabled by " + name
+		case rule.AllowedVersions != "" && len(rule.MatchUpdateTypes) == 0:
+			entry.Max = maxBelow(rule.AllowedVersions)
+			if entry.Max == "" {
+				continue
+			}
+		default:
+			continue
+		}
+
+		for _, pkg := range rule.MatchPackageNames {
+			// Newer versions of Renovate also accept globs and /regexps/
+			if re, ok := strings.CutPrefix(pkg, "/"); ok && strings.HasSuffix(re, "/") {
+				rule.MatchPackagePatterns = append(rule.MatchPackagePatterns, strings.TrimSuffix(re, "/"))
+				continue
+			}
+			entry.Path = pkg
+			entries = append(entries, entry)
+		}
+		for _, prefix := range rule.MatchPackagePrefixes {
+			entry.Path = strings.TrimSuffix(prefix, "/")
+			entries = append(entries, entry)
+		}
+		for _, pattern := range rule.MatchPackagePatterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid package pattern %q in %s: %s", pattern, name, err)
+			}
+			entry.Path = pattern
+			entry.re = re
+			entries = append(entries, entry)
+			entry.re = nil
+		}
+	}
+	return entries, nil
+}
+
+// matchesAny reports whether a list of a rule's values is empty (which
+// matches anything), or contains the value
+func matchesAny(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+var upperBoundRegexp = regexp.MustCompile(`^(<=?)\s*v?(\d+)((?:\.[\dx*]+)*)$`)
+
+// maxBelow returns the highest major version allowed by an upper bound on
+// versions (e.g. v2 for "<3.0.0", or "<= 2.5"), or an empty string if the
+// version range isn't an upper bound
+func maxBelow(versions string) string {
+	m := upperBoundRegexp.FindStringSubmatch(strings.TrimSpace(versions))
+	if m == nil {
+		return ""
+	}
+	major, _ := strconv.Atoi(m[2])
+	// "<3.1" allows some versions of v3, but "<3" and "<3.0.0" don't
+	if m[1] == "<" && strings.Trim(m[3], ".0") == "" {
+		major--
+	}
+	if major < 0 {
+		return ""
+	}
+	return fmt.Sprintf("v%d", major)
+}
+
+var lowerBoundRegexp = regexp.MustCompile(`^>=\s*v?(\d+)(\.0)*$`)
+
+func dependabotPolicies(name string, b []byte, dir string) ([]modulePolicy, error) {
+	doc, err := parseYAML(b)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", name, err)
+	}
+	config, _ := doc.(map[string]any)
+	updates, _ := config["updates"].([]any)
+
+	var entries []modulePolicy
+	for _, u := range updates {
+		update, _ := u.(map[string]any)
+		if update["package-ecosystem"] != "gomod" || !sameDependabotDir(yamlString(update["directory"]), dir) {
+			continue
+		}
+
+		ignores, _ := update["ignore"].([]any)
+		for _, i := range ignores {
+			ignore, _ := i.(map[string]any)
+			dep := yamlString(ignore["dependency-name"])
+			if dep == "" {
+				continue
+			}
+			entry := modulePolicy{Path: dep, Reason: "ignored by " + name}
+			if strings.Contains(dep, "*") {
+				entry.re = dependabotPattern(dep)
+			}
+
+			versions := yamlStrings(ignore["versions"])
+			updateTypes := yamlStrings(ignore["update-types"])
+			switch {
+			case len(versions) == 0 && (len(updateTypes) == 0 || matchesAny(updateTypes, "version-update:semver-major")):
+				entry.Deny = true
+			case len(versions) == 1 && lowerBoundRegexp.MatchString(strings.TrimSpace(versions[0])):
+				// e.g. ">= 3" ignores v3 and above
+				m := lowerBoundRegexp.FindStringSubmatch(strings.TrimSpace(versions[0]))
+				major, _ := strconv.Atoi(m[1])
+				if major == 0 {
+					continue
+				}
+				entry.Max = fmt.Sprintf("v%d", major-1)
+			default:
+				continue
+			}
+			entries = append(entries, entry)
+		}
+
+		// With allow entries, only the dependencies they name are updated
+		allows, _ := update["allow"].([]any)
+		var allowed []modulePolicy
+		for _, a := range allows {
+			allow, _ := a.(map[string]any)
+			if dep := yamlString(allow["dependency-name"]); dep != "" {
+				entry := modulePolicy{Path: dep}
+				if strings.Contains(dep, "*") {
+					entry.re = dependabotPattern(dep)
+				}
+				allowed = append(allowed, entry)
+			}
+		}
+		if len(allowed) > 0 {
+			entries = append(entries, allowed...)
+			entries = append(entries, modulePolicy{Path: "*", Deny: true, Reason: "not allowed by " + name})
+		}
+	}
+	return entries, nil
+}
+
+// sameDependabotDir reports whether an update's directory (e.g. "/" or
+// "/services/api/") is the module directory
+func sameDependabotDir(updateDir, dir string) bool {
+	return strings.Trim(updateDir, "/") == strings.Trim(dir, "/")
+}
+
+// dependabotPattern returns the regexp of a dependency name with wildcards,
+// which match any characters (including slashes)
+func dependabotPattern(name string) *regexp.Regexp {
+	parts := strings.Split(name, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+}
+
+func yamlString(v any) string {
+	s, _ := v.(string)
+	return s
+}
+
+func yamlStrings(v any) []string {
+	list, _ := v.([]any)
+	var strs []string
+	for _, item := range list {
+		if s, ok := item.(string); ok {
+			strs = append(strs, s)
+		}
+	}
+	return strs
+}
+
+// yamlLine is a non-empty line of a YAML document, without its comment
+type yamlLine struct {
+	n       int // Line number
+	indent  int
+	content string
+}
+
+// parseYAML parses the subset of YAML used by Dependabot configuration files
+// into maps, lists and strings: block mappings and sequences, scalars (which
+// can be quoted), flow sequences of scalars, and comments.
+func parseYAML(b []byte) (any, error) {
+	var lines []yamlLine
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		text := strings.TrimRight(stripComment(strings.TrimRight(scanner.Text(), "\r")), " \t")
+		content := strings.TrimLeft(text, " ")
+		if content == "" || content == "---" {
+			continue
+		}
+		lines = append(lines, yamlLine{n: n, indent: len(text) - len(content), content: content})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	p := &yamlParser{lines: lines}
+	v, err := p.node(lines[0].indent)
+	if err == nil && p.i < len(lines) {
+		err = fmt.Errorf("line %d: unexpected indentation", lines[p.i].n)
+	}
+	return v, err
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	i     int
+}
+
+// node parses the mapping or sequence starting at the current line, whose
+// entries are at the given indentation
+func (p *yamlParser) node(indent int) (any, error) {
+	if isYAMLItem(p.lines[p.i].content) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *yamlParser) sequence(indent int) ([]any, error) {
+	list := []any{}
+	for p.i < len(p.lines) && p.lines[p.i].indent == indent && isYAMLItem(p.lines[p.i].content) {
+		line := p.lines[p.i]
+		rest := strings.TrimLeft(strings.TrimPrefix(line.content, "-"), " ")
+		switch {
+		case rest == "":
+			p.i++
+			if p.i >= len(p.lines) || p.lines[p.i].indent <= indent {
+				list = append(list, nil)
+				continue
+			}
+			v, err := p.node(p.lines[p.i].indent)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		case isYAMLKey(rest):
+			// A mapping starting on the item's line, whose other entries are
+			// aligned with its first key
+			p.lines[p.i] = yamlLine{n: line.n, indent: line.indent + len(line.content) - len(rest), content: rest}
+			v, err := p.mapping(p.lines[p.i].indent)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		default:
+			v, err := yamlScalar(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", line.n, err)
+			}
+			list = append(list, v)
+			p.i++
+		}
+	}
+	return list, nil
+}
+
+func (p *yamlParser) mapping(indent int) (map[string]any, error) {
+	m := map[string]any{}
+	for p.i < len(p.lines) && p.lines[p.i].indent == indent {
+		line := p.lines[p.i]
+		if !isYAMLKey(line.content) {
+			return nil, fmt.Errorf("line %d: expected a \"key: value\" entry", line.n)
+		}
+		key, rest := splitYAMLKey(line.content)
+		p.i++
+		if rest != "" {
+			v, err := yamlScalar(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", line.n, err)
+			}
+			m[key] = v
+			continue
+		}
+		// A nested node, or a sequence at the same indentation as the key
+		switch {
+		case p.i < len(p.lines) && p.lines[p.i].indent > indent:
+			v, err := p.node(p.lines[p.i].indent)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+		case p.i < len(p.lines) && p.lines[p.i].indent == indent && isYAMLItem(p.lines[p.i].content):
+			v, err := p.sequence(indent)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+		default:
+			m[key] = nil
+		}
+	}
+	return m, nil
+}
+
+func isYAMLItem(content string) bool {
+	return content == "-" || strings.HasPrefix(content, "- ")
+}
+
+func isYAMLKey(content string) bool {
+	if strings.HasPrefix(content, "[") || strings.HasPrefix(content, "{") {
+		return false
+	}
+	key, _ := splitYAMLKey(content)
+	return key != ""
+}
+
+// splitYAMLKey splits a "key: value" entry (whose key may be quoted)
+func splitYAMLKey(content string) (key, rest string) {
+	var quote rune
+	for i, r := range content {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case i == 0 && (r == '\'' || r == '"'):
+			quote = r
+		case r == ':' && (i+1 == len(content) || content[i+1] == ' '):
+			key, err := unquoteConfig(content[:i])
+			if err != nil {
+				return "", ""
+			}
+			return key, strings.TrimSpace(content[i+1:])
+		}
+	}
+	return "", ""
+}
+
+// yamlScalar parses a scalar, or a flow sequence of scalars
+func yamlScalar(s string) (any, error) {
+	inner, ok := strings.CutPrefix(s, "[")
+	if !ok {
+		return unquoteConfig(s)
+	}
+	inner, ok = strings.CutSuffix(inner, "]")
+	if !ok {
+		return nil, fmt.Errorf("unterminated flow sequence: %s", s)
+	}
+	list := []any{}
+	var (
+		quote rune
+		start int
+	)
+	for i, r := range inner + "," {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == ',':
+			item := strings.TrimSpace(inner[start:min(i, len(inner))])
+			start = i + 1
+			if item == "" {
+				continue
+			}
+			v, err := unquoteConfig(item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+	}
+	return list, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Version metadata (the responses of module proxies, and the versions that
+// 'go list -m' resolves queries to for modules fetched directly) is cached in
+// the user's cache directory for -cache-ttl, so that repeated runs against
+// the same dependencies (e.g. report in CI, followed by the upgrade itself, or
+// -f across many modules requiring the same dependencies) don't fetch it
+// again. Versions that don't exist are cached too, since most of the lookups
+// made probing for new major versions are for versions that don't exist. The
+// -no-cache flag ignores cached entries (and refreshes them). Failed lookups
+// (other than the ones for versions that don't exist) aren't cached.
+
+type cacheEntry struct {
+	Time     time.Time `json:"time"`
+	Body     []byte    `json:"body,omitempty"`
+	NotFound string    `json:"notFound,omitempty"` // Error message, if the lookup found nothing
+}
+
+// cachedNotFound is the error returned for a cached lookup that found nothing
+type cachedNotFound string
+
+func (e cachedNotFound) Error() string { return string(e) }
+func (e cachedNotFound) Unwrap() error { return errNotFound }
+
+// cachePath returns the path of the cache entry with the given key
+func cachePath(key ...string) (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(strings.Join(key, "\x00")))
+	return filepath.Join(cacheDir, "upgrade", "metadata", hex.EncodeToString(sum[:16])+".json"), nil
+}
+
+// readCache returns the cache entry with the given key, or nil if there isn't
+// one that's fresh enough
+func readCache(key ...string) *cacheEntry {
+	if *noCache || *cacheTTL <= 0 {
+		return nil
+	}
+	name, err := cachePath(key...)
+	if err != nil {
+		return nil
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(b, &entry); err != nil || time.Since(entry.Time) > *cacheTTL {
+		return nil
+	}
+	return &entry
+}
+
+// result returns the cached body, or the error of a lookup that found nothing
+func (e *cacheEntry) result() ([]byte, error) {
+	if e.NotFound != "" {
+		return nil, cachedNotFound(e.NotFound)
+	}
+	return e.Body, nil
+}
+
+// writeCache caches the result of the lookup with the given key, if it
+// succeeded or found nothing
+func writeCache(body []byte, lookupErr error, key ...string) {
+	if *cacheTTL <= 0 {
+		return
+	}
+	entry := cacheEntry{Time: time.Now(), Body: body}
+	switch {
+	case errors.Is(lookupErr, errNotFound):
+		entry.Body, entry.NotFound = nil, lookupErr.Error()
+	case lookupErr != nil:
+		return
+	}
+
+	name, err := cachePath(key...)
+	if err != nil {
+		return
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	// NOTE: Entries are written to a temporary file and renamed, so that
+	// concurrent runs never read a partially written one. Failing to cache a
+	// lookup only makes the next run slower, so errors are ignored.
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), ".tmp-*")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || os.Rename(f.Name(), name) != nil {
+		os.Remove(f.Name())
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+)
+
+// targets are the special (non-module) targets, completed along with the
+// module paths in the go.mod file
+var targets = []string{"all", "completion", "doctor", "enforce", "finish", "impact", "init", "plan", "report", "resume", "serve", "verify"}
+
+// printCompletion prints the completion script for the given shell. The
+// scripts complete flags (and their values, where possible), and complete
+// targets by running '<prog> -d <dir> __complete', which lists the module
+// paths in the go.mod file (see printCompletionTargets).
+func printCompletion(shell string) error {
+	prog := filepath.Base(os.Args[0])
+
+	var (
+		flags     []string // All flags
+		fileFlags []string // Flags whose value is a file
+		dirFlags  []string // Flags whose value is a directory
+		argFlags  []string // Other flags that take a value
+	)
+	flag.VisitAll(func(f *flag.Flag) {
+		flags = append(flags, "-"+f.Name)
+		if isBoolFlag(f) {
+			return
+		}
+		switch name, _ := flag.UnquoteUsage(f); {
+		case f.Name == "format":
+			// Completed with the formats
+		case f.Name == "d":
+			dirFlags = append(dirFlags, "-"+f.Name)
+		case name == "file" || name == "path":
+			fileFlags = append(fileFlags, "-"+f.Name)
+		default:
+			argFlags = append(argFlags, "-"+f.Name)
+		}
+	})
+
+	switch shell {
+	case "bash":
+		fmt.Print(bashCompletion(prog, flags, fileFlags, dirFlags, argFlags))
+	case "zsh":
+		// NOTE: zsh can run bash completion functions, which saves
+		// maintaining a separate script
+		fmt.Printf("autoload -U +X bashcompinit && bashcompinit\n\n%s", bashCompletion(prog, flags, fileFlags, dirFlags, argFlags))
+	case "fish":
+		fmt.Print(fishCompletion(prog))
+	default:
+		return fmt.Errorf("unsupported shell %q: must be bash, zsh or fish", shell)
+	}
+	return nil
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+func bashCompletion(prog string, flags, fileFlags, dirFlags, argFlags []string) string {
+	name := "_" + strings.NewReplacer("-", "_", ".", "_").Replace(prog)
+	return fmt.Sprintf(`%[1]s() {
+	local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}"
+	case "$prev" in
+	%[3]s)
+		COMPREPLY=($(compgen -f -- "$cur"))
+		return
+		;;
+	%[4]s)
+		COMPREPLY=($(compgen -d -- "$cur"))
+		return
+		;;
+	-format)
+		COMPREPLY=($(compgen -W "%[6]s %[7]s" -- "$cur"))
+		return
+		;;
+	%[5]s)
+		return
+		;;
+	esac
+
+	if [[ "$cur" == -* ]]; then
+		COMPREPLY=($(compgen -W "%[8]s" -- "$cur"))
+		return
+	fi
+
+	local dir=. i
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		if [[ "${COMP_WORDS[i]}" == -d ]]; then
+			dir="${COMP_WORDS[i+1]}"
+		fi
+	done
+	COMPREPLY=($(compgen -W "$(%[2]s -d "$dir" __complete 2>/dev/null)" -- "$cur"))
+}
+
+complete -F %[1]s %[2]s
+`,
+		name, prog,
+		strings.Join(fileFlags, "|"), strings.Join(dirFlags, "|"), strings.Join(argFlags, "|"),
+		formatText, formatGHA, strings.Join(flags, " "),
+	)
+}
+
+func fishCompletion(prog string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `function __%[1]s_targets
+	set -l tokens (commandline -opc)
+	set -l dir .
+	for i in (seq (count $tokens))
+		if test "$tokens[$i]" = -d
+			set dir $tokens[(math $i + 1)]
+		end
+	end
+	%[1]s -d $dir __complete 2>/dev/null
+end
+
+complete -c %[1]s -f -a '(__%[1]s_targets)'
+`, prog)
+
+	flag.VisitAll(func(f *flag.Flag) {
+		name, usage := flag.UnquoteUsage(f)
+		usage = strings.ReplaceAll(usage, "'", `\'`)
+		switch {
+		case isBoolFlag(f):
+			fmt.Fprintf(&b, "complete -c %s -o %s -d '%s'\n", prog, f.Name, usage)
+		case f.Name == "format":
+			fmt.Fprintf(&b, "complete -c %s -o %s -x -a '%s %s' -d '%s'\n", prog, f.Name, formatText, formatGHA, usage)
+		case f.Name == "d":
+			fmt.Fprintf(&b, "complete -c %s -o %s -x -a '(__fish_complete_directories)' -d '%s'\n", prog, f.Name, usage)
+		case name == "file" || name == "path":
+			fmt.Fprintf(&b, "complete -c %s -o %s -r -F -d '%s'\n", prog, f.Name, usage)
+		default:
+			fmt.Fprintf(&b, "complete -c %s -o %s -x -d '%s'\n", prog, f.Name, usage)
+		}
+	})
+	return b.String()
+}
+
+// printCompletionTargets prints the targets that can be given: the module's
+// own path, the paths of its requirements, and the special targets. Errors
+// are ignored, since there's nowhere to report them while completing.
+func printCompletionTargets(dir string) {
+	paths := append([]string(nil), targets...)
+	if root, err := findModuleRoot(dir); err == nil {
+		filePath := filepath.Join(root, "go.mod")
+		if b, err := os.ReadFile(filePath); err == nil {
+			if file, err := modfile.Parse(filePath, b, nil); err == nil {
+				paths = append(paths, file.Module.Mod.Path)
+				for _, require := range file.Require {
+					paths = append(paths, require.Mod.Path)
+				}
+			}
+		}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fmt.Println(path)
+	}
+}
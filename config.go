@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/sync/errgroup"
+)
+
+// A .upgrade.yaml file in the module directory holds the default values of
+// flags, so that a module's upgrade settings can be checked in, e.g.:
+//
+//	exclude-file:
+//	  - '\.pb\.go$'
+//	policy: upgrade-policy.json
+//	private:
+//	  - github.com/acme
+//
+// Each setting is named after its flag, and flags given on the command line
+// take precedence. Lists are only allowed for the flags that can be repeated.
+// The "private" setting holds the patterns of modules that aren't available
+// from the module proxy, and sets GOPRIVATE (unless it's already set).
+//
+// NOTE: Only the subset of YAML needed for that is supported: top-level keys,
+// with a scalar value or a list of scalars (which can be quoted), and comments.
+const configFile = ".upgrade.yaml"
+
+// configSetting is a setting of the configuration file
+type configSetting struct {
+	key    string
+	values []string
+	isList bool
+	line   int
+}
+
+// loadConfig applies the configuration file of the module in the given
+// directory, if it has one
+func loadConfig(dir string) error {
+	filename := filepath.Join(dir, configFile)
+	b, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error reading configuration file: %s", err)
+	}
+	settings, err := parseConfig(filename, b)
+	if err != nil {
+		return err
+	}
+
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	for _, setting := range settings {
+		if setting.key == "private" {
+			if os.Getenv("GOPRIVATE") == "" {
+				os.Setenv("GOPRIVATE", strings.Join(setting.values, ","))
+			}
+			continue
+		}
+
+		f := flag.Lookup(setting.key)
+		switch {
+		case f == nil:
+			return fmt.Errorf("%s:%d: unknown setting %q", filename, setting.line, setting.key)
+		case setting.key == "d" || setting.key == "f":
+			return fmt.Errorf("%s:%d: the %s flag can't be set in the configuration file", filename, setting.line, setting.key)
+		case setting.isList && !isRepeatable(f):
+			return fmt.Errorf("%s:%d: the %s flag can't be given more than once", filename, setting.line, setting.key)
+		case given[setting.key]:
+			continue
+		}
+		for _, value := range setting.values {
+			if err := f.Value.Set(value); err != nil {
+				return fmt.Errorf("%s:%d: invalid value %q for %s: %s", filename, setting.line, value, setting.key, err)
+			}
+		}
+	}
+	return nil
+}
+
+func isRepeatable(f *flag.Flag) bool {
+	switch f.Value.(type) {
+	case *stringsFlag, *regexpsFlag, *textRulesFlag:
+		return true
+	}
+	return false
+}
+
+// parseConfig parses the supported subset of YAML
+func parseConfig(filename string, b []byte) ([]configSetting, error) {
+	var (
+		settings []configSetting
+		current  *configSetting // The setting whose list is being parsed
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		line := stripComment(strings.TrimRight(scanner.Text(), " \t\r"))
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+
+		if item, ok := strings.CutPrefix(trimmed, "- "); ok && line != trimmed {
+			if current == nil {
+				return nil, fmt.Errorf("%s:%d: list item outside of a list", filename, n)
+			}
+			value, err := unquoteConfig(strings.TrimSpace(item))
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", filename, n, err)
+			}
+			current.values = append(current.values, value)
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || line != trimmed || key == "" {
+			return nil, fmt.Errorf("%s:%d: expected a top-level \"key: value\" setting", filename, n)
+		}
+		setting := configSetting{key: key, line: n}
+		if value = strings.TrimSpace(value); value == "" {
+			setting.isList = true
+		} else {
+			unquoted, err := unquoteConfig(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", filename, n, err)
+			}
+			setting.values = []string{unquoted}
+		}
+		settings = append(settings, setting)
+		current = nil
+		if setting.isList {
+			current = &settings[len(settings)-1]
+		}
+	}
+	return settings, scanner.Err()
+}
+
+// stripComment removes a trailing comment (starting with a # at the start of
+// the line, or after whitespace, outside of quotes) from the line
+func stripComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func unquoteConfig(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		return strconv.Unquote(value)
+	case strings.HasPrefix(value, "'"):
+		if len(value) < 2 || !strings.HasSuffix(value, "'") {
+			return "", fmt.Errorf("unterminated quoted value: %s", value)
+		}
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'"), nil
+	}
+	return value, nil
+}
+
+// quoteConfig single-quotes the value, so that it's never interpreted as
+// anything but a string
+func quoteConfig(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// initConfig writes a starter configuration file for the module in the given
+// directory, with settings inferred from its layout and requirements
+func initConfig(ctx context.Context, dir string) {
+	filename := filepath.Join(dir, configFile)
+	if _, err := os.Stat(filename); err == nil {
+		log.Fatalf("%s already exists", filename)
+	}
+
+	file := readModFile(dir)
+	excludes, packageDirs, err := inspectLayout(dir)
+	if err != nil {
+		log.Fatalf("Error inspecting module: %s", err)
+	}
+	private := privatePrefixes(ctx, file.Require)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Configuration of the upgrade tool for %s.\n", file.Module.Mod.Path)
+	fmt.Fprintf(&b, "# Each setting is the default value of the flag of the same name (see\n")
+	fmt.Fprintf(&b, "# 'upgrade -h'); flags given on the command line take precedence.\n")
+
+	fmt.Fprintf(&b, "\n# Never rewrite imports in these files (regular expressions matched against\n")
+	fmt.Fprintf(&b, "# paths relative to the module directory). Vendor and hidden directories, and\n")
+	fmt.Fprintf(&b, "# files ignored by git, are always skipped. Implies -keep-old (run 'upgrade\n")
+	fmt.Fprintf(&b, "# finish' to drop the old requirements once they're no longer imported).\n")
+	writeConfigList(&b, "exclude-file", excludes)
+
+	fmt.Fprintf(&b, "\n# Only rewrite imports in these packages (implies -keep-old).\n")
+	fmt.Fprintf(&b, "# only:\n")
+	for _, d := range packageDirs {
+		fmt.Fprintf(&b, "#   - %s\n", quoteConfig("./"+d+"/..."))
+	}
+
+	fmt.Fprintf(&b, "\n# Modules that aren't available from the module proxy, and are fetched\n")
+	fmt.Fprintf(&b, "# directly from version control (sets GOPRIVATE, unless it's already set).\n")
+	writeConfigList(&b, "private", private)
+
+	oldHash := fileHash(filename)
+	if err := os.WriteFile(filename, []byte(b.String()), 0o644); err != nil {
+		log.Fatalf("Error writing configuration file: %s", err)
+	}
+	auditor.recordWrite(filename, oldHash, "")
+	fmt.Printf("Wrote %s\n", filename)
+}
+
+// writeConfigList writes a list setting, commented out if it's empty
+func writeConfigList(b *strings.Builder, key string, values []string) {
+	if len(values) == 0 {
+		fmt.Fprintf(b, "# %s:\n#   - ''\n", key)
+		return
+	}
+	fmt.Fprintf(b, "%s:\n", key)
+	for _, value := range values {
+		fmt.Fprintf(b, "  - %s\n", quoteConfig(value))
+	}
+}
+
+// inspectLayout returns the -exclude-file patterns of the module's testdata
+// directories and generated files, and its top-level package directories
+func inspectLayout(dir string) (excludes, packageDirs []string, err error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	ig, err := newIgnorer(root)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		seen     = map[string]bool{}
+		topLevel = map[string]bool{}
+	)
+	add := func(pattern string) {
+		if !seen[pattern] {
+			seen[pattern] = true
+			excludes = append(excludes, pattern)
+		}
+	}
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		if d.IsDir() {
+			if ig.skip(path, true) {
+				return filepath.SkipDir
+			}
+			// Nested modules have their own configuration
+			if _, err := os.Stat(filepath.Join(path, "go.mod")); err == nil {
+				return filepath.SkipDir
+			}
+			if d.Name() == "testdata" {
+				add(`(^|/)testdata/`)
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".go") || ig.skip(path, false) {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(root, path)
+		rel = filepath.ToSlash(rel)
+		if top, _, ok := strings.Cut(rel, "/"); ok {
+			topLevel[top] = true
+		}
+		fileAST, err := parser.ParseFile(token.NewFileSet(), path, nil, parser.PackageClauseOnly|parser.ParseComments)
+		if err == nil && ast.IsGenerated(fileAST) {
+			add(generatedPattern(rel))
+		}
+		return nil
+	})
+	for d := range topLevel {
+		packageDirs = append(packageDirs, d)
+	}
+	sort.Strings(packageDirs)
+	return excludes, packageDirs, err
+}
+
+// generatedPattern returns a regular expression matching the generated file
+// at the given path, and the other files generated like it, going by the
+// usual naming conventions (e.g. .pb.go, _gen.go or zz_generated.*.go files)
+func generatedPattern(rel string) string {
+	name := filepath.Base(rel)
+	base := strings.TrimSuffix(name, ".go")
+	switch {
+	case strings.Contains(base, "."):
+		// e.g. foo.pb.go, foo.pb.gw.go
+		return regexp.QuoteMeta(name[strings.Index(name, "."):]) + "$"
+	case strings.HasPrefix(base, "zz_"), strings.HasPrefix(base, "mock_"):
+		prefix, _, _ := strings.Cut(base, "_")
+		return "(^|/)" + prefix + "_[^/]*\\.go$"
+	case strings.Contains(base, "_"):
+		// e.g. foo_gen.go, foo_string.go
+		return regexp.QuoteMeta(base[strings.LastIndex(base, "_"):]) + "\\.go$"
+	}
+	return "^" + regexp.QuoteMeta(rel) + "$"
+}
+
+// privatePrefixes returns the patterns of the required modules that aren't
+// available from the module proxy (or that are already configured to be
+// fetched directly), by organization on the usual code hosts, or else by host
+func privatePrefixes(ctx context.Context, requires []*modfile.Require) []string {
+	var (
+		lock     sync.Mutex
+		prefixes = map[string]bool{}
+	)
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(*jobs)
+	for _, require := range requires {
+		path := require.Mod.Path
+		g.Go(func() error {
+			_, err := proxyFetch(ctx, path, "@v/list")
+			if errors.Is(err, errDirect) || errors.Is(err, errNotFound) {
+				lock.Lock()
+				defer lock.Unlock()
+				prefixes[privatePrefix(path)] = true
+			}
+			return nil
+		})
+	}
+	g.Wait()
+
+	var patterns []string
+	for prefix := range prefixes {
+		patterns = append(patterns, prefix)
+	}
+	sort.Strings(patterns)
+	return patterns
+}
+
+// privatePrefix returns the GOPRIVATE pattern covering the given module and
+// the other modules of the same organization (or host)
+func privatePrefix(path string) string {
+	parts := strings.Split(path, "/")
+	switch parts[0] {
+	case "github.com", "gitlab.com", "bitbucket.org":
+		if len(parts) >= 2 {
+			return parts[0] + "/" + parts[1]
+		}
+	}
+	return parts[0]
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// consolidateDependencies finishes stalled migrations between major versions
+// of a dependency: when several major versions of the same module are
+// required (e.g. because some files were already changed to import the new
+// major version, while others still import the old one), the older ones are
+// upgraded to the newest major version that's required, at its required
+// version. No versions are looked up. If a module path is given, only that
+// module (at any major version) is consolidated.
+func consolidateDependencies(file *modfile.File, path string) []upgrade {
+	prefix := ""
+	if path != "" {
+		var ok bool
+		if prefix, _, ok = module.SplitPathVersion(path); !ok {
+			log.Fatalf("Invalid module path: %s", path)
+		}
+	}
+
+	// Group the requirements by module path prefix, in go.mod order
+	var (
+		prefixes []string
+		families = map[string][]*modfile.Require{}
+	)
+	for _, require := range file.Require {
+		p, _, ok := module.SplitPathVersion(require.Mod.Path)
+		if !ok || (prefix != "" && p != prefix) {
+			continue
+		}
+		// Forks are upgraded via their replacement
+		if findForkReplacement(file, require.Mod.Path) != nil {
+			continue
+		}
+		if families[p] == nil {
+			prefixes = append(prefixes, p)
+		}
+		families[p] = append(families[p], require)
+	}
+
+	var upgrades []upgrade
+	for _, p := range prefixes {
+		requires := families[p]
+		if len(requires) < 2 {
+			continue
+		}
+
+		newest := requires[0]
+		for _, require := range requires[1:] {
+			if compareMajors(require, newest) > 0 {
+				newest = require
+			}
+		}
+		for _, require := range requires {
+			if require == newest {
+				continue
+			}
+			// NOTE: The new requirement inherits the indirect marker of the
+			// newest one, which is cleared if the code imports it (see
+			// markDirectRequirements)
+			upgrades = append(upgrades, upgrade{
+				oldPath:    require.Mod.Path,
+				newPath:    newest.Mod.Path,
+				oldVersion: require.Mod.Version,
+				newVersion: newest.Mod.Version,
+				indirect:   newest.Indirect,
+			})
+		}
+	}
+
+	for _, upgrade := range upgrades {
+		fmt.Printf("%s %s -> %s %s\n", upgrade.oldPath, upgrade.oldVersion, upgrade.newPath, upgrade.newVersion)
+		carryComments(file, upgrade.oldPath, upgrade.newPath)
+		if err := file.DropRequire(upgrade.oldPath); err != nil {
+			log.Fatalf("Error dropping module requirement %s: %s", upgrade.oldPath, err)
+		}
+	}
+	if len(upgrades) == 0 {
+		fmt.Println("No dependencies are required at more than one major version")
+	}
+	return upgrades
+}
+
+// compareMajors compares the major versions of two requirements of the same
+// module, by path suffix, then by version (for +incompatible versions)
+func compareMajors(a, b *modfile.Require) int {
+	if c := currentMajor(a.Mod.Path, a.Mod.Version) - currentMajor(b.Mod.Path, b.Mod.Version); c != 0 {
+		return c
+	}
+	return semver.Compare(a.Mod.Version, b.Mod.Version)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// An upgrade of a large module shouldn't be abandoned because of a single
+// package that fails to load, or a single file that can't be rewritten (or
+// written): the failures are collected instead, the rest of the upgrade is
+// carried out, and they're reported together, grouped by what failed, at the
+// end of the run (which then exits with a non-zero status).
+
+// Kinds of failures, in the order they're reported
+const (
+	failedLoad    = "Packages that failed to load"
+	failedRewrite = "Files that failed to be rewritten"
+	failedWrite   = "Files that failed to be written"
+)
+
+var failureKinds = []string{failedLoad, failedRewrite, failedWrite}
+
+type failure struct {
+	kind     string
+	filename string // Empty if the failure isn't about a single file
+	msg      string
+}
+
+type failureList struct {
+	lock     sync.Mutex
+	failures []failure
+}
+
+var failures failureList
+
+// add records a failure of the given kind (about the given file, if any),
+// printing it as it happens if -v is set
+func (l *failureList) add(kind, filename string, err error) {
+	msg := err.Error()
+	if filename != "" {
+		msg = fmt.Sprintf("%s: %s", relativePath(filename), msg)
+	}
+	recorder.recordWarning(msg)
+	if *verbose {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", msg)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.failures = append(l.failures, failure{kind: kind, filename: filename, msg: msg})
+}
+
+// report prints the failures recorded, grouped by kind, and reports whether
+// there were any
+func (l *failureList) report() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.failures) == 0 {
+		return false
+	}
+
+	for _, kind := range failureKinds {
+		var printed bool
+		for _, f := range l.failures {
+			if f.kind != kind {
+				continue
+			}
+			if *outputFormat == formatGHA {
+				fmt.Printf("::error%s::%s\n", annotationLocation(f.filename, 0), escapeAnnotation(f.msg))
+				continue
+			}
+			if !printed {
+				fmt.Fprintf(os.Stderr, "\n%s:\n", kind)
+				printed = true
+			}
+			fmt.Fprintf(os.Stderr, "\t%s\n", f.msg)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "\nThe upgrade is incomplete: %d error(s) occurred\n", len(l.failures))
+	return true
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go/version"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/sync/errgroup"
+)
+
+// Most of the problems running this tool come from its environment, rather
+// than from the module being upgraded: a go command that's too old, a module
+// proxy that can't be reached, a module cache that can't be written to, a
+// missing git command, or private modules that GOPRIVATE doesn't cover. The
+// "doctor" target checks each of them upfront, and prints what to do about the
+// ones that fail.
+
+// minGoVersion is the oldest go command the tool supports, the first one
+// with toolchain switching (see bumpGoVersion)
+const minGoVersion = "go1.21"
+
+// doctorTimeout bounds each check that makes network requests
+const doctorTimeout = 10 * time.Second
+
+// diagnosis prints the outcome of each check, counting the problems found
+type diagnosis struct {
+	warnings int
+	failures int
+}
+
+func (d *diagnosis) ok(check, format string, args ...any) {
+	fmt.Printf("ok       %s: %s\n", check, fmt.Sprintf(format, args...))
+}
+
+// warn reports a problem that only gets in the way of some of the tool's
+// features, along with how to fix it
+func (d *diagnosis) warn(check, fix, format string, args ...any) {
+	d.warnings++
+	fmt.Printf("warning  %s: %s\n", check, fmt.Sprintf(format, args...))
+	fmt.Printf("         -> %s\n", fix)
+}
+
+// fail reports a problem that prevents upgrades, along with how to fix it
+func (d *diagnosis) fail(check, fix, format string, args ...any) {
+	d.failures++
+	fmt.Printf("FAILED   %s: %s\n", check, fmt.Sprintf(format, args...))
+	fmt.Printf("         -> %s\n", fix)
+}
+
+// doctor checks the environment the tool depends on (and, within a module,
+// the module's requirements against it), printing a diagnosis of each check.
+// Exits with a non-zero status if any check failed.
+func doctor(ctx context.Context, dir string) {
+	var d diagnosis
+	if checkGoCommand(ctx, &d) {
+		checkModuleGoVersion(ctx, &d, dir)
+		checkModuleProxy(ctx, &d)
+		checkModuleCache(ctx, &d)
+		checkGit(ctx, &d)
+		checkPrivateModules(ctx, &d, dir)
+	}
+	checkMetadataCache(&d)
+
+	switch {
+	case d.failures > 0:
+		fmt.Printf("\n%d problem(s) found, and %d warning(s)\n", d.failures, d.warnings)
+		os.Exit(1)
+	case d.warnings > 0:
+		fmt.Printf("\nNo problems found, but %d warning(s)\n", d.warnings)
+	default:
+		fmt.Println("\nNo problems found")
+	}
+}
+
+// checkGoCommand checks that the go command is installed and recent enough,
+// and reports whether it can be run at all (which the other checks need)
+func checkGoCommand(ctx context.Context, d *diagnosis) bool {
+	const check = "go command"
+	path, err := exec.LookPath("go")
+	if err != nil {
+		d.fail(check, "install Go (see https://go.dev/dl/), and add its bin directory to PATH", "not found in PATH")
+		return false
+	}
+	local, toolchain := localGoVersion(ctx)
+	if local == "" {
+		d.fail(check, "run 'go env' to see what's wrong with the installation", "'go env GOVERSION GOTOOLCHAIN' failed (%s)", path)
+		return false
+	}
+	if version.Compare(local, minGoVersion) < 0 {
+		d.fail(check, "install a newer version of Go (see https://go.dev/dl/)", "%s (%s) is older than %s, the oldest version supported", local, path, minGoVersion)
+		return true
+	}
+	d.ok(check, "%s (%s), GOTOOLCHAIN=%s", local, path, toolchain)
+	return true
+}
+
+// checkModuleGoVersion checks that the go command can build the module in the
+// given directory (if it's in one), given its go and toolchain directives
+func checkModuleGoVersion(ctx context.Context, d *diagnosis, dir string) {
+	const check = "go version"
+	root, err := findModuleRoot(dir)
+	if err != nil {
+		return
+	}
+	file := readModFile(root)
+	required := "go1.16" // The default, when there's no go directive
+	if file.Go != nil {
+		required = "go" + file.Go.Version
+	}
+	if file.Toolchain != nil && version.Compare(file.Toolchain.Name, required) > 0 {
+		required = file.Toolchain.Name
+	}
+
+	local, toolchain := localGoVersion(ctx)
+	switch {
+	case version.Compare(local, required) >= 0:
+		d.ok(check, "the module requires %s, and the go command is %s", required, local)
+	case canSwitchToolchain(toolchain):
+		d.ok(check, "the module requires %s, which the go command (%s) will download and switch to", required, local)
+	default:
+		d.fail(check, fmt.Sprintf("install %s, or allow the go command to switch toolchains with 'go env -w GOTOOLCHAIN=auto'", required),
+			"the module requires %s, but the go command is %s, and GOTOOLCHAIN=%s prevents switching toolchains", required, local, toolchain,
+		)
+	}
+}
+
+// checkModuleProxy checks that each proxy of the GOPROXY setting can be
+// reached, by listing the versions of a module that every proxy is expected to
+// know (a proxy that responds that it doesn't is reachable all the same)
+func checkModuleProxy(ctx context.Context, d *diagnosis) {
+	const check = "GOPROXY"
+	entries, _, err := goproxy(ctx)
+	if err != nil {
+		d.fail(check, "run 'go env GOPROXY' to see what's wrong", "%s", err)
+		return
+	}
+
+	for _, entry := range entries {
+		switch entry.url {
+		case "direct":
+			d.ok(check, "direct (modules are fetched from version control, with git)")
+			continue
+		case "off":
+			d.warn(check, "set GOPROXY to a module proxy (e.g. 'go env -w GOPROXY=https://proxy.golang.org,direct')",
+				"off (versions can't be looked up, unless they're in the module cache)",
+			)
+			continue
+		}
+
+		probeCtx, cancel := context.WithTimeout(ctx, doctorTimeout)
+		start := time.Now()
+		_, err := fetchURL(probeCtx, entry.url+"/golang.org/x/mod/@v/list")
+		cancel()
+		if err != nil && !errors.Is(err, errNotFound) {
+			d.fail(check, "check the network connection and proxy settings (e.g. HTTPS_PROXY), or set GOPROXY to a proxy that can be reached",
+				"%s can't be reached: %s", entry.url, err,
+			)
+			continue
+		}
+		d.ok(check, "%s can be reached (%s)", entry.url, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// checkModuleCache checks that the module cache (GOMODCACHE) can be written
+// to, since the go command downloads the new versions of dependencies to it
+func checkModuleCache(ctx context.Context, d *diagnosis) {
+	const check = "module cache"
+	out, err := exec.CommandContext(ctx, "go", "env", "GOMODCACHE").Output()
+	if err != nil {
+		d.fail(check, "run 'go env GOMODCACHE' to see what's wrong", "error executing 'go env GOMODCACHE' command: %s", err)
+		return
+	}
+	cacheDir := strings.TrimSpace(string(out))
+	if err := checkWritable(cacheDir); err != nil {
+		d.fail(check, "fix the permissions of the directory, or point GOMODCACHE to a writable one (e.g. 'go env -w GOMODCACHE=$HOME/go/pkg/mod')",
+			"%s can't be written to: %s", cacheDir, err,
+		)
+		return
+	}
+	d.ok(check, "%s", cacheDir)
+}
+
+// checkMetadataCache checks that the cache of version metadata can be written
+// to (see -cache-ttl), which only makes runs slower if it can't
+func checkMetadataCache(d *diagnosis) {
+	const check = "metadata cache"
+	if *cacheTTL <= 0 {
+		d.ok(check, "disabled")
+		return
+	}
+	entry, err := cachePath()
+	cacheDir := filepath.Dir(entry)
+	if err == nil {
+		err = checkWritable(cacheDir)
+	}
+	if err != nil {
+		d.warn(check, "fix the permissions of the user's cache directory (or set XDG_CACHE_HOME), or disable the cache with -cache-ttl 0",
+			"version metadata can't be cached, so every run fetches it again: %s", err,
+		)
+		return
+	}
+	d.ok(check, "%s", cacheDir)
+}
+
+// checkWritable checks that files can be created in the given directory
+// (creating it, if needed)
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".upgrade-doctor-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkGit checks that the git command is installed, which the go command
+// needs to fetch modules directly from version control (with GOPROXY=direct,
+// or for private modules), and -batch needs to commit upgrades
+func checkGit(ctx context.Context, d *diagnosis) {
+	const check = "git"
+	out, err := exec.CommandContext(ctx, "git", "--version").Output()
+	if err == nil {
+		d.ok(check, "%s", strings.TrimSpace(string(out)))
+		return
+	}
+
+	entries, noProxy, _ := goproxy(ctx)
+	direct := noProxy != "" || slices.ContainsFunc(entries, func(entry proxyEntry) bool {
+		return entry.url == "direct"
+	})
+	if direct {
+		d.fail(check, "install git, and add it to PATH",
+			"not found, but modules are fetched directly from version control (GOPROXY=direct, or GOPRIVATE/GONOPROXY is set): %s", err,
+		)
+		return
+	}
+	d.warn(check, "install git, and add it to PATH", "not found, so -batch and -pr can't be used: %s", err)
+}
+
+// checkPrivateModules checks that the requirements of the module in the given
+// directory (if it's in one) that the module proxy doesn't have are covered by
+// GOPRIVATE (or GONOSUMDB), since the checksum database can't vouch for them
+// either, which makes the go command refuse to download them
+func checkPrivateModules(ctx context.Context, d *diagnosis, dir string) {
+	const check = "GOPRIVATE"
+	root, err := findModuleRoot(dir)
+	if err != nil {
+		return
+	}
+	sumdb, noSumdb, err := sumdbSettings(ctx)
+	if err != nil {
+		d.fail(check, "run 'go env GOSUMDB GONOSUMDB' to see what's wrong", "%s", err)
+		return
+	}
+	if sumdb == "off" {
+		d.ok(check, "not needed, since GOSUMDB=off")
+		return
+	}
+
+	file := readModFile(root)
+	var (
+		lock    sync.Mutex
+		missing = map[string]bool{}
+	)
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(*jobs)
+	for _, require := range file.Require {
+		path := require.Mod.Path
+		if module.MatchPrefixPatterns(noSumdb, path) || replacedBy(file, path) {
+			continue
+		}
+		g.Go(func() error {
+			probeCtx, cancel := context.WithTimeout(gctx, doctorTimeout)
+			defer cancel()
+			// NOTE: The cache is bypassed, so that the diagnosis is current
+			_, err := proxy.fetch(probeCtx, path, "@v/list")
+			if errors.Is(err, errDirect) || errors.Is(err, errNotFound) {
+				lock.Lock()
+				defer lock.Unlock()
+				missing[privatePrefix(path)] = true
+			}
+			return nil
+		})
+	}
+	g.Wait()
+
+	if len(missing) == 0 {
+		if noSumdb != "" {
+			d.ok(check, "%s", noSumdb)
+		} else {
+			d.ok(check, "not needed, since the module proxy has every requirement")
+		}
+		return
+	}
+	prefixes := sortedKeys(missing, nil)
+	patterns := prefixes
+	if noSumdb != "" {
+		patterns = append([]string{noSumdb}, prefixes...)
+	}
+	d.warn(check, fmt.Sprintf("run 'go env -w GOPRIVATE=%s' (or add them to the private setting of %s)", strings.Join(patterns, ","), configFile),
+		"the module proxy doesn't have the modules matching %s, which GOPRIVATE doesn't cover, so the go command can't verify them against the checksum database",
+		strings.Join(prefixes, ", "),
+	)
+}
+
+// replacedBy reports whether the given requirement is replaced (by a fork, or
+// a local directory), in which case it isn't fetched under its own path
+func replacedBy(file *modfile.File, path string) bool {
+	return slices.ContainsFunc(file.Replace, func(replace *modfile.Replace) bool {
+		return replace.Old.Path == path
+	})
+}
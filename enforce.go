@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// enforce checks that none of the module's direct dependencies is more than
+// -max-behind major versions behind its latest one, e.g. as a CI guardrail.
+// The dependencies that are (or couldn't be checked) are printed as a table
+// (like report's), and the exit status is 1. Dependencies denied by the
+// -policy file are exempt. Nothing is modified.
+func enforce(ctx context.Context, dir string, args []string) {
+	flags := flag.NewFlagSet("enforce", flag.ExitOnError)
+	maxBehind := flags.Int("max-behind", 0, "maximum `number` of major versions any direct dependency can be behind")
+	flags.Parse(args)
+	if *maxBehind < 0 {
+		log.Fatalf("Invalid -max-behind value %d: must not be negative", *maxBehind)
+	}
+
+	status := checkModule(ctx, dir)
+	if status.Error != "" {
+		log.Fatalf("Error checking module: %s", status.Error)
+	}
+	if err := ctx.Err(); err != nil {
+		log.Fatalf("Enforcement cancelled: %s", context.Cause(ctx))
+	}
+
+	var violations []dependencyStatus
+	for _, dependency := range status.Dependencies {
+		if dependency.Indirect || dependency.Denied {
+			continue
+		}
+		if dependency.Error != "" || dependency.MajorsBehind > *maxBehind {
+			violations = append(violations, dependency)
+		}
+	}
+	// With -format=csv, stdout only contains the table (with just the
+	// header, if there are no violations), and likewise with -format=sarif
+	out := os.Stdout
+	if *outputFormat == formatCSV || *outputFormat == formatSARIF {
+		out = os.Stderr
+	}
+	if *outputFormat == formatSARIF {
+		if err := writeStatusSARIF(os.Stdout, dir, violations, "error"); err != nil {
+			log.Fatalf("Error encoding violations: %s", err)
+		}
+	}
+	if len(violations) == 0 {
+		if *outputFormat == formatCSV {
+			printStatusTable(nil)
+		}
+		fmt.Fprintf(out, "No direct dependency of %s is more than %d major version(s) behind\n", status.Path, *maxBehind)
+		return
+	}
+
+	if *outputFormat != formatSARIF {
+		printStatusTable(violations)
+	}
+	fmt.Fprintf(out, "\n%d direct dependency(ies) of %s are more than %d major version(s) behind, or couldn't be checked\n",
+		len(violations), status.Path, *maxBehind,
+	)
+	os.Exit(1)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// regexpsFlag is a flag of regular expressions that can be given more than
+// once (see -include-file and -exclude-file)
+type regexpsFlag []*regexp.Regexp
+
+func (r *regexpsFlag) String() string {
+	var exprs []string
+	for _, re := range *r {
+		exprs = append(exprs, re.String())
+	}
+	return strings.Join(exprs, ", ")
+}
+
+func (r *regexpsFlag) Set(value string) error {
+	re, err := regexp.Compile(value)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, re)
+	return nil
+}
+
+// fileSelected reports whether the imports of the file at the given path,
+// relative to the module directory, may be rewritten: it must match one of
+// the -include-file expressions (if any), and none of the -exclude-file ones.
+// Paths are matched with forward slashes on every platform.
+func fileSelected(rel string) bool {
+	rel = filepath.ToSlash(rel)
+	if len(includeFiles) > 0 && !matchAny(includeFiles, rel) {
+		return false
+	}
+	return !matchAny(excludeFiles, rel)
+}
+
+func matchAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
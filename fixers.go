@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// A fixer migrates a file that imports one or more upgraded modules (after
+// its imports have been rewritten), e.g. to adapt it to breaking API changes.
+// It can modify the file's AST in place, or replace it (along with its file
+// set) altogether.
+type fixer interface {
+	fix(ctx context.Context, f *file, upgrades []upgrade) error
+	String() string
+}
+
+// fixers are applied, in order, to each file that imports an upgraded module
+var fixers []fixer
+
+// ruleFixer applies gofmt -r style rewrite rules (see -rules)
+type ruleFixer struct {
+	filename string
+	rules    []rewriteRule
+}
+
+func (r *ruleFixer) fix(ctx context.Context, f *file, upgrades []upgrade) error {
+	for _, rule := range r.rules {
+		if n := rule.apply(f.fset, f.ast); n > 0 && *verbose {
+			fmt.Printf("\t%s (%d matches)\n", rule.text, n)
+		}
+	}
+	return nil
+}
+
+func (r *ruleFixer) String() string {
+	return "rules from " + r.filename
+}
+
+// processFixer runs an external command to fix each file (see -fixer). The
+// command is run through the shell, once per upgraded module that the file
+// imports, with:
+//
+//   - The file's current contents on stdin
+//   - The upgrade described by the OLD_PATH, NEW_PATH, OLD_VERSION and
+//     NEW_VERSION environment variables, and the file's path by FILE
+//
+// It must print the fixed contents of the file to stdout, or nothing at all
+// if it has nothing to change. A non-zero exit status is treated as an error.
+type processFixer struct {
+	command string
+}
+
+func (p *processFixer) fix(ctx context.Context, f *file, upgrades []upgrade) error {
+	for _, upgrade := range upgrades {
+		in, err := formatFile(*f)
+		if err != nil {
+			return err
+		}
+
+		var stdout, stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, "sh", "-c", p.command)
+		cmd.Stdin = bytes.NewReader(in)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		cmd.Env = append(os.Environ(),
+			"OLD_PATH="+upgrade.oldPath,
+			"NEW_PATH="+upgrade.newPath,
+			"OLD_VERSION="+upgrade.oldVersion,
+			"NEW_VERSION="+upgrade.newVersion,
+			"FILE="+f.name,
+		)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("error running fixer %q on %s: %s: %s", p.command, f.name, err, strings.TrimSpace(stderr.String()))
+		}
+		if stdout.Len() == 0 || bytes.Equal(stdout.Bytes(), in) {
+			continue
+		}
+
+		fset := token.NewFileSet()
+		fileAST, err := parser.ParseFile(fset, f.name, stdout.Bytes(), parser.ParseComments)
+		if err != nil {
+			return fmt.Errorf("error parsing output of fixer %q for %s: %s", p.command, f.name, err)
+		}
+		f.ast, f.fset = fileAST, fset
+		if *verbose {
+			fmt.Printf("\tFixed by %q for %s\n", p.command, upgrade.newPath)
+		}
+	}
+	return nil
+}
+
+func (p *processFixer) String() string {
+	return fmt.Sprintf("fixer %q", p.command)
+}
+
+// stringsFlag is a flag that can be given multiple times
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
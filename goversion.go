@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go/version"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/mod/modfile"
+)
+
+// bumpGoVersion raises the go directive of the go.mod file to the highest go
+// version required by the new versions of the upgraded dependencies (the go
+// command refuses to build a module whose dependencies require a newer go
+// version than the module itself). The toolchain directive, if there is one,
+// is raised to match. Exits with an error if the installed go command is too
+// old for the new go version and isn't allowed to switch toolchains
+// (GOTOOLCHAIN=local).
+func bumpGoVersion(ctx context.Context, file *modfile.File, upgrades []upgrade) {
+	current := "1.16" // The default, when there's no go directive
+	if file.Go != nil {
+		current = file.Go.Version
+	}
+
+	required, requiredBy := current, ""
+	for _, upgrade := range upgrades {
+		// Nothing to do when upgrading the current module
+		if upgrade.newVersion == "" {
+			continue
+		}
+		goVersion, err := moduleGoVersion(ctx, upgrade.newSource(), upgrade.newVersion)
+		if err != nil {
+			warnf("error getting go version required by %s %s: %s", upgrade.newSource(), upgrade.newVersion, err)
+			continue
+		}
+		if goVersion != "" && version.Compare("go"+goVersion, "go"+required) > 0 {
+			required = goVersion
+			requiredBy = fmt.Sprintf("%s %s", upgrade.newSource(), upgrade.newVersion)
+		}
+	}
+	if requiredBy == "" {
+		return
+	}
+
+	local, toolchain := localGoVersion(ctx)
+	if local != "" && version.Compare(local, "go"+required) < 0 {
+		if !canSwitchToolchain(toolchain) {
+			log.Fatalf("%s requires go %s, but the installed go command is %s (and GOTOOLCHAIN=%s prevents switching toolchains)",
+				requiredBy, required, local, toolchain,
+			)
+		}
+		warnf("%s requires go %s, which is newer than the installed go command (%s): the go command will download and switch to a newer toolchain to build the module",
+			requiredBy, required, local,
+		)
+	}
+
+	fmt.Printf("Bumping go directive from %s to %s (required by %s)\n", current, required, requiredBy)
+	if err := file.AddGoStmt(required); err != nil {
+		log.Fatalf("Error updating go directive: %s", err)
+	}
+	if file.Toolchain != nil && version.Compare(file.Toolchain.Name, "go"+required) < 0 {
+		if err := file.AddToolchainStmt("go" + required); err != nil {
+			log.Fatalf("Error updating toolchain directive: %s", err)
+		}
+	}
+}
+
+// moduleGoVersion returns the go version declared in the go.mod file of the
+// given module version, or an empty string if it doesn't declare one
+func moduleGoVersion(ctx context.Context, path, version string) (string, error) {
+	b, err := proxyFetch(ctx, path, "@v/"+escapeVersion(version)+".mod")
+	if errors.Is(err, errDirect) {
+		var downloaded *DownloadedModule
+		if downloaded, err = downloadModule(ctx, path, version); err == nil {
+			b, err = os.ReadFile(downloaded.GoMod)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	modFile, err := modfile.ParseLax("go.mod", b, nil)
+	if err != nil {
+		return "", fmt.Errorf("error parsing go.mod file: %s", err)
+	}
+	if modFile.Go == nil {
+		return "", nil
+	}
+	return modFile.Go.Version, nil
+}
+
+// buildable reports whether the given version of a module can be built with
+// the go version it would be limited to (see goVersionLimit), i.e. whether
+// the go version it requires isn't newer.
+// NOTE: Only the module's go directive counts, since the go command ignores
+// the toolchain directives of dependencies.
+func buildable(ctx context.Context, path, modVersion string) (bool, error) {
+	limit, reason := goVersionLimit(ctx)
+	if limit == "" {
+		return true, nil
+	}
+	goVersion, err := moduleGoVersion(ctx, path, modVersion)
+	if err != nil {
+		return false, fmt.Errorf("error getting go version required by %s@%s: %s", path, modVersion, err)
+	}
+	if goVersion != "" && version.Compare("go"+goVersion, limit) > 0 {
+		if *verbose {
+			fmt.Printf("%s@%s: requires go %s, newer than %s\n", path, modVersion, goVersion, reason)
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// goVersionLimit returns the highest go version (e.g. "go1.22.3") that the
+// new versions of dependencies may require, and a description of where the
+// limit comes from, or an empty string if there's no limit. The versions are
+// limited to the installed go command's, if GOTOOLCHAIN prevents it from
+// switching to a newer toolchain, and, with -compat, to the module's go
+// directive.
+func goVersionLimit(ctx context.Context) (limit, reason string) {
+	if local, toolchain := localGoVersion(ctx); local != "" && !canSwitchToolchain(toolchain) {
+		limit = local
+		reason = fmt.Sprintf("the installed go command (%s), and GOTOOLCHAIN=%s prevents switching toolchains", local, toolchain)
+	}
+	if declared := declaredGoVersion(); *compat && declared != "" && (limit == "" || version.Compare("go"+declared, limit) < 0) {
+		limit = "go" + declared
+		reason = fmt.Sprintf("the module's go directive (go %s), with -compat", declared)
+	}
+	return limit, reason
+}
+
+var (
+	declaredGoOnce sync.Once
+	declaredGo     string
+)
+
+// declaredGoVersion returns the version of the module's go directive (e.g.
+// "1.22"), as it was before the upgrade, or an empty string if it doesn't have
+// one (or its go.mod file can't be read)
+func declaredGoVersion() string {
+	declaredGoOnce.Do(func() {
+		b, err := os.ReadFile(filepath.Join(*dir, "go.mod"))
+		if err != nil {
+			return
+		}
+		modFile, err := modfile.ParseLax("go.mod", b, nil)
+		if err == nil && modFile.Go != nil {
+			declaredGo = modFile.Go.Version
+		}
+	})
+	return declaredGo
+}
+
+// warnUnbuildable warns about the versions of a module that were skipped
+// because they require a newer go version than the limit (highest first), if
+// any
+func warnUnbuildable(ctx context.Context, path string, versions []string) {
+	if len(versions) == 0 {
+		return
+	}
+	_, reason := goVersionLimit(ctx)
+	skipped := versions[0]
+	if len(versions) > 1 {
+		skipped = fmt.Sprintf("%s (and %d older version(s))", versions[0], len(versions)-1)
+	}
+	warnf("skipping %s %s, which requires a newer go version than %s", path, skipped, reason)
+}
+
+// canSwitchToolchain reports whether the go command may switch to a newer
+// toolchain (downloading it, if needed) to build a module that requires one,
+// according to the GOTOOLCHAIN setting (see 'go help toolchain')
+func canSwitchToolchain(toolchain string) bool {
+	return toolchain == "" || toolchain == "auto" || toolchain == "path" ||
+		strings.HasSuffix(toolchain, "+auto") || strings.HasSuffix(toolchain, "+path")
+}
+
+var (
+	localGoOnce      sync.Once
+	localGo          string
+	localToolchainGo string
+)
+
+// localGoVersion returns the version of the installed go command (e.g.
+// "go1.22.3") and the GOTOOLCHAIN setting, or empty strings if they can't be
+// determined
+func localGoVersion(ctx context.Context) (goVersion, toolchain string) {
+	localGoOnce.Do(func() {
+		localGo, localToolchainGo = readLocalGoVersion(ctx)
+	})
+	return localGo, localToolchainGo
+}
+
+func readLocalGoVersion(ctx context.Context) (goVersion, toolchain string) {
+	cmd := exec.CommandContext(ctx, "go", "env", "GOVERSION", "GOTOOLCHAIN")
+	// Run outside of the current module, so that its toolchain directive
+	// doesn't trigger a toolchain switch
+	cmd.Dir = os.TempDir()
+	out, err := cmd.Output()
+	if err != nil {
+		return "", ""
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 2 {
+		return "", ""
+	}
+	return strings.TrimSpace(lines[0]), strings.TrimSpace(lines[1])
+}
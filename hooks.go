@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// runHook runs the given shell command in the module directory once for each
+// upgrade, with the details of the upgrade exposed as environment variables:
+// OLD_PATH, NEW_PATH, OLD_VERSION and NEW_VERSION (the versions are empty when
+// upgrading the current module). The command's output is passed through.
+func runHook(ctx context.Context, name, command, dir string, upgrades []upgrade) error {
+	for _, upgrade := range upgrades {
+		if *verbose {
+			fmt.Printf("Running %s for %s: %s\n", name, upgrade.newPath, command)
+		}
+
+		cmd := exec.CommandContext(ctx, "sh", "-c", command)
+		cmd.Dir = dir
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Env = append(os.Environ(),
+			"OLD_PATH="+upgrade.oldPath,
+			"NEW_PATH="+upgrade.newPath,
+			"OLD_VERSION="+upgrade.oldVersion,
+			"NEW_VERSION="+upgrade.newVersion,
+		)
+		done := auditor.recordCommand("hook", dir, cmd.Args, filepath.Join(dir, "go.mod"), filepath.Join(dir, "go.sum"))
+		err := cmd.Run()
+		done(err)
+		if err != nil {
+			return fmt.Errorf("error running %s for %s: %s", name, upgrade.newPath, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With -html, a standalone HTML report of the run is written at the end of it
+// (e.g. to attach to a change management ticket), with the upgrades, the
+// warnings printed, and a diff of every changed file. The original contents
+// of files are recorded as they're first written, and diffed against their
+// final contents, so changes made by fixers and hooks are included.
+type htmlRecorder struct {
+	lock      sync.Mutex
+	originals map[string][]byte // By path, before the run wrote to them
+	warnings  []string
+}
+
+// recorder records the run for the HTML report, if -html was given
+var recorder *htmlRecorder
+
+func newHTMLRecorder() *htmlRecorder {
+	return &htmlRecorder{originals: map[string][]byte{}}
+}
+
+// recordOriginal records the contents of the named file before it's first
+// written (a file that doesn't exist yet is recorded as empty)
+func (r *htmlRecorder) recordOriginal(name string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.originals[name]; ok {
+		return
+	}
+	b, _ := os.ReadFile(name)
+	r.originals[name] = b
+}
+
+func (r *htmlRecorder) recordWarning(msg string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.warnings = append(r.warnings, msg)
+}
+
+// htmlReport is the data of the HTML report template, for a run or (with
+// 'report -html') for the staleness report
+type htmlReport struct {
+	Title     string
+	Module    string
+	Generated time.Time
+
+	// Run
+	Upgrades []htmlUpgrade
+	Stats    []htmlStat
+	Warnings []string
+	Diffs    []htmlDiff
+
+	// Staleness report
+	Staleness    bool
+	Dependencies []dependencyStatus
+	MajorsBehind int
+}
+
+type htmlUpgrade struct {
+	OldPath, OldVersion, NewPath, NewVersion string
+}
+
+type htmlStat struct {
+	Name, Value string
+}
+
+type htmlDiff struct {
+	Name    string
+	Added   int
+	Deleted int
+	Lines   []htmlDiffLine
+}
+
+type htmlDiffLine struct {
+	Class, Text string
+}
+
+// writeRunReport writes the HTML report of the run to the named file
+func (r *htmlRecorder) writeRunReport(filename, modulePath string, upgrades []upgrade) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	base, err := filepath.Abs(*dir)
+	if err != nil {
+		return err
+	}
+	if stage != nil {
+		base = stage.dir
+	}
+
+	report := htmlReport{
+		Title:     "Upgrade of " + modulePath,
+		Module:    modulePath,
+		Generated: time.Now(),
+		Stats:     runStatsTable(),
+		Warnings:  r.warnings,
+	}
+	for _, upgrade := range upgrades {
+		report.Upgrades = append(report.Upgrades, htmlUpgrade{
+			OldPath:    upgrade.oldPath,
+			OldVersion: upgrade.oldVersion,
+			NewPath:    upgrade.newPath,
+			NewVersion: upgrade.newVersion,
+		})
+	}
+	for name, old := range r.originals {
+		new, err := os.ReadFile(name)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error reading file %s: %s", name, err)
+		}
+		rel := name
+		if abs, err := filepath.Abs(name); err == nil {
+			if relToBase, err := filepath.Rel(base, abs); err == nil {
+				rel = relToBase
+			}
+		}
+		if diff := newHTMLDiff(filepath.ToSlash(rel), old, new); diff != nil {
+			report.Diffs = append(report.Diffs, *diff)
+		}
+	}
+	sort.Slice(report.Diffs, func(i, j int) bool { return report.Diffs[i].Name < report.Diffs[j].Name })
+	return writeHTMLReport(filename, report)
+}
+
+// newHTMLDiff returns the diff of a file, with its lines classified for
+// highlighting, or nil if the file is unchanged
+func newHTMLDiff(name string, old, new []byte) *htmlDiff {
+	patch := unifiedDiff(name, old, new)
+	if patch == "" {
+		return nil
+	}
+	diff := &htmlDiff{Name: name}
+	for _, line := range splitLines(patch) {
+		line = strings.TrimSuffix(line, "\n")
+		class := ""
+		switch {
+		case strings.HasPrefix(line, "diff "), strings.HasPrefix(line, "--- "), strings.HasPrefix(line, "+++ "),
+			strings.HasPrefix(line, "new file"), strings.HasPrefix(line, "deleted file"):
+			// The file header is shown as the diff's title
+			continue
+		case strings.HasPrefix(line, "@@"):
+			class = "hunk"
+		case strings.HasPrefix(line, "+"):
+			class = "add"
+			diff.Added++
+		case strings.HasPrefix(line, "-"):
+			class = "del"
+			diff.Deleted++
+		}
+		diff.Lines = append(diff.Lines, htmlDiffLine{Class: class, Text: line})
+	}
+	return diff
+}
+
+// runStatsTable returns the statistics printed in the summary of the run
+func runStatsTable() []htmlStat {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	table := []htmlStat{
+		{"Packages scanned", fmt.Sprint(stats.packages)},
+		{"Files scanned", fmt.Sprint(stats.files)},
+		{"Files modified", fmt.Sprint(stats.modified)},
+		{"Imports rewritten", fmt.Sprint(stats.imports)},
+	}
+	for _, checksum := range stats.checksums {
+		table = append(table, htmlStat{"Checksum", checksum})
+	}
+	for _, finding := range stats.vetFindings {
+		table = append(table, htmlStat{"Vet finding", finding})
+	}
+	table = append(table, htmlStat{"Elapsed time", formatDuration(time.Since(stats.start))})
+	return table
+}
+
+// writeHTMLReport writes the report to the named file (or to stdout, if the
+// name is "-")
+func writeHTMLReport(filename string, report htmlReport) error {
+	var buf bytes.Buffer
+	if err := htmlTemplate.Execute(&buf, report); err != nil {
+		return fmt.Errorf("error executing HTML report template: %s", err)
+	}
+	if filename == "-" {
+		_, err := os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	if err := os.WriteFile(filename, buf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("error writing HTML report %s: %s", filename, err)
+	}
+	return nil
+}
+
+var htmlTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #1f2328; }
+h1 { font-size: 1.5em; }
+h2 { font-size: 1.2em; margin-top: 2em; border-bottom: 1px solid #d1d9e0; padding-bottom: .3em; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: .3em .8em; border: 1px solid #d1d9e0; }
+th { background: #f6f8fa; }
+code, pre { font-family: ui-monospace, SFMono-Regular, Menlo, Consolas, monospace; font-size: .9em; }
+.warnings li { color: #9a6700; }
+details { margin: .5em 0; border: 1px solid #d1d9e0; border-radius: 6px; }
+summary { padding: .5em; background: #f6f8fa; cursor: pointer; }
+pre { margin: 0; padding: .5em 0; overflow-x: auto; }
+pre span { display: block; padding: 0 .5em; white-space: pre; }
+.add { background: #dafbe1; }
+.del { background: #ffebe9; }
+.hunk { color: #59636e; background: #ddf4ff; }
+.count-add { color: #1a7f37; }
+.count-del { color: #d1242f; }
+.muted { color: #59636e; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="muted">Generated {{.Generated.Format "2006-01-02 15:04:05 MST"}}</p>
+{{- if .Staleness}}
+<h2>Dependencies</h2>
+<table>
+<tr><th>Module</th><th>Version</th><th>Latest</th><th>Behind</th></tr>
+{{- range .Dependencies}}
+<tr><td><code>{{.Path}}</code>{{if .Indirect}} (indirect){{end}}{{if .Denied}} (denied){{end}}</td><td><code>{{.Version}}</code></td>
+{{- if .Error}}<td>error: {{.Error}}</td><td>?</td>
+{{- else}}<td>{{if .LatestVersion}}<code>{{.LatestPath}} {{.LatestVersion}}</code>{{if not .LatestPublished.IsZero}} <span class="muted">(published {{.LatestPublished.Format "2006-01-02"}})</span>{{end}}{{else}}-{{end}}</td><td>{{.MajorsBehind}}</td>{{end}}</tr>
+{{- end}}
+</table>
+<p>{{.Module}} is {{.MajorsBehind}} major version(s) behind in total.</p>
+{{- else}}
+<h2>Upgrades</h2>
+{{- if .Upgrades}}
+<table>
+<tr><th>Module</th><th>Version</th><th>New module</th><th>New version</th></tr>
+{{- range .Upgrades}}
+<tr><td><code>{{.OldPath}}</code></td><td><code>{{.OldVersion}}</code></td><td><code>{{.NewPath}}</code></td><td><code>{{.NewVersion}}</code></td></tr>
+{{- end}}
+</table>
+{{- else}}
+<p>No upgrades</p>
+{{- end}}
+{{- end}}
+{{- if .Stats}}
+<h2>Summary</h2>
+<table>
+{{- range .Stats}}
+<tr><th>{{.Name}}</th><td>{{.Value}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- if .Warnings}}
+<h2>Warnings</h2>
+<ul class="warnings">
+{{- range .Warnings}}
+<li>{{.}}</li>
+{{- end}}
+</ul>
+{{- end}}
+{{- if .Diffs}}
+<h2>Changes</h2>
+{{- range .Diffs}}
+<details open>
+<summary><code>{{.Name}}</code> <span class="count-add">+{{.Added}}</span> <span class="count-del">-{{.Deleted}}</span></summary>
+<pre>{{range .Lines}}<span{{if .Class}} class="{{.Class}}"{{end}}>{{.Text}}</span>{{end}}</pre>
+</details>
+{{- end}}
+{{- end}}
+</body>
+</html>
+`))
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ignorer decides which files and directories the tool should leave alone
+// when scanning a module: vendor directories, hidden (dot) directories, and
+// anything matched by a .gitignore file. Vendored copies and build artifacts
+// are managed by other tools, and rewriting them corrupts their state.
+type ignorer struct {
+	// root is the module directory, within which vendor and hidden
+	// directories are skipped
+	root string
+	// base is the directory paths are matched relative to, which is the root
+	// of the enclosing git repository (if any), so that .gitignore files
+	// above the module directory are taken into account
+	base string
+
+	lock     sync.Mutex
+	patterns map[string][]ignorePattern // Keyed by directory
+}
+
+type ignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+func newIgnorer(dir string) (*ignorer, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	base := gitRoot(root)
+	if base == "" {
+		base = root
+	}
+
+	return &ignorer{
+		root:     root,
+		base:     base,
+		patterns: map[string][]ignorePattern{},
+	}, nil
+}
+
+// gitRoot returns the root of the git repository containing the given
+// absolute directory path, or an empty string if it isn't in one
+func gitRoot(dir string) string {
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(filepath.Join(d, ".git")); err == nil {
+			return d
+		}
+		if filepath.Dir(d) == d {
+			return ""
+		}
+	}
+}
+
+// skip reports whether the given absolute path should be skipped, either
+// because it (or one of its parent directories) is ignored.
+func (ig *ignorer) skip(path string, isDir bool) bool {
+	return ig.skipReason(path, isDir) != ""
+}
+
+// skipReason returns the reason the given absolute path should be skipped
+// (e.g. "it's ignored by git"), or an empty string if it shouldn't be
+func (ig *ignorer) skipReason(path string, isDir bool) string {
+	rel, err := filepath.Rel(ig.base, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+
+	// Number of path components leading from the base directory to the
+	// module root (vendor and hidden directories are only skipped beneath it)
+	offset := 0
+	if rootRel, err := filepath.Rel(ig.base, ig.root); err == nil && rootRel != "." {
+		offset = len(strings.Split(filepath.ToSlash(rootRel), "/"))
+	}
+
+	// Check every parent directory as well as the path itself, since git
+	// does not allow re-including a file if one of its parents is excluded
+	for i, part := range parts {
+		partIsDir := isDir || i < len(parts)-1
+		if partIsDir && i >= offset && skipDirName(part) {
+			if part == "vendor" {
+				return "it's in a vendor directory"
+			}
+			return "it's in a hidden directory"
+		}
+		if ig.match(parts[:i+1], partIsDir) {
+			return "it's ignored by git"
+		}
+	}
+	return ""
+}
+
+func skipDirName(name string) bool {
+	return name == "vendor" || strings.HasPrefix(name, ".")
+}
+
+// match reports whether the path (given as a list of components relative to
+// the base directory) is matched by the .gitignore files in its parent
+// directories. Patterns from deeper .gitignore files, and later patterns
+// within the same file, take precedence.
+func (ig *ignorer) match(parts []string, isDir bool) bool {
+	ignored := false
+	for i := 0; i < len(parts); i++ {
+		dir := filepath.Join(append([]string{ig.base}, parts[:i]...)...)
+		rel := strings.Join(parts[i:], "/")
+		for _, pattern := range ig.load(dir) {
+			if pattern.dirOnly && !isDir {
+				continue
+			}
+			if pattern.re.MatchString(rel) {
+				ignored = !pattern.negate
+			}
+		}
+	}
+	return ignored
+}
+
+// load returns the (cached) patterns in the given directory's .gitignore file
+func (ig *ignorer) load(dir string) []ignorePattern {
+	ig.lock.Lock()
+	defer ig.lock.Unlock()
+
+	if patterns, ok := ig.patterns[dir]; ok {
+		return patterns
+	}
+
+	var patterns []ignorePattern
+	if f, err := os.Open(filepath.Join(dir, ".gitignore")); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if pattern, ok := parseIgnorePattern(scanner.Text()); ok {
+				patterns = append(patterns, pattern)
+			}
+		}
+		f.Close()
+	}
+	ig.patterns[dir] = patterns
+	return patterns
+}
+
+// parseIgnorePattern converts a line from a .gitignore file into a regular
+// expression matching slash-separated paths relative to the file's directory.
+// See https://git-scm.com/docs/gitignore#_pattern_format.
+func parseIgnorePattern(line string) (ignorePattern, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignorePattern{}, false
+	}
+
+	var pattern ignorePattern
+	if strings.HasPrefix(line, "!") {
+		pattern.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+
+	// Patterns without a slash match a file or directory name at any depth.
+	// Otherwise, they're anchored to the directory containing the .gitignore.
+	prefix := "^(?:.*/)?"
+	if strings.Contains(line, "/") {
+		prefix = "^"
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return ignorePattern{}, false
+	}
+
+	var expr strings.Builder
+	expr.WriteString(prefix)
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; c {
+		case '*':
+			if strings.HasPrefix(line[i:], "**") {
+				switch {
+				case strings.HasPrefix(line[i:], "**/"):
+					expr.WriteString("(?:.*/)?")
+					i += 2
+				default:
+					expr.WriteString(".*")
+					i++
+				}
+				continue
+			}
+			expr.WriteString("[^/]*")
+		case '?':
+			expr.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(line[i+1:], ']')
+			if end < 0 {
+				expr.WriteString(`\[`)
+				continue
+			}
+			class := line[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(line) {
+				i++
+				expr.WriteString(regexp.QuoteMeta(line[i : i+1]))
+			}
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return ignorePattern{}, false
+	}
+	pattern.re = re
+	return pattern, true
+}
+
+// walkFiles calls fn for each regular file within the module directory,
+// skipping anything the ignorer says to skip.
+func walkFiles(ig *ignorer, fn func(path string) error) error {
+	return filepath.WalkDir(ig.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == ig.root {
+			return nil
+		}
+		if ig.skip(path, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		return fn(path)
+	})
+}
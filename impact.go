@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// packageImpact is how much of a package depends on a module
+type packageImpact struct {
+	pkgPath   string
+	files     []fileImpact
+	callSites int // References to the module's exported symbols
+	symbols   map[string]int
+}
+
+type fileImpact struct {
+	name      string // Relative to the module directory
+	callSites int
+}
+
+// impact lists the module's packages and files that import the given module
+// (at the major version in its path), with the number of references to the
+// module's exported symbols (call sites) in each, and the symbols referenced
+// most. Nothing is modified.
+func impact(ctx context.Context, dir, path string) {
+	if path == "" {
+		log.Fatalf("No module given")
+	}
+	modFile := readModFile(dir)
+	if owningModule(modFile, path) != path {
+		warnf("%s isn't required by %s", path, modFile.Module.Mod.Path)
+	}
+
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		log.Fatalf("Error getting absolute path of module directory: %s", err)
+	}
+	realDir := realPath(absDir)
+	ig, err := newIgnorer(dir)
+	if err != nil {
+		log.Fatalf("Error resolving module directory: %s", err)
+	}
+	pkgs, err := loadPackages(ctx, dir)
+	if err != nil {
+		log.Fatalf("Error loading packages: %s", err)
+	}
+	reportPackageErrors(pkgs)
+
+	var (
+		impacts      = map[string]*packageImpact{}
+		filesVisited = map[string]bool{}
+		upgradeMap   = map[string]upgrade{path: {oldPath: path}}
+	)
+	for _, pkg := range pkgs {
+		for _, fileAST := range pkg.Syntax {
+			filename := pkg.Fset.File(fileAST.Pos()).Name()
+			if !hasPathPrefix(filename, absDir) || ig.skip(filename, false) {
+				continue
+			}
+			// Files symlinked within the module are counted once, under the
+			// path of the file they resolve to (see rewriteImports)
+			filename, ok := resolveModuleFile(filename, absDir, realDir)
+			if !ok || filesVisited[filename] {
+				continue
+			}
+			filesVisited[filename] = true
+
+			imported := false
+			for _, spec := range fileAST.Imports {
+				importPath, _ := strconv.Unquote(spec.Path.Value)
+				if matchModule(importPath, []string{path}) == path {
+					imported = true
+					break
+				}
+			}
+			if !imported {
+				continue
+			}
+
+			// External test packages belong to the package they test
+			pkgPath := strings.TrimSuffix(pkg.PkgPath, "_test")
+			pi := impacts[pkgPath]
+			if pi == nil {
+				pi = &packageImpact{pkgPath: pkgPath, symbols: map[string]int{}}
+				impacts[pkgPath] = pi
+			}
+			usages := collectAPIUsages(pkg, file{name: filename, ast: fileAST, fset: pkg.Fset}, upgradeMap)
+			rel, _ := filepath.Rel(absDir, filename)
+			pi.files = append(pi.files, fileImpact{name: filepath.ToSlash(rel), callSites: len(usages)})
+			pi.callSites += len(usages)
+			for _, usage := range usages {
+				pi.symbols[usage.pkgName+"."+usage.symbol]++
+			}
+		}
+	}
+
+	if len(impacts) == 0 {
+		fmt.Printf("%s isn't imported by any package\n", path)
+		return
+	}
+
+	var sorted []*packageImpact
+	for _, pi := range impacts {
+		sort.Slice(pi.files, func(i, j int) bool { return pi.files[i].name < pi.files[j].name })
+		sorted = append(sorted, pi)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].pkgPath < sorted[j].pkgPath })
+
+	var (
+		totalFiles, totalCallSites int
+		symbols                    = map[string]int{}
+	)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PACKAGE\tFILES\tCALL SITES")
+	for _, pi := range sorted {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", pi.pkgPath, len(pi.files), pi.callSites)
+		for _, f := range pi.files {
+			fmt.Fprintf(w, "  %s\t\t%d\n", f.name, f.callSites)
+		}
+		totalFiles += len(pi.files)
+		totalCallSites += pi.callSites
+		for symbol, n := range pi.symbols {
+			symbols[symbol] += n
+		}
+	}
+	w.Flush()
+
+	fmt.Printf("\n%s is imported by %d package(s) and %d file(s), with %d call site(s)\n",
+		path, len(sorted), totalFiles, totalCallSites,
+	)
+
+	// The most referenced symbols are the ones most likely to make a breaking
+	// change in the new major version costly
+	var names []string
+	for symbol := range symbols {
+		names = append(names, symbol)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if symbols[names[i]] != symbols[names[j]] {
+			return symbols[names[i]] > symbols[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > 10 {
+		names = names[:10]
+	}
+	if len(names) > 0 {
+		fmt.Println("\nMost referenced symbols:")
+		for _, symbol := range names {
+			fmt.Printf("\t%s: %d\n", symbol, symbols[symbol])
+		}
+	}
+}
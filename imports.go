@@ -1,156 +1,564 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"go/ast"
 	"go/format"
+	"go/parser"
 	"go/token"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 
+	"golang.org/x/mod/modfile"
 	"golang.org/x/mod/module"
+	"golang.org/x/sync/errgroup"
 	"golang.org/x/tools/go/packages"
+	"golang.org/x/tools/imports"
 )
 
 type upgrade struct {
 	oldPath string
 	newPath string
+
+	// Versions are empty when upgrading the current module
+	oldVersion string
+	newVersion string
+
+	// Whether the old version was an indirect requirement
+	indirect bool
+
+	// When the dependency is replaced by a fork, the old and new paths of the
+	// fork (which the versions refer to)
+	oldForkPath string
+	newForkPath string
+}
+
+// oldSource returns the path of the module that the old version refers to:
+// the fork's path, if the dependency is replaced by a fork
+func (u upgrade) oldSource() string {
+	if u.oldForkPath != "" {
+		return u.oldForkPath
+	}
+	return u.oldPath
+}
+
+// newSource returns the path of the module that the new version refers to:
+// the fork's path, if the dependency is replaced by a fork
+func (u upgrade) newSource() string {
+	if u.newForkPath != "" {
+		return u.newForkPath
+	}
+	return u.newPath
 }
 
 type file struct {
 	name string
 	ast  *ast.File
 	fset *token.FileSet
+
+	// The formatted contents of the file, for files that aren't rewritten
+	// from a syntax tree (see -text-file)
+	content []byte
+	// The temporary file holding the formatted contents of the file, once its
+	// syntax tree has been released (see -chunk)
+	staged string
 }
 
-func rewriteImports(dir string, upgrades []upgrade) error {
-	if len(upgrades) == 0 {
-		return nil
+// chunkDir is the temporary directory holding the formatted contents of the
+// files modified by each chunk, until they're all written (see -chunk)
+var chunkDir string
+
+// rewriteImports rewrites the imports of the upgraded modules in the module's
+// files, returning the files that were modified (which haven't been written
+// to disk yet). All of the upgrades are applied in a single pass, however
+// many there are (e.g. with "all"): the packages are loaded once (or a chunk
+// at a time, with -chunk), and each file is rewritten and returned once.
+func rewriteImports(ctx context.Context, dir string, modFile *modfile.File, upgrades []upgrade) ([]file, error) {
+	if len(upgrades) == 0 && len(pathMappings) == 0 {
+		return nil, nil
 	}
 
-	upgradeMap := map[string]string{}
+	// Paths can be the same in case of minor version update, in which case
+	// there's nothing to rewrite
+	upgradeMap := map[string]upgrade{}
 	for _, upgrade := range upgrades {
-		upgradeMap[upgrade.oldPath] = upgrade.newPath
+		if upgrade.newPath != upgrade.oldPath {
+			upgradeMap[upgrade.oldPath] = upgrade
+		}
+	}
+	if len(upgradeMap) == 0 && len(pathMappings) == 0 {
+		return nil, nil
+	}
+
+	// Collect the paths of all modules known to the go.mod file (including
+	// the ones being upgraded, which may already have been dropped from it),
+	// for resolving imports whose packages failed to load
+	known := []string{modFile.Module.Mod.Path}
+	for _, require := range modFile.Require {
+		known = append(known, require.Mod.Path)
+	}
+	for _, upgrade := range upgrades {
+		known = append(known, upgrade.oldPath)
 	}
 
 	absDir, err := filepath.Abs(dir)
 	if err != nil {
-		return fmt.Errorf("error getting absolute path of module directory: %s", err)
+		return nil, fmt.Errorf("error getting absolute path of module directory: %s", err)
 	}
+	realDir := realPath(absDir)
 
-	pkgs, err := loadPackages(dir)
+	ig, err := newIgnorer(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving module directory: %s", err)
+	}
+	nestedRoots, err := nestedModuleRoots(ig)
 	if err != nil {
-		return fmt.Errorf("error loading packages: %s", err)
+		return nil, fmt.Errorf("error finding nested modules: %s", err)
+	}
+
+	// With -chunk, packages are loaded (with their syntax trees and type
+	// information, which is what takes up most of the memory) a chunk at a
+	// time, and the trees of the modified files are released once they've
+	// been formatted into chunkDir, before loading the next chunk. Nothing is
+	// written to the module until every chunk has been rewritten, so later
+	// chunks are loaded against the module as it was, like the first one.
+	chunks := [][]string{{"./..."}}
+	if *chunkSize > 0 {
+		if chunks, err = packageChunks(ctx, dir, *chunkSize); err != nil {
+			return nil, fmt.Errorf("error listing packages: %s", err)
+		}
 	}
 
+	selected := packageMatcher(modFile.Module.Mod.Path, onlyPatterns)
+
+	// Imports whose package is named differently at the new path keep the
+	// old name
+	names := newPackageNamer(ctx, modFile, dir)
+
 	var (
-		modified     = []file{}
-		filesVisited = map[string]bool{}
+		modified        = []file{}
+		usages          []apiUsage
+		filesVisited    = map[string]bool{}
+		packagesVisited = map[string]bool{}
 	)
-	for _, pkg := range pkgs {
-		if *verbose {
-			fmt.Printf("Package: %s\n", pkg.PkgPath)
-		}
-		for i, fileAST := range pkg.Syntax {
-			filename := pkg.CompiledGoFiles[i]
-
-			// Skip the file if it isn't located within the module directory.
-			// This is particularly important for preventing changes to "test
-			// binary" files, which are typically located in the user's
-			// $HOME/.cache/go-build/ directory, and should not be modified
-			// (but are returned when loading test packages).
-			// NOTE: This feels a little hacky, but I could not find a more
-			// reliable way to identify the test binary package or ignore its
-			// files. See: https://github.com/nathanjcochran/upgrade/issues/2.
-			if !strings.HasPrefix(filename, absDir) {
-				continue
-			}
-
-			// Skip the file if we've already visited it (including test
-			// packages means some files can appear more than once)
-			if filesVisited[filename] {
-				continue
-			}
-			filesVisited[filename] = true
-
-			var found bool
-			for _, fileImp := range fileAST.Imports {
-				importPath := strings.Trim(fileImp.Path.Value, "\"")
-
-				// We have to actually compare module paths, not just import
-				// path prefixes. Imagine upgrading dep to dep/v5, but dep/v3
-				// is also installed. If we only looked at import paths, we'd
-				// be liable to get dep/v5/v3, which is invalid.
-				impPkg, exists := pkg.Imports[importPath]
-				if !exists {
-					return fmt.Errorf("error getting package information for import %s: %s", importPath, err)
-				}
-
-				// NOTE: Some imports, such as standard library packages, do
-				// not have a corresponding module. In these case, we default
-				// to the package name as it was specified in the import
-				// statement (it won't be updated).
-				modulePath := importPath
-				if impPkg.Module != nil {
-					modulePath = impPkg.Module.Path
-				}
-
-				if newPath, ok := upgradeMap[modulePath]; ok {
-					if !found {
-						found = true
-						if *verbose {
-							fmt.Printf("%s:\n", filename)
-						}
+	// rewriteFile rewrites the imports of the upgraded modules in the file,
+	// adding it to the modified files if any of them were rewritten
+	rewriteFile := func(pkg *packages.Package, fileAST *ast.File, fset *token.FileSet, filename, resolved string) error {
+		stats.add(&stats.files, 1)
+		recordStringReferences(fset, fileAST, upgrades)
+
+		var (
+			fileUpgrades []upgrade
+			rewritten    int
+		)
+		for _, fileImp := range fileAST.Imports {
+			importPath := strings.Trim(fileImp.Path.Value, "\"")
+
+			// We have to actually compare module paths, not just import
+			// path prefixes. Imagine upgrading dep to dep/v5, but dep/v3
+			// is also installed. If we only looked at import paths, we'd
+			// be liable to get dep/v5/v3, which is invalid.
+			modulePath := moduleForImport(pkg, importPath, known)
+
+			// With -map, the import path's prefix is mapped instead
+			// (which may or may not be the module's path)
+			if newImportPath, mapping, ok := mapPath(importPath, pathMappings); ok {
+				if len(fileUpgrades) == 0 && *verbose {
+					fmt.Printf("%s:\n", filename)
+				}
+				// Fixers are given the mapping as an upgrade, unless
+				// it's a renamed module's
+				upgrade, ok := upgradeMap[modulePath]
+				if !ok {
+					upgrade = pathMappingUpgrade(mapping)
+				}
+				if !slices.Contains(fileUpgrades, upgrade) {
+					fileUpgrades = append(fileUpgrades, upgrade)
+				}
+				if err := module.CheckImportPath(newImportPath); err != nil {
+					return fmt.Errorf("invalid import path after mapping: %s", newImportPath)
+				}
+				fileImp.Path.Value = fmt.Sprintf("\"%s\"", newImportPath)
+				rewritten++
+
+				if *verbose {
+					fmt.Printf("\t%s -> %s\n", importPath, newImportPath)
+				}
+				if name := names.keepName(pkg, fileImp, importPath, upgrade); name != "" && *verbose {
+					fmt.Printf("\t\tNamed %s, since the package's name changed\n", name)
+				}
+			} else if upgrade, ok := upgradeMap[modulePath]; ok {
+				if len(fileUpgrades) == 0 && *verbose {
+					fmt.Printf("%s:\n", filename)
+				}
+				if !slices.Contains(fileUpgrades, upgrade) {
+					fileUpgrades = append(fileUpgrades, upgrade)
+				}
+
+				newImportPath := strings.Replace(importPath, modulePath, upgrade.newPath, 1)
+				if err := module.CheckImportPath(newImportPath); err != nil {
+					return fmt.Errorf("invalid import path after upgrade: %s", newImportPath)
+				}
+				fileImp.Path.Value = fmt.Sprintf("\"%s\"", newImportPath)
+				rewritten++
+
+				if *verbose {
+					fmt.Printf("\t%s -> %s\n", importPath, newImportPath)
+				}
+				if name := names.keepName(pkg, fileImp, importPath, upgrade); name != "" && *verbose {
+					fmt.Printf("\t\tNamed %s, since the package's name changed\n", name)
+				}
+			}
+		}
+
+		// If any of the file's import paths were updated, merge any
+		// resulting duplicate imports, apply the fixers (if any) and
+		// write it to disk
+		if len(fileUpgrades) > 0 {
+			if n := mergeDuplicateImports(pkg, fileAST); n > 0 && *verbose {
+				fmt.Printf("\tMerged %d duplicate import(s)\n", n)
+			}
+
+			f := file{
+				name: resolved,
+				ast:  fileAST,
+				fset: fset,
+			}
+			for _, fixer := range fixers {
+				if err := fixer.fix(ctx, &f, fileUpgrades); err != nil {
+					return fmt.Errorf("error applying %s: %s", fixer, err)
+				}
+			}
+			// NOTE: Uses that were rewritten by a fixer no longer have
+			// type information, so they aren't checked
+			if *symbols && f.fset == pkg.Fset {
+				usages = append(usages, collectAPIUsages(pkg, f, upgradeMap)...)
+			}
+			modified = append(modified, f)
+			stats.add(&stats.imports, rewritten)
+		}
+		return nil
+	}
+
+	for _, patterns := range chunks {
+		endPhase := stats.startPhase("load")
+		pkgs, err := loadPackages(ctx, dir, patterns...)
+		endPhase()
+		// NOTE: The files of packages that failed to load are rewritten
+		// below, like the files excluded from the build, based on syntax
+		// alone
+		if err != nil {
+			failures.add(failedLoad, "", fmt.Errorf("error loading packages %s: %s", strings.Join(patterns, " "), err))
+			continue
+		}
+		reportPackageErrors(pkgs)
+
+		endPhase = stats.startPhase("rewrite")
+		start := len(modified)
+		for _, pkg := range pkgs {
+			if !packagesVisited[pkg.PkgPath] {
+				packagesVisited[pkg.PkgPath] = true
+				stats.add(&stats.packages, 1)
+			}
+			if *verbose {
+				fmt.Printf("Package: %s\n", pkg.PkgPath)
+			}
+			for _, fileAST := range pkg.Syntax {
+				// NOTE: Files that failed to parse are missing from pkg.Syntax,
+				// so it can't be indexed in parallel with pkg.CompiledGoFiles
+				filename := pkg.Fset.File(fileAST.Pos()).Name()
+
+				// Skip the file if it isn't located within the module directory.
+				// This is particularly important for preventing changes to "test
+				// binary" files, which are typically located in the user's
+				// $HOME/.cache/go-build/ directory, and should not be modified
+				// (but are returned when loading test packages).
+				// NOTE: This feels a little hacky, but I could not find a more
+				// reliable way to identify the test binary package or ignore its
+				// files. See: https://github.com/nathanjcochran/upgrade/issues/2.
+				if !hasPathPrefix(filename, absDir) {
+					continue
+				}
+
+				// Skip the file if it belongs to a nested module, which
+				// isn't part of the module, even if its packages were
+				// loaded along with the module's
+				if inNestedModule(filename, nestedRoots) {
+					if *verbose {
+						fmt.Printf("Skipping file %s of a nested module\n", filename)
+					}
+					continue
+				}
+
+				// Files symlinked within the module are rewritten through the
+				// symlink: they're identified by the path of the file the
+				// symlink resolves to, which is the one that gets written (and
+				// that's visited only once, no matter how many symlinks point
+				// to it). Files symlinked from outside of the module belong to
+				// something else, so they're left alone.
+				resolved, ok := resolveModuleFile(filename, absDir, realDir)
+				if !ok {
+					if *verbose {
+						fmt.Printf("Skipping file %s, a symlink to %s outside of the module\n", filename, resolved)
 					}
+					recordSkippedImports(pkg, pkg.Fset, fileAST, upgradeMap, known,
+						fmt.Sprintf("the file is a symlink to %s, outside of the module", resolved),
+					)
+					continue
+				}
 
-					newImportPath := strings.Replace(importPath, modulePath, newPath, 1)
-					if err := module.CheckImportPath(newImportPath); err != nil {
-						return fmt.Errorf("invalid import path after upgrade: %s", newImportPath)
+				// Skip the file if we've already visited it (including test
+				// packages means some files can appear more than once)
+				if filesVisited[resolved] {
+					continue
+				}
+				filesVisited[resolved] = true
+
+				// Skip files in vendor or hidden directories, or that are ignored
+				// by git (e.g. generated build artifacts)
+				if reason := ig.skipReason(filename, false); reason != "" {
+					if *verbose {
+						fmt.Printf("Skipping ignored file %s\n", filename)
 					}
-					fileImp.Path.Value = fmt.Sprintf("\"%s\"", newImportPath)
+					recordSkippedImports(pkg, pkg.Fset, fileAST, upgradeMap, known, reason)
+					continue
+				}
 
+				// With -only, files outside of the selected packages are left
+				// importing the old major version
+				if !selected(pkg.PkgPath) {
+					if *verbose {
+						fmt.Printf("Skipping unselected file %s\n", filename)
+					}
+					continue
+				}
+				// Likewise for files excluded by -include-file or -exclude-file
+				if rel, err := filepath.Rel(absDir, resolved); err == nil && !fileSelected(rel) {
 					if *verbose {
-						fmt.Printf("\t%s -> %s\n", importPath, newImportPath)
+						fmt.Printf("Skipping excluded file %s\n", filename)
 					}
+					continue
+				}
+				if err := rewriteFile(pkg, fileAST, pkg.Fset, filename, resolved); err != nil {
+					failures.add(failedRewrite, filename, err)
 				}
 			}
+		}
 
-			// If any of the file's import paths were updated, write it to disk
-			if found {
-				modified = append(modified, file{
-					name: filename,
-					ast:  fileAST,
-					fset: pkg.Fset,
-				})
+		// Release the syntax trees (and, with them, the packages) of the
+		// modified files
+		if *chunkSize > 0 {
+			if chunkDir == "" {
+				if chunkDir, err = os.MkdirTemp("", "upgrade-chunks-"); err != nil {
+					return nil, fmt.Errorf("error creating temporary directory: %s", err)
+				}
+			}
+			formatted := modified[:start]
+			for _, f := range modified[start:] {
+				staged, err := stageFile(f, len(formatted))
+				if err != nil {
+					failures.add(failedRewrite, f.name, err)
+					continue
+				}
+				formatted = append(formatted, file{name: f.name, staged: staged})
 			}
+			modified = formatted
 		}
+		endPhase()
 	}
 
-	// Write modified files at the end, to avoid issues with "go list"
-	// during the process (in case the upgrade breaks the build)
-	for _, file := range modified {
-		if err := writeFile(file); err != nil {
-			return fmt.Errorf("error writing file: %s", err)
+	// Files excluded from the build by their build constraints (e.g. scripts
+	// and code generators guarded by '//go:build ignore', or files for other
+	// platforms) aren't loaded with the packages, so they're found and parsed
+	// directly (as are the files of packages that failed to load). Without
+	// type information, the modules of their imports are inferred from the
+	// import paths alone.
+	endPhase := stats.startPhase("rewrite")
+	excluded, unbuilt, err := findExcludedFiles(dir, ig, filesVisited)
+	if err != nil {
+		return nil, fmt.Errorf("error finding files excluded from the build: %s", err)
+	}
+	for _, filename := range unbuilt {
+		// NOTE: Files that fail to parse are still left with the imports that
+		// did
+		fset := token.NewFileSet()
+		if fileAST, _ := parser.ParseFile(fset, filename, nil, parser.ImportsOnly); fileAST != nil {
+			recordSkippedImports(&packages.Package{}, fset, fileAST, upgradeMap, known,
+				"the go command ignores files in testdata directories, and in directories whose names begin with '_' or '.'",
+			)
 		}
 	}
-	return nil
+	for _, filename := range excluded {
+		rel, err := filepath.Rel(absDir, filename)
+		if err != nil {
+			return nil, fmt.Errorf("error getting relative path of %s: %s", filename, err)
+		}
+		pkgPath := path.Join(modFile.Module.Mod.Path, filepath.ToSlash(filepath.Dir(rel)))
+		if !selected(pkgPath) || !fileSelected(rel) {
+			if *verbose {
+				fmt.Printf("Skipping excluded file %s\n", filename)
+			}
+			continue
+		}
+
+		fset := token.NewFileSet()
+		fileAST, err := parser.ParseFile(fset, filename, nil, parser.ParseComments)
+		if err != nil {
+			// NOTE: Files that fail to parse have already been reported as
+			// package errors, if they're part of the build, but the imports
+			// they're left with are reported too
+			if *verbose {
+				fmt.Printf("Skipping file %s, which failed to parse: %s\n", filename, err)
+			}
+			if fileAST != nil {
+				recordSkippedImports(&packages.Package{}, fset, fileAST, upgradeMap, known, "the file failed to parse")
+			}
+			continue
+		}
+		if *verbose {
+			fmt.Printf("File excluded from the build: %s\n", filename)
+		}
+		if err := rewriteFile(&packages.Package{}, fileAST, fset, filename, filename); err != nil {
+			failures.add(failedRewrite, filename, err)
+		}
+	}
+	endPhase()
+
+	if len(usages) > 0 {
+		defer stats.startPhase("api check")()
+		checkAPIUsages(ctx, usages)
+	}
+	return modified, nil
 }
 
-func loadPackages(dir string) ([]*packages.Package, error) {
+// findExcludedFiles returns the Go files within the module directory that
+// weren't visited when loading its packages, which are the ones excluded from
+// the build by their build constraints (or that failed to parse). Like the go
+// command, it skips testdata directories and files and directories whose names
+// begin with '_' or '.' (which are returned separately), as well as nested
+// modules.
+func findExcludedFiles(dir string, ig *ignorer, visited map[string]bool) (files, unbuilt []string, err error) {
+	nestedRoots, err := nestedModuleRoots(ig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = walkFiles(ig, func(filename string) error {
+		if filepath.Ext(filename) != ".go" || visited[filename] {
+			return nil
+		}
+		rel, err := filepath.Rel(ig.root, filename)
+		if err != nil {
+			return err
+		}
+		if inNestedModule(filename, nestedRoots) {
+			return nil
+		}
+		for _, elem := range strings.Split(filepath.ToSlash(rel), "/") {
+			if elem == "testdata" || strings.HasPrefix(elem, "_") || strings.HasPrefix(elem, ".") {
+				unbuilt = append(unbuilt, filename)
+				return nil
+			}
+		}
+		files = append(files, filename)
+		return nil
+	})
+	return files, unbuilt, err
+}
+
+// moduleForImport returns the path of the module providing the given import.
+// If the imported package was loaded successfully, its module information is
+// used. Otherwise (e.g. if the package has errors, or its module can't be
+// found), the module is inferred from the import path alone.
+//
+// NOTE: Some imports, such as standard library packages, do not have a
+// corresponding module. In these case, we default to the package name as it
+// was specified in the import statement (it won't be updated).
+func moduleForImport(pkg *packages.Package, importPath string, known []string) string {
+	if impPkg, ok := pkg.Imports[importPath]; ok && impPkg.Module != nil {
+		return impPkg.Module.Path
+	}
+	if modulePath := matchModule(importPath, known); modulePath != "" {
+		return modulePath
+	}
+	return importPath
+}
+
+// matchModule returns the longest of the given module paths that contains the
+// import path, or an empty string if there isn't one. A path whose next
+// element is a major version suffix (e.g. dep/v3, given dep) is assumed to
+// belong to a different major version of the module, not to a subdirectory.
+func matchModule(importPath string, modulePaths []string) string {
+	var match string
+	for _, modulePath := range modulePaths {
+		if len(modulePath) <= len(match) {
+			continue
+		}
+		if importPath == modulePath {
+			match = modulePath
+			continue
+		}
+		rest, ok := strings.CutPrefix(importPath, modulePath+"/")
+		if !ok {
+			continue
+		}
+		elem, _, _ := strings.Cut(rest, "/")
+		if _, pathMajor, ok := module.SplitPathVersion(modulePath + "/" + elem); ok && pathMajor != "" {
+			continue
+		}
+		match = modulePath
+	}
+	return match
+}
+
+// reportPackageErrors prints a warning for each package that could not be
+// loaded cleanly. Upgrades are often done in modules that don't currently
+// build, so these errors aren't fatal: imports in the affected packages are
+// rewritten based on syntax alone.
+func reportPackageErrors(pkgs []*packages.Package) {
+	reported := map[string]bool{}
+	for _, pkg := range pkgs {
+		if len(pkg.Errors) == 0 || reported[pkg.PkgPath] {
+			continue
+		}
+		reported[pkg.PkgPath] = true
+
+		var msgs []string
+		for _, err := range pkg.Errors {
+			msgs = append(msgs, err.Error())
+		}
+		warnf("package %s has errors:\n\t%s", pkg.PkgPath, strings.Join(msgs, "\n\t"))
+	}
+}
+
+// loadPackages loads the packages matching the patterns (by default, all of
+// the module's packages), including their tests
+func loadPackages(ctx context.Context, dir string, patterns ...string) ([]*packages.Package, error) {
+	if len(patterns) == 0 {
+		patterns = []string{"./..."}
+	}
 	cfg := &packages.Config{
+		Context: ctx,
 		Mode: packages.NeedName |
 			packages.NeedCompiledGoFiles |
 			packages.NeedImports |
 			packages.NeedDeps |
 			packages.NeedTypes |
+			packages.NeedTypesInfo |
 			packages.NeedSyntax |
 			packages.NeedModule,
 		Tests: true, // Necessary to rewrite imports in _test.go files
 	}
-	loadPath := fmt.Sprintf("%s/...", path.Clean(dir))
-	pkgs, err := packages.Load(cfg, loadPath)
+	// NOTE: Packages are loaded from within the module directory, so that
+	// they're resolved in the context of its go.mod file, rather than that
+	// of whichever module the current directory is in
+	cfg.Dir = dir
+	pkgs, err := packages.Load(cfg, patterns...)
 	if err != nil {
 		return nil, fmt.Errorf("error loading package info: %s", err)
 	}
@@ -162,16 +570,214 @@ func loadPackages(dir string) ([]*packages.Package, error) {
 	return pkgs, nil
 }
 
-func writeFile(file file) error {
-	f, err := os.Create(file.name)
+// writeFiles writes the modified files to disk concurrently, using a pool of
+// at most -j workers. Formatting and writing each file is independent of the
+// others, and serial writes can dominate the run time on slow (e.g. network)
+// filesystems. If the context is cancelled, writes that have already started
+// are completed, but no new ones are started.
+func writeFiles(ctx context.Context, files []file) error {
+	var (
+		errs    = make([]error, len(files))
+		written = make([]bool, len(files))
+	)
+
+	g := errgroup.Group{}
+	g.SetLimit(*jobs)
+	for i, file := range files {
+		g.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				errs[i] = fmt.Errorf("not writing file %s: %s", file.name, context.Cause(ctx))
+				return nil
+			}
+			written[i], errs[i] = writeFile(file)
+			return nil
+		})
+	}
+	g.Wait()
+
+	// Report results in the order the files were visited, rather than the
+	// order in which the writes happened to complete, so that output (and the
+	// reported errors, if any) is deterministic. Files that fail to be written
+	// don't prevent writing the others, unless the run is cancelled.
+	for i, file := range files {
+		if errs[i] != nil && ctx.Err() != nil {
+			return fmt.Errorf("error writing file: %s", errs[i])
+		}
+		if errs[i] != nil {
+			failures.add(failedWrite, file.name, errs[i])
+			continue
+		}
+		if !written[i] {
+			if *verbose {
+				fmt.Printf("Left %s as it was, since its contents didn't change\n", file.name)
+			}
+			continue
+		}
+		stats.add(&stats.modified, 1)
+		if *verbose {
+			fmt.Printf("Wrote %s\n", file.name)
+		}
+	}
+	return nil
+}
+
+// writeFile writes the modified file, and reports whether it was written
+// (files whose contents didn't actually change aren't, so that rerunning an
+// upgrade doesn't touch their modification times, which build caches go by)
+func writeFile(file file) (bool, error) {
+	out, err := formatFile(file)
 	if err != nil {
-		return fmt.Errorf("error opening file %s: %s", file.name, err)
+		return false, err
+	}
+	name := outputPath(file.name)
+	if orig, err := os.ReadFile(name); err == nil && bytes.Equal(orig, out) {
+		return false, nil
+	}
+	if err := writeFileAtomic(name, out); err != nil {
+		return false, fmt.Errorf("error writing file %s: %s", file.name, err)
 	}
-	defer f.Close()
 
-	if err := format.Node(f, file.fset, file.ast); err != nil {
-		return fmt.Errorf("error writing file %s: %s", file.name, err)
+	return true, nil
+}
+
+// stageFile formats the modified file into chunkDir, under a name based on
+// its index in the modified files, and returns the path it was written to
+func stageFile(file file, index int) (string, error) {
+	out, err := formatFile(file)
+	if err != nil {
+		return "", err
+	}
+	staged := filepath.Join(chunkDir, fmt.Sprintf("%d.go", index))
+	if err := os.WriteFile(staged, out, 0o600); err != nil {
+		return "", fmt.Errorf("error staging file %s: %s", file.name, err)
+	}
+	return staged, nil
+}
+
+// formatFile returns the contents of the modified file
+func formatFile(file file) ([]byte, error) {
+	if file.staged != "" {
+		out, err := os.ReadFile(file.staged)
+		if err != nil {
+			return nil, fmt.Errorf("error reading staged file %s: %s", file.name, err)
+		}
+		return out, nil
+	}
+	if file.ast == nil {
+		return file.content, nil
+	}
+
+	orig, err := os.ReadFile(file.name)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file %s: %s", file.name, err)
+	}
+
+	var buf bytes.Buffer
+	if err := format.Node(&buf, file.fset, file.ast); err != nil {
+		return nil, fmt.Errorf("error formatting file %s: %s", file.name, err)
+	}
+
+	// Rewritten imports can end up out of order, or in the wrong group (e.g.
+	// when a module is mapped to a standard library package), so the imports
+	// are sorted and grouped the way goimports does it (without adding or
+	// removing any)
+	out, err := imports.Process(file.name, buf.Bytes(), &imports.Options{
+		Comments:   true,
+		TabIndent:  true,
+		TabWidth:   8,
+		FormatOnly: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error formatting imports of file %s: %s", file.name, err)
+	}
+
+	return preserveEncoding(orig, out), nil
+}
+
+// writeFileAtomic replaces the contents of the named file by writing them to
+// a temporary file in the same directory, then renaming it over the original.
+// That way, an interrupted write can't leave a truncated file behind.
+func writeFileAtomic(name string, data []byte) error {
+	recorder.recordOriginal(name)
+
+	// Write through symlinks, rather than replacing them with the file.
+	// NOTE: Files in the staging directory start out as symlinks to the
+	// originals, which must be replaced instead (see stagingDir).
+	if stage == nil {
+		name = realPath(name)
+	}
+
+	var oldHash string
+	if auditor != nil {
+		oldHash = fileHash(name)
 	}
 
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(name); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := renameFile(tmp.Name(), name); err != nil {
+		return err
+	}
+	auditor.recordWrite(name, oldHash, "")
 	return nil
 }
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// preserveEncoding applies the original file's line ending convention and
+// UTF-8 byte order mark (if any) to the formatted output. The go/printer
+// package always emits LF line endings without a BOM, which would otherwise
+// turn a one-line import change into a rewrite of the entire file.
+func preserveEncoding(orig, out []byte) []byte {
+	// Consider the file to use CRLF line endings if its first line does
+	if i := bytes.IndexByte(orig, '\n'); i > 0 && orig[i-1] == '\r' {
+		out = bytes.ReplaceAll(out, []byte("\n"), []byte("\r\n"))
+	}
+	if bytes.HasPrefix(orig, utf8BOM) && !bytes.HasPrefix(out, utf8BOM) {
+		out = append(append([]byte{}, utf8BOM...), out...)
+	}
+	return out
+}
+
+// packageChunks lists the module's packages (without loading their syntax or
+// types), and splits their import paths into chunks of at most n packages
+func packageChunks(ctx context.Context, dir string, n int) ([][]string, error) {
+	cfg := &packages.Config{
+		Context: ctx,
+		Mode:    packages.NeedName,
+		Dir:     dir,
+	}
+	pkgs, err := packages.Load(cfg, "./...")
+	if err != nil {
+		return nil, fmt.Errorf("error loading package info: %s", err)
+	}
+
+	var chunks [][]string
+	for chunk := range slices.Chunk(pkgs, n) {
+		var paths []string
+		for _, pkg := range chunk {
+			paths = append(paths, pkg.PkgPath)
+		}
+		chunks = append(chunks, paths)
+	}
+	return chunks, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build/constraint"
+	"slices"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+)
+
+// The "// indirect" markers of the requirements an upgrade touches are
+// brought in line with what the module's packages import once the files are
+// written, like 'go mod tidy' would: the new major version of a dependency can
+// be imported directly where the old one wasn't (e.g. because a fixer
+// added an import), or the other way around (e.g. when the old major version
+// is kept with -keep-old, but nothing imports it anymore). Changed markers
+// show up in the summary of the go.mod changes.
+
+// updateIndirectMarkers marks the requirements of the upgraded dependencies
+// (old and new major versions) as direct if a package of the module in the
+// given directory imports them (or provides one of its tools), and as
+// indirect otherwise
+func updateIndirectMarkers(dir string, file *modfile.File, upgrades []upgrade) {
+	affected := map[string]bool{}
+	for _, upgrade := range upgrades {
+		affected[upgrade.oldPath] = true
+		affected[upgrade.newPath] = true
+	}
+
+	direct := map[string]bool{}
+	err := walkModuleGoFiles(dir, func(rel string, f *ast.File) {
+		if !tidyIncludes(rel, f) {
+			return
+		}
+		for _, spec := range f.Imports {
+			importPath := strings.Trim(spec.Path.Value, "\"")
+			if modulePath := owningModule(file, importPath); modulePath != "" {
+				direct[modulePath] = true
+			}
+		}
+	})
+	if err != nil {
+		warnf("error checking which upgraded dependencies are imported directly, so their \"// indirect\" markers were left as they were: %s", err)
+		return
+	}
+	for _, tool := range file.Tool {
+		if modulePath := owningModule(file, tool.Path); modulePath != "" {
+			direct[modulePath] = true
+		}
+	}
+
+	for _, require := range file.Require {
+		path := require.Mod.Path
+		switch {
+		case !affected[path] || require.Indirect == !direct[path]:
+		case direct[path]:
+			if *verbose {
+				fmt.Printf("Marking %s as a direct dependency\n", path)
+			}
+			clearIndirect(require)
+		default:
+			if *verbose {
+				fmt.Printf("Marking %s as an indirect dependency\n", path)
+			}
+			setIndirect(require)
+		}
+	}
+}
+
+// tidyIncludes reports whether 'go mod tidy' considers the imports of the
+// given file (by its path relative to the module directory): files in
+// testdata directories, and in directories starting with "_" or ".", aren't
+// part of any package, and build constraints count as satisfied by any set of
+// build tags, except for the "ignore" tag
+func tidyIncludes(rel string, f *ast.File) bool {
+	dirs := strings.Split(rel, "/")
+	if slices.ContainsFunc(dirs[:len(dirs)-1], func(dir string) bool {
+		return dir == "testdata" || strings.HasPrefix(dir, "_") || strings.HasPrefix(dir, ".")
+	}) {
+		return false
+	}
+
+	for _, group := range f.Comments {
+		if group.Pos() >= f.Package {
+			break
+		}
+		for _, comment := range group.List {
+			if expr, err := constraint.Parse(comment.Text); err == nil && constraint.IsGoBuild(comment.Text) {
+				return anyTags(expr, true)
+			}
+		}
+	}
+	return true
+}
+
+// anyTags evaluates a build constraint the way 'go mod tidy' does: every tag
+// is satisfied (or not, under a negation) except "ignore", which never is
+func anyTags(expr constraint.Expr, prefer bool) bool {
+	switch expr := expr.(type) {
+	case *constraint.TagExpr:
+		return expr.Tag != "ignore" && prefer
+	case *constraint.NotExpr:
+		return !anyTags(expr.X, !prefer)
+	case *constraint.AndExpr:
+		return anyTags(expr.X, prefer) && anyTags(expr.Y, prefer)
+	case *constraint.OrExpr:
+		return anyTags(expr.X, prefer) || anyTags(expr.Y, prefer)
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+// With -i, the version a dependency is upgraded to can be picked among the
+// versions of its new major version, rather than always being the highest one
+// (e.g. to upgrade to v3.1.0, which the rest of an organization is on, rather
+// than v3.4.0). The versions that -min-age (or -compat) rule out aren't
+// offered.
+
+// chooseVersion asks which version of the given module to upgrade to, among
+// the versions of the same major version as the highest one (which is the
+// default), and returns it
+func chooseVersion(ctx context.Context, path, highest string) string {
+	versions, err := majorVersions(ctx, path, highest)
+	if errors.Is(err, errDirect) {
+		warnf("the versions of %s can't be listed, since it's fetched directly from version control: upgrading to %s", path, highest)
+		return highest
+	}
+	if err != nil {
+		log.Fatalf("Error listing versions of %s: %s", path, err)
+	}
+	if len(versions) < 2 {
+		return highest
+	}
+
+	fmt.Fprintf(os.Stderr, "Versions of %s:\n", path)
+	for i, version := range versions {
+		fmt.Fprintf(os.Stderr, "\t%d) %s%s\n", i+1, version, publishedSuffix(ctx, path, version))
+	}
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Fprintf(os.Stderr, "Version to upgrade to [%s]: ", highest)
+		answer, err := reader.ReadString('\n')
+		answer = strings.TrimSpace(answer)
+		switch n, convErr := strconv.Atoi(answer); {
+		case answer == "" && err == nil:
+			return highest
+		case convErr == nil && n >= 1 && n <= len(versions):
+			return versions[n-1]
+		case slices.Contains(versions, answer):
+			return answer
+		case errors.Is(err, io.EOF):
+			fmt.Fprintln(os.Stderr)
+			log.Fatalf("Upgrade cancelled: no version of %s chosen", path)
+		case err != nil:
+			log.Fatalf("Error reading the version to upgrade to: %s", err)
+		}
+		fmt.Fprintf(os.Stderr, "Invalid choice %q: enter a number from 1 to %d, or one of the versions\n", answer, len(versions))
+	}
+}
+
+// majorVersions returns the versions of the given module with the same major
+// version as the given one (releases only, unless it's a pre-release), that
+// the upgrade is allowed to target, highest first
+func majorVersions(ctx context.Context, path, version string) ([]string, error) {
+	all, err := listVersions(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	prerelease := semver.Prerelease(version) != ""
+	var versions []string
+	for _, v := range all {
+		if semver.Major(v) != semver.Major(version) || (semver.Prerelease(v) != "" && !prerelease) {
+			continue
+		}
+		if ok, err := oldEnough(ctx, path, v); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		if ok, err := buildable(ctx, path, v); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		versions = append(versions, v)
+	}
+	semver.Sort(versions)
+	slices.Reverse(versions)
+	return versions, nil
+}
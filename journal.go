@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Runs keep a journal of their progress, so that a long run that's
+// interrupted (e.g. by a CI timeout or Ctrl-C) can be continued with the
+// "resume" target, rather than started over: the upgrades found by probing
+// for new versions (and the resulting go.mod file) are recorded as soon as
+// they're resolved, and so are the modules upgraded by -f and the branches
+// created by -batch as each one is done. Resuming runs the interrupted
+// command again, with the same arguments, which skips whatever the journal
+// says is done. The journal is a file in the user's cache directory, named
+// after the directory of the run, and it's removed once the run succeeds.
+
+// resumeEnv is the environment variable set when resuming a run
+const resumeEnv = "UPGRADE_RESUME"
+
+// noJournalEnv is the environment variable set for the runs started by -f and
+// -batch, which don't keep a journal of their own
+const noJournalEnv = "UPGRADE_NO_JOURNAL"
+
+type journal struct {
+	path string
+
+	Cwd      string           `json:"cwd"`  // Working directory of the run
+	Args     []string         `json:"args"` // Command line arguments of the run
+	ModFile  string           `json:"modFile,omitempty"`
+	Upgrades []journalUpgrade `json:"upgrades,omitempty"`
+	Done     []string         `json:"done,omitempty"` // Module directories (-f) or branches (-batch) done
+}
+
+type journalUpgrade struct {
+	OldPath     string `json:"oldPath"`
+	NewPath     string `json:"newPath"`
+	OldVersion  string `json:"oldVersion,omitempty"`
+	NewVersion  string `json:"newVersion,omitempty"`
+	Indirect    bool   `json:"indirect,omitempty"`
+	OldForkPath string `json:"oldForkPath,omitempty"`
+	NewForkPath string `json:"newForkPath,omitempty"`
+}
+
+// journalPath returns the path of the journal of runs in the given directory
+func journalPath(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+	sum := sha256.Sum256([]byte(realPath(abs)))
+	return filepath.Join(cacheDir, "upgrade", "journals", hex.EncodeToString(sum[:8])+".json"), nil
+}
+
+// readJournal reads the journal of runs in the given directory, returning
+// nil if there isn't one
+func readJournal(dir string) (*journal, error) {
+	name, err := journalPath(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error getting journal path: %s", err)
+	}
+	b, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading journal: %s", err)
+	}
+	j := &journal{path: name}
+	if err := json.Unmarshal(b, j); err != nil {
+		return nil, fmt.Errorf("error decoding journal %s: %s", name, err)
+	}
+	return j, nil
+}
+
+// startJournal returns the journal of the run in the given directory: the
+// existing one when resuming, or a new one. Runs started by -f and -batch get
+// one that isn't saved.
+func startJournal(dir string) *journal {
+	if os.Getenv(noJournalEnv) != "" {
+		return &journal{}
+	}
+	if os.Getenv(resumeEnv) != "" {
+		j, err := readJournal(dir)
+		if err != nil {
+			log.Fatalf("Error resuming: %s", err)
+		}
+		if j != nil {
+			return j
+		}
+	}
+
+	name, err := journalPath(dir)
+	if err != nil {
+		log.Fatalf("Error getting journal path: %s", err)
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		log.Fatalf("Error getting working directory: %s", err)
+	}
+	return &journal{path: name, Cwd: cwd, Args: os.Args[1:]}
+}
+
+// resolved returns the upgrades recorded in the journal, and the go.mod file
+// they resulted in, or nil if they haven't been resolved yet
+func (j *journal) resolved() ([]upgrade, []byte) {
+	if j.ModFile == "" {
+		return nil, nil
+	}
+	var upgrades []upgrade
+	for _, u := range j.Upgrades {
+		upgrades = append(upgrades, upgrade{
+			oldPath:     u.OldPath,
+			newPath:     u.NewPath,
+			oldVersion:  u.OldVersion,
+			newVersion:  u.NewVersion,
+			indirect:    u.Indirect,
+			oldForkPath: u.OldForkPath,
+			newForkPath: u.NewForkPath,
+		})
+	}
+	return upgrades, []byte(j.ModFile)
+}
+
+// recordResolved records the upgrades found, and the go.mod file they
+// resulted in
+func (j *journal) recordResolved(upgrades []upgrade, modFile []byte) {
+	j.Upgrades = nil
+	for _, u := range upgrades {
+		j.Upgrades = append(j.Upgrades, journalUpgrade{
+			OldPath:     u.oldPath,
+			NewPath:     u.newPath,
+			OldVersion:  u.oldVersion,
+			NewVersion:  u.newVersion,
+			Indirect:    u.indirect,
+			OldForkPath: u.oldForkPath,
+			NewForkPath: u.newForkPath,
+		})
+	}
+	j.ModFile = string(modFile)
+	j.save()
+}
+
+func (j *journal) done(item string) bool {
+	return slices.Contains(j.Done, item)
+}
+
+// recordDone records that a module (-f) or a branch (-batch) is done
+func (j *journal) recordDone(item string) {
+	j.Done = append(j.Done, item)
+	j.save()
+}
+
+func (j *journal) save() {
+	if j.path == "" {
+		return
+	}
+	b, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		log.Fatalf("Error encoding journal: %s", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0o755); err != nil {
+		log.Fatalf("Error creating journal directory: %s", err)
+	}
+	if err := os.WriteFile(j.path, b, 0o644); err != nil {
+		log.Fatalf("Error writing journal: %s", err)
+	}
+}
+
+// remove removes the journal, once the run is done
+func (j *journal) remove() {
+	if j.path == "" {
+		return
+	}
+	if err := os.Remove(j.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		warnf("error removing journal %s: %s", j.path, err)
+	}
+}
+
+// resume runs the interrupted run in the given directory (or in the module
+// containing it) again, with the same arguments, continuing from its journal
+func resume(dir string) {
+	j, err := readJournal(dir)
+	if err != nil {
+		log.Fatalf("Error resuming: %s", err)
+	}
+	if j == nil {
+		if root, err := findModuleRoot(dir); err == nil {
+			if j, err = readJournal(root); err != nil {
+				log.Fatalf("Error resuming: %s", err)
+			}
+		}
+	}
+	if j == nil {
+		log.Fatalf("No interrupted run to resume in %s", dir)
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Error finding executable: %s", err)
+	}
+	fmt.Printf("Resuming 'upgrade %s' in %s\n", strings.Join(j.Args, " "), j.Cwd)
+	cmd := exec.Command(self, j.Args...)
+	cmd.Dir = j.Cwd
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), resumeEnv+"=1")
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.ExitCode())
+		}
+		log.Fatalf("Error resuming: %s", err)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// References to upgraded modules that the upgrade leaves alone (the imports
+// of files that are skipped, e.g. because they're ignored by git or fail to
+// parse, and module paths in string literals) are recorded as they're found,
+// and reported together at the end of the run, with the reason each was left
+// alone, so that nothing is left behind silently.
+// NOTE: Files left out on purpose (with -only, -include-file or
+// -exclude-file) aren't reported, since keeping them is the point.
+
+type leftBehindRef struct {
+	filename string
+	line     int
+	msg      string
+}
+
+var leftBehind struct {
+	lock sync.Mutex
+	refs []leftBehindRef
+}
+
+// recordLeftBehind records a reference to an upgraded module at the given
+// location that was left alone, for the given reason
+func recordLeftBehind(filename string, line int, what, reason string) {
+	leftBehind.lock.Lock()
+	defer leftBehind.lock.Unlock()
+	leftBehind.refs = append(leftBehind.refs, leftBehindRef{
+		filename: filename,
+		line:     line,
+		msg:      fmt.Sprintf("%s was left as it is, since %s", what, reason),
+	})
+}
+
+// recordSkippedImports records each import of an upgraded module in a file
+// that was skipped for the given reason, since it won't be rewritten
+func recordSkippedImports(pkg *packages.Package, fset *token.FileSet, fileAST *ast.File, upgradeMap map[string]upgrade, known []string, reason string) {
+	// NOTE: Generated files are best fixed by regenerating them
+	if ast.IsGenerated(fileAST) {
+		reason += " (regenerate it instead)"
+	}
+	for _, fileImp := range fileAST.Imports {
+		importPath, err := strconv.Unquote(fileImp.Path.Value)
+		if err != nil {
+			continue
+		}
+		modulePath := moduleForImport(pkg, importPath, known)
+		if upgrade, ok := upgradeMap[modulePath]; ok {
+			position := fset.Position(fileImp.Pos())
+			recordLeftBehind(position.Filename, position.Line,
+				fmt.Sprintf("the import of %s (upgraded to %s)", importPath, upgrade.newPath), reason,
+			)
+		}
+	}
+}
+
+// recordStringReferences records each string literal in the file that refers
+// to an upgraded module (e.g. a package path passed to a code generator),
+// other than the import paths, since only imports are rewritten
+func recordStringReferences(fset *token.FileSet, fileAST *ast.File, upgrades []upgrade) {
+	imports := map[*ast.BasicLit]bool{}
+	for _, fileImp := range fileAST.Imports {
+		imports[fileImp.Path] = true
+	}
+	ast.Inspect(fileAST, func(node ast.Node) bool {
+		lit, ok := node.(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING || imports[lit] {
+			return true
+		}
+		for _, upgrade := range upgrades {
+			if upgrade.oldPath == upgrade.newPath || !strings.Contains(lit.Value, upgrade.oldPath) {
+				continue
+			}
+			if replaceModuleReference(lit.Value, upgrade) != lit.Value {
+				position := fset.Position(lit.Pos())
+				recordLeftBehind(position.Filename, position.Line,
+					fmt.Sprintf("the reference to %s (upgraded to %s) in a string literal", upgrade.oldPath, upgrade.newPath),
+					"string literals aren't rewritten",
+				)
+			}
+		}
+		return true
+	})
+}
+
+// reportLeftBehind warns about the references to upgraded modules that were
+// left alone, in the order of their locations
+func reportLeftBehind() {
+	leftBehind.lock.Lock()
+	defer leftBehind.lock.Unlock()
+	sort.SliceStable(leftBehind.refs, func(i, j int) bool {
+		a, b := leftBehind.refs[i], leftBehind.refs[j]
+		if a.filename != b.filename {
+			return a.filename < b.filename
+		}
+		return a.line < b.line
+	})
+	for _, ref := range leftBehind.refs {
+		warnfAt(ref.filename, ref.line, "%s", ref.msg)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// licensePatterns identify common licenses by distinctive phrases in their
+// text, in order of precedence (e.g. the LGPL must be checked before the GPL,
+// since its text mentions the GPL)
+var licensePatterns = []struct {
+	id      string
+	phrases []string // All must be present
+}{
+	{"BUSL-1.1", []string{"Business Source License"}},
+	{"SSPL-1.0", []string{"Server Side Public License"}},
+	{"Elastic-2.0", []string{"Elastic License 2.0"}},
+	{"AGPL-3.0", []string{"GNU AFFERO GENERAL PUBLIC LICENSE"}},
+	{"LGPL-3.0", []string{"GNU LESSER GENERAL PUBLIC LICENSE", "Version 3"}},
+	{"LGPL-2.1", []string{"GNU LESSER GENERAL PUBLIC LICENSE", "Version 2.1"}},
+	{"GPL-3.0", []string{"GNU GENERAL PUBLIC LICENSE", "Version 3"}},
+	{"GPL-2.0", []string{"GNU GENERAL PUBLIC LICENSE", "Version 2"}},
+	{"MPL-2.0", []string{"Mozilla Public License", "2.0"}},
+	{"Apache-2.0", []string{"Apache License", "Version 2.0"}},
+	{"BSD-3-Clause", []string{"Redistribution and use in source and binary forms", "Neither the name"}},
+	{"BSD-2-Clause", []string{"Redistribution and use in source and binary forms"}},
+	{"MIT", []string{"Permission is hereby granted, free of charge"}},
+	{"ISC", []string{"Permission to use, copy, modify, and/or distribute this software for any"}},
+	{"Unlicense", []string{"This is free and unencumbered software released into the public domain"}},
+}
+
+// checkLicenses warns about each upgraded dependency whose license differs
+// between its old and new versions (e.g. a switch from BSD to BUSL), since
+// that typically requires legal review. Both versions are downloaded to the
+// module cache in order to find their license files.
+func checkLicenses(ctx context.Context, upgrades []upgrade) {
+	for _, upgrade := range upgrades {
+		// Nothing to compare when upgrading the current module
+		if upgrade.oldVersion == "" || upgrade.newVersion == "" {
+			continue
+		}
+
+		oldLicense, err := moduleLicense(ctx, upgrade.oldSource(), upgrade.oldVersion)
+		if err != nil {
+			warnf("error checking license of %s %s: %s", upgrade.oldSource(), upgrade.oldVersion, err)
+			continue
+		}
+		newLicense, err := moduleLicense(ctx, upgrade.newSource(), upgrade.newVersion)
+		if err != nil {
+			warnf("error checking license of %s %s: %s", upgrade.newSource(), upgrade.newVersion, err)
+			continue
+		}
+
+		if *verbose {
+			fmt.Printf("License of %s %s: %s\n", upgrade.newSource(), upgrade.newVersion, newLicense)
+		}
+		if oldLicense != newLicense {
+			warnf("LICENSE CHANGED: %s %s is licensed under %s, but %s %s is licensed under %s",
+				upgrade.oldSource(), upgrade.oldVersion, oldLicense,
+				upgrade.newSource(), upgrade.newVersion, newLicense,
+			)
+		}
+	}
+}
+
+// moduleLicense returns the license identifier(s) of the given module
+// version, based on the license files in its root directory
+func moduleLicense(ctx context.Context, path, version string) (string, error) {
+	downloaded, err := downloadModule(ctx, path, version)
+	if err != nil {
+		return "", err
+	}
+	return detectLicense(downloaded.Dir)
+}
+
+// detectLicense identifies the license(s) in the given directory's license
+// files. Multiple licenses are joined with "AND". Returns "none" if there are
+// no license files, and "unknown" for license files that aren't recognized.
+func detectLicense(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("error reading directory %s: %s", dir, err)
+	}
+
+	ids := map[string]bool{}
+	for _, entry := range entries {
+		name := strings.ToUpper(entry.Name())
+		if entry.IsDir() || !(strings.HasPrefix(name, "LICENSE") ||
+			strings.HasPrefix(name, "LICENCE") ||
+			strings.HasPrefix(name, "COPYING")) {
+			continue
+		}
+
+		b, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return "", fmt.Errorf("error reading license file %s: %s", entry.Name(), err)
+		}
+		ids[identifyLicense(string(b))] = true
+	}
+
+	if len(ids) == 0 {
+		return "none", nil
+	}
+	var sorted []string
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Strings(sorted)
+	return strings.Join(sorted, " AND "), nil
+}
+
+func identifyLicense(text string) string {
+	// Prefer an explicit SPDX identifier, if there is one
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		if _, id, ok := strings.Cut(scanner.Text(), "SPDX-License-Identifier:"); ok {
+			return strings.TrimSpace(id)
+		}
+	}
+
+	// Normalize whitespace, since license text is often re-wrapped
+	text = strings.Join(strings.Fields(text), " ")
+	for _, pattern := range licensePatterns {
+		matches := true
+		for _, phrase := range pattern.phrases {
+			if !strings.Contains(text, phrase) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return pattern.id
+		}
+	}
+	return "unknown"
+}
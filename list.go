@@ -4,23 +4,106 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand/v2"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
-func list(ctx context.Context) error {
+func list(ctx context.Context, dir string) error {
 	cmd := exec.CommandContext(ctx, "go", "list", "-mod=mod", "./...")
+	cmd.Dir = dir
+	// NOTE: The go command doesn't allow -mod=mod in workspace mode, and it's
+	// this module's go.mod file that needs updating, not the workspace's
+	cmd.Env = moduleModeEnv()
 
-	if err := cmd.Run(); err != nil {
-		if err := err.(*exec.ExitError); err != nil {
-			fmt.Println(string(err.Stderr)) // TODO: Remove
+	done := auditor.recordCommand("go", dir, cmd.Args, filepath.Join(dir, "go.mod"), filepath.Join(dir, "go.sum"))
+	out, err := cmd.CombinedOutput()
+	done(err)
+	if err != nil {
+		// NOTE: The go command says what went wrong (e.g. a missing
+		// dependency) in its output, if it got to run at all
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return fmt.Errorf("error executing 'go list' command: %s: %s", err, strings.TrimSpace(string(out)))
 		}
 		return fmt.Errorf("error executing 'go list' command: %s", err)
 	}
+
+	// If the module's dependencies are vendored, the vendor directory has to
+	// be brought in line with the updated go.mod file, or builds will fail
+	if vendored(dir) {
+		if *verbose {
+			fmt.Println("Updating vendor directory")
+		}
+		cmd := exec.CommandContext(ctx, "go", "mod", "vendor")
+		cmd.Dir = dir
+		cmd.Env = moduleModeEnv()
+		done := auditor.recordCommand("go", dir, cmd.Args, filepath.Join(dir, "vendor", "modules.txt"))
+		out, err := cmd.CombinedOutput()
+		done(err)
+		if err != nil {
+			return fmt.Errorf("error executing 'go mod vendor' command: %s: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// updateRequirements updates the requirements of the upgraded dependencies
+// (and theirs, transitively) to their latest minor or patch versions, with
+// 'go get -u', so that the new major versions land with a current set of
+// dependencies rather than whatever the module happened to require. The
+// upgraded dependencies themselves stay at their new versions.
+func updateRequirements(ctx context.Context, dir string, upgrades []upgrade) error {
+	args := []string{"get", "-u"}
+	for _, upgrade := range upgrades {
+		// NOTE: Dependencies replaced by a fork are left alone, since the
+		// required version of the original module doesn't matter
+		if upgrade.newVersion == "" || upgrade.newForkPath != "" {
+			continue
+		}
+		args = append(args, upgrade.newPath+"@"+upgrade.newVersion)
+	}
+	if len(args) == 2 {
+		return nil
+	}
+
+	cmd := exec.CommandContext(ctx, "go", args...)
+	cmd.Dir = dir
+	cmd.Env = moduleModeEnv()
+	done := auditor.recordCommand("go", dir, cmd.Args, filepath.Join(dir, "go.mod"), filepath.Join(dir, "go.sum"))
+	out, err := cmd.CombinedOutput()
+	done(err)
+	if err != nil {
+		return fmt.Errorf("error executing 'go get' command: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	// 'go get' reports the requirements it changed (e.g. "go: upgraded
+	// golang.org/x/text v0.3.0 => v0.14.0")
+	for _, line := range strings.Split(string(out), "\n") {
+		if change, ok := strings.CutPrefix(line, "go: upgraded "); ok {
+			fmt.Printf("Updated %s\n", change)
+		} else if *verbose && line != "" {
+			fmt.Println(line)
+		}
+	}
 	return nil
 }
 
+// vendored reports whether the module in the given directory uses vendoring:
+// either because it has a vendor directory (which the go command uses by
+// default), or because GOFLAGS says so
+func vendored(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, "vendor", "modules.txt")); err == nil {
+		return !strings.Contains(os.Getenv("GOFLAGS"), "-mod=mod")
+	}
+	return strings.Contains(os.Getenv("GOFLAGS"), "-mod=vendor")
+}
+
 // From "go help list" output
 type Module struct {
 	Path       string       // module path
@@ -46,18 +129,108 @@ type ModuleError struct {
 	Err string // the error itself
 }
 
+// listModules calls 'go list -m' for the given module queries. Transient
+// failures (e.g. network errors or proxy outages) are retried with exponential
+// backoff, up to -retries times. Results indicating that a module or version
+// genuinely doesn't exist are returned as-is.
 func listModules(ctx context.Context, modulePaths ...string) ([]Module, error) {
-	cmd := exec.CommandContext(ctx,
-		"go", append([]string{"list", "-m", "-u", "-e", "-json", "-mod=readonly"},
-			modulePaths...,
-		)...,
+	return retryListModules(ctx, nil, modulePaths)
+}
+
+// listModuleVersions calls 'go list -m -versions' for the given module paths,
+// to list the versions of several modules with a single command (retrying
+// like listModules)
+func listModuleVersions(ctx context.Context, modulePaths ...string) ([]Module, error) {
+	return retryListModules(ctx, []string{"-versions"}, modulePaths)
+}
+
+func retryListModules(ctx context.Context, flags, modulePaths []string) ([]Module, error) {
+	for attempt := 0; ; attempt++ {
+		results, err := runListModules(ctx, flags, modulePaths...)
+
+		// NOTE: Failures of the go command itself (e.g. a bad module path or
+		// GOFLAGS) are only retried if they look like network problems too
+		retryable := false
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && isRetryable(string(exitErr.Stderr)) {
+			retryable = true
+		}
+		for _, result := range results {
+			if result.Error != nil && isRetryable(result.Error.Err) {
+				retryable = true
+				err = errors.New(result.Error.Err)
+			}
+		}
+		if !retryable || attempt >= *retries || ctx.Err() != nil {
+			return results, err
+		}
+
+		delay := backoff(attempt)
+		if *verbose {
+			fmt.Printf("Retrying in %s: %s\n", delay.Round(time.Millisecond), err)
+		}
+		select {
+		case <-ctx.Done():
+			return results, err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Errors reported by the go command that indicate a (probably) transient
+// network or proxy problem, rather than a missing module or version
+var retryableErrors = []string{
+	"dial tcp",
+	"i/o timeout",
+	"connection reset",
+	"connection refused",
+	"TLS handshake timeout",
+	"unexpected EOF",
+	"429 Too Many Requests",
+	"500 Internal Server Error",
+	"502 Bad Gateway",
+	"503 Service Unavailable",
+	"504 Gateway Timeout",
+}
+
+func isRetryable(msg string) bool {
+	for _, retryable := range retryableErrors {
+		if strings.Contains(msg, retryable) {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay before the given retry attempt: exponential, with
+// up to 50% random jitter so that concurrent lookups don't retry in lockstep
+func backoff(attempt int) time.Duration {
+	const (
+		base     = 500 * time.Millisecond
+		maxDelay = 10 * time.Second
 	)
+	delay := base << attempt
+	if delay > maxDelay || delay <= 0 {
+		delay = maxDelay
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+func runListModules(ctx context.Context, flags []string, modulePaths ...string) ([]Module, error) {
+	args := append([]string{"list", "-m", "-u", "-e", "-json", "-mod=readonly"}, flags...)
+	cmd := exec.CommandContext(ctx, "go", append(args, modulePaths...)...)
+	// Resolve queries in the context of the module being upgraded (e.g. its
+	// replace directives), rather than the current directory's
+	cmd.Dir = *dir
 	out, err := cmd.Output()
 	if err != nil {
-		if err := err.(*exec.ExitError); err != nil {
-			fmt.Println(string(err.Stderr)) // TODO: Remove
+		// NOTE: The go command says which proxy (or repository) failed, and
+		// how, on stderr
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return nil, fmt.Errorf("error executing 'go %s' command: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(exitErr.Stderr)))
 		}
-		return nil, fmt.Errorf("error executing 'go list -m -u -e -json -mod=readonly' command: %s", err)
+		return nil, fmt.Errorf("error executing 'go %s' command: %s", strings.Join(args, " "), err)
 	}
 
 	var results []Module
@@ -65,9 +238,48 @@ func listModules(ctx context.Context, modulePaths ...string) ([]Module, error) {
 	for decoder.More() {
 		var result Module
 		if err := decoder.Decode(&result); err != nil {
-			return nil, fmt.Errorf("error parsing results of 'go list -m -u -e -json -mod=readonly' command: %s", err)
+			return nil, fmt.Errorf("error parsing results of 'go %s' command: %s", strings.Join(args, " "), err)
 		}
 		results = append(results, result)
 	}
 	return results, nil
 }
+
+// From "go help mod download" output
+type DownloadedModule struct {
+	Path     string // module path
+	Query    string // version query corresponding to this version
+	Version  string // module version
+	Error    string // error loading module
+	Info     string // absolute path to cached .info file
+	GoMod    string // absolute path to cached .mod file
+	Zip      string // absolute path to cached .zip file
+	Dir      string // absolute path to cached source root directory
+	Sum      string // checksum for path, version (as in go.sum)
+	GoModSum string // checksum for go.mod (as in go.sum)
+}
+
+// downloadModule downloads the given module version into the module cache
+// (if it isn't already there) using 'go mod download', and returns its
+// location.
+func downloadModule(ctx context.Context, path, version string) (*DownloadedModule, error) {
+	query := fmt.Sprintf("%s@%s", path, version)
+	cmd := exec.CommandContext(ctx, "go", "mod", "download", "-json", query)
+	// Run outside of the current module, so its go.mod/go.sum files
+	// aren't affected
+	cmd.Dir = os.TempDir()
+	out, err := cmd.Output()
+	// NOTE: 'go mod download -json' exits with a non-zero status if there's
+	// an error, but still reports it in its JSON output
+	var result DownloadedModule
+	if jsonErr := json.Unmarshal(out, &result); jsonErr != nil {
+		if err != nil {
+			return nil, fmt.Errorf("error executing 'go mod download -json %s' command: %s", query, err)
+		}
+		return nil, fmt.Errorf("error parsing results of 'go mod download -json %s' command: %s", query, jsonErr)
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("error downloading %s: %s", query, result.Error)
+	}
+	return &result, nil
+}
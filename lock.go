@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Runs that modify a module hold a lock on it, so that two of them (e.g. a
+// person's and a nightly job's) can't rewrite the same files at the same time.
+// The lock is a file in the user's cache directory (rather than in the module,
+// where it would show up as a change), named after the module directory's
+// path, and created exclusively. It records the process holding it, so that
+// the lock of a run that died without releasing it (e.g. after a fatal error)
+// can be taken over.
+
+// moduleLockPath returns the path of the lock file of the module directory
+func moduleLockPath(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+	sum := sha256.Sum256([]byte(realPath(abs)))
+	return filepath.Join(cacheDir, "upgrade", "locks", hex.EncodeToString(sum[:8])+".lock"), nil
+}
+
+// lockModule acquires the lock of the module directory, returning a function
+// that releases it. Fails if another run holds it.
+func lockModule(dir string) (func(), error) {
+	name, err := moduleLockPath(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error getting lock file path: %s", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return nil, fmt.Errorf("error creating lock directory: %s", err)
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "localhost"
+	}
+
+	// NOTE: The second attempt is after removing a stale lock
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err == nil {
+			fmt.Fprintf(f, "%d %s %s\n", os.Getpid(), hostname, time.Now().Format(time.RFC3339))
+			f.Close()
+			return func() { os.Remove(name) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("error creating lock file: %s", err)
+		}
+
+		b, err := os.ReadFile(name)
+		if errors.Is(err, os.ErrNotExist) {
+			// Released in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading lock file %s: %s", name, err)
+		}
+		// NOTE: A lock file without contents is still being written. A
+		// process on another host (sharing the directory) can't be checked,
+		// so its lock is never considered stale.
+		fields := strings.Fields(string(b))
+		switch {
+		case len(fields) != 3:
+			return nil, fmt.Errorf("%s is being upgraded by another run; remove %s if it's no longer running", dir, name)
+		case fields[1] != hostname:
+			return nil, fmt.Errorf("%s is being upgraded by another run (on %s, started %s); remove %s if it's no longer running", dir, fields[1], fields[2], name)
+		}
+		if pid, err := strconv.Atoi(fields[0]); err != nil || processRunning(pid) {
+			return nil, fmt.Errorf("%s is being upgraded by another run (pid %s, started %s); remove %s if it's no longer running", dir, fields[0], fields[2], name)
+		}
+
+		if *verbose {
+			fmt.Printf("Removing stale lock file %s\n", name)
+		}
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("error removing stale lock file %s: %s", name, err)
+		}
+	}
+	return nil, fmt.Errorf("error acquiring lock file %s", name)
+}
+
+// processRunning reports whether the process with the given id is running
+func processRunning(pid int) bool {
+	// NOTE: On Windows, finding a process fails if it doesn't exist, while
+	// elsewhere it always succeeds, and sending it signal 0 checks instead
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	err = proc.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// mustLockModule acquires the lock of the module directory, exiting if it
+// can't, and returns a function that releases it
+func mustLockModule(dir string) func() {
+	unlock, err := lockModule(dir)
+	if err != nil {
+		log.Fatalf("Error locking module: %s", err)
+	}
+	return unlock
+}
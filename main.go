@@ -1,27 +1,51 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"path"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"golang.org/x/mod/modfile"
 	"golang.org/x/mod/module"
 	"golang.org/x/mod/semver"
 )
 
-const usage = `Usage: %s [-d dir] [-v] [module] [version]
+const usage = `Usage: %s [-allow-replaced] [-audit file] [-batch [-commit-template file] [-pr [-pr-template file]]] [-bot-rules=false] [-cache-ttl d] [-chunk n] [-compat] [-consolidate] [-d dir] [-dry-mod] [-exclude-file regexp]... [-f pattern] [-fixer cmd]... [-format f] [-html file] [-i] [-include-file regexp]... [-indirect] [-j n] [-keep-old] [-license] [-map file] [-max vN] [-max-requests n] [-min-age d] [-no-cache] [-notes] [-o file] [-only pattern]... [-policy file] [-post-hook cmd] [-pre-hook cmd] [-print path] [-probe-timeout d] [-r] [-rate n] [-replace-local] [-retries n] [-rules file] [-sbom file] [-slack url] [-subdir] [-symbols] [-text-file rule]... [-timeout d] [-u] [-v] [-verify] [-vet] [-webhook url] [-workspace file] [module] [new-module] [version]
+       %s [-d dir] plan [dir...]
+       %s [-cache-ttl d] [-d dir] [-indirect] [-j n] [-max-requests n] [-no-cache] [-rate n] serve [-addr a] [-interval d] [-metrics] [dir...]
+       %s [-d dir] [-bot-rules=false] [-cache-ttl d] [-compat] [-format f] [-indirect] [-j n] [-max-requests n] [-no-cache] [-rate n] [-workspace file] report [-html] [-json] [-renovate]
+       %s [-d dir] [-bot-rules=false] [-cache-ttl d] [-format f] [-j n] [-max-requests n] [-no-cache] [-policy file] [-rate n] enforce [-max-behind n]
+       %s [-d dir] finish [module]
+       %s [-d dir] impact module
+       %s [-d dir] [-format f] verify module
+       %s [-d dir] init
+       %s [-d dir] resume
+       %s [-cache-ttl d] [-d dir] [-j n] doctor
+       %s completion bash|zsh|fish
 
 Upgrades the major version of a module, or the major version of one of its
 dependencies, by editing the module's go.mod file and the corresponding import
-statements in its .go files.
+statements in its .go files. Requirements are edited in place, keeping their
+position and comments (including "// indirect" markers), so each upgrade
+changes a single line of the go.mod file. Comments that mention the old module
+path are updated, and the ones that mention the old version (e.g.
+"// pinned to v1.2.0 because of #123") are warned about. When the new major
+version was already required, the old requirement's comments are moved to it.
 
 If no arguments are given, upgrades the major version of the module rooted in
 the current working directory by incrementing the major version component of
@@ -32,13 +56,239 @@ The same behavior is triggered by supplying the module's own path for the
 making it possible to jump several major versions at once, or to downgrade
 versions.
 
+Modules that publish each new major version from a subdirectory named after it
+(e.g. v2/), rather than from a branch, can be upgraded with the [-subdir] flag:
+the module is copied to the subdirectory of its new major version (except for
+nested modules and files ignored by git), and the copy is upgraded instead (its
+module path, and its imports of its own packages), leaving the module as it is.
+Replacements by local directories are adjusted to the copy's location.
+
 If the module path of a dependency is given, upgrades the dependency to the
 specified version, or, if no version is given, to the highest major version
-available.
+available. To find it, the versions of the next few major versions (e.g.
+example.com/lib/v2 to example.com/lib/v5) are listed at once: concurrently, from
+the module proxy, or with a single 'go list -m -versions' command for modules
+fetched directly. Only if all of them were released are higher ones probed one
+at a time. The major versions of gopkg.in modules follow their own convention
+(e.g. gopkg.in/yaml.v2 to gopkg.in/yaml.v3, or gopkg.in/x.v2-unstable to
+gopkg.in/x.v3-unstable), and module paths with uppercase letters (e.g.
+github.com/Azure/azure-sdk-for-go) are escaped in requests to the module proxy,
+like the go command does.
+
+The version can also be a pseudo-version (e.g.
+v3.0.0-20240101000000-abcdef123456), a commit hash or a branch name (e.g.
+master, or @main, like with 'go get'), e.g. to upgrade to an unreleased fix
+on the branch of the next major version, before it's tagged. Commit hashes and
+branch names are resolved to the module path and pseudo-version of the commit,
+by trying each major version above the current one (including one that hasn't
+been released yet). For scripts, the version "latest" spells out the default
+(the highest version of the highest major version), and "vN.latest" (e.g.
+v3.latest) the highest version of a major version, like v3.
+
+If the dependency already requires the version it would be upgraded to (e.g.
+when the upgrade is run again), or has no newer major version when none is
+given, nothing is modified, and the exit status is 3, so that scripts can tell
+it apart from an upgrade (0) and a failure (1). With [-f pattern] or [-r], such
+modules are reported as up to date, and count as upgraded.
+
+If the dependency's new major version is published under another module path
+than its own with a major version suffix (e.g. from another repository), the
+[new-module] path can be given after the dependency's (e.g. 'upgrade
+example.com/lib example.com/newlib/v2'), followed by the version, if any (the
+highest version of the new path's major version otherwise). The requirement
+and the imports are moved to it in one step, like for any other upgrade. A
+branch name that's also a module path must then be given as @branch.
+
+With the [-i] flag, the version of the dependency's new major version (the
+highest one, or the one given, e.g. v3) to upgrade to is picked from the list of
+its versions, e.g. to upgrade to v3.1.0, which other modules are on, rather than
+to v3.4.0. The highest version is picked by default.
 
 If the special target "all" is given, attempts to upgrade all direct
 dependencies in the go.mod file to the highest major version available.
 
+The [-consolidate] flag finishes stalled migrations between major versions of
+a dependency: when several major versions of the same module are required
+(e.g. because some files were already changed to import the new major version
+while others still import the old one), the remaining imports of the older
+versions are rewritten to the newest major version that's required, and their
+requirements are dropped, leaving one. No versions are looked up. Every
+dependency is consolidated, unless a [module] is given (at any of its major
+versions).
+
+The [-map file] flag rewrites imports according to a file of path prefix
+mappings instead of upgrading a dependency, e.g. for an organization-wide
+rename. Each line of the file maps an old import path prefix to a new one
+(e.g. 'github.com/oldorg -> github.com/neworg'), and blank lines and comments
+(starting with '#' or '//') are ignored. All of the mappings are applied in
+one pass: a prefix matches whole path elements, and the longest one wins. The
+module itself, and the dependencies it requires or replaces, are renamed in
+the go.mod file when their paths match, with renamed dependencies required at
+the same version under the new path (which must exist). Prefixes that only
+match packages within a module just rewrite the imports of them.
+
+The [-keep-old] flag keeps requiring the old major version of each upgraded
+dependency alongside the new one, with a comment marking the migration as in
+progress, so that a large module can be migrated gradually (e.g. one package at
+a time, with [-only pattern]), over several changes. The special "finish"
+target then drops the old requirements (of every migration, or of the given
+[module]) once none of the module's files import them, and reports the
+migrations that are still in progress.
+
+The [-only pattern] flag restricts the rewriting of imports to the packages
+matching the given pattern (which can be repeated), and implies [-keep-old].
+Patterns are import paths, or paths relative to the module directory, and can
+contain "..." wildcards, like the go command's package patterns (e.g.
+'upgrade -only ./service/payments/... example.com/lib v3').
+
+The [-include-file regexp] and [-exclude-file regexp] flags (which can be
+repeated) give finer-grained control over which files have their imports
+rewritten: only the files whose path, relative to the module directory and
+with forward slashes, matches one of the [-include-file] expressions (if any),
+and none of the [-exclude-file] ones, are rewritten (e.g. 'upgrade
+-exclude-file "(^|/)zz_.*\.go$" example.com/lib v3', to never rewrite
+generated zz_*.go files). They also imply [-keep-old], and can be combined
+with [-only pattern].
+
+With the [-batch] flag, "all" applies each upgrade separately, on its own git
+branch (named after the new module path, e.g. 'upgrade/example.com/lib/v3'),
+created from HEAD in a temporary worktree, and commits it, so that each branch
+has its own isolated go.mod and import changes. Uncommitted changes aren't
+included. The [-pr] flag also pushes each branch to the "origin" remote and
+opens a pull request for it with the GitHub CLI ('gh'). Failing to apply one
+upgrade doesn't stop the others.
+
+The [-commit-template file] and [-pr-template file] flags set Go templates
+(see https://pkg.go.dev/text/template) for the commit message and the pull
+request description of each upgrade. The pull request's title is the first
+line of the commit message. The templates can use the fields {{.Module}} and
+{{.NewModule}} (the old and new module paths), {{.OldVersion}},
+{{.NewVersion}}, {{.Branch}}, {{.FilesChanged}} (a list of paths relative to
+the repository root), {{.VetFindings}} (see [-vet]), {{.ModChanges}} (a list
+of the changes made to the go.mod file) and {{.ReleaseNotes}} (see [-notes]).
+The default pull request description lists the changes made to the go.mod file.
+
+Dependencies that are replaced by a fork (another module, rather than a local
+directory) are upgraded given either the dependency's path or the fork's. If
+the dependency has a new major version, the fork is upgraded to the same one:
+to its latest release in it, or to the head of its branch named after it (e.g.
+"v2") if it hasn't released one yet. Otherwise (with a warning if the fork
+lags behind), the fork is upgraded to its own highest major version. Both the
+requirement and the replace directive are moved to the new major version of
+the dependency's path (e.g. 'replace example.com/lib/v2 =>
+example.com/fork/lib/v2 v2.0.0').
+
+Dependencies that are replaced by a local directory (e.g. 'replace
+example.com/lib => ../lib') are upgraded like any other, with a warning that
+the replacement doesn't apply to the new major version, and that the local
+checkout's module path needs to be upgraded too (unless its go.mod file already
+declares the new path). Since that quietly decouples the code from the local
+checkout, the tool asks for confirmation first (or exits, if stdin isn't a
+terminal), unless the [-allow-replaced] flag is set. The [-replace-local] flag
+moves the replace directive to the new major version (e.g. 'replace
+example.com/lib/v2 => ../lib') instead.
+
+The [-u] flag also updates the requirements of the upgraded dependencies (and
+theirs, transitively) to their latest minor or patch versions, like 'go get -u'
+does, so that the new major versions land with a current set of dependencies.
+The requirements that change are printed. Dependencies replaced by a fork are
+left alone.
+
+The [-f pattern] flag applies the same upgrade (or runs the same target) to
+each module whose go.mod file matches the given glob pattern, relative to the
+[-d dir] directory (e.g. 'upgrade -f "services/*/go.mod" example.com/lib v3'),
+one after the other, as a lighter-weight alternative to the "plan" target's
+discovery of every module. A combined summary of the modules is printed at the
+end. Failing to upgrade one module doesn't stop the others, but makes the run
+fail.
+
+The [-r] flag applies the same upgrade (or runs the same target) to every
+module within the [-d dir] directory, like [-f pattern], in the order printed
+by the "plan" target, so that each module is upgraded after the local modules
+it requires. When the modules' own major versions are upgraded (i.e. no
+[module] is given), the requirements of each module on the local modules
+upgraded before it are moved to their new major versions first, along with
+their imports and their replacements by the local directories (e.g. 'replace
+example.com/lib => ../lib' becomes 'replace example.com/lib/v2 => ../lib'), so
+that no module is left referring to the old major version of another. Such
+requirements are given the first version of the new major version (e.g.
+v2.0.0), which the replacement overrides. Requirements on local modules that
+aren't replaced by their directories are left alone, with a warning, since
+the new major versions aren't published yet.
+
+Without [-r], the files of nested modules (directories within the module with a
+go.mod file of their own) are never rewritten, since they're part of separate
+modules. Nested modules that still require the old major version of an
+upgraded dependency are reported with a warning instead.
+
+The special "plan" target takes a list of module directories (or, if none are
+given, finds all modules within the module directory), and prints the order in
+which they should be upgraded, so that each module is upgraded before the
+modules that depend on it. It also warns about modules whose upgrade would
+leave other modules requiring their old major version. Nothing is modified.
+
+The special "serve" target takes a list of module directories (or, if none are
+given, finds all modules within the module directory), checks their
+dependencies for available major upgrades every [-interval d] (default '1h'),
+and serves the results over HTTP on [-addr a] (default ':8080'), as JSON:
+'GET /modules' returns the status of every module, and 'GET /modules/{path}'
+that of the given module, including how many major versions behind each
+dependency is. The [-metrics] flag also serves the same data as Prometheus
+metrics at 'GET /metrics'. 'GET /renovate/{path}' returns the Renovate
+datasource document of the given dependency (see below). The go.mod files are
+re-read on every check, and nothing is modified.
+
+The special "impact" target lists the module's packages and files that import
+the given module (at the major version in its path), with the number of
+references to the module's exported symbols (call sites) in each, and the
+symbols referenced most, to help estimate the cost of upgrading it. Nothing is
+modified.
+
+The special "verify" target checks that no file of the module imports the
+given module (at the major version in its path) anymore, e.g. as a CI gate
+after a manual or partial migration to a new major version. Every .go file is
+checked, regardless of its build constraints (including tests, files for other
+platforms and generated files, but not files ignored by git, or within testdata
+directories). The remaining imports are printed (as error annotations, with
+[-format f] 'gha'), and the exit status is 1. Nothing is modified.
+
+The special "report" target prints, for each requirement in the go.mod file
+(including indirect ones, with [-indirect]), its latest major version (and the
+date it was published, to judge how mature it is) and how many major versions
+behind it is, as a table or, with [-json], as JSON (in the same format as
+"serve") or, with [-html], as a standalone HTML page. Nothing is modified. With
+[-v], the publish date of each major version found is printed as well.
+
+Renovate can delegate major upgrades of Go dependencies to this tool, since it
+can't rewrite their imports on its own: with [-renovate], "report" prints the
+document a Renovate custom datasource expects for each dependency (by module
+path), listing its current version and the latest version of its newest major
+version (unless it's denied). A custom datasource can read it (or fetch
+'GET /renovate/{path}' from "serve"), and a post-upgrade task can then run
+'upgrade {{{depName}}} {{{newVersion}}}' to apply the upgrade.
+
+The tool can also be run by 'go vet', as an analyzer (named "outdated") that
+reports the imports of dependencies that have a newer major version, with a
+suggested fix that rewrites the import, so that upgrades show up in CI (or
+anything else that runs vet tools) without running the tool itself:
+'go vet -vettool=$(which upgrade) ./...'. The go.mod file still has to be
+upgraded by running the tool. Dependencies ignored by the module's Renovate or
+Dependabot configuration aren't reported. The analyzer can also be added to a
+multichecker (or any other analysis driver) from the
+github.com/nicheinc/upgrade/analyzer package, in which case versions are
+looked up with the go command instead.
+
+The special "enforce" target checks that no direct dependency is more than
+[-max-behind n] (0, by default) major versions behind its latest one, as an
+organizational guardrail in CI. The dependencies that are (or couldn't be
+checked) are printed as a table, like by "report", and the exit status is 1.
+Dependencies denied by the [-policy file] are exempt. Nothing is modified.
+
+The special "completion" target prints a completion script for the given
+shell (bash, zsh or fish), which completes flags, and completes targets with
+the module paths in the go.mod file (of the module directory given by [-d dir],
+if any). For example, add 'source <(upgrade completion bash)' to ~/.bashrc.
+
 If given, [module] must be a fully qualified module path, as written in the
 go.mod file. It must include the major version component, if applicable. For
 example: "github.com/nicheinc/upgrade/v2".
@@ -52,60 +302,1026 @@ available matching version, unless the target major version of the dependency
 is already required, in which case it will maintain the existing minor/patch
 version.
 
-NOTE: This tool does not add version tags in any version control systems. Its
-only external dependency is the "go list" command.
+If the target version of a dependency requires a newer version of Go than the
+module's go directive declares, the go directive (and the toolchain directive,
+if there is one) is raised to match. If the installed go command is too old,
+the go command will switch to a newer toolchain to build the module, which is
+reported. If GOTOOLCHAIN prevents switching toolchains (e.g. GOTOOLCHAIN=local),
+the versions that require a newer version of Go than the installed one are
+skipped instead (with a warning), in favor of the highest one it can build.
+
+The [-compat] flag also skips the versions of dependencies that require a newer
+version of Go than the module's go directive declares, so that dependencies are
+upgraded to the highest major version (and the highest minor or patch version
+within it) that supports the version of Go the module targets, rather than to
+the highest one, and the go directive is left as it is.
+
+All of the upgrades of a run (e.g. with "all") are applied in a single pass:
+the module's packages are loaded once, and each file is rewritten for every
+upgrade at once and written at most once, so upgrading many dependencies takes
+about as long as upgrading one.
+
+At the end of a run, a summary of the upgrades is printed, along with the
+number of packages scanned, files modified and imports rewritten, the changes
+made to the go.mod file (requirements added, removed, upgraded or updated,
+replacements touched, and go and toolchain directives bumped), and the time
+taken by each phase of the run.
+
+If a file imports both the old and the new major version of an upgraded module
+(e.g. midway through a migration), the two imports are merged, and references
+to the name of the one that's removed are renamed to match the other. The
+imports of rewritten files are sorted and grouped (standard library packages
+first) the way goimports does it. When the package at an import's new path is
+named differently (e.g. a fork, or a new major version whose package is named
+barv2), the import is given the package's old name, so that references to it
+keep compiling (e.g. 'bar "example.com/bar/v2"').
+
+Files excluded from the build by their build constraints (e.g. scripts and
+code generators guarded by '//go:build ignore', or files for other platforms) are
+rewritten too, except within testdata directories. Since they aren't type
+checked, the modules of their imports are inferred from the import paths.
+That includes tools.go files (guarded by '//go:build tools'), whose blank
+imports pin the versions of the tools a module uses. Tools tracked with tool
+directives in the go.mod file (e.g. 'tool example.com/lib/cmd/gen') are
+rewritten along with the requirements of their modules.
+
+Packages that fail to load, and files that fail to be rewritten (e.g. because a
+fixer fails) or written, don't stop the upgrade: the files of packages that
+failed to load are rewritten based on their syntax alone, like the files
+excluded from the build, the rest of the files are upgraded, and the failures
+are reported together at the end of the run, grouped by what failed, with a
+non-zero exit status.
+
+When the module is part of a workspace (see 'go help work'), the other modules
+of the workspace that still require the old major version of an upgraded
+dependency are reported once the upgrade is done, since the workspace would
+resolve both major versions. If stdin is a terminal, the tool offers to
+upgrade each of them too, running again in its directory with the same flags.
+
+Packages are loaded, and versions resolved, in workspace mode if the go command
+would use it (i.e. according to GOWORK, or to the go.work file found in a
+parent directory). The [-workspace file] flag selects the go.work file to use
+instead, or disables workspace mode with '-workspace off', the same way GOWORK
+does for the go command. The go.mod file (and the vendor directory, if any) is
+always updated in module mode, since it's the module's own.
+
+Files within vendor directories or hidden directories, and files matched by a
+.gitignore file, are never modified. The imports of upgraded modules that are
+left alone (in those files, in files that fail to parse, and in testdata
+directories), as well as module paths in string literals, are reported at the
+end of the run, with their locations and the reason each was left alone.
+
+Files keep their line endings (e.g. CRLF) and byte order marks, including the
+go.mod file. On Windows, paths are compared case-insensitively, file paths are
+reported with forward slashes, and replacing a file is retried for a moment if
+it's locked (e.g. by antivirus software scanning it).
+Files whose contents don't actually change (including the go.mod file) aren't
+written at all, so that rerunning an upgrade is a no-op that leaves their
+modification times (which build caches go by) alone.
+
+Symlinked files are written through: a file symlinked within the module is
+rewritten (once, no matter how many symlinks point to it) at the path it
+resolves to, and the symlinks are left in place. Files symlinked from outside of
+the module are not modified, and a warning is printed if they import an
+upgraded module.
+
+Versions are resolved the same way the go command resolves them: the GOPROXY
+setting (including its fallback lists) is honored, and modules matching
+GONOPROXY/GOPRIVATE are fetched directly. When GOPROXY lists several proxies
+(e.g. 'https://corp.example,https://proxy.golang.org,direct'), each one is
+tried in turn, like the go command does: with [-v], the proxy that answered is
+printed, and when a lookup fails, the error says how each proxy tried before
+failed too. If the module's dependencies are vendored (it has a vendor
+directory, or GOFLAGS contains -mod=vendor), the vendor directory is updated
+with 'go mod vendor' after the go.mod file is.
+
+To run the tool hermetically (e.g. in tests of tooling built around it), point
+GOPROXY at a directory laid out like a module proxy (e.g.
+GOPROXY=file:///path/to/proxy, with example.com/lib/v2/@v/list,
+v2.0.0.info, v2.0.0.mod and v2.0.0.zip files), and set GOSUMDB=off: no
+network access is needed then.
 
-By default, the tool assumes the module being updated is rooted in the current
-directory. The [-d dir] flag can be provided to override that behavior.
+NOTE: This tool does not add version tags in any version control systems. Its
+external dependencies are the go command (to load packages, query the module
+graph and download modules) and the module proxies in GOPROXY, which versions
+are looked up from over HTTP (modules that GOPROXY says to fetch "direct" are
+looked up with the go command instead). The others are only used with the
+flags that need them: [-notes] calls the GitHub releases API (as GITHUB_TOKEN,
+if set), [-webhook url] and [-slack url] post to the given URLs, [-batch] runs
+git (and [-pr] runs gh too), and [-fixer cmd], [-pre-hook cmd] and
+[-post-hook cmd] run their commands with sh.
+
+By default, the tool upgrades the module containing the current directory,
+whose root is found by looking for a go.mod file in the current directory and
+its parents (like the go command does). The [-d dir] flag can be provided to
+start looking from another directory instead, or to point at a go.mod file
+directly. Packages are always loaded from the module root.
+
+The [-fixer cmd] flag runs an external migration "fixer" on each file that
+imports an upgraded module, after its imports have been rewritten. The command
+is run through the shell, once for each upgraded module the file imports, and
+is given the file's contents on stdin. It must print the fixed contents to
+stdout (or nothing, if it has nothing to change). The upgrade is described by
+the OLD_PATH, NEW_PATH, OLD_VERSION and NEW_VERSION environment variables, and
+the path of the file by FILE. The flag can be given more than once, in which
+case the fixers are run in order (after any -rules).
+
+The [-format f] flag sets the format of warnings and of the summary. With
+'-format=gha', they're printed as GitHub Actions workflow commands (e.g.
+'::warning file=go.mod,line=5::...' and '::notice title=Summary::...'), so that
+they show up as annotations on pull requests. Warnings include upgraded modules
+that are deprecated, modules required at more than one major version, and
+skipped (e.g. git-ignored, generated) files that import an upgraded module.
+When the old major version of an upgraded dependency is still required after
+the upgrade (because another dependency needs it), the warning explains why,
+with the chain of imports found by 'go mod why -m' (or, if no package imports
+it, the modules that require it).
+
+With '-format=csv', the tables printed by the "report" and "enforce" targets are
+printed as CSV instead (with a header line), e.g. for spreadsheets of dependency
+audits. It can't be used with other targets.
+
+With '-format=sarif', the "report" and "enforce" targets print a SARIF log
+instead, for code scanning platforms (e.g. uploaded with GitHub's
+codeql-action/upload-sarif), with a result for each dependency that's behind
+its latest major version (a warning with "report", an error with "enforce") or
+that couldn't be checked, pointing at its require line in the go.mod file.
+
+By default, indirect dependencies (marked "// indirect" in the go.mod file) are
+not upgraded: "all" skips them, and a warning is printed if one is given as the
+[module] argument. The [-indirect] flag allows upgrading them. The new version
+remains an indirect requirement, unless the module's code imports it.
+
+Once the files are written, the "// indirect" markers of the old and new
+requirements of the upgraded dependencies are brought in line with what the
+module's packages import, like 'go mod tidy' would (e.g. the old major version
+kept with [-keep-old] is marked indirect once nothing imports it), and the
+markers that changed are listed in the summary of the go.mod changes.
+
+The [-j n] flag sets the maximum number of files rewritten concurrently. It
+defaults to the number of available CPUs.
+
+The [-chunk n] flag bounds the memory used to rewrite very large modules: their
+packages are loaded (with their syntax trees and type information) and
+rewritten n at a time, and the syntax trees of modified files are released
+once they've been formatted into a temporary directory, before the next chunk
+is loaded. Files are still only written once every chunk has been rewritten.
+Since the dependencies shared by several chunks are loaded again for each of
+them, the run takes longer. By default, all packages are loaded at once.
+
+The [-license] flag compares the license of each upgraded dependency between
+its current and target versions, and prints a warning if it changed (for
+example, from BSD-3-Clause to BUSL-1.1). The check is off by default, since it
+downloads both versions of the dependency to the module cache.
+
+The [-max vN] flag sets the highest major version that dependencies are
+upgraded to when no target [version] is given (including by "all"), for
+example to stay one major version behind the latest one.
+
+The [-min-age d] flag prevents upgrading to versions published less than the
+given duration ago (e.g. 14d), according to the time reported by the module
+proxy, as a guard against upgrading to a release that may soon be retracted.
+When no target version (or only a major version) is given, the highest version
+that's old enough is selected instead, including by "serve" and "report".
+
+The [-policy file] flag reads a JSON policy file listing modules that must
+never be upgraded automatically, or only up to a given major version, e.g.:
+
+    {
+      "modules": [
+        {"path": "example.com/legacy", "deny": true, "reason": "v3 breaks the wire format"},
+        {"path": "github.com/aws/*", "max": "v2"}
+      ]
+    }
+
+Paths are matched against module path prefixes, with the same glob patterns as
+GOPRIVATE, and the first matching entry applies. Denied modules are skipped by
+the "all" target (and so by [-batch]), and marked as denied by "serve" and
+"report", which don't notify about their upgrades. A module given explicitly is
+still upgraded, with a warning. The maximum major version of a module applies
+wherever its highest version is looked up, like [-max vN].
+
+The ignore rules of the module's Renovate (renovate.json, .renovaterc, ...) and
+Dependabot (.github/dependabot.yml) configurations, in the module directory or
+at the root of its git repository, apply like a -policy file's entries (after
+them), so that teams don't have to maintain a parallel policy: dependencies
+that Renovate ignores (ignoreDeps, or disabled packageRules for all or major
+updates) or that Dependabot ignores (for all or major updates) are denied, and
+upper bounds on versions (e.g. Renovate's allowedVersions "<3.0.0", or
+Dependabot's ">= 3" ignored versions) limit their major version. With
+Dependabot allow entries, other dependencies are denied. The
+[-bot-rules=false] flag disables this.
+
+A .upgrade.yaml file in the module directory holds the default values of
+flags (named after them, with lists for the flags that can be repeated), so
+that the module's upgrade settings can be checked in. Flags given on the
+command line take precedence. Its "private" setting lists the patterns of
+modules that aren't available from the module proxy, and sets GOPRIVATE
+(unless it's already set). The special "init" target writes a starter
+configuration file, with [-exclude-file] patterns for the module's testdata
+directories and generated files, its package directories (as commented-out
+[-only] patterns), and the organizations (or hosts) of the required modules
+that the module proxy doesn't have.
+
+The [-notes] flag prints the release notes of every version between the current
+and target version of each upgraded dependency. Notes are taken from the
+changelog file included in the target version of the module (if any) and, for
+modules hosted on GitHub, from its GitHub releases (set GITHUB_TOKEN to avoid
+GitHub's rate limit for anonymous requests).
+
+The [-dry-mod] flag quickly answers "what version would it pick?", even in
+huge modules: it only prints the changes that would be made to the go.mod file
+(requirements, replacements, exclusions and the go directive), as a diff
+followed by a summary of the changes (e.g. "Upgraded requirement
+example.com/lib v1.2.0 -> example.com/lib/v2 v2.0.0"), without loading any
+packages or modifying anything.
+
+The [-o file] flag writes all of the changes (to the go.mod and go.sum files,
+and to any .go files) to the given file as a unified diff, which can be applied
+with 'git apply', instead of modifying the module. A file name of '-' writes
+the patch to stdout. The upgrade is carried out in a temporary copy of the
+module directory, so the module itself is left untouched.
+
+The [-pre-hook cmd] and [-post-hook cmd] flags run a shell command in the
+module directory before and after each upgrade is applied (i.e. before any
+files are modified, and after the go.mod file and imports have been updated),
+for example to regenerate mocks or protobuf code. The upgrade is described by
+the OLD_PATH, NEW_PATH, OLD_VERSION and NEW_VERSION environment variables (the
+versions are empty when upgrading the current module). If a hook fails, the
+tool exits with an error.
+
+The [-print path] flag prints the rewritten contents of the given .go file (or
+of each .go file in the given package directory) to stdout, instead of
+modifying the module, like gofmt does without -w. Nothing else is printed to
+stdout, so the output can be piped to other tools (e.g. an editor).
+
+The [-probe-timeout d] flag bounds the lookup of each candidate major version of
+a dependency (default '30s', or '0' for no limit), so that a request to a
+module proxy that hangs doesn't stall the search for the others. Unlike a major
+version that wasn't released, a lookup that times out is warned about, and the
+highest major version found otherwise is used (or, if a higher one was
+released, the timeout doesn't matter). Major versions looked up directly from
+version control aren't bounded by it.
+
+The [-retries n] flag sets the number of times a version lookup is retried
+after a transient (e.g. network or proxy) failure. Retries back off
+exponentially.
+
+The [-rate n] and [-max-requests n] flags limit the number of requests made to
+module proxies per second, and the number made concurrently, so that probing
+many modules (e.g. with "all", "report" or "serve") doesn't trip the rate
+limits of proxy.golang.org or a corporate proxy. Requests are spaced evenly
+(e.g. one every 200ms with '-rate 5'). Runs started by this one (with [-batch]
+or [-f pattern]) each get their own limits.
+
+Version metadata (the responses of module proxies, and the versions 'go list
+-m' resolves queries to for private modules) is cached in the user's cache
+directory for [-cache-ttl d] (default '15m', or '0' to disable the cache), so
+that repeated runs (e.g. "report" in CI, followed by the upgrade itself, or
+[-f pattern] across modules with the same dependencies) don't fetch it again.
+Versions that don't exist are cached too. The [-no-cache] flag ignores cached
+metadata, and refreshes it.
+
+The [-rules file] flag applies rewrite rules to each file that imports an
+upgraded module, to adapt it to breaking API changes. Rules use the same syntax
+as 'gofmt -r', one per line (blank lines and lines starting with '#' or '//'
+are ignored), and single-character lowercase identifiers are wildcards. For
+example:
+
+	foo.NewClient(x) -> foo.NewClient(ctx, x)
+
+Package qualifiers must match the name under which the package is imported.
+
+The [-text-file rule] flag also rewrites the references to upgraded modules in
+the non-Go files matching the rule's glob pattern (e.g. 'Dockerfile', 'Makefile'
+or '*.md'; patterns without a slash match file names in any directory), such as
+'go install example.com/lib/cmd/tool@v1.2.0' in a build script, which would
+otherwise break silently. Versions following a reference are replaced too. A
+pattern can be followed by '=' and a regular expression, in which case only the
+references within its matches are rewritten (e.g. '*.proto=option go_package
+= .*'). The rewritten files are included in the diff of [-o file] and in the
+[-html file] report. The flag can be repeated (or set in the configuration
+file, as a list).
+
+The [-sbom file] flag writes a CycloneDX SBOM fragment to the given file,
+describing each upgraded dependency at its old and new versions, along with any
+other requirements that were added, removed or changed as a result of the
+upgrade.
+
+The [-html file] flag writes a standalone HTML report of the run to the given
+file, e.g. to attach to a change management ticket: a table of the upgrades, the
+summary, the warnings printed, and a diff of every changed file (including the
+changes made by fixers and hooks). With [-o file], the diffs are those of the
+patch.
+
+The [-symbols] flag checks every use of an upgraded dependency's exported
+functions, types, variables, constants and methods against the target version
+of the dependency, and prints a warning (with the location of the use) for each
+symbol that no longer exists, since it was removed or renamed, or whose
+signature (or declared type) changed, and likely won't compile after the
+upgrade. A table of the compatibility of every symbol used (ok, missing,
+changed, or unknown if the new version couldn't be read) is printed too. The
+check is off by default, since it downloads both versions of the dependency to
+the module cache.
+
+The [-audit file] flag appends a record of every change the run makes to the
+given file, as JSON lines: each file written (including the go.mod and go.sum
+files), with the SHA-256 hashes of its contents before and after, and each go,
+git, gh or hook command run that can change things, with timestamps. Runs
+started by this one (with [-batch] or [-f pattern]) append to the same file.
+Nothing is recorded with [-o file], since the module isn't modified.
+
+Runs that modify the module hold a lock on it (a file in the user's cache
+directory), so that two runs (e.g. a person's and a nightly job's) can't
+rewrite the same files at the same time: the second one fails, saying which
+process holds the lock. The lock of a run that exited without releasing it is
+taken over.
+
+Runs keep a journal of their progress (in the user's cache directory), so
+that a long run that's interrupted (e.g. by a CI timeout or Ctrl-C) can be
+continued with the 'resume' target rather than started over: it runs the
+interrupted command again, reusing the upgrades it found instead of probing for
+new versions, and skipping the modules ([-f pattern]) or branches ([-batch])
+that were already done. The journal is removed once the run succeeds.
+
+The special "doctor" target checks the environment the tool depends on, and
+prints what to do about each problem it finds: that the go command is
+installed, recent enough, and able to build the module (given its go and
+toolchain directives, and GOTOOLCHAIN), that each module proxy of GOPROXY can
+be reached, that the module cache (GOMODCACHE) and the tool's own cache can be
+written to, that git is installed (which fetching modules directly from
+version control needs), and that the requirements the module proxy doesn't have
+are covered by GOPRIVATE. It exits with a non-zero status if any check fails.
+
+The [-timeout d] flag limits the duration of the run (e.g. '5m'). When the
+timeout expires, or the tool is interrupted (SIGINT/SIGTERM), any running 'go'
+commands are cancelled and no further files are written. Files are replaced
+atomically, so none are left half-written.
 
 The [-v] flag turns on verbose output.
 
+The [-verify] flag verifies the new version of each upgraded dependency against
+the checksum database (GOSUMDB) before any files are modified, and the tool
+exits with an error if verification fails. Modules excluded from verification
+by GOSUMDB=off or GONOSUMDB/GOPRIVATE are reported as unverified. The result
+for each module is included in the summary. The check is off by default, since
+it downloads the new versions to the module cache.
+
+The [-vet] flag runs 'go vet' on the packages containing the rewritten files,
+before and after the upgrade, and warns about the findings that are new after
+it (e.g. a printf verb that no longer matches the type of a dependency's
+constant), which a build doesn't catch. The new findings are included in the
+summary, and with [-pr], in the default pull request description.
+
+The [-webhook url] flag POSTs a JSON description of the applied upgrades to the
+given URL: {"event": "applied", "module": ..., "dir": ..., "repo": ...,
+"upgrades": [{"oldPath": ..., "oldVersion": ..., "newPath": ..., "newVersion":
+...}]}, where "repo" is the root of the git repository containing the module.
+The [-slack url] flag posts a message listing them to the given Slack incoming
+webhook URL. Nothing is sent when the module isn't modified (with [-o file] or
+[-print path]). With "serve", the same notifications (with the "detected"
+event) are sent when a new major version of a dependency is found, after the
+first check. Failing to send a notification only results in a warning.
+
 Options:
 `
 
 var (
-	dir     = flag.String("d", ".", "Module directory path")
-	verbose = flag.Bool("v", false, "verbose output")
+	allowReplace = flag.Bool("allow-replaced", false, "upgrade dependencies replaced by local directories without asking for confirmation")
+	auditFile    = flag.String("audit", "", "append a JSON lines log of every change made (files written and commands run) to `file`")
+	batch        = flag.Bool("batch", false, "with all, apply each upgrade on its own git branch and commit it")
+	botRules     = flag.Bool("bot-rules", true, "apply the ignore rules of the module's Renovate and Dependabot configurations, like -policy")
+	cacheTTL     = flag.Duration("cache-ttl", 15*time.Minute, "how long version metadata fetched from module proxies is cached for (0 to disable the cache)")
+	chunkSize    = flag.Int("chunk", 0, "load and rewrite packages `n` at a time, to bound memory use in very large modules (0 for all at once)")
+	commitFile   = flag.String("commit-template", "", "with -batch, Go template `file` of the commit message of each upgrade")
+	compat       = flag.Bool("compat", false, "only upgrade dependencies to versions whose go directive isn't newer than the module's")
+	consolidate  = flag.Bool("consolidate", false, "upgrade dependencies required at several major versions to the newest one required")
+	dir          = flag.String("d", ".", "Module directory path")
+	dryMod       = flag.Bool("dry-mod", false, "only print the changes to the go.mod file, without loading packages or modifying anything")
+	modFiles     = flag.String("f", "", "apply the upgrade to each module whose go.mod file matches the glob `pattern` (e.g. 'services/*/go.mod')")
+	outputFormat = flag.String("format", formatText, "output `format`: text, gha for GitHub Actions annotations, or csv or sarif (with report and enforce)")
+	htmlFile     = flag.String("html", "", "write an HTML report of the run, with a diff of every changed file, to `file`")
+	interactive  = flag.Bool("i", false, "pick the version to upgrade a dependency to among the versions of its new major version, instead of the highest one")
+	indirect     = flag.Bool("indirect", false, "allow upgrading indirect dependencies")
+	jobs         = flag.Int("j", runtime.GOMAXPROCS(0), "max number of files to rewrite concurrently")
+	keepOld      = flag.Bool("keep-old", false, "keep requiring the old major version of upgraded dependencies, for gradual migrations (see finish)")
+	license      = flag.Bool("license", false, "warn if an upgraded dependency's license changed")
+	mapFile      = flag.String("map", "", "rewrite imports according to the `file` of 'old/prefix -> new/prefix' path mappings, renaming the modules they match")
+	maxMajor     = flag.String("max", "", "highest major `version` to upgrade dependencies to (e.g. v4)")
+	maxRequests  = flag.Int("max-requests", 0, "maximum `number` of concurrent requests to module proxies (0 for no limit)")
+	noCache      = flag.Bool("no-cache", false, "ignore cached version metadata, fetching it again")
+	notes        = flag.Bool("notes", false, "print release notes between the current and target versions")
+	patchFile    = flag.String("o", "", "write the changes to a patch `file` instead of modifying the module (- for stdout)")
+	policyFile   = flag.String("policy", "", "JSON `file` of modules that mustn't be upgraded automatically, or only up to a major version")
+	postHook     = flag.String("post-hook", "", "shell `command` to run after each upgrade is applied")
+	pullRequests = flag.Bool("pr", false, "with -batch, push each branch and open a pull request for it with gh")
+	prFile       = flag.String("pr-template", "", "with -pr, Go template `file` of the pull request description of each upgrade")
+	preHook      = flag.String("pre-hook", "", "shell `command` to run before each upgrade is applied")
+	printPath    = flag.String("print", "", "print the rewritten contents of the file or package directory at `path`, instead of modifying the module")
+	probeTimeout = flag.Duration("probe-timeout", 30*time.Second, "maximum `duration` of the lookup of each candidate major version of a dependency (0 for no limit)")
+	recursive    = flag.Bool("r", false, "apply the upgrade to every module within the module directory, in dependency order")
+	rate         = flag.Float64("rate", 0, "maximum `number` of requests to module proxies per second (0 for no limit)")
+	replaceLocal = flag.Bool("replace-local", false, "move replacements of upgraded dependencies by local directories to the new major version")
+	retries      = flag.Int("retries", 3, "number of times to retry failed version lookups")
+	rulesFile    = flag.String("rules", "", "apply the gofmt -r style rewrite rules in `file` to files importing an upgraded module")
+	sbom         = flag.String("sbom", "", "write a CycloneDX SBOM of the changed requirements to `file`")
+	slack        = flag.String("slack", "", "post applied (or, with serve, detected) upgrades to the Slack incoming webhook `url`")
+	subdir       = flag.Bool("subdir", false, "when upgrading the module itself, copy it to the subdirectory of its new major version (e.g. v2/) and upgrade the copy")
+	symbols      = flag.Bool("symbols", false, "warn about uses of symbols that are missing from an upgraded dependency's new version")
+	timeout      = flag.Duration("timeout", 0, "maximum duration of the run (0 for no limit)")
+	updateDeps   = flag.Bool("u", false, "also update the requirements of the upgraded dependencies to their latest minor or patch versions, like 'go get -u'")
+	verbose      = flag.Bool("v", false, "verbose output")
+	verify       = flag.Bool("verify", false, "verify the new versions of dependencies against the checksum database")
+	vet          = flag.Bool("vet", false, "run go vet on the rewritten packages, and warn about findings that are new after the upgrade")
+	webhook      = flag.String("webhook", "", "POST applied (or, with serve, detected) upgrades as JSON to `url`")
+	workspace    = flag.String("workspace", "", "go.work `file` to load packages and resolve versions with, or off to disable workspace mode (defaults to GOWORK)")
 )
 
+// The -exclude-file, -fixer, -include-file, -only and -text-file flags can be
+// given more than once
+var (
+	excludeFiles  regexpsFlag
+	fixerCommands stringsFlag
+	includeFiles  regexpsFlag
+	minAge        ageFlag
+	onlyPatterns  stringsFlag
+	textRules     textRulesFlag
+)
+
+// exitUpToDate is the exit status of a run whose dependency already requires
+// the version it would be upgraded to, so that scripts can tell it apart from
+// an upgrade (0) and a failure (1)
+const exitUpToDate = 3
+
 func main() {
+	flag.Var(&excludeFiles, "exclude-file", "never rewrite imports in the files whose path matches the `regexp` (can be repeated; implies -keep-old)")
+	flag.Var(&fixerCommands, "fixer", "shell `command` that fixes each file importing an upgraded module (can be repeated)")
+	flag.Var(&includeFiles, "include-file", "only rewrite imports in the files whose path matches the `regexp` (can be repeated; implies -keep-old)")
+	flag.Var(&minAge, "min-age", "never upgrade to versions published less than `duration` ago (e.g. 14d)")
+	flag.Var(&onlyPatterns, "only", "only rewrite imports in the packages matching `pattern` (can be repeated; implies -keep-old)")
+	flag.Var(&textRules, "text-file", "also rewrite references to upgraded modules in the non-Go files matching the `rule` 'glob[=regexp]' (e.g. Dockerfile, or '*.md'; can be repeated)")
 	flag.Usage = func() {
-		if _, err := fmt.Fprintf(flag.CommandLine.Output(), usage, os.Args[0]); err != nil {
+		if _, err := fmt.Fprintf(flag.CommandLine.Output(), usage, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0]); err != nil {
 			log.Fatalf("Error outputting usage message: %s", err)
 		}
 		flag.PrintDefaults()
 	}
+
+	// When run by 'go vet -vettool', the tool is an analyzer instead
+	if isVetTool(os.Args[1:]) {
+		runVetTool()
+		return
+	}
 	flag.Parse()
 
+	// Flags that weren't given default to the settings of the module's
+	// configuration file, if any
+	if root, err := findModuleRoot(*dir); err == nil {
+		if err := loadConfig(root); err != nil {
+			log.Fatalf("Error loading configuration: %s", err)
+		}
+	}
+
+	if *chunkSize < 0 {
+		log.Fatalf("Invalid -chunk value %d: must be at least 0", *chunkSize)
+	}
+	if *jobs < 1 {
+		log.Fatalf("Invalid -j value %d: must be at least 1", *jobs)
+	}
+	switch *outputFormat {
+	case formatText, formatGHA:
+	case formatCSV, formatSARIF:
+		if flag.Arg(0) != "report" && flag.Arg(0) != "enforce" {
+			log.Fatalf("The -format=%s flag can only be used with the report and enforce targets", *outputFormat)
+		}
+	default:
+		log.Fatalf("Invalid -format value %q: must be %q, %q, %q or %q", *outputFormat, formatText, formatGHA, formatCSV, formatSARIF)
+	}
+	if *maxMajor != "" && (!semver.IsValid(*maxMajor) || semver.Major(*maxMajor) != *maxMajor) {
+		log.Fatalf("Invalid -max value %q: must be a major version, such as v4", *maxMajor)
+	}
+	if *probeTimeout < 0 {
+		log.Fatalf("Invalid -probe-timeout value %s: must not be negative", *probeTimeout)
+	}
+	if *retries < 0 {
+		log.Fatalf("Invalid -retries value %d: must not be negative", *retries)
+	}
+	if *rate < 0 {
+		log.Fatalf("Invalid -rate value %g: must not be negative", *rate)
+	}
+	if *maxRequests < 0 {
+		log.Fatalf("Invalid -max-requests value %d: must not be negative", *maxRequests)
+	}
+	if *cacheTTL < 0 {
+		log.Fatalf("Invalid -cache-ttl value %s: must not be negative", *cacheTTL)
+	}
+	if *policyFile != "" {
+		var err error
+		if policies, err = loadPolicy(*policyFile); err != nil {
+			log.Fatalf("Error loading policy: %s", err)
+		}
+	}
+
+	// Files outside of the selected packages (or files) still import the old
+	// major versions, so they must stay required
+	if len(onlyPatterns) > 0 || len(includeFiles) > 0 || len(excludeFiles) > 0 {
+		*keepOld = true
+	}
+	if *subdir && (*dryMod || *patchFile != "" || *printPath != "" || *batch || *modFiles != "" || *recursive) {
+		log.Fatalf("The -subdir flag can't be used with the -dry-mod, -o, -print, -batch, -f or -r flags")
+	}
+	if *subdir && newPathArg() != "" {
+		log.Fatalf("The -subdir flag can't be used with a new module path")
+	}
+	if *pullRequests && !*batch {
+		log.Fatalf("The -pr flag can only be used with -batch")
+	}
+	if (*commitFile != "" && !*batch) || (*prFile != "" && !*pullRequests) {
+		log.Fatalf("The -commit-template flag can only be used with -batch, and the -pr-template flag with -pr")
+	}
+	if *commitFile != "" {
+		var err error
+		if commitTemplate, err = loadTemplate("commit", *commitFile); err != nil {
+			log.Fatalf("Error loading commit message template: %s", err)
+		}
+	}
+	if *prFile != "" {
+		var err error
+		if prTemplate, err = loadTemplate("pr", *prFile); err != nil {
+			log.Fatalf("Error loading pull request template: %s", err)
+		}
+	}
+	if *batch && (flag.Arg(0) != "all" || *consolidate || *patchFile != "" || *printPath != "") {
+		log.Fatalf("The -batch flag can only be used with the all target, and not with the -consolidate, -o or -print flags")
+	}
+	if *interactive {
+		if target := flag.Arg(0); target == "" || target == "all" || *consolidate || *mapFile != "" || *modFiles != "" || *recursive {
+			log.Fatalf("The -i flag can only be used when upgrading a single dependency, and not with the -consolidate, -f, -map or -r flags")
+		}
+		if !stdinIsTerminal() {
+			log.Fatalf("The -i flag requires a terminal, to ask which version to upgrade to")
+		}
+	}
+	if *dryMod && (*batch || *patchFile != "" || *printPath != "" || *htmlFile != "" || *preHook != "" || *postHook != "") {
+		log.Fatalf("The -dry-mod flag can't be used with the -batch, -html, -o, -print, -pre-hook or -post-hook flags")
+	}
+	if *modFiles != "" && *recursive {
+		log.Fatalf("The -f and -r flags can't be used together")
+	}
+	if (*modFiles != "" || *recursive) && (*patchFile != "" || *printPath != "" || *htmlFile != "" || *sbom != "") {
+		log.Fatalf("The -f and -r flags can't be used with the -html, -o, -print or -sbom flags, since they'd be overwritten for each module")
+	}
+	if *htmlFile != "" && (*batch || *printPath != "") {
+		log.Fatalf("The -html flag can't be used with the -batch or -print flags")
+	}
+	if (*preHook != "" || *postHook != "") && (*patchFile != "" || *printPath != "") {
+		log.Fatalf("Hooks can't be used with the -o or -print flags, since the module isn't modified")
+	}
+	if *vet && *printPath != "" {
+		log.Fatalf("The -vet flag can't be used with the -print flag, since nothing is written")
+	}
+	if *printPath != "" {
+		if *patchFile != "" {
+			log.Fatalf("The -print and -o flags can't be used together")
+		}
+		// NOTE: Everything else that would normally be printed to stdout
+		// (progress, warnings, etc.) goes to stderr instead, so that stdout
+		// only contains the rewritten contents
+		var err error
+		if printing, err = newPrintTarget(*printPath, os.Stdout); err != nil {
+			log.Fatalf("Invalid -print path: %s", err)
+		}
+		os.Stdout = os.Stderr
+	}
+	if *workspace != "" {
+		if err := setWorkspace(*workspace); err != nil {
+			log.Fatalf("Invalid -workspace value: %s", err)
+		}
+	}
+
+	if *auditFile != "" {
+		// NOTE: The path is made absolute, so that the runs started by this
+		// one (with -batch or -f) append to the same log
+		*auditFile = absPath(*auditFile)
+		var err error
+		if auditor, err = openAuditLog(*auditFile); err != nil {
+			log.Fatalf("Error opening audit log: %s", err)
+		}
+	}
+
+	if *mapFile != "" {
+		if flag.NArg() > 0 || *consolidate {
+			log.Fatalf("The -map flag can't be used with a module, a target or the -consolidate flag")
+		}
+		var err error
+		if pathMappings, err = loadPathMappings(*mapFile); err != nil {
+			log.Fatalf("Error loading path mappings: %s", err)
+		}
+	}
+
+	if *rulesFile != "" {
+		rules, err := loadRules(*rulesFile)
+		if err != nil {
+			log.Fatalf("Error loading rewrite rules: %s", err)
+		}
+		fixers = append(fixers, &ruleFixer{filename: *rulesFile, rules: rules})
+	}
+	for _, command := range fixerCommands {
+		fixers = append(fixers, &processFixer{command: command})
+	}
+
+	// Cancel any in-progress work when interrupted or when the timeout
+	// expires. A second interrupt kills the process immediately.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	switch flag.Arg(0) {
+	case "plan":
+		plan(flag.Args()[1:])
+		return
+	case "serve":
+		serve(ctx, flag.Args()[1:])
+		return
+	case "completion":
+		if err := printCompletion(flag.Arg(1)); err != nil {
+			log.Fatalf("Error printing completion script: %s", err)
+		}
+		return
+	case "__complete":
+		printCompletionTargets(*dir)
+		return
+	case "resume":
+		resume(*dir)
+		return
+	case "doctor":
+		doctor(ctx, *dir)
+		return
+	}
+
+	// With -f (or -r), this tool is run again in each of the selected modules
+	// (or in each module within the directory, in dependency order)
+	if *modFiles != "" {
+		runModules(ctx, *modFiles, flag.Args())
+		return
+	}
+	if *recursive {
+		runRecursive(ctx, flag.Args())
+		return
+	}
+
+	root, err := findModuleRoot(*dir)
+	if err != nil {
+		log.Fatalf("Error finding module: %s", err)
+	}
+	if *verbose && root != *dir {
+		fmt.Printf("Module root: %s\n", root)
+	}
+	*dir = root
+
+	// Ignore rules already configured for Renovate or Dependabot apply after
+	// the -policy file's
+	if *botRules {
+		entries, err := loadBotPolicies(*dir)
+		if err != nil {
+			log.Fatalf("Error loading Renovate or Dependabot ignore rules: %s", err)
+		}
+		policies = append(policies, entries...)
+	}
+
+	switch flag.Arg(0) {
+	case "report":
+		report(ctx, *dir, flag.Args()[1:])
+		return
+	case "enforce":
+		enforce(ctx, *dir, flag.Args()[1:])
+		return
+	case "finish":
+		defer mustLockModule(*dir)()
+		finish(ctx, *dir, flag.Arg(1))
+		return
+	case "impact":
+		impact(ctx, *dir, flag.Arg(1))
+		return
+	case "verify":
+		verifyMigration(*dir, flag.Arg(1))
+		return
+	case "init":
+		defer mustLockModule(*dir)()
+		initConfig(ctx, *dir)
+		return
+	}
+
+	// With -subdir, the module is copied to the subdirectory of its new major
+	// version, and the copy is upgraded instead
+	if *subdir {
+		*dir = copyToMajorSubdir(*dir, flag.Arg(0), versionArg())
+	}
+
+	// Runs that modify the module hold a lock on it, to keep other runs from
+	// modifying it at the same time
+	unlock := func() {}
+	if !*dryMod && *patchFile == "" && printing == nil {
+		unlock = mustLockModule(*dir)
+	}
+	defer unlock()
+
+	if *htmlFile != "" {
+		recorder = newHTMLRecorder()
+	}
+
 	file := readModFile(*dir)
+	before := requirements(file)
+	original := readModFile(*dir) // Left unmodified, to summarize the changes made
 
 	path := flag.Arg(0)
-	version := flag.Arg(1)
+	target := newPathArg()
+	version := versionArg()
 
-	switch path {
-	case "", file.Module.Mod.Path:
-		upgradeModule(file, version)
-	case "all":
-		upgradeAllDependencies(file)
-	default:
-		upgradeDependency(file, path, version)
+	// Long runs can be resumed once interrupted, from the upgrades recorded in
+	// their journal, instead of probing for new versions again
+	var (
+		upgrades   []upgrade
+		runJournal = startJournal(*dir)
+	)
+	endPhase := stats.startPhase("resolve")
+	if resolved, modFile := runJournal.resolved(); modFile != nil {
+		fmt.Println("Resuming with the upgrades found by the interrupted run")
+		upgrades = resolved
+		var err error
+		if file, err = modfile.Parse(file.Syntax.Name, modFile, nil); err != nil {
+			log.Fatalf("Error parsing module file from journal: %s", err)
+		}
+	} else {
+		switch {
+		case *consolidate:
+			if path == "all" {
+				path = ""
+			}
+			upgrades = consolidateDependencies(file, path)
+		case *mapFile != "":
+			upgrades = mapModulePaths(ctx, file, pathMappings)
+		case path == "" || path == file.Module.Mod.Path:
+			if target != "" {
+				log.Fatalf("A new module path can only be given for a dependency (use -map to rename the module itself)")
+			}
+			upgrades = upgradeModule(ctx, file, version)
+		case path == "all":
+			upgrades = upgradeAllDependencies(ctx, file)
+		default:
+			var upToDate bool
+			if upgrades, upToDate = upgradeDependency(ctx, file, path, target, version); upToDate {
+				unlock()
+				os.Exit(exitUpToDate)
+			}
+		}
+		replaceTools(file, upgrades)
+	}
+	endPhase()
+
+	// With -dry-mod, only the changes to the go.mod file are printed, without
+	// loading any packages (or downloading the new versions, to verify them or
+	// check their licenses)
+	if *dryMod {
+		bumpGoVersion(ctx, file, upgrades)
+		printModDiff(*dir, file)
+		return
+	}
+
+	confirmLocalReplacements(file, upgrades)
+
+	_, out := formatModFile(*dir, file)
+	runJournal.recordResolved(upgrades, out)
+
+	if *batch {
+		if err := runBatch(ctx, *dir, upgrades, runJournal); err != nil {
+			log.Fatalf("Error applying upgrades on separate branches: %s", err)
+		}
+		runJournal.remove()
+		return
+	}
+
+	checkLocalReplacements(file, *dir, upgrades)
+
+	if *verify {
+		endPhase := stats.startPhase("verify")
+		if err := verifyChecksums(ctx, upgrades); err != nil {
+			log.Fatalf("Error verifying upgrades: %s", err)
+		}
+		endPhase()
+	}
+
+	if *license {
+		endPhase := stats.startPhase("license check")
+		checkLicenses(ctx, upgrades)
+		endPhase()
+	}
+
+	// When writing a patch, carry out the upgrade in a staging directory
+	// instead of the module directory, and diff the two at the end.
+	// NOTE: log.Fatalf doesn't run deferred functions, so the staging
+	// directory is only cleaned up on success.
+	if *patchFile != "" {
+		var err error
+		if stage, err = newStagingDir(*dir); err != nil {
+			log.Fatalf("Error staging changes: %s", err)
+		}
+		defer stage.remove()
+	}
+	// The go command may change go.sum, without going through writeFileAtomic
+	recorder.recordOriginal(outputPath(filepath.Join(*dir, "go.mod")))
+	recorder.recordOriginal(outputPath(filepath.Join(*dir, "go.sum")))
+
+	// Make sure the module's go version is high enough for the upgraded
+	// dependencies
+	bumpGoVersion(ctx, file, upgrades)
+
+	if *preHook != "" {
+		if err := runHook(ctx, "pre-hook", *preHook, *dir, upgrades); err != nil {
+			log.Fatalf("Error running pre-upgrade hook: %s", err)
+		}
+	}
+
+	// Rewrite import paths in files
+	modified, err := rewriteImports(ctx, *dir, file, upgrades)
+	// NOTE: Like the staging directory, the temporary directory of -chunk is
+	// only cleaned up on success
+	defer os.RemoveAll(chunkDir)
+	if err != nil {
+		log.Fatalf("Error rewriting imports: %s", err)
+	}
+
+	// In pipe mode, nothing is modified
+	if printing != nil {
+		if err := printing.print(modified); err != nil {
+			log.Fatalf("Error printing rewritten files: %s", err)
+		}
+		runJournal.remove()
+		reportLeftBehind()
+		if failures.report() {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// With -vet, the rewritten packages are vetted before the upgrade too, so
+	// that only the findings it introduces are reported
+	var (
+		vetPatterns []string
+		vetBefore   []vetFinding
+	)
+	if *vet && len(modified) > 0 {
+		endPhase := stats.startPhase("vet")
+		if vetPatterns, err = vetPackageDirs(*dir, modified); err != nil {
+			log.Fatalf("Error finding packages to vet: %s", err)
+		}
+		if vetBefore, err = vetPackages(ctx, *dir, vetPatterns); err != nil {
+			warnf("error vetting packages before the upgrade: %s", err)
+			vetPatterns = nil
+		}
+		endPhase()
+	}
+
+	// Non-Go files referring to the upgraded modules (see -text-file)
+	textFiles, err := rewriteTextFiles(*dir, upgrades)
+	if err != nil {
+		log.Fatalf("Error rewriting module references in non-Go files: %s", err)
+	}
+	modified = append(modified, textFiles...)
+
+	// Write modified files at the end, to avoid issues with "go list"
+	// during the process (in case the upgrade breaks the build)
+	endPhase = stats.startPhase("write")
+	if err := writeFiles(ctx, modified); err != nil {
+		log.Fatalf("Error writing files: %s", err)
 	}
+	endPhase()
 
+	if err := ctx.Err(); err != nil {
+		log.Fatalf("Upgrade cancelled before writing go.mod file: %s", context.Cause(ctx))
+	}
+	updateIndirectMarkers(outputPath(*dir), file, upgrades)
 	writeModFile(*dir, file)
 
 	// Run 'go list' after writing the updated go.mod file, in case there are
 	// transitive dependencies that need to be updated in the go.mod file
 	// (otherwise, the user's go.mod file would change again the next time they
 	// ran go install, go get, go list, etc.)
-	if err := list(context.Background()); err != nil {
+	endPhase = stats.startPhase("finalize")
+	if *updateDeps {
+		if err := updateRequirements(ctx, outputPath(*dir), upgrades); err != nil {
+			log.Fatalf("Error updating requirements of upgraded dependencies: %s", err)
+		}
+	}
+	if err := list(ctx, outputPath(*dir)); err != nil {
 		log.Fatalf("Error finalizing transitive dependency versions: %s", err)
 	}
+	endPhase()
+
+	if len(vetPatterns) > 0 {
+		endPhase := stats.startPhase("vet")
+		vetAfter, err := vetPackages(ctx, outputPath(*dir), vetPatterns)
+		if err != nil {
+			warnf("error vetting packages after the upgrade: %s", err)
+		} else if err := reportVetFindings(*dir, newVetFindings(vetBefore, vetAfter)); err != nil {
+			log.Fatalf("Error reporting vet findings: %s", err)
+		}
+		endPhase()
+	}
+
+	if *postHook != "" {
+		if err := runHook(ctx, "post-hook", *postHook, *dir, upgrades); err != nil {
+			log.Fatalf("Error running post-upgrade hook: %s", err)
+		}
+	}
+
+	final := readModFile(*dir)
+	stats.setModChanges(modFileChanges(original, final))
+	checkDeprecations(ctx, final, upgrades)
+	checkDualMajors(final)
+	explainRemainingMajors(ctx, outputPath(*dir), final, upgrades)
+	if stage == nil {
+		reportNestedRequirements(ctx, *dir, upgrades)
+		checkWorkspace(ctx, *dir, upgrades)
+	}
+
+	if *sbom != "" {
+		after := requirements(final)
+		if err := writeSBOM(*sbom, file.Module.Mod.Path, upgrades, before, after); err != nil {
+			log.Fatalf("Error writing SBOM: %s", err)
+		}
+	}
+
+	if stage != nil {
+		if err := stage.writePatch(*patchFile); err != nil {
+			log.Fatalf("Error writing patch: %s", err)
+		}
+	}
+
+	if *notes {
+		printReleaseNotes(ctx, upgrades)
+	}
+
+	if stage == nil {
+		notify(ctx, eventApplied, file.Module.Mod.Path, *dir, upgrades)
+	}
+
+	if recorder != nil {
+		if err := recorder.writeRunReport(*htmlFile, file.Module.Mod.Path, upgrades); err != nil {
+			log.Fatalf("Error writing HTML report: %s", err)
+		}
+	}
+
+	runJournal.remove()
+	stats.printSummary(upgrades)
+	reportLeftBehind()
+	if failures.report() {
+		os.Exit(1)
+	}
+}
+
+// findModuleRoot returns the root directory of the module containing the given
+// directory, like the go command does: the closest directory, going up from
+// the given one, that contains a go.mod file. A path to a go.mod file itself
+// is also accepted.
+func findModuleRoot(dir string) (string, error) {
+	if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+		if filepath.Base(dir) != "go.mod" {
+			return "", fmt.Errorf("%s is not a directory or go.mod file", dir)
+		}
+		return filepath.Dir(dir), nil
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for d := abs; ; d = filepath.Dir(d) {
+		if info, err := os.Stat(filepath.Join(d, "go.mod")); err == nil && !info.IsDir() {
+			// Keep relative paths relative, for readability
+			if d == abs {
+				return dir, nil
+			}
+			return d, nil
+		}
+		if filepath.Dir(d) == d {
+			return "", fmt.Errorf("go.mod file not found in %s or any parent directory", dir)
+		}
+	}
 }
 
 func readModFile(dir string) *modfile.File {
 	// Read and parse the go.mod file
-	filePath := path.Join(dir, "go.mod")
-	b, err := ioutil.ReadFile(filePath)
+	filePath := filepath.Join(dir, "go.mod")
+	b, err := ioutil.ReadFile(outputPath(filePath))
 	if err != nil {
 		log.Fatalf("Error reading module file %s: %s", filePath, err)
 	}
@@ -120,20 +1336,53 @@ func readModFile(dir string) *modfile.File {
 
 func writeModFile(dir string, f *modfile.File) {
 	// Format and re-write the module file
-	f.SortBlocks()
+	filePath := filepath.Join(dir, "go.mod")
+	orig, out := formatModFile(dir, f)
+	if bytes.Equal(orig, out) {
+		if *verbose {
+			fmt.Printf("Left %s as it was, since its contents didn't change\n", filePath)
+		}
+		return
+	}
+	if err := writeFileAtomic(outputPath(filePath), out); err != nil {
+		log.Fatalf("Error writing module file %s: %s", filePath, err)
+	}
+}
+
+// formatModFile returns the original and the new contents of the module file
+func formatModFile(dir string, f *modfile.File) (orig, out []byte) {
+	// NOTE: The blocks aren't sorted, so that lines edited in place stay where
+	// they are (see modedit.go)
 	f.Cleanup()
 	out, err := f.Format()
 	if err != nil {
 		log.Fatalf("Error formatting module file: %s", err)
 	}
 
-	filePath := path.Join(dir, "go.mod")
-	if err := ioutil.WriteFile(filePath, out, 0o644); err != nil {
-		log.Fatalf("Error writing module file %s: %s", filePath, err)
+	// Keep the original line endings (e.g. CRLF, on Windows)
+	orig, err = os.ReadFile(outputPath(filepath.Join(dir, "go.mod")))
+	if err == nil {
+		out = preserveEncoding(orig, out)
+	}
+	return orig, out
+}
+
+// printModDiff prints the changes made to the module file, without writing
+// it (see -dry-mod)
+func printModDiff(dir string, f *modfile.File) {
+	orig, out := formatModFile(dir, f)
+	diff := unifiedDiff("go.mod", orig, out)
+	if diff == "" {
+		fmt.Println("No changes to go.mod")
+		return
+	}
+	fmt.Print(diff)
+	for _, change := range parseModFileChanges(orig, out) {
+		fmt.Printf("\t%s\n", change)
 	}
 }
 
-func upgradeModule(file *modfile.File, version string) {
+func upgradeModule(ctx context.Context, file *modfile.File, version string) []upgrade {
 	path := file.Module.Mod.Path
 
 	if version != "" {
@@ -160,33 +1409,69 @@ func upgradeModule(file *modfile.File, version string) {
 		log.Fatalf("Error upgrading module to %s: %s", newPath, err)
 	}
 
-	// Rewrite import paths in files
-	if err := rewriteImports(*dir, []upgrade{{oldPath: path, newPath: newPath}}); err != nil {
-		log.Fatalf("Error rewriting imports: %s", err)
-	}
+	return []upgrade{{oldPath: path, newPath: newPath}}
 }
 
-func upgradeDependency(file *modfile.File, path, version string) {
+// upgradeDependency upgrades the given dependency to the given version (or to
+// the highest major version, if none is given), at the given new module path
+// (if any, see resolveMovedVersion), and reports whether it was already up to
+// date instead, i.e. whether the version it would be upgraded to is already
+// required (e.g. when the upgrade is run again)
+func upgradeDependency(ctx context.Context, file *modfile.File, path, target, version string) ([]upgrade, bool) {
 	// Validate and parse the module path
 	if err := module.CheckPath(path); err != nil {
 		log.Fatalf("Invalid module path %s: %s", path, err)
 	}
 
+	if entry := policyFor(path); entry != nil && entry.Deny {
+		warnf("%s is denied by the policy, but is upgraded since it was given explicitly", path)
+	}
+
+	// Dependencies replaced by a fork are upgraded via the fork (unless the
+	// new module path is given)
+	if replace := findForkReplacement(file, path); replace != nil && target == "" {
+		return upgradeReplacedDependency(ctx, file, replace, version), false
+	}
+	// Dependencies replaced by a local module follow its upgrades
+	if replace := findLocalReplacement(file, path); replace != nil && version == "" && target == "" {
+		if upgrades := upgradeLocalDependency(file, *dir, replace); upgrades != nil {
+			return upgrades, false
+		}
+	}
+
 	var (
 		newPath     string
 		fullVersion string
 	)
-	switch version {
-	case "":
+	switch {
+	case target != "":
+		if version != "" && !semver.IsValid(version) && !isRevision(version) {
+			log.Fatalf("Invalid upgrade version: %s", version)
+		}
+		var err error
+		newPath = target
+		if fullVersion, err = resolveMovedVersion(ctx, path, target, version); err != nil {
+			log.Fatalf("Error getting upgrade version: %s", err)
+		}
+		if *interactive && (version == "" || semver.Major(version) == version) {
+			fullVersion = chooseVersion(ctx, newPath, fullVersion)
+		}
+	case version == "":
 		// If no target major version was given, call 'go list -m'
 		// to find the highest available major version
 		var err error
-		fullVersion, err = getUpgradeVersion(path)
+		fullVersion, err = getUpgradeVersion(ctx, path)
 		if err != nil {
 			log.Fatalf("Error finding upgrade version: %s", err)
 		}
+		// NOTE: Without a newer major version, the dependency is already up
+		// to date (e.g. when the upgrade is run again)
 		if fullVersion == "" {
-			log.Fatalf("No versions available for upgrade")
+			if !slices.ContainsFunc(file.Require, func(require *modfile.Require) bool { return require.Mod.Path == path }) {
+				log.Fatalf("Module not a known dependency: %s", path)
+			}
+			fmt.Printf("%s is already at its highest major version\n", path)
+			return nil, true
 		}
 
 		// Figure out what the post-upgrade module path should be
@@ -194,34 +1479,46 @@ func upgradeDependency(file *modfile.File, path, version string) {
 		if err != nil {
 			log.Fatalf("Error upgrading module path %s to %s: %s", path, fullVersion, err)
 		}
+		if *interactive {
+			fullVersion = chooseVersion(ctx, newPath, fullVersion)
+		}
 	default:
 		// If a target version was given, make sure it's valid, then call
 		// 'go list -m' to get the full version and path (which depends on
 		// whether the version is incompatible or not)
-		if !semver.IsValid(version) {
+		if !semver.IsValid(version) && !isRevision(version) {
 			log.Fatalf("Invalid upgrade version: %s", version)
 		}
 
 		var err error
-		newPath, fullVersion, err = upgradePathToVersion(path, version)
+		newPath, fullVersion, err = upgradePathToVersion(ctx, path, version)
 		if err != nil {
 			log.Fatalf("Error getting upgrade path and version: %s", err)
 		}
+		// Only a major version (e.g. v3) leaves the choice of the version
+		if *interactive && semver.Major(version) == version {
+			fullVersion = chooseVersion(ctx, newPath, fullVersion)
+		}
 	}
 
 	// Make sure the given module is actually a dependency in the go.mod file
 	var (
 		found             = false
 		oldVersion        = ""
+		oldIndirect       = false
+		newRequired       = ""
 		alreadyExists     = false
 		removePreexisting = false
+		resolved          = fullVersion // Before it's overridden below
 	)
 	for _, require := range file.Require {
 		switch require.Mod.Path {
 		case path:
 			found = true
 			oldVersion = require.Mod.Version
+			oldIndirect = require.Indirect
 		case newPath:
+			newRequired = require.Mod.Version
 			if strings.HasPrefix(require.Mod.Version, version) {
 				// Only keep existing version if it matches
 				// the provided version (and/or is more specific)
@@ -234,41 +1531,58 @@ func upgradeDependency(file *modfile.File, path, version string) {
 		}
 	}
 
+	// NOTE: If the old major version is still required alongside the new
+	// one, dropping it is left to do
+	if (path == newPath && oldVersion == resolved) || (!found && newRequired == resolved) {
+		fmt.Printf("%s %s is already required\n", newPath, resolved)
+		return nil, true
+	}
 	if !found {
 		log.Fatalf("Module not a known dependency: %s", path)
 	}
+	if oldIndirect && !*indirect {
+		warnf("%s is an indirect dependency, so it wasn't upgraded (use -indirect to upgrade it)", path)
+		return nil, false
+	}
 
 	fmt.Printf("%s %s -> %s %s\n", path, oldVersion, newPath, fullVersion)
 
-	// Drop the old module dependency and add the new, upgraded one (unless the
+	// Replace the old module dependency with the new, upgraded one (unless the
 	// new major version of the dependency already existed as a dependency, in
 	// which case, we drop it if didn't match the provided version, or maintain
 	// it if it did)
-	if err := file.DropRequire(path); err != nil {
-		log.Fatalf("Error dropping module requirement %s: %s", path, err)
-	}
 	if removePreexisting {
 		if err := file.DropRequire(newPath); err != nil {
 			log.Fatalf("Error dropping module requirement %s: %s", newPath, err)
 		}
 	}
-	if !alreadyExists {
-		if err := file.AddRequire(newPath, fullVersion); err != nil {
+	if alreadyExists {
+		carryComments(file, path, newPath)
+		if err := file.DropRequire(path); err != nil {
+			log.Fatalf("Error dropping module requirement %s: %s", path, err)
+		}
+	} else if *keepOld {
+		if err := startMigration(file, path, newPath, fullVersion, oldIndirect); err != nil {
 			log.Fatalf("Error adding module requirement %s: %s", newPath, err)
 		}
-	}
-
-	// If new path differs from old, rewrite import paths (paths can be the
-	// same in case of minor version update)
-	if newPath != path {
-		// Rewrite import paths in files
-		if err := rewriteImports(*dir, []upgrade{{oldPath: path, newPath: newPath}}); err != nil {
-			log.Fatalf("Error rewriting imports: %s", err)
+	} else {
+		// NOTE: An indirect requirement stays indirect, unless the module's
+		// code turns out to import it (see updateIndirectMarkers)
+		if err := replaceRequire(file, path, newPath, fullVersion); err != nil {
+			log.Fatalf("Error replacing module requirement %s: %s", path, err)
 		}
 	}
+
+	return []upgrade{{
+		oldPath:    path,
+		newPath:    newPath,
+		oldVersion: oldVersion,
+		newVersion: fullVersion,
+		indirect:   oldIndirect,
+	}}, false
 }
 
-func upgradeAllDependencies(file *modfile.File) {
+func upgradeAllDependencies(ctx context.Context, file *modfile.File) []upgrade {
 	required := map[string]string{}
 	for _, require := range file.Require {
 		required[require.Mod.Path] = require.Mod.Version
@@ -277,14 +1591,30 @@ func upgradeAllDependencies(file *modfile.File) {
 	// For each requirement, check if there is a higher major version available
 	var (
 		upgrades []upgrade
+		replaced []*modfile.Replace
 		wg       = sync.WaitGroup{}
 		lock     = sync.Mutex{}
 	)
 	for _, require := range file.Require {
 
 		// Don't upgrade indirect dependencies (don't have access
-		// to the source code, so can't modify import paths)
-		if require.Indirect {
+		// to the source code, so can't modify import paths), unless
+		// explicitly asked to
+		if require.Indirect && !*indirect {
+			if *verbose {
+				fmt.Printf("%s - skipping indirect dependency\n", require.Mod.Path)
+			}
+			continue
+		}
+
+		if denied(require.Mod.Path) {
+			continue
+		}
+
+		// Dependencies replaced by a fork are upgraded via the fork, once
+		// the other dependencies are done (see below)
+		if replace := findForkReplacement(file, require.Mod.Path); replace != nil {
+			replaced = append(replaced, replace)
 			continue
 		}
 
@@ -298,7 +1628,7 @@ func upgradeAllDependencies(file *modfile.File) {
 			if *verbose {
 				fmt.Printf("Fetching %s\n", require.Mod.Path)
 			}
-			version, err := getUpgradeVersion(require.Mod.Path)
+			version, err := getUpgradeVersion(ctx, require.Mod.Path)
 			if err != nil {
 				log.Fatalf("Error getting upgrade version for module %s: %s",
 					require.Mod.Path, err,
@@ -336,74 +1666,120 @@ func upgradeAllDependencies(file *modfile.File) {
 			}
 
 			upgrades = append(upgrades, upgrade{
-				oldPath: require.Mod.Path,
-				newPath: newPath,
+				oldPath:    require.Mod.Path,
+				newPath:    newPath,
+				oldVersion: require.Mod.Version,
+				newVersion: version,
+				indirect:   require.Indirect,
 			})
 
 			fmt.Printf("%s %s -> %s %s\n", require.Mod.Path, require.Mod.Version, newPath, version)
 
-			// Drop the old module dependency and add the new, upgraded one
-			// NOTE: require.Mod becomes invalid after this operation
-			if err := file.DropRequire(require.Mod.Path); err != nil {
-				log.Fatalf("Error dropping module requirement %s: %s",
-					require.Mod.Path, err,
-				)
-			}
-
-			// Add the upgraded version if it doesn't already exist as a dependency
-			if !exists {
-				if err := file.AddRequire(newPath, version); err != nil {
+			// Replace the old module dependency with the new, upgraded one, or
+			// drop it if the upgraded version already exists as a dependency
+			oldPath := require.Mod.Path
+			switch {
+			case exists:
+				carryComments(file, oldPath, newPath)
+				if err := file.DropRequire(oldPath); err != nil {
+					log.Fatalf("Error dropping module requirement %s: %s", oldPath, err)
+				}
+			case *keepOld:
+				if err := startMigration(file, oldPath, newPath, version, require.Indirect); err != nil {
 					log.Fatalf("Error adding module requirement %s: %s", newPath, err)
 				}
 				required[newPath] = version
+			default:
+				if err := replaceRequire(file, oldPath, newPath, version); err != nil {
+					log.Fatalf("Error replacing module requirement %s: %s", oldPath, err)
+				}
+				required[newPath] = version
 			}
 		}(require)
 	}
 	wg.Wait()
 
-	if err := rewriteImports(*dir, upgrades); err != nil {
-		log.Fatalf("Error rewriting imports: %s", err)
+	for _, replace := range replaced {
+		upgrade, err := resolveForkUpgrade(ctx, file, replace, "")
+		if err != nil {
+			log.Fatalf("Error upgrading replaced dependency %s: %s", replace.Old.Path, err)
+		}
+		if upgrade == nil {
+			if *verbose {
+				fmt.Printf("%s - no versions available for upgrade\n", replace.New.Path)
+			}
+			continue
+		}
+		applyForkUpgrade(file, replace, *upgrade)
+		upgrades = append(upgrades, *upgrade)
 	}
+
+	return upgrades
 }
 
 func upgradePath(path, version string) (string, error) {
-	prefix, pathMajor, ok := module.SplitPathVersion(path)
+	_, pathMajor, ok := module.SplitPathVersion(path)
 	if !ok {
 		return "", fmt.Errorf("invalid module path: %s", path)
 	}
 
 	if version == "" {
 		// If no version was specified, upgrade to next sequential version
+		num, err := pathMajorNumber(pathMajor)
+		if err != nil {
+			return "", err
+		}
+		// NOTE: v0 and v1 share a path (except for gopkg.in modules)
 		if pathMajor == "" {
-			version = "v2"
-		} else {
-			num, err := strconv.Atoi(strings.TrimPrefix(pathMajor, "/v"))
-			if err != nil {
-				return "", fmt.Errorf("invalid major version in module path: %s", pathMajor)
-			}
-			num++
-			version = fmt.Sprintf("v%d", num)
+			num = 1
 		}
+		version = fmt.Sprintf("v%d", num+1)
 	}
 
-	major := semver.Major(version)
-	switch major {
-	case "v0", "v1":
-		return prefix, nil
-	}
-	newPath := fmt.Sprintf("%s/%s", prefix, major)
+	newPath := majorPath(path, semver.Major(version))
 	if err := module.CheckPath(newPath); err != nil {
 		return "", fmt.Errorf("invalid module path after upgrade - %s: %s", newPath, err)
 	}
 	return newPath, nil
 }
 
-// Smaller batch size seems to actually be better sometimes. I think maybe
-// because it prevents the go module proxy from trying to fetch/load too many
-// non-existent major versions? Sticking with 1 for now for simplicity.
-const batchSize = 1
+// majorPath returns the path of the given major version (e.g. v3) of the
+// module with the given path (at any major version, or without one). The
+// major version is a path element of its own (e.g. example.com/lib/v3),
+// except for v0 and v1, which have none, and for gopkg.in modules, whose paths
+// always end with it, after a period (e.g. gopkg.in/yaml.v3), followed by the
+// given path's -unstable suffix, if it has one (e.g. gopkg.in/yaml.v3-unstable).
+func majorPath(path, major string) string {
+	prefix, pathMajor, ok := module.SplitPathVersion(path)
+	if !ok {
+		// NOTE: gopkg.in paths are invalid without a major version
+		prefix, pathMajor = path, ""
+	}
+	if strings.HasPrefix(prefix, "gopkg.in/") {
+		return prefix + "." + major + strings.TrimPrefix(pathMajor, "."+module.PathMajorPrefix(pathMajor))
+	}
+	switch major {
+	case "v0", "v1":
+		return prefix
+	}
+	return prefix + "/" + major
+}
+
+// pathMajorNumber returns the number of the major version suffix of a module
+// path, as split by module.SplitPathVersion (e.g. 2, given /v2, or .v2 or
+// .v2-unstable for gopkg.in modules), or 0 if there's none
+func pathMajorNumber(pathMajor string) (int, error) {
+	if pathMajor == "" {
+		return 0, nil
+	}
+	num, err := strconv.Atoi(strings.TrimPrefix(module.PathMajorPrefix(pathMajor), "v"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid major version in module path: %s", pathMajor)
+	}
+	return num, nil
+}
 
-func getUpgradeVersion(path string) (string, error) {
+func getUpgradeVersion(ctx context.Context, path string) (string, error) {
 	// Split module path
 	prefix, pathMajor, ok := module.SplitPathVersion(path)
 	if !ok {
@@ -415,29 +1791,29 @@ func getUpgradeVersion(path string) (string, error) {
 		// If the dependency already has a major version in its import path,
 		// start our search for a higher major version there
 		var err error
-		version, err = strconv.Atoi(strings.TrimPrefix(pathMajor, "/v"))
+		version, err = pathMajorNumber(pathMajor)
 		if err != nil {
-			return "", fmt.Errorf("invalid major version '%s': %s", pathMajor, err)
+			return "", err
 		}
 		version++
 	} else {
 		// If the dependency does not have a major version in its import path,
-		// get the highest available minor update version (including
-		// incompatible major versions, which allows us to skip over them and
-		// start at the first module-aware major version)
-		minorUpdateVersion, err := getMinorUpdateVersion(path)
+		// get the highest available version (including incompatible major
+		// versions, which allows us to skip over them and start at the first
+		// module-aware major version)
+		highestVersion, err := getHighestVersion(ctx, path)
 		if err != nil {
-			return "", fmt.Errorf("error getting minor update version for %s: %s", path, err)
+			return "", fmt.Errorf("error getting highest version for %s: %s", path, err)
 		}
 
-		major := semver.Major(minorUpdateVersion)
+		major := semver.Major(highestVersion)
 		version, err = strconv.Atoi(strings.TrimPrefix(major, "v"))
 		if err != nil {
-			return "", fmt.Errorf("invalid minor update version: %s", minorUpdateVersion)
+			return "", fmt.Errorf("invalid highest version: %s", highestVersion)
 		}
 
 		// Make sure not to try upgrading path to /v1
-		// (i.e. if the highest minor update version is v0.x.x)
+		// (i.e. if the highest version is v0.x.x)
 		if version < 1 {
 			version = 1
 		}
@@ -449,36 +1825,114 @@ func getUpgradeVersion(path string) (string, error) {
 	// strange if I'm on, say, v1.0.0+incompatible and it wouldn't upgrade me
 	// to, for example, v2.0.0+incompatible. Would need to ensure it's actually
 	// a higher major than the current version.
-	var upgradeVersion string
-	for {
-		// Make batched calls to 'go list -m' for
-		// better performance (ideally, a single call).
-		var batch []string
-		for i := 0; i < batchSize; i++ {
-			modulePath := fmt.Sprintf("%s/v%d@v%d", prefix, version, version)
-			batch = append(batch, modulePath)
-			version++
-		}
+	maxVersion := -1
+	if *maxMajor != "" {
+		maxVersion, _ = strconv.Atoi(strings.TrimPrefix(*maxMajor, "v"))
+	}
+	// The policy can pin a module to a lower major version than -max
+	if pinned := policyMax(path); pinned >= 0 && (maxVersion < 0 || pinned < maxVersion) {
+		maxVersion = pinned
+	}
 
-		results, err := listModules(context.Background(), batch...)
+	// The next few major versions are listed at once, and only the highest
+	// one released (before the first one that wasn't) is queried. Only if
+	// they were all released are the major versions probed one at a time.
+	last := version + majorWindow - 1
+	if maxVersion >= 0 {
+		last = min(last, maxVersion)
+	}
+	if last >= version {
+		listed, timedOut, err := listMajors(ctx, path, version, last)
 		if err != nil {
-			return "", fmt.Errorf("error getting module info: %s", err)
+			return "", fmt.Errorf("error listing versions of %s: %s", prefix, err)
+		}
+		// NOTE: A major version whose lookup timed out is skipped over if
+		// a higher one was released (which implies it was too), and
+		// otherwise leaves the result incomplete
+		highest := version - 1
+		for major := version; major <= last; major++ {
+			if len(listed[major]) > 0 {
+				highest = major
+			} else if !timedOut[major] {
+				break
+			}
+		}
+		for major := highest + 1; major <= last && timedOut[major]; major++ {
+			warnProbeTimedOut(majorPath(path, fmt.Sprintf("v%d", major)))
+		}
+		if highest < last || last == maxVersion {
+			if *verbose && highest < last && !timedOut[highest+1] {
+				fmt.Printf("%s: not released\n", majorPath(path, fmt.Sprintf("v%d", highest+1)))
+			}
+			return queryHighestMajor(ctx, path, version, highest)
 		}
+	}
 
-		for _, result := range results {
-			if result.Error != nil {
-				if *verbose {
-					fmt.Println(result.Error.Err)
-				}
-				return upgradeVersion, nil
+	var upgradeVersion string
+	for ; ; version++ {
+		major := fmt.Sprintf("v%d", version)
+		modulePath := majorPath(path, major)
+
+		// Don't go past the highest major version allowed by -max (or the
+		// policy)
+		if maxVersion >= 0 && version > maxVersion {
+			if *verbose {
+				fmt.Printf("%s: above maximum v%d\n", modulePath, maxVersion)
+			}
+			return upgradeVersion, nil
+		}
+
+		// Stop at the first major version that hasn't been released. Any
+		// other error means we can't tell whether there's a higher version,
+		// so we have to give up rather than silently under-upgrading, unless
+		// the lookup timed out, which is warned about instead.
+		probeCtx, cancel := probeMajor(ctx)
+		result, err := queryVersion(probeCtx, modulePath, major)
+		cancel()
+		if probeTimedOut(ctx, err) {
+			warnProbeTimedOut(modulePath)
+			return upgradeVersion, nil
+		}
+		if errors.Is(err, errNotFound) {
+			if *verbose {
+				fmt.Printf("%s: not released\n", modulePath)
 			}
-			upgradeVersion = result.Version
+			return upgradeVersion, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("error getting module info for %s: %s", modulePath, err)
+		}
+		if *verbose {
+			fmt.Printf("%s: %s%s\n", modulePath, result, publishedSuffix(ctx, modulePath, result))
 		}
+		upgradeVersion = result
 	}
 }
 
-func getMinorUpdateVersion(path string) (string, error) {
-	results, err := listModules(context.Background(), path)
+// getHighestVersion returns the highest tagged version of the given module,
+// including incompatible (pre-module) major versions. Returns v0.0.0 if the
+// module has no tagged versions.
+func getHighestVersion(ctx context.Context, path string) (string, error) {
+	versions, err := listVersions(ctx, path)
+	if errors.Is(err, errDirect) {
+		return getMinorUpdateVersion(ctx, path)
+	}
+	if errors.Is(err, errNotFound) {
+		return "v0.0.0", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	highest := "v0.0.0"
+	for _, version := range versions {
+		highest = semver.Max(highest, version)
+	}
+	return highest, nil
+}
+
+func getMinorUpdateVersion(ctx context.Context, path string) (string, error) {
+	results, err := listModules(ctx, path)
 	if err != nil {
 		return "", fmt.Errorf("error getting module info: %s", err)
 	}
@@ -503,30 +1957,127 @@ func getMinorUpdateVersion(path string) (string, error) {
 	return result.Version, nil
 }
 
-func upgradePathToVersion(path, version string) (string, string, error) {
+func upgradePathToVersion(ctx context.Context, path, version string) (string, string, error) {
 	prefix, _, ok := module.SplitPathVersion(path)
 	if !ok {
 		return "", "", fmt.Errorf("invalid module path: %s", path)
 	}
+	if isRevision(version) {
+		return upgradePathToRevision(ctx, path, version)
+	}
 
 	newPath, err := upgradePath(path, version)
 	if err != nil {
 		return "", "", fmt.Errorf("error upgrading module path %s to %s: %s", path, version, err)
 	}
 
-	results, err := listModules(context.Background(),
-		fmt.Sprintf("%s@%s", newPath, version), // Module-aware
-		fmt.Sprintf("%s@%s", prefix, version),  // Incompatible
-	)
-	if err != nil {
-		return "", "", fmt.Errorf("error getting module info: %s", err)
+	// Try the module-aware path first, then the incompatible one (which
+	// gopkg.in modules don't have, since their paths always have a major
+	// version suffix)
+	candidates := []string{newPath}
+	if prefix != newPath && module.CheckPath(prefix) == nil {
+		candidates = append(candidates, prefix)
+	}
+	for _, candidate := range candidates {
+		result, err := queryVersion(ctx, candidate, version)
+		if errors.Is(err, errNotFound) {
+			continue
+		}
+		if err != nil {
+			return "", "", fmt.Errorf("error getting module info for %s: %s", candidate, err)
+		}
+		return candidate, result, nil
+	}
+
+	if minAge > 0 {
+		return "", "", fmt.Errorf("no version of %s matching %s published at least %s ago found", path, version, minAge.String())
+	}
+	return "", "", fmt.Errorf("no version of %s matching %s found", path, version)
+}
+
+// versionArg returns the version given as an argument. Like with 'go get', it
+// can be given as @version. The keywords "latest" (the highest version of the
+// highest major version, as if no version were given) and "vN.latest" (the
+// highest version of major version N, as if vN were given) spell out what's
+// otherwise implied, for scripts.
+func versionArg() string {
+	// NOTE: The version follows the new module path, if one is given
+	i := 1
+	if newPathArg() != "" {
+		i = 2
+	}
+	version := strings.TrimPrefix(flag.Arg(i), "@")
+	if version == "latest" {
+		return ""
+	}
+	if major, ok := strings.CutSuffix(version, ".latest"); ok {
+		if !semver.IsValid(major) || semver.Major(major) != major {
+			log.Fatalf("Invalid upgrade version: %s (must be latest, or a major version followed by .latest, e.g. v3.latest)", version)
+		}
+		return major
+	}
+	return version
+}
+
+var revisionRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+
+// isRevision reports whether the upgrade version is a revision (i.e. a
+// possibly abbreviated commit hash, or a branch name), rather than a semantic
+// version
+func isRevision(version string) bool {
+	return !semver.IsValid(version) && revisionRegexp.MatchString(version)
+}
+
+// upgradePathToRevision resolves a revision (a commit hash or branch name) of
+// the dependency to the module path and pseudo-version of the commit, the
+// way 'go get' does, so that the dependency can be upgraded to an unreleased
+// commit (e.g. a fix on the branch of the next major version). A revision
+// doesn't say which major version it belongs to, so each major version above
+// the current one is tried, from one above the latest released major version
+// (which may not have been tagged yet) down, then the incompatible path (if
+// the current path has no major version suffix).
+func upgradePathToRevision(ctx context.Context, path, revision string) (string, string, error) {
+	prefix, _, _ := module.SplitPathVersion(path)
+
+	current := currentMajor(path, "")
+	latest := current
+	if version, err := getUpgradeVersion(ctx, path); err != nil {
+		return "", "", fmt.Errorf("error finding upgrade version: %s", err)
+	} else if version != "" {
+		latest = max(latest, majorNumber(version))
+	}
+	highest := latest + 1
+	if *maxMajor != "" {
+		highest = min(highest, majorNumber(*maxMajor))
+	}
+
+	var candidates []string
+	for n := highest; n > current; n-- {
+		candidate, err := upgradePath(path, fmt.Sprintf("v%d", n))
+		if err != nil {
+			return "", "", fmt.Errorf("error upgrading module path %s to v%d: %s", path, n, err)
+		}
+		candidates = append(candidates, candidate)
+	}
+	// Only modules without a major version suffix can have +incompatible
+	// versions
+	if path == prefix {
+		candidates = append(candidates, prefix)
 	}
 
-	for _, result := range results {
-		if result.Error == nil {
-			return result.Path, result.Version, nil
+	for _, candidate := range candidates {
+		version, err := queryRevision(ctx, candidate, revision)
+		if errors.Is(err, errNotFound) {
+			continue
 		}
+		if err != nil {
+			return "", "", fmt.Errorf("error getting module info for %s@%s: %s", candidate, revision, err)
+		}
+		return candidate, version, nil
 	}
 
-	return "", "", fmt.Errorf("error getting version information: %s", results[0].Error.Err)
+	if minAge > 0 {
+		return "", "", fmt.Errorf("revision %s published at least %s ago not found in any major version of %s above the current one", revision, minAge.String(), path)
+	}
+	return "", "", fmt.Errorf("revision %s not found in any major version of %s above the current one", revision, path)
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/mod/module"
+)
+
+func TestMajorPath(t *testing.T) {
+	tests := []struct {
+		path, major string
+		want        string
+	}{
+		{path: "example.com/lib", major: "v3", want: "example.com/lib/v3"},
+		{path: "example.com/lib/v2", major: "v3", want: "example.com/lib/v3"},
+		{path: "example.com/lib/v2", major: "v1", want: "example.com/lib"},
+		{path: "example.com/lib/v2", major: "v0", want: "example.com/lib"},
+		{path: "gopkg.in/yaml.v2", major: "v3", want: "gopkg.in/yaml.v3"},
+		{path: "gopkg.in/yaml.v2", major: "v1", want: "gopkg.in/yaml.v1"},
+		{path: "gopkg.in/yaml", major: "v3", want: "gopkg.in/yaml.v3"},
+		{path: "gopkg.in/x.v2-unstable", major: "v3", want: "gopkg.in/x.v3-unstable"},
+		{path: "example.com/v2x", major: "v2", want: "example.com/v2x/v2"},
+		{path: "github.com/Azure/Sdk", major: "v2", want: "github.com/Azure/Sdk/v2"},
+	}
+	for _, test := range tests {
+		if got := majorPath(test.path, test.major); got != test.want {
+			t.Errorf("majorPath(%q, %q) = %q, want %q", test.path, test.major, got, test.want)
+		}
+	}
+}
+
+func TestPathMajorNumber(t *testing.T) {
+	tests := []struct {
+		pathMajor string
+		want      int
+	}{
+		{pathMajor: "", want: 0},
+		{pathMajor: "/v2", want: 2},
+		{pathMajor: "/v10", want: 10},
+		{pathMajor: ".v1", want: 1},
+		{pathMajor: ".v2-unstable", want: 2},
+	}
+	for _, test := range tests {
+		if got, err := pathMajorNumber(test.pathMajor); err != nil || got != test.want {
+			t.Errorf("pathMajorNumber(%q) = %d, %v; want %d", test.pathMajor, got, err, test.want)
+		}
+	}
+}
+
+func TestUpgradePath(t *testing.T) {
+	tests := []struct {
+		path, version string
+		want          string
+		escaped       string // The path as requested from module proxies
+	}{
+		{path: "example.com/lib", want: "example.com/lib/v2"},
+		{path: "example.com/lib/v2", want: "example.com/lib/v3"},
+		{path: "example.com/lib/v2", version: "v4.1.0", want: "example.com/lib/v4"},
+		{path: "gopkg.in/yaml.v2", want: "gopkg.in/yaml.v3"},
+		{path: "gopkg.in/yaml.v1", version: "v3.0.1", want: "gopkg.in/yaml.v3"},
+		{path: "gopkg.in/x.v2-unstable", want: "gopkg.in/x.v3-unstable"},
+		{path: "example.com/v2x", want: "example.com/v2x/v2"},
+		{path: "example.com/tools/v1x", want: "example.com/tools/v1x/v2"},
+		{path: "github.com/Azure/Sdk", want: "github.com/Azure/Sdk/v2", escaped: "github.com/!azure/!sdk/v2"},
+	}
+	for _, test := range tests {
+		got, err := upgradePath(test.path, test.version)
+		if err != nil || got != test.want {
+			t.Errorf("upgradePath(%q, %q) = %q, %v; want %q", test.path, test.version, got, err, test.want)
+			continue
+		}
+		if test.escaped == "" {
+			continue
+		}
+		if escaped, err := module.EscapePath(got); err != nil || escaped != test.escaped {
+			t.Errorf("module.EscapePath(%q) = %q, %v; want %q", got, escaped, err, test.escaped)
+		}
+	}
+}
+
+func TestGetUpgradeVersion(t *testing.T) {
+	useProxy(t, fakeProxy{
+		"gopkg.in/x.v3-unstable": {{Version: "v3.0.0"}, {Version: "v3.1.0"}},
+		"gopkg.in/yaml.v3":       {{Version: "v3.0.1"}},
+	})
+	ctx := context.Background()
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "gopkg.in/x.v2-unstable", want: "v3.1.0"},
+		{path: "gopkg.in/yaml.v2", want: "v3.0.1"},
+		{path: "gopkg.in/yaml.v3", want: ""},
+	}
+	for _, test := range tests {
+		if got, err := getUpgradeVersion(ctx, test.path); err != nil || got != test.want {
+			t.Errorf("getUpgradeVersion(%q) = %q, %v; want %q", test.path, got, err, test.want)
+		}
+	}
+}
+
+func TestIsVetTool(t *testing.T) {
+	cfg := filepath.Join(t.TempDir(), "vet.cfg")
+	if err := os.WriteFile(cfg, []byte("{}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args []string
+		want bool
+	}{
+		{args: nil, want: false},
+		{args: []string{"-V=full"}, want: true},
+		{args: []string{"-flags"}, want: true},
+		{args: []string{cfg}, want: true},
+		{args: []string{"-json", cfg}, want: true},
+		{args: []string{"missing.cfg"}, want: false},
+		{args: []string{"-dry-mod", "-text-file", "conf/*.cfg"}, want: false},
+		{args: []string{"-d", cfg}, want: false},
+		{args: []string{"-v", cfg}, want: false},
+		{args: []string{"example.com/lib"}, want: false},
+	}
+	for _, test := range tests {
+		if got := isVetTool(test.args); got != test.want {
+			t.Errorf("isVetTool(%q) = %t, want %t", test.args, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// majorWindow is the number of major versions above the current one that are
+// listed at once when looking for the highest one, before falling back to
+// probing them one at a time (which only modules with more new major versions
+// than that need)
+const majorWindow = 4
+
+// probeMajor returns the context of the lookup of a candidate major version,
+// bounded by -probe-timeout of its own, so that a request to a proxy that
+// hangs doesn't stall the search for the highest major version
+func probeMajor(ctx context.Context) (context.Context, context.CancelFunc) {
+	if *probeTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, *probeTimeout)
+}
+
+// probeTimedOut reports whether the lookup of a candidate major version failed
+// because its own timeout expired (rather than the run's, given its parent
+// context)
+func probeTimedOut(ctx context.Context, err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil
+}
+
+// warnProbeTimedOut warns that the lookup of a candidate major version timed
+// out, which, unlike a major version that wasn't released, leaves the result
+// of the search incomplete
+func warnProbeTimedOut(path string) {
+	warnf("looking up %s timed out after %s, so it's unknown whether it was released (retry, or raise -probe-timeout)", path, *probeTimeout)
+}
+
+// listMajors lists the versions of each major version of a module from first
+// to last (e.g. of example.com/lib/v2 to example.com/lib/v5, given the path of
+// any of its major versions), all at once: concurrently from the module proxy,
+// and with a single 'go list -m -versions' command for the ones fetched
+// directly. Major versions that weren't released have no versions, and the
+// ones whose lookup timed out are returned separately.
+func listMajors(ctx context.Context, modulePath string, first, last int) (map[int][]string, map[int]bool, error) {
+	var (
+		listed   = map[int][]string{}
+		timedOut = map[int]bool{}
+		direct   = map[string]int{} // Majors fetched directly, keyed by path
+		lock     sync.Mutex
+	)
+	g, gctx := errgroup.WithContext(ctx)
+	for major := first; major <= last; major++ {
+		path := majorPath(modulePath, fmt.Sprintf("v%d", major))
+		g.Go(func() error {
+			probeCtx, cancel := probeMajor(gctx)
+			defer cancel()
+			versions, err := listVersions(probeCtx, path)
+			lock.Lock()
+			defer lock.Unlock()
+			switch {
+			case errors.Is(err, errDirect):
+				direct[path] = major
+			case errors.Is(err, errNotFound):
+			case probeTimedOut(gctx, err):
+				timedOut[major] = true
+			case err != nil:
+				return err
+			default:
+				listed[major] = versions
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, nil, err
+	}
+	if len(direct) == 0 {
+		return listed, timedOut, nil
+	}
+
+	// NOTE: The majors fetched directly are listed by a single command, so
+	// it isn't bounded by -probe-timeout (only by -timeout)
+	paths := sortedKeys(direct, nil)
+	results, err := listModuleVersions(ctx, paths...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting module info: %s", err)
+	}
+	// NOTE: Like with 'go list -m' queries, any error other than a transient
+	// one is assumed to mean the major version wasn't released
+	for _, result := range results {
+		if major, ok := direct[result.Path]; ok && result.Error == nil {
+			listed[major] = result.Versions
+		}
+	}
+	return listed, timedOut, nil
+}
+
+// queryHighestMajor resolves the version to upgrade to among the major
+// versions from first to highest, which were all released: the highest
+// allowed version of the highest major version, or of the next highest one if
+// none of its versions are allowed (e.g. by -min-age) or its lookup timed
+// out, and so on
+func queryHighestMajor(ctx context.Context, path string, first, highest int) (string, error) {
+	for major := highest; major >= first; major-- {
+		modulePath := majorPath(path, fmt.Sprintf("v%d", major))
+		probeCtx, cancel := probeMajor(ctx)
+		result, err := queryVersion(probeCtx, modulePath, fmt.Sprintf("v%d", major))
+		cancel()
+		if probeTimedOut(ctx, err) {
+			warnProbeTimedOut(modulePath)
+			continue
+		}
+		if errors.Is(err, errNotFound) {
+			if *verbose {
+				fmt.Printf("%s: no version allowed\n", modulePath)
+			}
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("error getting module info for %s: %s", modulePath, err)
+		}
+		if *verbose {
+			fmt.Printf("%s: %s%s\n", modulePath, result, publishedSuffix(ctx, modulePath, result))
+		}
+		return result, nil
+	}
+	return "", nil
+}
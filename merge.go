@@ -0,0 +1,118 @@
+package main
+
+import (
+	"go/ast"
+	"go/types"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+)
+
+// importedName is an import spec, along with the name it declares
+type importedName struct {
+	spec *ast.ImportSpec
+	name string
+	obj  *types.PkgName
+}
+
+// mergeDuplicateImports merges import specs that import the same path, which
+// happens when a file imported both the old and the new major version of an
+// upgraded module before its imports were rewritten. Typically, one of them
+// has an alias, e.g.:
+//
+//	import (
+//		"example.com/dep"
+//		depv2 "example.com/dep/v2"
+//	)
+//
+// One of the specs is kept, and references to the other's name are renamed
+// to match. Whichever spec's name isn't shadowed anywhere it would be used is
+// kept (if neither is, both are left alone, and a warning is printed).
+// Returns the number of specs that were removed.
+func mergeDuplicateImports(pkg *packages.Package, fileAST *ast.File) int {
+	if pkg.TypesInfo == nil {
+		return 0
+	}
+
+	byPath := map[string][]importedName{}
+	var paths []string
+	for _, spec := range fileAST.Imports {
+		path := strings.Trim(spec.Path.Value, "\"")
+		var obj *types.PkgName
+		if spec.Name != nil {
+			obj, _ = pkg.TypesInfo.Defs[spec.Name].(*types.PkgName)
+		} else {
+			obj, _ = pkg.TypesInfo.Implicits[spec].(*types.PkgName)
+		}
+		// Blank and dot imports are left alone
+		if obj == nil {
+			continue
+		}
+		if _, ok := byPath[path]; !ok {
+			paths = append(paths, path)
+		}
+		byPath[path] = append(byPath[path], importedName{spec: spec, name: obj.Name(), obj: obj})
+	}
+
+	// References to each imported package name
+	refs := map[*types.PkgName][]*ast.Ident{}
+	ast.Inspect(fileAST, func(node ast.Node) bool {
+		if ident, ok := node.(*ast.Ident); ok {
+			if obj, ok := pkg.TypesInfo.Uses[ident].(*types.PkgName); ok {
+				refs[obj] = append(refs[obj], ident)
+			}
+		}
+		return true
+	})
+	fileScope := pkg.TypesInfo.Scopes[fileAST]
+
+	// canRename reports whether every reference to the from name can refer to
+	// the to name instead, without being shadowed
+	canRename := func(from, to importedName) bool {
+		if fileScope == nil {
+			return false
+		}
+		for _, ident := range refs[from.obj] {
+			scope := fileScope.Innermost(ident.Pos())
+			if scope == nil {
+				return false
+			}
+			if _, obj := scope.LookupParent(to.name, ident.Pos()); obj != to.obj {
+				return false
+			}
+		}
+		return true
+	}
+
+	var removed int
+	for _, path := range paths {
+		names := byPath[path]
+		for len(names) > 1 {
+			keep, drop := names[0], names[1]
+			if !canRename(drop, keep) {
+				if !canRename(keep, drop) {
+					position := pkg.Fset.Position(drop.spec.Pos())
+					warnfAt(position.Filename, position.Line, "%s is imported more than once, and the imports couldn't be merged", path)
+					break
+				}
+				keep, drop = drop, keep
+			}
+
+			for _, ident := range refs[drop.obj] {
+				ident.Name = keep.name
+			}
+			refs[keep.obj] = append(refs[keep.obj], refs[drop.obj]...)
+
+			var dropName string
+			if drop.spec.Name != nil {
+				dropName = drop.spec.Name.Name
+			}
+			if astutil.DeleteNamedImport(pkg.Fset, fileAST, dropName, path) {
+				removed++
+			}
+			names = append([]importedName{keep}, names[2:]...)
+		}
+	}
+	return removed
+}
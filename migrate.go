@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+)
+
+// With -keep-old, the old major version of an upgraded dependency stays
+// required alongside the new one, so that a large module can be migrated
+// gradually (e.g. one package at a time, with -only), over several changes.
+// The old requirement is marked with a comment, e.g.:
+//
+//	// upgrade: migrating to example.com/lib/v3 (run 'upgrade finish' once example.com/lib is no longer imported)
+//	example.com/lib v1.2.0
+//	example.com/lib/v3 v3.0.0
+//
+// The finish target drops the marked requirements that are no longer
+// imported.
+
+const migrationMarker = "// upgrade: migrating to "
+
+// startMigration adds the new requirement of an upgraded dependency, keeping
+// the old one, which is marked as being migrated from
+func startMigration(file *modfile.File, oldPath, newPath, version string, indirect bool) error {
+	for _, require := range file.Require {
+		if require.Mod.Path != oldPath {
+			continue
+		}
+		comment := fmt.Sprintf("%s%s (run 'upgrade finish' once %s is no longer imported)", migrationMarker, newPath, oldPath)
+		require.Syntax.Before = append(require.Syntax.Before, modfile.Comment{Token: comment})
+		file.AddNewRequire(newPath, version, indirect)
+		return nil
+	}
+	return fmt.Errorf("%s is not required", oldPath)
+}
+
+// migratingTo returns the module path that the given requirement is being
+// migrated to, or an empty string if it isn't
+func migratingTo(require *modfile.Require) string {
+	for _, comment := range require.Syntax.Before {
+		if rest, ok := strings.CutPrefix(comment.Token, migrationMarker); ok {
+			newPath, _, _ := strings.Cut(rest, " ")
+			return newPath
+		}
+	}
+	return ""
+}
+
+// finish completes the gradual migrations started with -keep-old (or only
+// the migration from the given module path, if any): the old requirement of
+// each one is dropped, provided the module's files no longer import it. The
+// migrations that are still in progress are reported.
+func finish(ctx context.Context, dir, path string) {
+	file := readModFile(dir)
+
+	var migrating []*modfile.Require
+	for _, require := range file.Require {
+		if migratingTo(require) != "" && (path == "" || require.Mod.Path == path) {
+			migrating = append(migrating, require)
+		}
+	}
+	if len(migrating) == 0 {
+		fmt.Println("No migrations in progress")
+		return
+	}
+
+	imports, err := moduleImports(dir, file)
+	if err != nil {
+		log.Fatalf("Error finding imports: %s", err)
+	}
+
+	finished := 0
+	for _, require := range migrating {
+		oldPath, newPath := require.Mod.Path, migratingTo(require)
+		if files := imports[oldPath]; len(files) > 0 {
+			fmt.Printf("%s -> %s: still imported by %d file(s), e.g. %s\n", oldPath, newPath, len(files), files[0])
+			continue
+		}
+		fmt.Printf("%s -> %s: finished\n", oldPath, newPath)
+		carryComments(file, oldPath, newPath)
+		if err := file.DropRequire(oldPath); err != nil {
+			log.Fatalf("Error dropping module requirement %s: %s", oldPath, err)
+		}
+		finished++
+	}
+	if finished == 0 {
+		return
+	}
+
+	writeModFile(dir, file)
+	if err := list(ctx, dir); err != nil {
+		log.Fatalf("Error finalizing transitive dependency versions: %s", err)
+	}
+}
+
+// moduleImports returns the .go files of the module (excluding nested
+// modules) that import each of the required modules, by module path
+func moduleImports(dir string, file *modfile.File) (map[string][]string, error) {
+	imports := map[string][]string{}
+	err := walkModuleGoFiles(dir, func(rel string, f *ast.File) {
+		for _, spec := range f.Imports {
+			importPath, _ := strconv.Unquote(spec.Path.Value)
+			if modulePath := owningModule(file, importPath); modulePath != "" {
+				imports[modulePath] = append(imports[modulePath], rel)
+			}
+		}
+	})
+	return imports, err
+}
+
+// walkModuleGoFiles parses the imports (and the comments before them, which
+// include build constraints) of each .go file of the module in the given
+// directory, excluding nested modules and ignored files (see newIgnorer), and
+// calls fn with its path (relative to the module directory, with forward
+// slashes) and syntax
+func walkModuleGoFiles(dir string, fn func(rel string, f *ast.File)) error {
+	ig, err := newIgnorer(dir)
+	if err != nil {
+		return err
+	}
+	nestedRoots, err := nestedModuleRoots(ig)
+	if err != nil {
+		return err
+	}
+
+	fset := token.NewFileSet()
+	return walkFiles(ig, func(path string) error {
+		if filepath.Ext(path) != ".go" {
+			return nil
+		}
+		if inNestedModule(path, nestedRoots) {
+			return nil
+		}
+
+		f, err := parser.ParseFile(fset, path, nil, parser.ImportsOnly|parser.ParseComments)
+		if err != nil {
+			return fmt.Errorf("error parsing file %s: %s", path, err)
+		}
+		rel, _ := filepath.Rel(ig.root, path)
+		fn(filepath.ToSlash(rel), f)
+		return nil
+	})
+}
+
+// owningModule returns the path of the required module that provides the
+// given package, i.e. the longest required module path that's a prefix of it
+func owningModule(file *modfile.File, importPath string) string {
+	owner := ""
+	for _, require := range file.Require {
+		p := require.Mod.Path
+		if (importPath == p || strings.HasPrefix(importPath, p+"/")) && len(p) > len(owner) {
+			owner = p
+		}
+	}
+	return owner
+}
+
+// packageMatcher returns a function reporting whether a package matches any
+// of the -only patterns (or true for every package, if there are none).
+// Patterns are import paths, or paths relative to the module directory
+// (starting with "./"), and can contain "..." wildcards, like the go
+// command's package patterns (e.g. './service/payments/...').
+func packageMatcher(modulePath string, patterns []string) func(pkgPath string) bool {
+	if len(patterns) == 0 {
+		return func(string) bool { return true }
+	}
+
+	var res []*regexp.Regexp
+	for _, pattern := range patterns {
+		pattern = filepath.ToSlash(pattern)
+		switch {
+		case pattern == ".":
+			pattern = modulePath
+		case strings.HasPrefix(pattern, "./"):
+			pattern = modulePath + "/" + strings.TrimPrefix(pattern, "./")
+		}
+		expr := regexp.QuoteMeta(pattern)
+		// As with the go command, "x/..." matches x itself as well
+		if rest, ok := strings.CutSuffix(expr, `/\.\.\.`); ok {
+			expr = rest + `(/.*)?`
+		}
+		expr = strings.ReplaceAll(expr, `\.\.\.`, `.*`)
+		res = append(res, regexp.MustCompile("^"+expr+"$"))
+	}
+
+	return func(pkgPath string) bool {
+		// External test packages belong to the package they test
+		pkgPath = strings.TrimSuffix(pkgPath, "_test")
+		for _, re := range res {
+			if re.MatchString(pkgPath) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+)
+
+// The changes made to the go.mod file are also summarized (e.g. "Updated
+// requirement example.com/lib v1.2.0 -> v1.3.0"), since they're easier to
+// review than a diff, especially in the pull requests opened with -pr.
+
+// modFileChanges describes the changes between two versions of a go.mod file:
+// the module path, go and toolchain directives, requirements, replacements
+// and tools that changed, in that order
+func modFileChanges(before, after *modfile.File) []string {
+	var changes []string
+	if before.Module != nil && after.Module != nil && before.Module.Mod.Path != after.Module.Mod.Path {
+		changes = append(changes, fmt.Sprintf("Changed module path %s -> %s", before.Module.Mod.Path, after.Module.Mod.Path))
+	}
+
+	var goBefore, goAfter string
+	if before.Go != nil {
+		goBefore = before.Go.Version
+	}
+	if after.Go != nil {
+		goAfter = after.Go.Version
+	}
+	changes = append(changes, directiveChange("go", goBefore, goAfter)...)
+
+	var toolchainBefore, toolchainAfter string
+	if before.Toolchain != nil {
+		toolchainBefore = before.Toolchain.Name
+	}
+	if after.Toolchain != nil {
+		toolchainAfter = after.Toolchain.Name
+	}
+	changes = append(changes, directiveChange("toolchain", toolchainBefore, toolchainAfter)...)
+
+	// Requirements, keyed by module path
+	requiredBefore := map[string]*modfile.Require{}
+	for _, require := range before.Require {
+		requiredBefore[require.Mod.Path] = require
+	}
+	requiredAfter := map[string]*modfile.Require{}
+	for _, require := range after.Require {
+		requiredAfter[require.Mod.Path] = require
+	}
+	// A requirement that was removed, and one of another major version of the
+	// same module that was added, are an upgrade
+	upgraded := map[string]string{} // New module paths, keyed by old path
+	upgradedTo := map[string]bool{} // New module paths
+	majors := map[string]string{}   // Module paths of the majors added, keyed by path prefix
+	for path := range requiredAfter {
+		if _, ok := requiredBefore[path]; !ok {
+			prefix, _, _ := module.SplitPathVersion(path)
+			majors[prefix] = path
+		}
+	}
+	for path := range requiredBefore {
+		if _, ok := requiredAfter[path]; !ok {
+			prefix, _, _ := module.SplitPathVersion(path)
+			if newPath, ok := majors[prefix]; ok {
+				upgraded[path] = newPath
+				upgradedTo[newPath] = true
+			}
+		}
+	}
+	for _, path := range sortedKeys(requiredBefore, requiredAfter) {
+		oldRequire, newRequire := requiredBefore[path], requiredAfter[path]
+		switch {
+		case newRequire == nil && upgraded[path] != "":
+			newRequire = requiredAfter[upgraded[path]]
+			// NOTE: The old requirement's marker is shown too, since the
+			// new major version can be direct where the old one wasn't (or
+			// the other way around)
+			changes = append(changes, fmt.Sprintf("Upgraded requirement %s%s -> %s%s",
+				formatModuleVersion(oldRequire.Mod), indirectSuffix(oldRequire.Indirect),
+				formatModuleVersion(newRequire.Mod), indirectSuffix(newRequire.Indirect),
+			))
+		case oldRequire == nil && upgradedTo[path]:
+			// Described with the requirement it replaced
+		case oldRequire == nil:
+			changes = append(changes, fmt.Sprintf("Added requirement %s%s", formatModuleVersion(newRequire.Mod), indirectSuffix(newRequire.Indirect)))
+		case newRequire == nil:
+			changes = append(changes, fmt.Sprintf("Removed requirement %s%s", formatModuleVersion(oldRequire.Mod), indirectSuffix(oldRequire.Indirect)))
+		case oldRequire.Mod.Version != newRequire.Mod.Version:
+			changes = append(changes, fmt.Sprintf("Updated requirement %s %s -> %s%s", path, oldRequire.Mod.Version, newRequire.Mod.Version, indirectSuffix(newRequire.Indirect)))
+		case newRequire.Indirect:
+			changes = append(changes, fmt.Sprintf("Marked requirement %s as indirect", path))
+		case oldRequire.Indirect:
+			changes = append(changes, fmt.Sprintf("Marked requirement %s as direct", path))
+		}
+	}
+
+	// Replacements, keyed by the module (and version) replaced
+	replacedBefore := map[string]*modfile.Replace{}
+	for _, replace := range before.Replace {
+		replacedBefore[formatModuleVersion(replace.Old)] = replace
+	}
+	replacedAfter := map[string]*modfile.Replace{}
+	for _, replace := range after.Replace {
+		replacedAfter[formatModuleVersion(replace.Old)] = replace
+	}
+	for _, replaced := range sortedKeys(replacedBefore, replacedAfter) {
+		oldReplace, newReplace := replacedBefore[replaced], replacedAfter[replaced]
+		switch {
+		case oldReplace == nil:
+			changes = append(changes, fmt.Sprintf("Added replacement %s => %s", replaced, formatModuleVersion(newReplace.New)))
+		case newReplace == nil:
+			changes = append(changes, fmt.Sprintf("Removed replacement %s => %s", replaced, formatModuleVersion(oldReplace.New)))
+		case oldReplace.New != newReplace.New:
+			changes = append(changes, fmt.Sprintf("Changed replacement %s => %s (was %s)", replaced, formatModuleVersion(newReplace.New), formatModuleVersion(oldReplace.New)))
+		}
+	}
+
+	// Tools, keyed by package path
+	toolsBefore := map[string]bool{}
+	for _, tool := range before.Tool {
+		toolsBefore[tool.Path] = true
+	}
+	toolsAfter := map[string]bool{}
+	for _, tool := range after.Tool {
+		toolsAfter[tool.Path] = true
+	}
+	for _, path := range sortedKeys(toolsBefore, toolsAfter) {
+		switch {
+		case !toolsBefore[path]:
+			changes = append(changes, fmt.Sprintf("Added tool %s", path))
+		case !toolsAfter[path]:
+			changes = append(changes, fmt.Sprintf("Removed tool %s", path))
+		}
+	}
+	return changes
+}
+
+// directiveChange describes the change of a go or toolchain directive, if any
+func directiveChange(name, before, after string) []string {
+	switch {
+	case before == after:
+		return nil
+	case before == "":
+		return []string{fmt.Sprintf("Added %s directive %s", name, after)}
+	case after == "":
+		return []string{fmt.Sprintf("Removed %s directive %s", name, before)}
+	default:
+		return []string{fmt.Sprintf("Bumped %s directive %s -> %s", name, before, after)}
+	}
+}
+
+func formatModuleVersion(m module.Version) string {
+	if m.Version == "" {
+		return m.Path
+	}
+	return m.Path + " " + m.Version
+}
+
+func indirectSuffix(indirect bool) string {
+	if indirect {
+		return " (indirect)"
+	}
+	return ""
+}
+
+// sortedKeys returns the keys of both maps, sorted
+func sortedKeys[V any](a, b map[string]V) []string {
+	var keys []string
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// parseModFileChanges describes the changes between two versions of the
+// contents of a go.mod file, or returns nil if either can't be parsed
+func parseModFileChanges(before, after []byte) []string {
+	beforeFile, err := modfile.Parse("go.mod", before, nil)
+	if err != nil {
+		return nil
+	}
+	afterFile, err := modfile.Parse("go.mod", after, nil)
+	if err != nil {
+		return nil
+	}
+	return modFileChanges(beforeFile, afterFile)
+}
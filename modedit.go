@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+)
+
+// NOTE: The modfile package's DropRequire/AddNewRequire (followed by
+// SortBlocks) moves an upgraded requirement to the end of the last require
+// block and loses any comments on its line, which makes for a noisy go.mod
+// diff. The functions below edit the existing lines in place instead, so that
+// each upgrade changes a single line.
+
+// replaceRequire changes the module path and version of the requirement of
+// oldPath in place, keeping its position and comments (including the
+// "// indirect" marker). Comments that refer to the old module path are
+// updated (see updateComments).
+func replaceRequire(file *modfile.File, oldPath, newPath, version string) error {
+	for _, require := range file.Require {
+		if require.Mod.Path != oldPath {
+			continue
+		}
+		updateComments(file, require.Syntax, oldPath, newPath, require.Mod.Version)
+		require.Mod.Path = newPath
+		require.Mod.Version = version
+		setLineTokens(require.Syntax, "require", modfile.AutoQuote(newPath), version)
+		return nil
+	}
+	return fmt.Errorf("%s is not required", oldPath)
+}
+
+// replaceReplace changes the replacement of oldPath in place, so that newPath
+// (at all versions) is replaced by the given module version (or, if the
+// version is empty, directory)
+func replaceReplace(file *modfile.File, oldPath, newPath, forkPath, forkVersion string) error {
+	for _, replace := range file.Replace {
+		if replace.Old.Path != oldPath {
+			continue
+		}
+		replace.Old.Path = newPath
+		replace.Old.Version = ""
+		replace.New.Path = forkPath
+		replace.New.Version = forkVersion
+		tokens := []string{modfile.AutoQuote(newPath), "=>", modfile.AutoQuote(forkPath)}
+		if forkVersion != "" {
+			tokens = append(tokens, forkVersion)
+		}
+		setLineTokens(replace.Syntax, "replace", tokens...)
+		return nil
+	}
+	return fmt.Errorf("%s is not replaced", oldPath)
+}
+
+// replaceTools rewrites the tool directives that name packages of the
+// upgraded modules (e.g. 'tool example.com/lib/cmd/gen') in place, like their
+// imports. Tools tracked the older way, with blank imports in a tools.go file
+// excluded from the build by a "tools" build constraint, are rewritten along
+// with the other files excluded from the build (see rewriteImports).
+func replaceTools(file *modfile.File, upgrades []upgrade) {
+	var (
+		upgradeMap  = map[string]upgrade{}
+		modulePaths []string
+	)
+	for _, upgrade := range upgrades {
+		if upgrade.oldPath != upgrade.newPath {
+			upgradeMap[upgrade.oldPath] = upgrade
+			modulePaths = append(modulePaths, upgrade.oldPath)
+		}
+	}
+	for _, require := range file.Require {
+		modulePaths = append(modulePaths, require.Mod.Path)
+	}
+	for _, tool := range file.Tool {
+		upgrade, ok := upgradeMap[matchModule(tool.Path, modulePaths)]
+		if !ok {
+			continue
+		}
+		newPath := upgrade.newPath + strings.TrimPrefix(tool.Path, upgrade.oldPath)
+		if *verbose {
+			fmt.Printf("Tool %s -> %s\n", tool.Path, newPath)
+		}
+		tool.Path = newPath
+		setLineTokens(tool.Syntax, "tool", modfile.AutoQuote(newPath))
+	}
+}
+
+// carryComments copies the comments of the requirement of oldPath, which is
+// about to be dropped because newPath is already required, to the
+// requirement of newPath, so that notes like "// pinned for #123" aren't
+// lost. The "// indirect" marker and migration markers (see migrate.go)
+// aren't copied, since they're specific to the old requirement.
+func carryComments(file *modfile.File, oldPath, newPath string) {
+	var from, to *modfile.Require
+	for _, require := range file.Require {
+		switch require.Mod.Path {
+		case oldPath:
+			from = require
+		case newPath:
+			to = require
+		}
+	}
+	if from == nil || to == nil {
+		return
+	}
+	updateComments(file, from.Syntax, oldPath, newPath, from.Mod.Version)
+
+	for _, comment := range from.Syntax.Before {
+		if !strings.HasPrefix(comment.Token, migrationMarker) {
+			to.Syntax.Before = append(to.Syntax.Before, comment)
+		}
+	}
+	for _, comment := range from.Syntax.Suffix {
+		text := strings.TrimSpace(strings.TrimPrefix(comment.Token, "//"))
+		if text == "indirect" {
+			continue
+		}
+		text, _ = strings.CutPrefix(text, "indirect; ")
+		// A line can only have one suffix comment, so they're joined like
+		// the go command joins "// indirect" with other comments
+		if n := len(to.Syntax.Suffix); n > 0 {
+			to.Syntax.Suffix[n-1].Token += "; " + text
+		} else {
+			to.Syntax.Suffix = append(to.Syntax.Suffix, modfile.Comment{Token: "// " + text})
+		}
+	}
+}
+
+// updateComments updates the comments on (and above) the requirement line of
+// an upgraded dependency that refer to its old module path, and warns about
+// the ones that refer to its old version (e.g. "// pinned to v1.2.0 because
+// of #123"), which probably need to be revised by hand
+func updateComments(file *modfile.File, line *modfile.Line, oldPath, newPath, oldVersion string) {
+	update := func(comments []modfile.Comment) {
+		for i, comment := range comments {
+			comments[i].Token = replaceWord(comment.Token, oldPath, newPath)
+			if oldVersion != "" && replaceWord(comment.Token, oldVersion, "") != comment.Token {
+				warnfAt(file.Syntax.Name, comment.Start.Line, "the comment %q on the requirement of %s refers to its old version %s",
+					comment.Token, oldPath, oldVersion,
+				)
+			}
+		}
+	}
+	update(line.Before)
+	update(line.Suffix)
+}
+
+// replaceWord replaces the occurrences of old in s that aren't part of a
+// longer module path or version (e.g. example.com/lib in
+// "example.com/lib/v2")
+func replaceWord(s, old, new string) string {
+	isWordByte := func(c byte) bool {
+		return c == '.' || c == '/' || c == '-' || c == '_' || c == '+' ||
+			'0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+	}
+
+	var b strings.Builder
+	for {
+		i := strings.Index(s, old)
+		if i < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		end := i + len(old)
+		// Trailing punctuation (e.g. "see example.com/lib.") isn't part of
+		// the word
+		after := end < len(s) && isWordByte(s[end]) &&
+			!(s[end] == '.' && (end+1 == len(s) || !isWordByte(s[end+1])))
+		if (i > 0 && isWordByte(s[i-1])) || after {
+			b.WriteString(s[:end])
+		} else {
+			b.WriteString(s[:i])
+			b.WriteString(new)
+		}
+		s = s[end:]
+	}
+}
+
+// setLineTokens sets the tokens of a go.mod line, which start with the verb
+// unless the line is in a block
+func setLineTokens(line *modfile.Line, verb string, tokens ...string) {
+	if len(line.Token) > 0 && line.Token[0] == verb {
+		tokens = append([]string{verb}, tokens...)
+	}
+	line.Token = tokens
+}
+
+// clearIndirect removes the "// indirect" marker from a requirement, keeping
+// any other comment on its line (e.g. "// indirect; see #123")
+func clearIndirect(require *modfile.Require) {
+	require.Indirect = false
+	suffix := require.Syntax.Suffix
+	for i, comment := range suffix {
+		text := strings.TrimSpace(strings.TrimPrefix(comment.Token, "//"))
+		if text == "indirect" {
+			require.Syntax.Suffix = append(suffix[:i:i], suffix[i+1:]...)
+			return
+		}
+		if rest, ok := strings.CutPrefix(text, "indirect;"); ok {
+			suffix[i].Token = "// " + strings.TrimSpace(rest)
+			return
+		}
+	}
+}
+
+// setIndirect adds the "// indirect" marker to a requirement, keeping its
+// other comments, the way the go command does
+func setIndirect(require *modfile.Require) {
+	require.Indirect = true
+	suffix := require.Syntax.Suffix
+	if len(suffix) == 0 {
+		require.Syntax.Suffix = []modfile.Comment{{Token: "// indirect", Suffix: true}}
+		return
+	}
+	text := strings.TrimSpace(strings.TrimPrefix(suffix[0].Token, "//"))
+	if text == "" {
+		suffix[0].Token = "// indirect"
+		return
+	}
+	suffix[0].Token = "// indirect; " + text
+}
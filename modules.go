@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// recursiveEnv is the environment variable set for the runs started by -r,
+// which leave reporting the nested modules to the runs of their own
+const recursiveEnv = "UPGRADE_RECURSIVE"
+
+// moduleResult is the outcome of running this tool in one of the modules
+// selected by -f
+type moduleResult struct {
+	dir      string
+	err      error
+	upToDate bool // Whether the (last) run found the module up to date
+}
+
+// runModules runs this tool again, with the same flags and arguments, in the
+// directory of each go.mod file matching the -f glob pattern (relative to the
+// -d directory), one module after the other, and prints a combined summary at
+// the end. Failing to upgrade one module doesn't stop the others, but makes
+// the run fail.
+func runModules(ctx context.Context, pattern string, args []string) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(*dir, pattern)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		log.Fatalf("Invalid -f pattern: %s", err)
+	}
+
+	var dirs []string
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		switch {
+		case err != nil:
+			continue
+		case info.IsDir():
+			// A pattern can also match module directories
+			if _, err := os.Stat(filepath.Join(match, "go.mod")); err != nil {
+				continue
+			}
+			dirs = append(dirs, match)
+		case filepath.Base(match) == "go.mod":
+			dirs = append(dirs, filepath.Dir(match))
+		}
+	}
+	if len(dirs) == 0 {
+		log.Fatalf("No go.mod files match %s", pattern)
+	}
+	sort.Strings(dirs)
+
+	runEachModule(ctx, dirs, func(string) [][]string {
+		return [][]string{args}
+	})
+}
+
+// runRecursive runs this tool again, with the same flags and arguments, in
+// each module within the -d directory (like -f), in dependency order (see
+// plan), so that each module is upgraded after the local modules it requires.
+// When the modules' own major versions are upgraded (i.e. no module is
+// given), the requirements of each module on the local modules upgraded
+// before it are moved to their new major versions first (see
+// upgradeLocalDependency), so that no module is left referring to the old
+// major version of another.
+func runRecursive(ctx context.Context, args []string) {
+	dirs, err := findModules(*dir)
+	if err != nil {
+		log.Fatalf("Error finding modules in %s: %s", *dir, err)
+	}
+	if len(dirs) == 0 {
+		log.Fatalf("No modules found in %s", *dir)
+	}
+
+	var modules []*localModule
+	for _, dir := range dirs {
+		modules = append(modules, &localModule{
+			dir:  dir,
+			file: readModFile(dir),
+		})
+	}
+	ordered, err := sortModules(modules)
+	if err != nil {
+		log.Fatalf("Error ordering modules: %s", err)
+	}
+
+	byDir := map[string]*localModule{}
+	dirs = dirs[:0]
+	for _, m := range ordered {
+		byDir[m.dir] = m
+		dirs = append(dirs, m.dir)
+	}
+	runEachModule(ctx, dirs, func(d string) [][]string {
+		if len(args) > 0 {
+			return [][]string{args}
+		}
+		var runs [][]string
+		for _, path := range staleLocalRequirements(byDir[d]) {
+			runs = append(runs, []string{path})
+		}
+		return append(runs, args)
+	})
+}
+
+// staleLocalRequirements returns the paths of the requirements of the given
+// module on older major versions of the local modules it requires (i.e. of
+// the ones whose major version was upgraded before it), which it can follow
+// because they're replaced by the local modules' directories. The ones that
+// aren't are warned about, since the new major versions aren't published yet.
+func staleLocalRequirements(m *localModule) []string {
+	// NOTE: The go.mod files are read again, since the modules were
+	// upgraded since they were ordered
+	file := readModFile(m.dir)
+	var paths []string
+	for _, dep := range m.requires {
+		depPath := readModFile(dep.dir).Module.Mod.Path
+		depPrefix, _, _ := module.SplitPathVersion(depPath)
+		for _, require := range file.Require {
+			prefix, _, _ := module.SplitPathVersion(require.Mod.Path)
+			if prefix != depPrefix || currentMajor(require.Mod.Path, require.Mod.Version) >= currentMajor(depPath, "") {
+				continue
+			}
+			if findLocalReplacement(file, require.Mod.Path) == nil {
+				warnfAt(filepath.Join(m.dir, "go.mod"), require.Syntax.Start.Line,
+					"%s requires %s from the module proxy, rather than from the local directory %s, so it's left on it until %s is published",
+					m.path(), require.Mod.Path, dep.dir, depPath,
+				)
+				continue
+			}
+			paths = append(paths, require.Mod.Path)
+		}
+	}
+	return paths
+}
+
+// runEachModule runs this tool in each of the given module directories, one
+// module after the other, with each of the argument lists returned for the
+// module (after the flags of this run), and prints a combined summary at the
+// end. Failing to upgrade one module doesn't stop the others (only that
+// module's remaining runs), but makes the run fail.
+func runEachModule(ctx context.Context, dirs []string, runs func(dir string) [][]string) {
+	self, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Error finding executable: %s", err)
+	}
+
+	// When resuming, the modules upgraded before the interruption are
+	// skipped
+	j := startJournal(*dir)
+
+	var results []moduleResult
+	for _, d := range dirs {
+		if err := ctx.Err(); err != nil {
+			log.Fatalf("Upgrade cancelled: %s", context.Cause(ctx))
+		}
+		if j.done(d) {
+			fmt.Printf("\n==> %s (upgraded before resuming)\n", filepath.ToSlash(d))
+			results = append(results, moduleResult{dir: d})
+			continue
+		}
+		fmt.Printf("\n==> %s\n", filepath.ToSlash(d))
+		result := moduleResult{dir: d}
+		for _, args := range runs(d) {
+			cmdArgs := append(append([]string{"-d", d}, forwardedFlags("d", "f", "r")...), args...)
+			cmd := exec.CommandContext(ctx, self, cmdArgs...)
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			// NOTE: The run doesn't keep a journal of its own, since it
+			// could be in the same directory as this one's, which
+			// records which modules are done
+			cmd.Env = append(os.Environ(), noJournalEnv+"=1")
+			if *recursive {
+				cmd.Env = append(cmd.Env, recursiveEnv+"=1")
+			}
+			err := cmd.Run()
+			if result.upToDate = exitedUpToDate(err); result.upToDate {
+				continue
+			}
+			if err != nil {
+				result.err = err
+				warnf("error upgrading module in %s: %s", d, err)
+				break
+			}
+		}
+		if result.err == nil {
+			j.recordDone(d)
+		}
+		results = append(results, result)
+	}
+
+	var (
+		b      strings.Builder
+		failed int
+	)
+	for _, result := range results {
+		switch {
+		case result.err != nil:
+			failed++
+			fmt.Fprintf(&b, "\t%s: failed\n", filepath.ToSlash(result.dir))
+		case result.upToDate:
+			fmt.Fprintf(&b, "\t%s: up to date\n", filepath.ToSlash(result.dir))
+		default:
+			fmt.Fprintf(&b, "\t%s: ok\n", filepath.ToSlash(result.dir))
+		}
+	}
+	fmt.Fprintf(&b, "\t%d module(s), %d failed\n", len(results), failed)
+	noticef("Modules", "%s", b.String())
+	if failed > 0 {
+		os.Exit(1)
+	}
+	j.remove()
+}
+
+// exitedUpToDate reports whether the error is that of a run of this tool that
+// exited with exitUpToDate, which counts as a success
+func exitedUpToDate(err error) bool {
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && exitErr.ExitCode() == exitUpToDate
+}
+
+// forwardedFlags returns the flags given to this run (except for the named
+// ones), to run this tool again with the same options
+func forwardedFlags(except ...string) []string {
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		switch {
+		case slices.Contains(except, f.Name):
+		case f.Name == "fixer", f.Name == "only", f.Name == "include-file", f.Name == "exclude-file", f.Name == "text-file":
+			// Repeated flags are forwarded one value at a time, below
+		default:
+			args = append(args, fmt.Sprintf("-%s=%s", f.Name, f.Value))
+		}
+	})
+	for _, command := range fixerCommands {
+		args = append(args, "-fixer", command)
+	}
+	for _, pattern := range onlyPatterns {
+		args = append(args, "-only", pattern)
+	}
+	for _, re := range includeFiles {
+		args = append(args, "-include-file", re.String())
+	}
+	for _, re := range excludeFiles {
+		args = append(args, "-exclude-file", re.String())
+	}
+	for _, rule := range textRules {
+		args = append(args, "-text-file", rule.String())
+	}
+	return args
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// Some projects publish their new major versions from another repository
+// (e.g. example.com/newlib/v2, after example.com/lib), so the new module path
+// can't be derived from the old one. It can be given explicitly instead,
+// after the dependency's path (e.g. 'upgrade example.com/lib
+// example.com/newlib/v2'), and the requirement and the imports are then
+// moved to it like for any other upgrade.
+
+// newPathArg returns the new module path given after the dependency's path,
+// if any. An argument is taken for one if it's a valid module path with more
+// than one element (a version can be given as @version to avoid ambiguity,
+// e.g. for a branch named example.com/fix).
+func newPathArg() string {
+	arg := flag.Arg(1)
+	if !isModulePathArg(arg) {
+		return ""
+	}
+	return arg
+}
+
+// isModulePathArg reports whether the argument is a module path (e.g.
+// example.com/newlib/v2), rather than a version
+func isModulePathArg(arg string) bool {
+	if strings.HasPrefix(arg, "@") || semver.IsValid(arg) || !strings.Contains(arg, "/") {
+		return false
+	}
+	return module.CheckPath(arg) == nil
+}
+
+// resolveMovedVersion resolves the version to upgrade a dependency to at the
+// new module path given for it: the given version (or revision), or the
+// highest version of the major version of the new path
+func resolveMovedVersion(ctx context.Context, path, newPath, version string) (string, error) {
+	if newPath == path {
+		return "", fmt.Errorf("the new module path %s is the same as the old one", newPath)
+	}
+	_, pathMajor, _ := module.SplitPathVersion(newPath)
+	major, err := pathMajorNumber(pathMajor)
+	if err != nil {
+		return "", err
+	}
+
+	var result string
+	switch {
+	case version != "" && isRevision(version):
+		result, err = queryRevision(ctx, newPath, version)
+	case version != "":
+		result, err = queryVersion(ctx, newPath, version)
+	default:
+		result, err = queryVersion(ctx, newPath, fmt.Sprintf("v%d", max(major, 1)))
+		// NOTE: A path without a major version suffix can be at v0 too
+		if errors.Is(err, errNotFound) && pathMajor == "" {
+			result, err = queryVersion(ctx, newPath, "v0")
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("error getting module info for %s: %s", newPath, err)
+	}
+	if err := module.CheckPathMajor(result, pathMajor); err != nil {
+		return "", fmt.Errorf("%s isn't a version of %s: %s", result, newPath, err)
+	}
+	return result, nil
+}
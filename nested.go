@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"golang.org/x/mod/modfile"
+)
+
+// Nested modules (directories within the module with a go.mod file of their
+// own) are separate modules, with their own requirements, so their files are
+// never rewritten as part of the upgrade of the module they're nested in. The
+// nested modules that still require the old major version of an upgraded
+// dependency are reported instead, since they're easy to miss: -r upgrades
+// each of them in a run of its own.
+
+// nestedModuleRoots returns the absolute paths of the directories of the
+// modules nested within the module in the ignorer's root directory
+func nestedModuleRoots(ig *ignorer) ([]string, error) {
+	dirs, err := findModules(ig.root)
+	if err != nil {
+		return nil, err
+	}
+	var roots []string
+	for _, d := range dirs {
+		abs, err := filepath.Abs(d)
+		if err == nil && !samePath(abs, ig.root) {
+			roots = append(roots, abs)
+		}
+	}
+	return roots, nil
+}
+
+// inNestedModule reports whether the (absolute) path is within one of the
+// given nested module directories
+func inNestedModule(path string, roots []string) bool {
+	for _, root := range roots {
+		if hasPathPrefix(path, root) {
+			return true
+		}
+	}
+	return false
+}
+
+// reportNestedRequirements warns about the modules nested within the module
+// in the given directory that still require the old major versions of the
+// upgraded dependencies, which the upgrade leaves alone. With -r, they're
+// upgraded by runs of their own, so they aren't reported.
+func reportNestedRequirements(ctx context.Context, dir string, upgrades []upgrade) {
+	if os.Getenv(recursiveEnv) != "" {
+		return
+	}
+	ig, err := newIgnorer(dir)
+	if err != nil {
+		warnf("error checking nested modules: %s", err)
+		return
+	}
+	roots, err := nestedModuleRoots(ig)
+	if err != nil {
+		warnf("error checking nested modules: %s", err)
+		return
+	}
+	// NOTE: The ones used by the same workspace are reported by
+	// checkWorkspace instead, which offers to upgrade them too
+	others, _ := workspaceModules(ctx, dir)
+	for _, root := range roots {
+		if slices.ContainsFunc(others, func(other string) bool { return samePath(other, root) }) {
+			continue
+		}
+		filename := filepath.Join(root, "go.mod")
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			warnf("error reading module file %s: %s", filename, err)
+			continue
+		}
+		nested, err := modfile.Parse(filename, b, nil)
+		if err != nil || nested.Module == nil {
+			warnf("error parsing module file %s: %v", filename, err)
+			continue
+		}
+		for _, upgrade := range upgrades {
+			if upgrade.oldPath == upgrade.newPath {
+				continue
+			}
+			if line := requireLine(nested, upgrade.oldPath); line != 0 {
+				warnfAt(filename, line, "%s, a nested module, still requires %s, which was upgraded to %s (use -r to upgrade every module)",
+					nested.Module.Mod.Path, upgrade.oldPath, upgrade.newPath,
+				)
+			}
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// releaseNote is the release information for a single version of a module
+type releaseNote struct {
+	version string
+	source  string // Where the note came from (e.g. "CHANGELOG.md")
+	text    string
+}
+
+// printReleaseNotes prints the release notes for every version between the
+// old and new versions of each upgraded dependency. Failing to find release
+// notes isn't fatal: they're informational only.
+func printReleaseNotes(ctx context.Context, upgrades []upgrade) {
+	for _, upgrade := range upgrades {
+		// Nothing to do when upgrading the current module
+		if upgrade.oldVersion == "" || upgrade.newVersion == "" {
+			continue
+		}
+
+		notes, err := releaseNotes(ctx, upgrade)
+		if err != nil {
+			warnf("error getting release notes for %s: %s", upgrade.newPath, err)
+			continue
+		}
+		fmt.Print(formatReleaseNotes(upgrade, notes))
+	}
+}
+
+func formatReleaseNotes(upgrade upgrade, notes []releaseNote) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "\nRelease notes for %s %s -> %s %s:\n",
+		upgrade.oldSource(), upgrade.oldVersion, upgrade.newSource(), upgrade.newVersion,
+	)
+	if len(notes) == 0 {
+		b.WriteString("\nNone found\n")
+	}
+	for _, note := range notes {
+		fmt.Fprintf(&b, "\n## %s (%s)\n\n%s\n", note.version, note.source, strings.TrimSpace(note.text))
+	}
+	return b.String()
+}
+
+// releaseNotes collects release notes for the versions after the upgrade's
+// old version, up to and including its new version, from the module's GitHub
+// releases (if it's hosted on GitHub) and from the changelog file included in
+// the new version of the module (if there is one). Notes are sorted from the
+// newest version to the oldest.
+func releaseNotes(ctx context.Context, upgrade upgrade) ([]releaseNote, error) {
+	inRange := func(version string) bool {
+		return semver.Compare(version, semver.Canonical(upgrade.oldVersion)) > 0 &&
+			semver.Compare(version, semver.Canonical(upgrade.newVersion)) <= 0
+	}
+
+	var notes []releaseNote
+	if strings.HasPrefix(upgrade.newSource(), "github.com/") {
+		releases, err := githubReleaseNotes(ctx, upgrade.newSource())
+		if err != nil {
+			return nil, err
+		}
+		for _, note := range releases {
+			if inRange(note.version) {
+				notes = append(notes, note)
+			}
+		}
+	}
+
+	changelog, err := changelogNotes(ctx, upgrade.newSource(), upgrade.newVersion)
+	if err != nil {
+		return nil, err
+	}
+	for _, note := range changelog {
+		if inRange(note.version) {
+			notes = append(notes, note)
+		}
+	}
+
+	sort.SliceStable(notes, func(i, j int) bool {
+		return semver.Compare(notes[i].version, notes[j].version) > 0
+	})
+	return notes, nil
+}
+
+// githubReleaseNotes returns the notes of the GitHub releases for the module.
+// For modules in a subdirectory of their repository, only releases whose tags
+// are prefixed by the subdirectory are included. If the GITHUB_TOKEN
+// environment variable is set, it's used to authenticate the requests (which
+// avoids GitHub's low rate limit for anonymous requests).
+func githubReleaseNotes(ctx context.Context, path string) ([]releaseNote, error) {
+	prefix, _, _ := module.SplitPathVersion(path)
+	parts := strings.SplitN(prefix, "/", 4)
+	if len(parts) < 3 {
+		return nil, fmt.Errorf("invalid GitHub module path: %s", path)
+	}
+	repo := parts[1] + "/" + parts[2]
+	tagPrefix := ""
+	if len(parts) == 4 {
+		tagPrefix = parts[3] + "/"
+	}
+
+	var notes []releaseNote
+	const perPage, maxPages = 100, 5
+	for page := 1; page <= maxPages; page++ {
+		url := fmt.Sprintf("https://api.github.com/repos/%s/releases?per_page=%d&page=%d", repo, perPage, page)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/vnd.github+json")
+		if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching GitHub releases: %s", err)
+		}
+		var releases []struct {
+			TagName string `json:"tag_name"`
+			Name    string `json:"name"`
+			Body    string `json:"body"`
+			Draft   bool   `json:"draft"`
+		}
+		err = errors.Join(
+			httpError(resp),
+			json.NewDecoder(resp.Body).Decode(&releases),
+		)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error fetching GitHub releases for %s: %s", repo, err)
+		}
+
+		for _, release := range releases {
+			version, ok := strings.CutPrefix(release.TagName, tagPrefix)
+			if !ok || release.Draft || !semver.IsValid(version) {
+				continue
+			}
+			source := "GitHub release"
+			if release.Name != "" && release.Name != release.TagName {
+				source = fmt.Sprintf("GitHub release %q", release.Name)
+			}
+			notes = append(notes, releaseNote{
+				version: version,
+				source:  source,
+				text:    release.Body,
+			})
+		}
+		if len(releases) < perPage {
+			break
+		}
+	}
+	return notes, nil
+}
+
+func httpError(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		return &httpStatusError{url: resp.Request.URL.String(), code: resp.StatusCode}
+	}
+	return nil
+}
+
+// Conventional names of changelog files, compared case-insensitively
+var changelogNames = []string{
+	"CHANGELOG.md",
+	"CHANGELOG",
+	"CHANGES.md",
+	"CHANGES",
+	"HISTORY.md",
+	"RELEASES.md",
+}
+
+// Matches the version in a changelog heading, e.g. "## [v1.2.3] - 2024-01-01"
+var changelogVersion = regexp.MustCompile(`\bv?(\d+\.\d+(?:\.\d+)?(?:-[0-9A-Za-z.-]+)?)\b`)
+
+// changelogNotes returns the sections of the changelog file at the given
+// version of the module, split up by the versions in their headings.
+func changelogNotes(ctx context.Context, path, version string) ([]releaseNote, error) {
+	downloaded, err := downloadModule(ctx, path, version)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(downloaded.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading module directory: %s", err)
+	}
+	var name string
+	for _, changelogName := range changelogNames {
+		for _, entry := range entries {
+			if name == "" && strings.EqualFold(entry.Name(), changelogName) {
+				name = entry.Name()
+			}
+		}
+	}
+	if name == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(filepath.Join(downloaded.Dir, name))
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %s", name, err)
+	}
+
+	var notes []releaseNote
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "#") {
+			if match := changelogVersion.FindStringSubmatch(line); match != nil {
+				if version := "v" + match[1]; semver.IsValid(version) {
+					notes = append(notes, releaseNote{version: semver.Canonical(version), source: name})
+					continue
+				}
+			}
+		}
+		if len(notes) > 0 {
+			notes[len(notes)-1].text += line + "\n"
+		}
+	}
+	return notes, nil
+}
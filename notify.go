@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Notification events
+const (
+	eventApplied  = "applied"  // Upgrades were applied to the module
+	eventDetected = "detected" // New major versions were found by serve
+)
+
+// notification is the JSON payload POSTed to the -webhook URL
+type notification struct {
+	Event    string                `json:"event"`
+	Module   string                `json:"module"`
+	Dir      string                `json:"dir"`            // Absolute module directory
+	Repo     string                `json:"repo,omitempty"` // Root of the git repository containing it
+	Upgrades []notificationUpgrade `json:"upgrades"`
+}
+
+type notificationUpgrade struct {
+	OldPath    string `json:"oldPath"`
+	OldVersion string `json:"oldVersion,omitempty"`
+	NewPath    string `json:"newPath"`
+	NewVersion string `json:"newVersion,omitempty"`
+}
+
+// notify POSTs the given upgrades of a module to the -webhook and -slack
+// URLs, if any. Failures are only warned about, since the upgrades themselves
+// have already been done (or detected) by then.
+func notify(ctx context.Context, event, modulePath, dir string, upgrades []upgrade) {
+	if (*webhook == "" && *slack == "") || len(upgrades) == 0 {
+		return
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		abs = dir
+	}
+	n := notification{
+		Event:  event,
+		Module: modulePath,
+		Dir:    abs,
+		Repo:   gitRoot(abs),
+	}
+	for _, upgrade := range upgrades {
+		n.Upgrades = append(n.Upgrades, notificationUpgrade{
+			OldPath:    upgrade.oldPath,
+			OldVersion: upgrade.oldVersion,
+			NewPath:    upgrade.newPath,
+			NewVersion: upgrade.newVersion,
+		})
+	}
+
+	if *webhook != "" {
+		if err := postJSON(ctx, *webhook, n); err != nil {
+			warnf("error sending webhook notification: %s", err)
+		}
+	}
+	if *slack != "" {
+		payload := map[string]string{"text": slackText(n)}
+		if err := postJSON(ctx, *slack, payload); err != nil {
+			warnf("error sending Slack notification: %s", err)
+		}
+	}
+}
+
+// slackText formats a notification as a Slack message (in Slack's "mrkdwn"
+// format). See https://api.slack.com/reference/surfaces/formatting.
+func slackText(n notification) string {
+	var b strings.Builder
+	switch n.Event {
+	case eventApplied:
+		fmt.Fprintf(&b, "Upgraded dependencies of *%s*", slackEscape(n.Module))
+	default:
+		fmt.Fprintf(&b, "New major versions available for *%s*", slackEscape(n.Module))
+	}
+	location := n.Dir
+	if n.Repo != "" {
+		if rel, err := filepath.Rel(filepath.Dir(n.Repo), n.Dir); err == nil {
+			location = rel
+		}
+	}
+	fmt.Fprintf(&b, " (`%s`):", slackEscape(location))
+	for _, upgrade := range n.Upgrades {
+		fmt.Fprintf(&b, "\n• %s %s → %s %s",
+			slackEscape(upgrade.OldPath), upgrade.OldVersion,
+			slackEscape(upgrade.NewPath), upgrade.NewVersion,
+		)
+	}
+	return b.String()
+}
+
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func slackEscape(s string) string {
+	return slackEscaper.Replace(s)
+}
+
+func postJSON(ctx context.Context, url string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error encoding payload: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending request: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Output formats (-format flag)
+const (
+	formatText  = "text"
+	formatGHA   = "gha"   // GitHub Actions workflow commands
+	formatCSV   = "csv"   // Tables of the report and enforce targets, as CSV
+	formatSARIF = "sarif" // Findings of the report and enforce targets, as SARIF
+)
+
+// stdinIsTerminal reports whether stdin is a terminal, i.e. whether the user
+// can be asked questions (which they can't be in CI, for example)
+func stdinIsTerminal() bool {
+	stat, err := os.Stdin.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// confirm asks the user a yes or no question, and reports whether they
+// answered yes (the default being no)
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// warnf prints a warning message to stderr (or, in GitHub Actions format, as
+// a warning annotation)
+func warnf(format string, args ...any) {
+	warnfAt("", 0, format, args...)
+}
+
+// warnfAt prints a warning message about the given location in a file (the
+// line is optional)
+func warnfAt(filename string, line int, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	defer func() { recorder.recordWarning(msg) }()
+
+	if *outputFormat == formatGHA {
+		fmt.Printf("::warning%s::%s\n", annotationLocation(filename, line), escapeAnnotation(msg))
+		return
+	}
+
+	switch {
+	case filename != "" && line > 0:
+		msg = fmt.Sprintf("%s:%d: %s", filename, line, msg)
+	case filename != "":
+		msg = fmt.Sprintf("%s: %s", filename, msg)
+	}
+	fmt.Fprintf(os.Stderr, "Warning: %s\n", msg)
+}
+
+// noticef prints an informational message, with the given title (in GitHub
+// Actions format, as a notice annotation)
+func noticef(title, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+
+	if *outputFormat == formatGHA {
+		fmt.Printf("::notice title=%s::%s\n", escapeAnnotationProperty(title), escapeAnnotation(msg))
+		return
+	}
+	fmt.Printf("\n%s:\n%s", title, msg)
+}
+
+// annotationLocation returns the properties of a GitHub Actions annotation
+// pointing at the given file and line. Paths are made relative to the
+// current directory (which is the root of the repository, in a workflow).
+func annotationLocation(filename string, line int) string {
+	if filename == "" {
+		return ""
+	}
+	location := " file=" + escapeAnnotationProperty(relativePath(filename))
+	if line > 0 {
+		location += fmt.Sprintf(",line=%d", line)
+	}
+	return location
+}
+
+// relativePath returns the path of the file relative to the current directory
+// (if it's within it), with forward slashes
+func relativePath(filename string) string {
+	if abs, err := filepath.Abs(filename); err == nil {
+		if cwd, err := os.Getwd(); err == nil {
+			if rel, err := filepath.Rel(cwd, abs); err == nil && !strings.HasPrefix(rel, "..") {
+				filename = rel
+			}
+		}
+	}
+	return filepath.ToSlash(filename)
+}
+
+// See https://github.com/actions/toolkit/blob/main/packages/core/src/command.ts
+func escapeAnnotation(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+func escapeAnnotationProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// stagingDir mirrors the module directory, so that an upgrade can be carried
+// out (including the 'go list' run that finalizes the go.mod file) without
+// modifying the module itself. Every file in the mirror starts out as a
+// symlink to the original, and is replaced by a regular file when written
+// (files are always replaced by renaming, so the originals are never written
+// through the symlinks). The go.mod and go.sum files are copied up front,
+// since the go command edits them in place.
+type stagingDir struct {
+	src string // Absolute path of the module directory
+	dir string // Absolute path of the mirror
+}
+
+// stage is the staging directory that files are written to instead of the
+// module directory, if any (see -o)
+var stage *stagingDir
+
+func newStagingDir(dir string) (*stagingDir, error) {
+	src, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := os.MkdirTemp("", "upgrade-")
+	if err != nil {
+		return nil, fmt.Errorf("error creating staging directory: %s", err)
+	}
+	s := &stagingDir{src: src, dir: tmp}
+
+	err = filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := s.path(path)
+		switch {
+		case path == src:
+			return nil
+		case d.IsDir() && d.Name() == ".git":
+			return filepath.SkipDir
+		case d.IsDir():
+			return os.Mkdir(target, 0o755)
+		case filepath.Dir(path) == src && (d.Name() == "go.mod" || d.Name() == "go.sum"):
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(target, b, 0o644)
+		default:
+			return os.Symlink(path, target)
+		}
+	})
+	if err != nil {
+		s.remove()
+		return nil, fmt.Errorf("error populating staging directory: %s", err)
+	}
+	return s, nil
+}
+
+// path returns the path in the staging directory corresponding to the given
+// path in the module directory
+func (s *stagingDir) path(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	rel, err := filepath.Rel(s.src, abs)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return path
+	}
+	return filepath.Join(s.dir, rel)
+}
+
+func (s *stagingDir) remove() {
+	os.RemoveAll(s.dir)
+}
+
+// outputPath returns the path that the given file in the module directory
+// should be read from and written to: its path in the staging directory, if
+// there is one, or else the path itself
+func outputPath(path string) string {
+	if stage == nil {
+		return path
+	}
+	return stage.path(path)
+}
+
+// writePatch writes a unified diff of every file changed in the staging
+// directory to the named file (or to stdout, if the name is "-"). Paths are
+// relative to the root of the enclosing git repository (or to the module
+// directory, outside of one), so that the patch can be applied with
+// 'git apply' (or 'patch -p1').
+func (s *stagingDir) writePatch(filename string) error {
+	base := gitRoot(s.src)
+	if base == "" {
+		base = s.src
+	}
+
+	var changed []string
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			changed = append(changed, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error reading staging directory: %s", err)
+	}
+	sort.Strings(changed)
+
+	var patch strings.Builder
+	for _, path := range changed {
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		orig := filepath.Join(s.src, rel)
+
+		new, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("error reading staged file %s: %s", rel, err)
+		}
+		old, err := os.ReadFile(orig)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error reading file %s: %s", orig, err)
+		}
+
+		name, err := filepath.Rel(base, orig)
+		if err != nil {
+			return err
+		}
+		patch.WriteString(unifiedDiff(filepath.ToSlash(name), old, new))
+	}
+
+	if filename == "-" {
+		_, err = os.Stdout.WriteString(patch.String())
+		return err
+	}
+	if err := os.WriteFile(filename, []byte(patch.String()), 0o644); err != nil {
+		return fmt.Errorf("error writing patch file %s: %s", filename, err)
+	}
+	return nil
+}
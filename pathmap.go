@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+)
+
+// With -map, imports are rewritten according to a file of import path prefix
+// mappings, one per line, instead of upgrading a dependency, e.g.:
+//
+//	# The organization was renamed
+//	github.com/oldorg -> github.com/neworg
+//	# The package was moved out of internal
+//	example.com/lib/internal/client -> example.com/lib/client
+//
+// All of the mappings are applied in a single rewrite pass. A prefix matches
+// whole path elements only, and the longest matching prefix wins. Modules
+// whose path matches a prefix (the module itself, or its requirements and
+// replacements) are renamed in the go.mod file as well; a prefix that only
+// matches packages within a module just rewrites the imports of them.
+
+// pathMapping maps imports with the old path prefix to the new one
+type pathMapping struct {
+	oldPrefix string
+	newPrefix string
+}
+
+// pathMappings are the mappings of the -map file, if any
+var pathMappings []pathMapping
+
+// loadPathMappings reads path mappings from the named file, one per line.
+// Blank lines and lines starting with '#' or '//' are ignored.
+func loadPathMappings(filename string) ([]pathMapping, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading path mapping file: %s", err)
+	}
+
+	var (
+		mappings []pathMapping
+		seen     = map[string]bool{}
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") || strings.HasPrefix(text, "//") {
+			continue
+		}
+		oldPrefix, newPrefix, ok := strings.Cut(text, "->")
+		if !ok || strings.Contains(newPrefix, "->") {
+			return nil, fmt.Errorf("%s:%d: path mapping must be of the form 'old/prefix -> new/prefix'", filename, line)
+		}
+		mapping := pathMapping{
+			oldPrefix: strings.TrimSpace(oldPrefix),
+			newPrefix: strings.TrimSpace(newPrefix),
+		}
+		for _, prefix := range []string{mapping.oldPrefix, mapping.newPrefix} {
+			if err := module.CheckImportPath(prefix); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid path prefix %q: %s", filename, line, prefix, err)
+			}
+		}
+		if seen[mapping.oldPrefix] {
+			return nil, fmt.Errorf("%s:%d: %s is mapped more than once", filename, line, mapping.oldPrefix)
+		}
+		seen[mapping.oldPrefix] = true
+		mappings = append(mappings, mapping)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading path mapping file: %s", err)
+	}
+	if len(mappings) == 0 {
+		return nil, fmt.Errorf("no path mappings in %s", filename)
+	}
+	return mappings, nil
+}
+
+// mapPath returns the path with its prefix mapped by the longest matching
+// mapping, and that mapping. Returns false if no mapping matches.
+func mapPath(path string, mappings []pathMapping) (string, pathMapping, bool) {
+	var (
+		match pathMapping
+		found bool
+	)
+	for _, mapping := range mappings {
+		if found && len(mapping.oldPrefix) <= len(match.oldPrefix) {
+			continue
+		}
+		if path == mapping.oldPrefix || strings.HasPrefix(path, mapping.oldPrefix+"/") {
+			match, found = mapping, true
+		}
+	}
+	if !found {
+		return "", pathMapping{}, false
+	}
+	return match.newPrefix + strings.TrimPrefix(path, match.oldPrefix), match, true
+}
+
+func pathMappingUpgrade(mapping pathMapping) upgrade {
+	return upgrade{oldPath: mapping.oldPrefix, newPath: mapping.newPrefix}
+}
+
+// mapModulePaths renames the module, and the modules it requires or
+// replaces, whose paths match the mappings, returning the renamed modules. A renamed
+// dependency is required at the same version under its new path, which must
+// exist, unless it's replaced by a fork (whose path is mapped as well), in
+// which case its version doesn't matter.
+func mapModulePaths(ctx context.Context, file *modfile.File, mappings []pathMapping) []upgrade {
+	var upgrades []upgrade
+	if newPath, _, ok := mapPath(file.Module.Mod.Path, mappings); ok {
+		fmt.Printf("%s -> %s\n", file.Module.Mod.Path, newPath)
+		upgrades = append(upgrades, upgrade{oldPath: file.Module.Mod.Path, newPath: newPath})
+		if err := file.AddModuleStmt(newPath); err != nil {
+			log.Fatalf("Error renaming module to %s: %s", newPath, err)
+		}
+	}
+
+	for _, require := range file.Require {
+		newPath, _, ok := mapPath(require.Mod.Path, mappings)
+		if !ok {
+			continue
+		}
+		upgrade := upgrade{
+			oldPath:    require.Mod.Path,
+			newPath:    newPath,
+			oldVersion: require.Mod.Version,
+			newVersion: require.Mod.Version,
+			indirect:   require.Indirect,
+		}
+
+		if replace := findForkReplacement(file, require.Mod.Path); replace != nil {
+			upgrade.oldForkPath = replace.New.Path
+			upgrade.newForkPath = replace.New.Path
+			if newForkPath, _, ok := mapPath(replace.New.Path, mappings); ok {
+				upgrade.newForkPath = newForkPath
+			}
+			upgrade.oldVersion = replace.New.Version
+			upgrade.newVersion = replace.New.Version
+		}
+
+		// NOTE: A renamed repository usually keeps its tags, so the same
+		// version is expected to exist under the new path
+		if upgrade.newSource() != upgrade.oldSource() {
+			if _, err := queryVersion(ctx, upgrade.newSource(), upgrade.newVersion); errors.Is(err, errNotFound) {
+				log.Fatalf("%s %s (mapped from %s) not found", upgrade.newSource(), upgrade.newVersion, upgrade.oldSource())
+			} else if err != nil {
+				log.Fatalf("Error getting module info for %s: %s", upgrade.newSource(), err)
+			}
+		}
+
+		if upgrade.oldForkPath != "" {
+			fmt.Printf("%s => %s %s -> %s => %s %s\n",
+				upgrade.oldPath, upgrade.oldForkPath, upgrade.oldVersion,
+				upgrade.newPath, upgrade.newForkPath, upgrade.newVersion,
+			)
+		} else {
+			fmt.Printf("%s %s -> %s %s\n", upgrade.oldPath, upgrade.oldVersion, upgrade.newPath, upgrade.newVersion)
+		}
+		if err := replaceRequire(file, require.Mod.Path, newPath, require.Mod.Version); err != nil {
+			log.Fatalf("Error replacing module requirement %s: %s", upgrade.oldPath, err)
+		}
+		upgrades = append(upgrades, upgrade)
+	}
+
+	// Replacements are renamed on both sides (the replaced module, and the
+	// module replacing it, if it isn't a directory), even if the replaced
+	// module isn't required
+	for _, replace := range file.Replace {
+		newPath, _, oldMapped := mapPath(replace.Old.Path, mappings)
+		if !oldMapped {
+			newPath = replace.Old.Path
+		}
+		// Directory replacements have no version
+		newReplacement, newMapped := replace.New.Path, false
+		if replace.New.Version != "" {
+			if p, _, ok := mapPath(replace.New.Path, mappings); ok {
+				newReplacement, newMapped = p, true
+			}
+		}
+		if !oldMapped && !newMapped {
+			continue
+		}
+		if *verbose {
+			fmt.Printf("Replacing %s => %s with %s => %s\n", replace.Old.Path, replace.New.Path, newPath, newReplacement)
+		}
+		if err := replaceReplace(file, replace.Old.Path, newPath, newReplacement, replace.New.Version); err != nil {
+			log.Fatalf("Error replacing %s with %s: %s", newPath, newReplacement, err)
+		}
+	}
+
+	if len(upgrades) == 0 && *verbose {
+		fmt.Println("No module paths match the path mappings, only imports are rewritten")
+	}
+	return upgrades
+}
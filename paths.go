@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Windows file systems are case-insensitive, and files there are often
+// briefly locked by antivirus software or search indexers right after being
+// written, so paths are compared (and files replaced) with these helpers.
+
+// hasPathPrefix reports whether the path is the given directory, or is within
+// it. Both paths must be clean and absolute (or relative to the same
+// directory). An empty directory (e.g. one whose absolute path couldn't be
+// determined) contains nothing.
+func hasPathPrefix(path, dir string) bool {
+	if dir == "" || len(path) < len(dir) || !samePath(path[:len(dir)], dir) {
+		return false
+	}
+	return len(path) == len(dir) || os.IsPathSeparator(path[len(dir)]) || os.IsPathSeparator(dir[len(dir)-1])
+}
+
+// samePath reports whether two clean paths are the same, ignoring case on
+// Windows
+func samePath(a, b string) bool {
+	if runtime.GOOS == "windows" {
+		return strings.EqualFold(filepath.ToSlash(a), filepath.ToSlash(b))
+	}
+	return a == b
+}
+
+// Delays between attempts to replace a file on Windows
+var renameRetryDelays = []time.Duration{
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+}
+
+// renameFile renames a file like os.Rename, retrying on Windows, where the
+// target can be briefly locked by another process (typically antivirus
+// software scanning the file that was just written), making the rename fail
+// with an access denied or sharing violation error
+func renameFile(oldpath, newpath string) error {
+	err := os.Rename(oldpath, newpath)
+	if runtime.GOOS != "windows" {
+		return err
+	}
+	for _, delay := range renameRetryDelays {
+		if err == nil {
+			return nil
+		}
+		time.Sleep(delay)
+		err = os.Rename(oldpath, newpath)
+	}
+	return err
+}
+
+// realPath returns the path with any symlinks resolved, or the path itself if
+// it can't be resolved (e.g. because it doesn't exist yet)
+func realPath(path string) string {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	return path
+}
+
+// resolveModuleFile resolves any symlinks in the path of a file within the
+// module directory dir (whose own resolved path is realDir), returning the
+// path, within dir, of the file it resolves to. If the file resolves to a
+// path outside of the module directory, that path is returned, and false.
+func resolveModuleFile(filename, dir, realDir string) (string, bool) {
+	resolved := realPath(filename)
+	if samePath(resolved, filename) {
+		return filename, true
+	}
+	if !hasPathPrefix(resolved, realDir) {
+		return resolved, false
+	}
+	rel, err := filepath.Rel(realDir, resolved)
+	if err != nil {
+		return resolved, false
+	}
+	return filepath.Join(dir, rel), true
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestHasPathPrefix(t *testing.T) {
+	root := filepath.FromSlash("/src/mod")
+	tests := []struct {
+		path, dir string
+		want      bool
+	}{
+		{path: root, dir: root, want: true},
+		{path: filepath.Join(root, "pkg", "a.go"), dir: root, want: true},
+		{path: filepath.Join(root, "pkg"), dir: string(filepath.Separator), want: true},
+		{path: root + "ule", dir: root, want: false},
+		{path: filepath.Dir(root), dir: root, want: false},
+		{path: root, dir: "", want: false},
+		{path: "", dir: "", want: false},
+	}
+	for _, test := range tests {
+		if got := hasPathPrefix(test.path, test.dir); got != test.want {
+			t.Errorf("hasPathPrefix(%q, %q) = %t, want %t", test.path, test.dir, got, test.want)
+		}
+	}
+}
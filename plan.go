@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+)
+
+// localModule is a module whose source is available locally (as opposed to
+// one that's only known by its requirement in a go.mod file)
+type localModule struct {
+	dir  string
+	file *modfile.File
+
+	requires   []*localModule // Local modules this module requires
+	dependents []*localModule // Local modules requiring this module
+}
+
+func (m *localModule) path() string {
+	return m.file.Module.Mod.Path
+}
+
+// plan prints the order in which the given local modules (or, if none are
+// given, all modules within the module directory) should be upgraded, so that
+// each module is upgraded before the modules that depend on it. Nothing is
+// modified.
+func plan(dirs []string) {
+	if len(dirs) == 0 {
+		var err error
+		dirs, err = findModules(*dir)
+		if err != nil {
+			log.Fatalf("Error finding modules in %s: %s", *dir, err)
+		}
+	}
+
+	var modules []*localModule
+	for _, dir := range dirs {
+		modules = append(modules, &localModule{
+			dir:  dir,
+			file: readModFile(dir),
+		})
+	}
+
+	ordered, err := sortModules(modules)
+	if err != nil {
+		log.Fatalf("Error ordering modules: %s", err)
+	}
+
+	fmt.Println("Upgrade order (dependencies first):")
+	for i, m := range ordered {
+		fmt.Printf("%d. %s (%s)\n", i+1, m.path(), m.dir)
+		for _, require := range m.requires {
+			fmt.Printf("\trequires %s\n", require.path())
+		}
+	}
+
+	// Upgrading the major version of a module that other local modules
+	// depend on leaves them requiring (and importing) the old major version,
+	// until they're upgraded to the new one. Each of them is upgraded from its
+	// own directory, so the command to run is given for each.
+	for _, m := range ordered {
+		if len(m.dependents) == 0 {
+			continue
+		}
+		newPath, err := upgradePath(m.path(), "")
+		if err != nil {
+			log.Fatalf("Error upgrading module path %s: %s", m.path(), err)
+		}
+		for _, dependent := range m.dependents {
+			warnf("upgrading %s to %s leaves %s requiring the old major version until upgraded with '%s -d %s %s'",
+				m.path(), newPath, dependent.path(), filepath.Base(os.Args[0]), dependent.dir, m.path(),
+			)
+		}
+	}
+}
+
+// findModules returns the directories of all modules within the given
+// directory (including the module rooted in the directory itself, if any)
+func findModules(dir string) ([]string, error) {
+	ig, err := newIgnorer(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	if err := walkFiles(ig, func(path string) error {
+		if filepath.Base(path) != "go.mod" {
+			return nil
+		}
+		rel, err := filepath.Rel(ig.root, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		dirs = append(dirs, filepath.Join(dir, rel))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return dirs, nil
+}
+
+// sortModules links the given modules to the ones they require, and returns
+// them in topological order (with each module preceding the modules that
+// depend on it). Modules at the same depth are sorted by path, so the order is
+// deterministic. A requirement on any major version of a local module counts
+// as a dependency on it.
+func sortModules(modules []*localModule) ([]*localModule, error) {
+	byPrefix := map[string]*localModule{}
+	for _, m := range modules {
+		prefix, _, _ := module.SplitPathVersion(m.path())
+		if other, ok := byPrefix[prefix]; ok {
+			return nil, fmt.Errorf("modules in %s and %s have the same path: %s", other.dir, m.dir, prefix)
+		}
+		byPrefix[prefix] = m
+	}
+
+	for _, m := range modules {
+		for _, require := range m.file.Require {
+			prefix, _, _ := module.SplitPathVersion(require.Mod.Path)
+			if dep, ok := byPrefix[prefix]; ok && dep != m && !slices.Contains(m.requires, dep) {
+				m.requires = append(m.requires, dep)
+				dep.dependents = append(dep.dependents, m)
+			}
+		}
+	}
+
+	var (
+		ordered   []*localModule
+		remaining = map[*localModule]int{} // Number of unordered requirements
+		ready     []*localModule
+	)
+	for _, m := range modules {
+		remaining[m] = len(m.requires)
+		if len(m.requires) == 0 {
+			ready = append(ready, m)
+		}
+	}
+	for len(ready) > 0 {
+		sort.Slice(ready, func(i, j int) bool {
+			return ready[i].path() < ready[j].path()
+		})
+		var next []*localModule
+		for _, m := range ready {
+			ordered = append(ordered, m)
+			for _, dependent := range m.dependents {
+				remaining[dependent]--
+				if remaining[dependent] == 0 {
+					next = append(next, dependent)
+				}
+			}
+		}
+		ready = next
+	}
+
+	if len(ordered) < len(modules) {
+		var cycle []string
+		for _, m := range modules {
+			if remaining[m] > 0 {
+				cycle = append(cycle, m.path())
+			}
+		}
+		sort.Strings(cycle)
+		return nil, fmt.Errorf("dependency cycle between modules: %s", strings.Join(cycle, ", "))
+	}
+	return ordered, nil
+}
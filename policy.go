@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// A -policy file exempts dependencies from automated upgrades (by the all
+// target, -batch and serve), or limits the major version they're upgraded
+// to, e.g.:
+//
+//	{
+//	  "modules": [
+//	    {"path": "example.com/legacy", "deny": true, "reason": "v3 breaks the wire format"},
+//	    {"path": "github.com/aws/*", "max": "v2"}
+//	  ]
+//	}
+//
+// Paths are patterns matched against module path prefixes, like GOPRIVATE's
+// (so example.com/legacy matches example.com/legacy/v2 too). The first
+// matching entry applies, so an entry without "deny" or "max" that comes
+// before a broader denial allows its modules to be upgraded.
+
+// modulePolicy is an entry of a -policy file
+type modulePolicy struct {
+	Path   string `json:"path"`
+	Deny   bool   `json:"deny,omitempty"`
+	Max    string `json:"max,omitempty"` // Highest major version, e.g. v3
+	Reason string `json:"reason,omitempty"`
+
+	// The regular expression module paths are matched against instead of
+	// the path pattern, for ignore rules of Renovate or Dependabot that
+	// aren't expressed as prefixes (see bots.go)
+	re *regexp.Regexp
+}
+
+var policies []modulePolicy
+
+// loadPolicy reads the entries of a -policy file
+func loadPolicy(filename string) ([]modulePolicy, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading policy file: %s", err)
+	}
+	var policy struct {
+		Modules []modulePolicy `json:"modules"`
+	}
+	if err := json.Unmarshal(b, &policy); err != nil {
+		return nil, fmt.Errorf("error parsing policy file %s: %s", filename, err)
+	}
+	for _, entry := range policy.Modules {
+		if entry.Path == "" {
+			return nil, fmt.Errorf("policy file %s has an entry without a path", filename)
+		}
+		if entry.Max != "" && (!semver.IsValid(entry.Max) || semver.Major(entry.Max) != entry.Max) {
+			return nil, fmt.Errorf("invalid max version %q for %s in policy file %s: must be a major version, such as v4", entry.Max, entry.Path, filename)
+		}
+	}
+	return policy.Modules, nil
+}
+
+// policyFor returns the policy entry that applies to the given module, or nil
+// if there's none
+func policyFor(path string) *modulePolicy {
+	for i, entry := range policies {
+		if entry.re != nil && entry.re.MatchString(path) || entry.re == nil && module.MatchPrefixPatterns(entry.Path, path) {
+			return &policies[i]
+		}
+	}
+	return nil
+}
+
+// denied reports whether the policy forbids automatically upgrading the
+// given module, printing why
+func denied(path string) bool {
+	entry := policyFor(path)
+	if entry == nil || !entry.Deny {
+		return false
+	}
+	if entry.Reason != "" {
+		fmt.Printf("%s - denied by policy: %s\n", path, entry.Reason)
+	} else {
+		fmt.Printf("%s - denied by policy\n", path)
+	}
+	return true
+}
+
+// policyMax returns the highest major version number the policy allows the
+// given module to be upgraded to, or -1 if there's no limit
+func policyMax(path string) int {
+	if entry := policyFor(path); entry != nil && entry.Max != "" {
+		return majorNumber(entry.Max)
+	}
+	return -1
+}
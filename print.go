@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// printTarget is the file, or the directory of the package, whose rewritten
+// contents are printed (see -print)
+type printTarget struct {
+	path  string // Absolute path
+	isDir bool
+	out   io.Writer
+}
+
+// printing is the target of the -print flag, if given
+var printing *printTarget
+
+func newPrintTarget(path string, out io.Writer) (*printTarget, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+	return &printTarget{path: abs, isDir: info.IsDir(), out: out}, nil
+}
+
+// print prints the contents of the target file, or of each .go file in the
+// target directory, as modified by the upgrade (files that weren't modified
+// are printed as-is). Like gofmt, the contents of multiple files are simply
+// concatenated.
+func (t *printTarget) print(modified []file) error {
+	names := []string{t.path}
+	if t.isDir {
+		entries, err := os.ReadDir(t.path)
+		if err != nil {
+			return fmt.Errorf("error reading directory %s: %s", t.path, err)
+		}
+		names = nil
+		for _, entry := range entries {
+			if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), ".go") {
+				names = append(names, filepath.Join(t.path, entry.Name()))
+			}
+		}
+		sort.Strings(names)
+	}
+
+	byName := map[string]file{}
+	for _, file := range modified {
+		byName[file.name] = file
+	}
+
+	for _, name := range names {
+		var out []byte
+		var err error
+		if file, ok := byName[name]; ok {
+			out, err = formatFile(file)
+		} else {
+			out, err = os.ReadFile(name)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := t.out.Write(out); err != nil {
+			return fmt.Errorf("error printing file %s: %s", name, err)
+		}
+	}
+	return nil
+}
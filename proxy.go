@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// Versions are resolved by speaking the module proxy protocol directly, rather
+// than by interpreting the error messages printed by 'go list -m'. Proxies
+// respond to requests for modules or versions that don't exist with a 404 or
+// 410 status code, which makes it possible to reliably distinguish a major
+// version that hasn't been released from a failed lookup (error messages vary
+// between proxies, go versions and locales).
+// See https://go.dev/ref/mod#goproxy-protocol.
+
+var (
+	// errNotFound indicates that the requested module or version definitively
+	// does not exist
+	errNotFound = errors.New("not found")
+
+	// errDirect indicates that the GOPROXY setting requires the module to be
+	// fetched directly from its version control repository, which the tool
+	// can't do itself (it falls back to 'go list -m' instead)
+	errDirect = errors.New("direct lookup required")
+)
+
+type proxyEntry struct {
+	url string // Proxy URL, or "direct" or "off"
+
+	// Whether to fall back to the next entry after any error ("|" separator),
+	// or only after a 404 or 410 response ("," separator)
+	fallbackOnError bool
+}
+
+var (
+	proxyOnce    sync.Once
+	proxyEntries []proxyEntry
+	proxyBypass  string // GONOPROXY patterns
+	proxyErr     error
+)
+
+// goproxy returns the parsed GOPROXY setting, along with the GONOPROXY
+// patterns (which default to GOPRIVATE), as reported by 'go env' (so that
+// settings in the go env file are honored).
+func goproxy(ctx context.Context) ([]proxyEntry, string, error) {
+	proxyOnce.Do(func() {
+		out, err := exec.CommandContext(ctx, "go", "env", "GOPROXY", "GONOPROXY").Output()
+		if err != nil {
+			proxyErr = fmt.Errorf("error executing 'go env GOPROXY GONOPROXY' command: %s", err)
+			return
+		}
+		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+		proxyEntries = parseGoproxy(strings.TrimSpace(lines[0]))
+		if len(lines) > 1 {
+			proxyBypass = strings.TrimSpace(lines[1])
+		}
+	})
+	return proxyEntries, proxyBypass, proxyErr
+}
+
+func parseGoproxy(value string) []proxyEntry {
+	if value == "" {
+		value = "https://proxy.golang.org,direct"
+	}
+
+	var entries []proxyEntry
+	for value != "" {
+		var (
+			entry           string
+			fallbackOnError bool
+		)
+		if i := strings.IndexAny(value, ",|"); i >= 0 {
+			entry, fallbackOnError, value = value[:i], value[i] == '|', value[i+1:]
+		} else {
+			entry, value = value, ""
+		}
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		entries = append(entries, proxyEntry{
+			url:             strings.TrimSuffix(entry, "/"),
+			fallbackOnError: fallbackOnError,
+		})
+	}
+	return entries
+}
+
+// proxyClient fetches module metadata using the module proxy protocol. Every
+// version lookup goes through it (falling back to 'go list -m' when it returns
+// errDirect), so it's the one place to substitute a fake source of versions
+// (like the tests do, with one that holds them in memory).
+type proxyClient interface {
+	fetch(ctx context.Context, path, endpoint string) ([]byte, error)
+}
+
+// proxy is the client that versions are looked up with
+var proxy proxyClient = goproxyClient{}
+
+// proxyFetch fetches the given endpoint (e.g. "@v/list", or "@v/v1.2.3.info")
+// for the module path
+func proxyFetch(ctx context.Context, path, endpoint string) ([]byte, error) {
+	// NOTE: Responses are cached per GOPROXY setting, since proxies can
+	// disagree (e.g. a corporate proxy that only serves some modules)
+	entries, noProxy, err := goproxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	key := []string{"proxy", noProxy}
+	for _, entry := range entries {
+		key = append(key, fmt.Sprintf("%s|%t", entry.url, entry.fallbackOnError))
+	}
+	key = append(key, path, endpoint)
+	if entry := readCache(key...); entry != nil {
+		return entry.result()
+	}
+
+	body, err := proxy.fetch(ctx, path, endpoint)
+	writeCache(body, err, key...)
+	return body, err
+}
+
+// goproxyClient fetches module metadata from the proxies configured by
+// GOPROXY, falling back through the list the same way the go command does
+type goproxyClient struct{}
+
+func (goproxyClient) fetch(ctx context.Context, path, endpoint string) ([]byte, error) {
+	entries, noProxy, err := goproxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Private modules are always fetched directly, like the go command does
+	if module.MatchPrefixPatterns(noProxy, path) {
+		return nil, errDirect
+	}
+
+	escaped, err := module.EscapePath(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid module path %s: %s", path, err)
+	}
+
+	// NOTE: The failures of the proxies tried before the one that answered
+	// (or failed for good) are kept, so that it's clear which hop of the
+	// chain failed, and how
+	var tried []string
+	lastErr := fmt.Errorf("no proxies configured: %w", errNotFound)
+	for _, entry := range entries {
+		switch entry.url {
+		case "direct":
+			if *verbose && len(entries) > 1 {
+				fmt.Printf("%s/%s: fetching directly%s\n", path, endpoint, afterFailures(tried))
+			}
+			return nil, errDirect
+		case "off":
+			return nil, fmt.Errorf("module lookup disabled by GOPROXY=off%s", afterFailures(tried))
+		}
+
+		body, err := fetchURL(ctx, entry.url+"/"+escaped+"/"+endpoint)
+		if err == nil {
+			if *verbose && len(entries) > 1 {
+				fmt.Printf("%s/%s: answered by %s%s\n", path, endpoint, entry.url, afterFailures(tried))
+			}
+			return body, nil
+		}
+		if !errors.Is(err, errNotFound) && !entry.fallbackOnError {
+			return nil, fmt.Errorf("%w%s", err, afterFailures(tried))
+		}
+		lastErr = fmt.Errorf("%w%s", err, afterFailures(tried))
+		tried = append(tried, err.Error())
+	}
+	return nil, lastErr
+}
+
+// afterFailures describes the failures of the proxies tried before (e.g. "
+// (after reading https://corp.example/...: 404 Not Found)"), if any
+func afterFailures(tried []string) string {
+	if len(tried) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (after %s)", strings.Join(tried, "; "))
+}
+
+type httpStatusError struct {
+	url  string
+	code int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("reading %s: %d %s", e.url, e.code, http.StatusText(e.code))
+}
+
+// fetchURL returns the body of the given proxy URL, retrying transient
+// failures (network errors, 429 and 5xx responses) up to -retries times.
+func fetchURL(ctx context.Context, rawURL string) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		body, err := fetchURLOnce(ctx, rawURL)
+		if err == nil || !isTransient(err) || attempt >= *retries || ctx.Err() != nil {
+			return body, err
+		}
+
+		delay := backoff(attempt)
+		if *verbose {
+			fmt.Printf("Retrying in %s: %s\n", delay.Round(time.Millisecond), err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+	}
+}
+
+func fetchURLOnce(ctx context.Context, rawURL string) ([]byte, error) {
+	// The go command supports file:// proxies (e.g. a module cache directory)
+	if strings.HasPrefix(rawURL, "file://") {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		body, err := os.ReadFile(u.Path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("reading %s: %w", rawURL, errNotFound)
+		}
+		return body, err
+	}
+
+	release, err := requests.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(resp.Body)
+	case http.StatusNotFound, http.StatusGone:
+		return nil, fmt.Errorf("%w: %w", &httpStatusError{url: rawURL, code: resp.StatusCode}, errNotFound)
+	default:
+		return nil, &httpStatusError{url: rawURL, code: resp.StatusCode}
+	}
+}
+
+// requestLimiter limits the rate (with -rate) and the concurrency (with
+// -max-requests) of requests to module proxies, so that probing many modules
+// (e.g. with all, report or serve) doesn't trip the proxies' rate limits.
+// Requests are spaced evenly, rather than allowed in bursts.
+type requestLimiter struct {
+	once  sync.Once
+	slots chan struct{} // Nil without -max-requests
+
+	lock sync.Mutex
+	next time.Time // When the next request can be made
+}
+
+// requests limits the requests to module proxies
+var requests = &requestLimiter{}
+
+// acquire waits until a request can be made, and returns a function to call
+// once it's done
+func (l *requestLimiter) acquire(ctx context.Context) (func(), error) {
+	l.once.Do(func() {
+		if *maxRequests > 0 {
+			l.slots = make(chan struct{}, *maxRequests)
+		}
+	})
+
+	if *rate > 0 {
+		interval := time.Duration(float64(time.Second) / *rate)
+		l.lock.Lock()
+		now := time.Now()
+		start := l.next
+		if start.Before(now) {
+			start = now
+		}
+		l.next = start.Add(interval)
+		l.lock.Unlock()
+
+		if wait := time.Until(start); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, context.Cause(ctx)
+			case <-time.After(wait):
+			}
+		}
+	}
+
+	if l.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, nil
+	}
+}
+
+func isTransient(err error) bool {
+	if errors.Is(err, errNotFound) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.code == http.StatusTooManyRequests || statusErr.code >= 500
+	}
+	// Anything else is a network error
+	return true
+}
+
+// listVersions returns the tagged versions of the given module known to the
+// proxy (which may be empty, if the module exists but has no tags).
+func listVersions(ctx context.Context, path string) ([]string, error) {
+	body, err := proxyFetch(ctx, path, "@v/list")
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []string
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && semver.IsValid(fields[0]) {
+			versions = append(versions, fields[0])
+		}
+	}
+	return versions, nil
+}
+
+// queryVersion resolves a version query for the given module. The query can
+// be a complete version (e.g. v2.3.4, or a pseudo-version), or a prefix of one
+// (e.g. v2 or v2.3), in which case the highest matching release is returned
+// (or the highest matching pre-release, if there are no releases). Returns an
+// error wrapping errNotFound if no version matches.
+func queryVersion(ctx context.Context, path, query string) (string, error) {
+	versions, err := listVersions(ctx, path)
+	if errors.Is(err, errDirect) {
+		return queryVersionDirect(ctx, path, query)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var releases, prereleases []string
+	for _, version := range versions {
+		if !matchesQuery(version, query) {
+			continue
+		}
+		if semver.Prerelease(version) == "" {
+			releases = append(releases, version)
+		} else {
+			prereleases = append(prereleases, version)
+		}
+	}
+	candidates := releases
+	if len(candidates) == 0 {
+		candidates = prereleases
+	}
+	// The highest matching version is selected, unless it's newer than
+	// -min-age allows, or requires a newer go version than the target versions
+	// are limited to (see goVersionLimit)
+	semver.Sort(candidates)
+	var unbuildable []string
+	for i := len(candidates) - 1; i >= 0; i-- {
+		ok, err := oldEnough(ctx, path, candidates[i])
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			continue
+		}
+		if ok, err = buildable(ctx, path, candidates[i]); err != nil {
+			return "", err
+		}
+		if !ok {
+			unbuildable = append(unbuildable, candidates[i])
+			continue
+		}
+		warnUnbuildable(ctx, path, unbuildable)
+		return candidates[i], nil
+	}
+	warnUnbuildable(ctx, path, unbuildable)
+	if len(unbuildable) > 0 {
+		_, reason := goVersionLimit(ctx)
+		return "", fmt.Errorf("no versions of %s matching %s can be built with %s: %w", path, query, reason, errNotFound)
+	}
+	if len(candidates) > 0 {
+		return "", fmt.Errorf("no versions of %s matching %s published at least %s ago: %w", path, query, minAge.String(), errNotFound)
+	}
+
+	// Complete versions that aren't tagged (e.g. pseudo-versions) aren't
+	// included in the list, but can still be requested directly
+	if semver.Canonical(query) == query {
+		body, err := proxyFetch(ctx, path, "@v/"+escapeVersion(query)+".info")
+		if err != nil {
+			return "", err
+		}
+		info, err := decodeInfo(body)
+		if err != nil {
+			return "", fmt.Errorf("error decoding module info for %s@%s: %s", path, query, err)
+		}
+		if !checkAge(path, query, info.Time) {
+			return "", fmt.Errorf("%s@%s was published less than %s ago: %w", path, query, minAge.String(), errNotFound)
+		}
+		return query, nil
+	}
+
+	return "", fmt.Errorf("no versions of %s matching %s: %w", path, query, errNotFound)
+}
+
+// matchesQuery reports whether the version matches the given complete version
+// or version prefix (in which case v2.3 matches v2.3.1, but not v2.30.0).
+func matchesQuery(version, query string) bool {
+	if semver.Canonical(query) == query {
+		return version == query
+	}
+	return strings.HasPrefix(version, query+".")
+}
+
+func escapeVersion(version string) string {
+	escaped, err := module.EscapeVersion(version)
+	if err != nil {
+		return version
+	}
+	return escaped
+}
+
+// queryVersionDirect resolves a version query via 'go list -m', for modules
+// that must be fetched directly from version control.
+// NOTE: Without a proxy's status codes, any error other than a transient one
+// is assumed to mean the version doesn't exist.
+func queryVersionDirect(ctx context.Context, path, query string) (string, error) {
+	// Queries are resolved in the context of the module being upgraded, so
+	// they're cached per module directory
+	abs, err := filepath.Abs(*dir)
+	if err != nil {
+		abs = *dir
+	}
+	key := []string{"direct", abs, path, query}
+	var info moduleInfo
+	if entry := readCache(key...); entry != nil {
+		body, err := entry.result()
+		if err != nil {
+			return "", err
+		}
+		if err := json.Unmarshal(body, &info); err == nil {
+			return checkDirectVersion(path, query, info)
+		}
+	}
+
+	results, err := listModules(ctx, fmt.Sprintf("%s@%s", path, query))
+	if err != nil {
+		return "", fmt.Errorf("error getting module info: %s", err)
+	}
+	if len(results) == 0 {
+		return "", fmt.Errorf("no module info returned for %s@%s", path, query)
+	}
+	if result := results[0]; result.Error != nil {
+		err := fmt.Errorf("%s: %w", result.Error.Err, errNotFound)
+		writeCache(nil, err, key...)
+		return "", err
+	}
+	info.Version = results[0].Version
+	if results[0].Time != nil {
+		info.Time = *results[0].Time
+	}
+	if body, err := json.Marshal(info); err == nil {
+		writeCache(body, nil, key...)
+	}
+	return checkDirectVersion(path, query, info)
+}
+
+// checkDirectVersion returns the version that a query for a module fetched
+// directly resolved to, if it's old enough.
+// NOTE: Only the version the query resolves to is checked against -min-age,
+// rather than falling back to an older one, since modules fetched directly
+// can't be listed with their publish times cheaply
+func checkDirectVersion(path, query string, info moduleInfo) (string, error) {
+	if !info.Time.IsZero() && !checkAge(path, info.Version, info.Time) {
+		return "", fmt.Errorf("%s@%s (%s) was published less than %s ago: %w", path, query, info.Version, minAge.String(), errNotFound)
+	}
+	return info.Version, nil
+}
+
+// moduleInfo is the response of a module proxy's .info endpoint
+type moduleInfo struct {
+	Version string
+	Time    time.Time
+}
+
+func decodeInfo(body []byte) (moduleInfo, error) {
+	var info moduleInfo
+	err := json.Unmarshal(body, &info)
+	return info, err
+}
+
+// queryRevision resolves a revision (a commit hash or branch name) of the
+// given module to the pseudo-version of the commit (or the version it's
+// tagged with), via the proxy's .info endpoint. Returns an error wrapping
+// errNotFound if the revision doesn't exist, or isn't a revision of the module
+// at that path (e.g. because its go.mod declares a different major version).
+func queryRevision(ctx context.Context, path, revision string) (string, error) {
+	body, err := proxyFetch(ctx, path, "@v/"+escapeVersion(revision)+".info")
+	if errors.Is(err, errDirect) {
+		return queryVersionDirect(ctx, path, revision)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	info, err := decodeInfo(body)
+	if err != nil {
+		return "", fmt.Errorf("error decoding module info for %s@%s: %s", path, revision, err)
+	}
+	if !semver.IsValid(info.Version) {
+		return "", fmt.Errorf("invalid version %q returned for %s@%s", info.Version, path, revision)
+	}
+	if !checkAge(path, info.Version, info.Time) {
+		return "", fmt.Errorf("%s@%s (%s) was published less than %s ago: %w", path, revision, info.Version, minAge.String(), errNotFound)
+	}
+	return info.Version, nil
+}
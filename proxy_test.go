@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// fakeProxy is a proxyClient that serves the versions of modules from memory,
+// so that version lookups can be tested without a network or a module cache
+type fakeProxy map[string][]moduleInfo // Versions of each module path
+
+func (p fakeProxy) fetch(ctx context.Context, path, endpoint string) ([]byte, error) {
+	return serveEndpoint(p[path], path, endpoint)
+}
+
+// serveEndpoint returns the response of a module proxy to a request for the
+// given endpoint (e.g. "@v/list", "@v/v1.2.3.info", or "@latest") of a module
+// with the given versions, or an error wrapping errNotFound
+func serveEndpoint(versions []moduleInfo, path, endpoint string) ([]byte, error) {
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("unknown module %s: %w", path, errNotFound)
+	}
+
+	info := func(version string) ([]byte, error) {
+		for _, v := range versions {
+			if v.Version == version {
+				return json.Marshal(v)
+			}
+		}
+		return nil, fmt.Errorf("unknown version %s@%s: %w", path, version, errNotFound)
+	}
+
+	switch {
+	case endpoint == "@v/list":
+		var b strings.Builder
+		for _, v := range versions {
+			fmt.Fprintln(&b, v.Version)
+		}
+		return []byte(b.String()), nil
+	case endpoint == "@latest":
+		latest := versions[0].Version
+		for _, v := range versions[1:] {
+			if semver.Compare(v.Version, latest) > 0 {
+				latest = v.Version
+			}
+		}
+		return info(latest)
+	case strings.HasPrefix(endpoint, "@v/") && strings.HasSuffix(endpoint, ".info"):
+		version, err := module.UnescapeVersion(strings.TrimSuffix(strings.TrimPrefix(endpoint, "@v/"), ".info"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid version: %w", errNotFound)
+		}
+		return info(version)
+	case strings.HasPrefix(endpoint, "@v/") && strings.HasSuffix(endpoint, ".mod"):
+		version, err := module.UnescapeVersion(strings.TrimSuffix(strings.TrimPrefix(endpoint, "@v/"), ".mod"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid version: %w", errNotFound)
+		}
+		if _, err := info(version); err != nil {
+			return nil, err
+		}
+		return []byte(fmt.Sprintf("module %s\n", path)), nil
+	}
+	return nil, fmt.Errorf("unsupported endpoint %s: %w", endpoint, errNotFound)
+}
+
+// newTestProxy starts a module proxy serving the versions of the given
+// modules over HTTP, and returns its URL
+func newTestProxy(t *testing.T, modules map[string][]moduleInfo) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		escaped, endpoint, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/@")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		path, err := module.UnescapePath(escaped)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		body, err := serveEndpoint(modules[path], path, "@"+endpoint)
+		switch {
+		case errors.Is(err, errNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			w.Write(body)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// useProxy makes version lookups go through the given client for the rest of
+// the test, without caching them
+func useProxy(t *testing.T, client proxyClient) {
+	t.Helper()
+	oldProxy, oldTTL := proxy, *cacheTTL
+	proxy, *cacheTTL = client, 0
+	t.Cleanup(func() {
+		proxy, *cacheTTL = oldProxy, oldTTL
+	})
+}
+
+// useGoproxy makes the GOPROXY client use the given setting for the rest of
+// the test, instead of the one reported by 'go env'
+func useGoproxy(t *testing.T, value string) {
+	t.Helper()
+	useProxy(t, goproxyClient{})
+	proxyOnce = sync.Once{}
+	proxyOnce.Do(func() {
+		proxyEntries, proxyBypass, proxyErr = parseGoproxy(value), "", nil
+	})
+	t.Cleanup(func() {
+		proxyOnce = sync.Once{}
+	})
+}
+
+func published(date string) time.Time {
+	t, err := time.Parse(time.DateOnly, date)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+var testModules = map[string][]moduleInfo{
+	"example.com/lib": {
+		{Version: "v1.0.0", Time: published("2021-01-10")},
+		{Version: "v1.2.0", Time: published("2021-06-01")},
+		{Version: "v1.3.0-rc.1", Time: published("2021-09-15")},
+	},
+	"example.com/lib/v2": {
+		{Version: "v2.0.0", Time: published("2022-03-01")},
+		{Version: "v2.1.1", Time: published("2022-08-20")},
+	},
+	"example.com/lib/v3": {
+		{Version: "v3.0.0-beta.1", Time: published("2023-02-02")},
+	},
+	"example.com/Azure/sdk": {
+		{Version: "v1.4.0", Time: published("2024-05-05")},
+	},
+}
+
+func TestQueryVersion(t *testing.T) {
+	useProxy(t, fakeProxy(testModules))
+	ctx := context.Background()
+
+	tests := []struct {
+		path, query string
+		want        string
+		notFound    bool
+	}{
+		{path: "example.com/lib", query: "v1", want: "v1.2.0"},
+		{path: "example.com/lib", query: "v1.0", want: "v1.0.0"},
+		{path: "example.com/lib", query: "v1.3", want: "v1.3.0-rc.1"},
+		{path: "example.com/lib", query: "v1.0.0", want: "v1.0.0"},
+		{path: "example.com/lib", query: "v1.1", notFound: true},
+		{path: "example.com/lib/v2", query: "v2", want: "v2.1.1"},
+		{path: "example.com/lib/v3", query: "v3", want: "v3.0.0-beta.1"},
+		{path: "example.com/lib/v4", query: "v4", notFound: true},
+	}
+	for _, test := range tests {
+		t.Run(test.path+"@"+test.query, func(t *testing.T) {
+			got, err := queryVersion(ctx, test.path, test.query)
+			if test.notFound {
+				if !errors.Is(err, errNotFound) {
+					t.Fatalf("got %q, %v; want an error wrapping errNotFound", got, err)
+				}
+				return
+			}
+			if err != nil || got != test.want {
+				t.Fatalf("got %q, %v; want %q", got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestListMajors(t *testing.T) {
+	useProxy(t, fakeProxy(testModules))
+	ctx := context.Background()
+
+	listed, timedOut, err := listMajors(ctx, "example.com/lib", 2, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timedOut) != 0 {
+		t.Errorf("got timed out majors %v, want none", timedOut)
+	}
+	if len(listed) != 2 || len(listed[2]) != 2 || len(listed[3]) != 1 {
+		t.Errorf("got %v, want the versions of v2 and v3", listed)
+	}
+
+	got, err := queryHighestMajor(ctx, "example.com/lib", 2, 3)
+	if err != nil || got != "v3.0.0-beta.1" {
+		t.Errorf("got %q, %v; want %q", got, err, "v3.0.0-beta.1")
+	}
+}
+
+func TestGoproxyClient(t *testing.T) {
+	// The first proxy doesn't have any modules, so every lookup falls back
+	// to the second one
+	empty := newTestProxy(t, nil)
+	full := newTestProxy(t, testModules)
+	useGoproxy(t, empty+","+full)
+	ctx := context.Background()
+
+	t.Run("list", func(t *testing.T) {
+		got, err := listVersions(ctx, "example.com/lib/v2")
+		if err != nil || strings.Join(got, " ") != "v2.0.0 v2.1.1" {
+			t.Fatalf("got %v, %v; want [v2.0.0 v2.1.1]", got, err)
+		}
+	})
+
+	t.Run("info", func(t *testing.T) {
+		got, err := publishTime(ctx, "example.com/lib", "v1.2.0")
+		if err != nil || !got.Equal(published("2021-06-01")) {
+			t.Fatalf("got %s, %v; want 2021-06-01", got, err)
+		}
+	})
+
+	t.Run("latest", func(t *testing.T) {
+		body, err := proxyFetch(ctx, "example.com/lib", "@latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := decodeInfo(body)
+		if err != nil || info.Version != "v1.3.0-rc.1" {
+			t.Fatalf("got %+v, %v; want v1.3.0-rc.1", info, err)
+		}
+	})
+
+	t.Run("case-encoded path", func(t *testing.T) {
+		got, err := queryVersion(ctx, "example.com/Azure/sdk", "v1")
+		if err != nil || got != "v1.4.0" {
+			t.Fatalf("got %q, %v; want v1.4.0", got, err)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		_, err := listVersions(ctx, "example.com/missing")
+		if !errors.Is(err, errNotFound) {
+			t.Fatalf("got %v, want an error wrapping errNotFound", err)
+		}
+		if !strings.Contains(err.Error(), empty) {
+			t.Errorf("got %v, want the failure of %s too", err, empty)
+		}
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Renovate can delegate major upgrades of Go dependencies to this tool: a
+// Renovate custom datasource fetches the available versions of each
+// dependency from 'report -renovate' (as a file) or from serve (at
+// /renovate/{module}), including the latest version of its newest major
+// version, and a post-upgrade task runs 'upgrade {module} {version}' to
+// rewrite the imports, which Renovate can't do on its own.
+
+// renovateDatasource is the document a Renovate custom datasource expects for
+// each package. See https://docs.renovatebot.com/modules/datasource/custom/.
+type renovateDatasource struct {
+	Releases []renovateRelease `json:"releases"`
+	Homepage string            `json:"homepage,omitempty"`
+}
+
+type renovateRelease struct {
+	Version          string    `json:"version"`
+	ReleaseTimestamp time.Time `json:"releaseTimestamp,omitzero"`
+}
+
+// renovateDatasources returns the datasource documents of the dependencies,
+// by module path. Denied dependencies only list their current version, so
+// that Renovate doesn't propose upgrading them either, and dependencies that
+// couldn't be checked are left out.
+func renovateDatasources(dependencies []dependencyStatus) map[string]renovateDatasource {
+	datasources := map[string]renovateDatasource{}
+	for _, dependency := range dependencies {
+		if dependency.Error == "" {
+			datasources[dependency.Path] = newRenovateDatasource(dependency)
+		}
+	}
+	return datasources
+}
+
+func newRenovateDatasource(dependency dependencyStatus) renovateDatasource {
+	datasource := renovateDatasource{
+		Releases: []renovateRelease{{Version: dependency.Version}},
+		Homepage: "https://pkg.go.dev/" + dependency.Path,
+	}
+	if dependency.LatestVersion != "" && !dependency.Denied {
+		datasource.Releases = append(datasource.Releases, renovateRelease{
+			Version:          dependency.LatestVersion,
+			ReleaseTimestamp: dependency.LatestPublished,
+		})
+		datasource.Homepage = "https://pkg.go.dev/" + dependency.LatestPath
+	}
+	return datasource
+}
+
+// handleRenovate serves the datasource document of a dependency of any of the
+// watched modules
+func (s *statusServer) handleRenovate(w http.ResponseWriter, r *http.Request) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	path := r.PathValue("path")
+	for _, status := range s.statuses {
+		for _, dependency := range status.Dependencies {
+			if dependency.Path == path && dependency.Error == "" {
+				writeJSON(w, http.StatusOK, newRenovateDatasource(dependency))
+				return
+			}
+		}
+	}
+	writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown dependency: " + path})
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+)
+
+// Dependencies can be replaced by a fork (i.e. by another module, as opposed
+// to a local directory), e.g.:
+//
+//	require github.com/orig/lib v1.2.0
+//	replace github.com/orig/lib => github.com/fork/lib v1.5.0
+//
+// In that case, the module's code imports the original path, but the versions
+// that matter are the fork's. Upgrading such a dependency (given either its
+// original or its fork path) upgrades the fork to the upstream's new major
+// version (or its own, see forkUpgradeVersion), and moves both the
+// requirement and the replacement to the corresponding major version of the
+// original path:
+//
+//	require github.com/orig/lib/v2 v2.0.0
+//	replace github.com/orig/lib/v2 => github.com/fork/lib/v2 v2.0.0
+
+// findForkReplacement returns the replacement of a dependency by a fork,
+// given either the dependency's path, or the fork's. Returns nil if there
+// isn't one.
+func findForkReplacement(file *modfile.File, path string) *modfile.Replace {
+	for _, replace := range file.Replace {
+		// Directory replacements have no version
+		if replace.New.Version == "" {
+			continue
+		}
+		if replace.Old.Path == path || replace.New.Path == path {
+			return replace
+		}
+	}
+	return nil
+}
+
+// upgradeReplacedDependency upgrades a dependency that's replaced by a fork to
+// the given version of the fork (or to its highest major version, if no
+// version is given)
+func upgradeReplacedDependency(ctx context.Context, file *modfile.File, replace *modfile.Replace, version string) []upgrade {
+	forkUpgrade, err := resolveForkUpgrade(ctx, file, replace, version)
+	if err != nil {
+		log.Fatalf("Error upgrading replaced dependency %s: %s", replace.Old.Path, err)
+	}
+	if forkUpgrade == nil {
+		log.Fatalf("No versions available for upgrade")
+	}
+	applyForkUpgrade(file, replace, *forkUpgrade)
+	return []upgrade{*forkUpgrade}
+}
+
+// resolveForkUpgrade finds the version to upgrade a fork to, returning nil if
+// there's no higher major version of the fork
+func resolveForkUpgrade(ctx context.Context, file *modfile.File, replace *modfile.Replace, version string) (*upgrade, error) {
+	var (
+		origPath = replace.Old.Path
+		forkPath = replace.New.Path
+	)
+
+	var found, indirect bool
+	for _, require := range file.Require {
+		if require.Mod.Path == origPath {
+			found, indirect = true, require.Indirect
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("module not a known dependency: %s (replaced by %s)", origPath, forkPath)
+	}
+
+	var (
+		newForkPath string
+		newVersion  string
+		err         error
+	)
+	if version == "" {
+		newForkPath, newVersion, err = forkUpgradeVersion(ctx, origPath, forkPath)
+		if err != nil {
+			return nil, err
+		}
+		if newVersion == "" {
+			return nil, nil
+		}
+	} else {
+		newForkPath, newVersion, err = upgradePathToVersion(ctx, forkPath, version)
+		if err != nil {
+			return nil, fmt.Errorf("error getting upgrade path and version of %s: %s", forkPath, err)
+		}
+	}
+
+	newOrigPath, err := upgradePath(origPath, newVersion)
+	if err != nil {
+		return nil, fmt.Errorf("error upgrading module path %s to %s: %s", origPath, newVersion, err)
+	}
+
+	return &upgrade{
+		oldPath:     origPath,
+		newPath:     newOrigPath,
+		oldVersion:  replace.New.Version,
+		newVersion:  newVersion,
+		indirect:    indirect,
+		oldForkPath: forkPath,
+		newForkPath: newForkPath,
+	}, nil
+}
+
+// forkUpgradeVersion returns the path and version to upgrade a fork to, when
+// no version was given. The fork follows the upstream: if the original module
+// has a higher major version, the fork is upgraded to the same major version,
+// either to its latest release in it, or (if the fork hasn't tagged one yet)
+// to the head of a branch named after it (e.g. "v2"), since that's how forks
+// usually keep up with upstream major versions before releasing them. If the
+// upstream hasn't released a higher major version, or the fork doesn't have
+// the matching one, the fork is upgraded to its own highest major version.
+// Returns an empty version if there's nothing to upgrade to.
+func forkUpgradeVersion(ctx context.Context, origPath, forkPath string) (string, string, error) {
+	upstreamVersion, err := getUpgradeVersion(ctx, origPath)
+	if err != nil {
+		return "", "", fmt.Errorf("error finding upgrade version of %s: %s", origPath, err)
+	}
+	if upstreamVersion != "" {
+		major := fmt.Sprintf("v%d", majorNumber(upstreamVersion))
+		newForkPath, err := upgradePath(forkPath, major)
+		if err != nil {
+			return "", "", fmt.Errorf("error upgrading module path %s to %s: %s", forkPath, major, err)
+		}
+
+		newVersion, err := queryVersion(ctx, newForkPath, major)
+		if errors.Is(err, errNotFound) {
+			// NOTE: A branch resolves to a pseudo-version of its head
+			// commit, which is only accepted at the new path if the
+			// branch's go.mod declares it
+			newVersion, err = queryRevision(ctx, newForkPath, major)
+		}
+		switch {
+		case err == nil:
+			if *verbose {
+				fmt.Printf("%s: matching %s %s\n", newForkPath, origPath, upstreamVersion)
+			}
+			return newForkPath, newVersion, nil
+		case errors.Is(err, errNotFound):
+			warnf("%s has a new major version (%s), but its fork %s has no %s release or branch", origPath, upstreamVersion, forkPath, major)
+		default:
+			return "", "", fmt.Errorf("error getting module info for %s: %s", newForkPath, err)
+		}
+	}
+
+	newVersion, err := getUpgradeVersion(ctx, forkPath)
+	if err != nil {
+		return "", "", fmt.Errorf("error finding upgrade version of %s: %s", forkPath, err)
+	}
+	if newVersion == "" {
+		return "", "", nil
+	}
+	newForkPath, err := upgradePath(forkPath, newVersion)
+	if err != nil {
+		return "", "", fmt.Errorf("error upgrading module path %s to %s: %s", forkPath, newVersion, err)
+	}
+	return newForkPath, newVersion, nil
+}
+
+// applyForkUpgrade updates the requirement and the replacement of a dependency
+// that's replaced by a fork
+func applyForkUpgrade(file *modfile.File, replace *modfile.Replace, upgrade upgrade) {
+	fmt.Printf("%s => %s %s -> %s => %s %s\n",
+		upgrade.oldPath, upgrade.oldForkPath, upgrade.oldVersion,
+		upgrade.newPath, upgrade.newForkPath, upgrade.newVersion,
+	)
+
+	// The required version of a replaced module is ignored (the replacement
+	// applies to all of its versions), but it must be valid for its major
+	// version, so the fork's version is used
+	if err := replaceRequire(file, upgrade.oldPath, upgrade.newPath, upgrade.newVersion); err != nil {
+		log.Fatalf("Error replacing module requirement %s: %s", upgrade.oldPath, err)
+	}
+	if err := replaceReplace(file, replace.Old.Path, upgrade.newPath, upgrade.newForkPath, upgrade.newVersion); err != nil {
+		log.Fatalf("Error replacing %s with %s: %s", upgrade.newPath, upgrade.newForkPath, err)
+	}
+}
+
+// confirmLocalReplacements asks for confirmation before upgrading dependencies
+// that are replaced by a local directory (unless the replacement is moved with
+// -replace-local, or -allow-replaced is set), since rewriting the imports
+// quietly decouples the code from the local checkout it was built against.
+// Exits if the upgrade isn't confirmed, or can't be (e.g. in CI, where stdin
+// isn't a terminal).
+func confirmLocalReplacements(file *modfile.File, upgrades []upgrade) {
+	if *replaceLocal || *allowReplace {
+		return
+	}
+	var replaced []string
+	for _, upgrade := range upgrades {
+		for _, replace := range file.Replace {
+			if replace.Old.Path == upgrade.oldPath && replace.New.Version == "" {
+				replaced = append(replaced, fmt.Sprintf("%s is replaced by the local directory %s, which won't apply to %s once its imports are rewritten",
+					upgrade.oldPath, replace.New.Path, upgrade.newPath,
+				))
+				break
+			}
+		}
+	}
+	if len(replaced) == 0 {
+		return
+	}
+
+	for _, message := range replaced {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", message)
+	}
+	if !stdinIsTerminal() {
+		log.Fatalf("Not upgrading dependencies replaced by local directories without confirmation: use -allow-replaced to upgrade them anyway, or -replace-local to move the replacements")
+	}
+	if !confirm("Upgrade anyway?") {
+		log.Fatalf("Upgrade cancelled: use -allow-replaced to upgrade dependencies replaced by local directories without confirmation")
+	}
+	// NOTE: The runs started by -batch are given the flag, so that they don't
+	// ask again
+	flag.Set("allow-replaced", "true")
+}
+
+// checkLocalReplacements warns about upgraded dependencies that are replaced
+// by a local directory (e.g. 'replace example.com/lib => ../lib'), since the
+// replacement doesn't apply to the new major version of the dependency, and
+// the local checkout's module path needs to be upgraded too. With
+// -replace-local, the replacement is moved to the new major version instead.
+func checkLocalReplacements(file *modfile.File, dir string, upgrades []upgrade) {
+	for _, upgrade := range upgrades {
+		for _, replace := range file.Replace {
+			if replace.Old.Path != upgrade.oldPath || replace.New.Version != "" {
+				continue
+			}
+
+			local := replace.New.Path
+			if !filepath.IsAbs(local) {
+				local = filepath.Join(dir, local)
+			}
+			localPath := ""
+			if b, err := os.ReadFile(filepath.Join(local, "go.mod")); err == nil {
+				localPath = modfile.ModulePath(b)
+			}
+
+			line := replace.Syntax.Start.Line
+			if localPath != upgrade.newPath {
+				warnfAt("go.mod", line, "%s is replaced by the local directory %s, whose module path (%s) needs to be upgraded to %s",
+					upgrade.oldPath, replace.New.Path, localPath, upgrade.newPath,
+				)
+			}
+			if !*replaceLocal {
+				warnfAt("go.mod", line, "the replacement of %s by %s doesn't apply to %s (use -replace-local to move it)",
+					upgrade.oldPath, replace.New.Path, upgrade.newPath,
+				)
+				break
+			}
+
+			if *verbose {
+				fmt.Printf("Moving the replacement of %s by %s to %s\n", upgrade.oldPath, replace.New.Path, upgrade.newPath)
+			}
+			if err := replaceReplace(file, upgrade.oldPath, upgrade.newPath, replace.New.Path, ""); err != nil {
+				log.Fatalf("Error replacing %s with %s: %s", upgrade.newPath, replace.New.Path, err)
+			}
+			break
+		}
+	}
+}
+
+// Dependencies replaced by a local directory (e.g. 'replace example.com/lib =>
+// ../lib', usually another module of the same repository) follow the module
+// in the directory: once its major version is upgraded (e.g. by -r),
+// upgrading the dependency moves its requirement, its replacement and its
+// imports to the local module's new path. Since the new major version isn't
+// published yet, the upgrade has no new version (like an upgrade of the
+// current module), and the requirement is given the first version of the new
+// major version, which is valid for it, and ignored because of the
+// replacement.
+
+// findLocalReplacement returns the replacement of a dependency by a local
+// directory, or nil if there isn't one
+func findLocalReplacement(file *modfile.File, path string) *modfile.Replace {
+	for _, replace := range file.Replace {
+		if replace.Old.Path == path && replace.New.Version == "" {
+			return replace
+		}
+	}
+	return nil
+}
+
+// upgradeLocalDependency upgrades a dependency replaced by the local module in
+// the given directory (relative to the module directory dir) to the local
+// module's path, if its major version is higher than the required one.
+// Returns nil otherwise.
+func upgradeLocalDependency(file *modfile.File, dir string, replace *modfile.Replace) []upgrade {
+	local := replace.New.Path
+	if !filepath.IsAbs(local) {
+		local = filepath.Join(dir, local)
+	}
+	b, err := os.ReadFile(filepath.Join(local, "go.mod"))
+	if err != nil {
+		return nil
+	}
+	localPath := modfile.ModulePath(b)
+	prefix, _, _ := module.SplitPathVersion(replace.Old.Path)
+	if localPrefix, _, ok := module.SplitPathVersion(localPath); !ok || localPrefix != prefix {
+		return nil
+	}
+
+	var require *modfile.Require
+	for _, r := range file.Require {
+		if r.Mod.Path == replace.Old.Path {
+			require = r
+		}
+	}
+	if require == nil || currentMajor(localPath, "") <= currentMajor(require.Mod.Path, require.Mod.Version) {
+		return nil
+	}
+
+	version := fmt.Sprintf("v%d.0.0", currentMajor(localPath, ""))
+	fmt.Printf("%s %s -> %s (replaced by %s)\n", require.Mod.Path, require.Mod.Version, localPath, replace.New.Path)
+	u := upgrade{
+		oldPath:    require.Mod.Path,
+		newPath:    localPath,
+		oldVersion: require.Mod.Version,
+		indirect:   require.Indirect,
+	}
+	if err := replaceRequire(file, u.oldPath, u.newPath, version); err != nil {
+		log.Fatalf("Error replacing module requirement %s: %s", u.oldPath, err)
+	}
+	if err := replaceReplace(file, u.oldPath, u.newPath, replace.New.Path, ""); err != nil {
+		log.Fatalf("Error replacing %s with %s: %s", u.newPath, replace.New.Path, err)
+	}
+	return []upgrade{u}
+}
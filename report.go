@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+)
+
+// report prints how many major versions behind each of the module's
+// dependencies is, along with its latest available version, as a table (or,
+// with -format=csv, as CSV, or with -format=sarif, as SARIF), (with -json) as
+// JSON, (with -html) as an HTML
+// page or (with -renovate) as Renovate datasource documents. Nothing is
+// modified.
+func report(ctx context.Context, dir string, args []string) {
+	flags := flag.NewFlagSet("report", flag.ExitOnError)
+	asHTML := flags.Bool("html", false, "print the report as a standalone HTML page")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	asRenovate := flags.Bool("renovate", false, "print the Renovate custom datasource document of each dependency, as JSON")
+	flags.Parse(args)
+
+	status := checkModule(ctx, dir)
+	if status.Error != "" {
+		log.Fatalf("Error checking module: %s", status.Error)
+	}
+	if err := ctx.Err(); err != nil {
+		log.Fatalf("Report cancelled: %s", context.Cause(ctx))
+	}
+
+	if *asHTML {
+		err := writeHTMLReport("-", htmlReport{
+			Title:        "Dependencies of " + status.Path,
+			Module:       status.Path,
+			Generated:    status.CheckedAt,
+			Staleness:    true,
+			Dependencies: status.Dependencies,
+			MajorsBehind: status.MajorsBehind,
+		})
+		if err != nil {
+			log.Fatalf("Error writing HTML report: %s", err)
+		}
+		return
+	}
+	if *asRenovate {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(renovateDatasources(status.Dependencies)); err != nil {
+			log.Fatalf("Error encoding report: %s", err)
+		}
+		return
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(status); err != nil {
+			log.Fatalf("Error encoding report: %s", err)
+		}
+		return
+	}
+
+	if *outputFormat == formatSARIF {
+		if err := writeStatusSARIF(os.Stdout, dir, status.Dependencies, "warning"); err != nil {
+			log.Fatalf("Error encoding report: %s", err)
+		}
+		return
+	}
+
+	printStatusTable(status.Dependencies)
+	if *outputFormat != formatCSV {
+		fmt.Printf("\n%s is %d major version(s) behind in total\n", status.Path, status.MajorsBehind)
+	}
+}
+
+// printStatusTable prints the latest major version of each dependency (and
+// when it was published), and how many major versions behind it is, as a table (or, with -format=csv, as
+// CSV)
+func printStatusTable(dependencies []dependencyStatus) {
+	if *outputFormat == formatCSV {
+		printStatusCSV(dependencies)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MODULE\tVERSION\tLATEST\tPUBLISHED\tBEHIND")
+	for _, dependency := range dependencies {
+		latest, published := "-", "-"
+		if dependency.LatestVersion != "" {
+			latest = dependency.LatestPath + " " + dependency.LatestVersion
+		}
+		if !dependency.LatestPublished.IsZero() {
+			published = formatDate(dependency.LatestPublished)
+		}
+		behind := fmt.Sprint(dependency.MajorsBehind)
+		if dependency.Error != "" {
+			latest, published, behind = "error: "+dependency.Error, "-", "?"
+		}
+		module := dependency.Path
+		if dependency.Indirect {
+			module += " (indirect)"
+		}
+		if dependency.Denied {
+			module += " (denied)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", module, dependency.Version, latest, published, behind)
+	}
+	w.Flush()
+}
+
+// printStatusCSV prints the status of each dependency as a CSV record, e.g.
+// for spreadsheets of dependency audits
+func printStatusCSV(dependencies []dependencyStatus) {
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"module", "version", "indirect", "denied", "latest_module", "latest_version", "latest_published", "majors_behind", "error"})
+	for _, dependency := range dependencies {
+		w.Write([]string{
+			dependency.Path,
+			dependency.Version,
+			strconv.FormatBool(dependency.Indirect),
+			strconv.FormatBool(dependency.Denied),
+			dependency.LatestPath,
+			dependency.LatestVersion,
+			formatDate(dependency.LatestPublished),
+			strconv.Itoa(dependency.MajorsBehind),
+			dependency.Error,
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Fatalf("Error writing CSV: %s", err)
+	}
+}
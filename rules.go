@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"reflect"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// rewriteRule is a gofmt -r style rewrite rule, e.g.:
+//
+//	foo.NewClient(x) -> foo.NewClient(ctx, x)
+//
+// Single-character lowercase identifiers in the pattern are wildcards, which
+// match any expression, and are substituted into the replacement.
+type rewriteRule struct {
+	text        string
+	pattern     ast.Expr
+	replacement ast.Expr
+}
+
+// loadRules reads rewrite rules from the named file, one per line. Blank lines
+// and lines starting with '#' or '//' are ignored.
+func loadRules(filename string) ([]rewriteRule, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading rules file: %s", err)
+	}
+
+	var rules []rewriteRule
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") || strings.HasPrefix(text, "//") {
+			continue
+		}
+		rule, err := parseRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", filename, line, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+func parseRule(text string) (rewriteRule, error) {
+	pattern, replacement, ok := strings.Cut(text, "->")
+	if !ok || strings.Contains(replacement, "->") {
+		return rewriteRule{}, fmt.Errorf("rewrite rule must be of the form 'pattern -> replacement'")
+	}
+	patternExpr, err := parser.ParseExpr(pattern)
+	if err != nil {
+		return rewriteRule{}, fmt.Errorf("error parsing pattern %q: %s", strings.TrimSpace(pattern), err)
+	}
+	replacementExpr, err := parser.ParseExpr(replacement)
+	if err != nil {
+		return rewriteRule{}, fmt.Errorf("error parsing replacement %q: %s", strings.TrimSpace(replacement), err)
+	}
+	return rewriteRule{
+		text:        fmt.Sprintf("%s -> %s", formatExpr(patternExpr), formatExpr(replacementExpr)),
+		pattern:     patternExpr,
+		replacement: replacementExpr,
+	}, nil
+}
+
+func formatExpr(expr ast.Expr) string {
+	var buf bytes.Buffer
+	format.Node(&buf, token.NewFileSet(), expr)
+	return buf.String()
+}
+
+// apply rewrites every match of the rule's pattern in the file, returning the
+// number of matches.
+//
+// NOTE: This works the same way as gofmt -r (and is largely borrowed from
+// cmd/gofmt/rewrite.go): the AST is walked via reflection, and each node that
+// matches the pattern is replaced by a copy of the replacement, positioned
+// where the matched node was.
+func (r rewriteRule) apply(fset *token.FileSet, file *ast.File) int {
+	cmap := ast.NewCommentMap(fset, file, file.Comments)
+	m := map[string]reflect.Value{}
+	pattern := reflect.ValueOf(r.pattern)
+	replacement := reflect.ValueOf(r.replacement)
+
+	var matches int
+	var rewriteVal func(val reflect.Value) reflect.Value
+	rewriteVal = func(val reflect.Value) reflect.Value {
+		if !val.IsValid() {
+			return reflect.Value{}
+		}
+		val = applyRewrite(rewriteVal, val)
+		clear(m)
+		if matchNode(m, pattern, val) {
+			matches++
+			val = substNode(m, replacement, reflect.ValueOf(val.Interface().(ast.Node).Pos()))
+		}
+		return val
+	}
+
+	applyRewrite(rewriteVal, reflect.ValueOf(file))
+	file.Comments = cmap.Filter(file).Comments()
+	return matches
+}
+
+var (
+	objectPtrNil = reflect.ValueOf((*ast.Object)(nil))
+	scopePtrNil  = reflect.ValueOf((*ast.Scope)(nil))
+
+	identType     = reflect.TypeOf((*ast.Ident)(nil))
+	objectPtrType = reflect.TypeOf((*ast.Object)(nil))
+	positionType  = reflect.TypeOf(token.NoPos)
+	callExprType  = reflect.TypeOf((*ast.CallExpr)(nil))
+	scopePtrType  = reflect.TypeOf((*ast.Scope)(nil))
+)
+
+// setValue sets x to y, unless x can't be set to y (e.g. if a rule would
+// replace a statement-level node with an expression)
+func setValue(x, y reflect.Value) {
+	if !x.CanSet() || !y.IsValid() {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			if s, ok := r.(string); ok && (strings.Contains(s, "type mismatch") || strings.Contains(s, "not assignable")) {
+				return
+			}
+			panic(r)
+		}
+	}()
+	x.Set(y)
+}
+
+// applyRewrite replaces each AST field x in val with f(x), returning val
+func applyRewrite(f func(reflect.Value) reflect.Value, val reflect.Value) reflect.Value {
+	if !val.IsValid() {
+		return reflect.Value{}
+	}
+
+	// Objects and scopes introduce cycles, and are likely to be incorrect
+	// after a rewrite, so they're dropped
+	switch val.Type() {
+	case objectPtrType:
+		return objectPtrNil
+	case scopePtrType:
+		return scopePtrNil
+	}
+
+	switch v := reflect.Indirect(val); v.Kind() {
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			e := v.Index(i)
+			setValue(e, f(e))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			e := v.Field(i)
+			setValue(e, f(e))
+		}
+	case reflect.Interface:
+		e := v.Elem()
+		setValue(v, f(e))
+	}
+	return val
+}
+
+func isWildcard(s string) bool {
+	r, size := utf8.DecodeRuneInString(s)
+	return size == len(s) && unicode.IsLower(r)
+}
+
+// matchNode reports whether the pattern matches val, recording wildcard
+// submatches in m. If m is nil, it checks whether the pattern equals val.
+func matchNode(m map[string]reflect.Value, pattern, val reflect.Value) bool {
+	// A wildcard matches any expression, but if it appears more than once in
+	// the pattern, it must match the same expression each time
+	if m != nil && pattern.IsValid() && pattern.Type() == identType {
+		name := pattern.Interface().(*ast.Ident).Name
+		if isWildcard(name) && val.IsValid() {
+			if _, ok := val.Interface().(ast.Expr); ok && !val.IsNil() {
+				if old, ok := m[name]; ok {
+					return matchNode(nil, old, val)
+				}
+				m[name] = val
+				return true
+			}
+		}
+	}
+
+	if !pattern.IsValid() || !val.IsValid() {
+		return !pattern.IsValid() && !val.IsValid()
+	}
+	if pattern.Type() != val.Type() {
+		return false
+	}
+
+	switch pattern.Type() {
+	case identType:
+		p := pattern.Interface().(*ast.Ident)
+		v := val.Interface().(*ast.Ident)
+		return p == nil && v == nil || p != nil && v != nil && p.Name == v.Name
+	case objectPtrType, positionType:
+		return true
+	case callExprType:
+		// f(x) and f(x...) are different calls
+		p := pattern.Interface().(*ast.CallExpr)
+		v := val.Interface().(*ast.CallExpr)
+		if p.Ellipsis.IsValid() != v.Ellipsis.IsValid() {
+			return false
+		}
+	}
+
+	p := reflect.Indirect(pattern)
+	v := reflect.Indirect(val)
+	if !p.IsValid() || !v.IsValid() {
+		return !p.IsValid() && !v.IsValid()
+	}
+
+	switch p.Kind() {
+	case reflect.Slice:
+		if p.Len() != v.Len() {
+			return false
+		}
+		for i := 0; i < p.Len(); i++ {
+			if !matchNode(m, p.Index(i), v.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Struct:
+		for i := 0; i < p.NumField(); i++ {
+			if !matchNode(m, p.Field(i), v.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Interface:
+		return matchNode(m, p.Elem(), v.Elem())
+	}
+
+	// Token kinds, literal values, etc.
+	return p.Interface() == v.Interface()
+}
+
+// substNode returns a copy of the pattern with the values in m substituted
+// for its wildcards, and with pos as the position of its tokens. If m is nil,
+// it returns a copy of the pattern, with its positions unchanged.
+func substNode(m map[string]reflect.Value, pattern reflect.Value, pos reflect.Value) reflect.Value {
+	if !pattern.IsValid() {
+		return reflect.Value{}
+	}
+
+	if m != nil && pattern.Type() == identType {
+		name := pattern.Interface().(*ast.Ident).Name
+		if isWildcard(name) {
+			if old, ok := m[name]; ok {
+				return substNode(nil, old, reflect.Value{})
+			}
+		}
+	}
+
+	if pos.IsValid() && pattern.Type() == positionType {
+		// Only replace positions that were valid to begin with
+		if old := pattern.Interface().(token.Pos); !old.IsValid() {
+			return pattern
+		}
+		return pos
+	}
+
+	switch p := pattern; p.Kind() {
+	case reflect.Slice:
+		// go/ast expects some lists to be nil if they're empty
+		if p.IsNil() {
+			return reflect.Zero(p.Type())
+		}
+		v := reflect.MakeSlice(p.Type(), p.Len(), p.Len())
+		for i := 0; i < p.Len(); i++ {
+			v.Index(i).Set(substNode(m, p.Index(i), pos))
+		}
+		return v
+	case reflect.Struct:
+		v := reflect.New(p.Type()).Elem()
+		for i := 0; i < p.NumField(); i++ {
+			v.Field(i).Set(substNode(m, p.Field(i), pos))
+		}
+		return v
+	case reflect.Pointer:
+		v := reflect.New(p.Type()).Elem()
+		if elem := p.Elem(); elem.IsValid() {
+			v.Set(substNode(m, elem, pos).Addr())
+		}
+		return v
+	case reflect.Interface:
+		v := reflect.New(p.Type()).Elem()
+		if elem := p.Elem(); elem.IsValid() {
+			v.Set(substNode(m, elem, pos))
+		}
+		return v
+	}
+	return pattern
+}
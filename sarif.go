@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/mod/modfile"
+)
+
+// With -format=sarif, the dependencies found by the report and enforce
+// targets are printed as a SARIF log, for code scanning platforms (e.g. by
+// uploading it with GitHub's codeql-action/upload-sarif), with each result
+// pointing at the dependency's require line in the go.mod file. See
+// https://docs.oasis-open.org/sarif/sarif/v2.1.0/sarif-v2.1.0.html.
+
+const (
+	sarifSchema  = "https://json.schemastore.org/sarif-2.1.0.json"
+	sarifVersion = "2.1.0"
+
+	sarifRuleOutdated = "outdated-major"
+	sarifRuleError    = "check-failed"
+)
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+	HelpURI          string       `json:"helpUri,omitempty"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"` // note, warning or error
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine int `json:"startLine"`
+}
+
+// writeStatusSARIF writes a SARIF log of the dependencies of the module in the
+// given directory, at the given level: one result for each dependency that's
+// behind its latest major version, or that couldn't be checked. Paths are
+// relative to the current directory (which is the root of the repository, in
+// a workflow).
+func writeStatusSARIF(w io.Writer, dir string, dependencies []dependencyStatus, level string) error {
+	filePath := filepath.Join(dir, "go.mod")
+	lines := map[string]int{} // Lines of the require directives, by module path
+	if b, err := os.ReadFile(filePath); err == nil {
+		if file, err := modfile.Parse(filePath, b, nil); err == nil {
+			for _, require := range file.Require {
+				if require.Syntax != nil {
+					lines[require.Mod.Path] = require.Syntax.Start.Line
+				}
+			}
+		}
+	}
+
+	results := []sarifResult{}
+	for _, dependency := range dependencies {
+		result := sarifResult{
+			RuleID: sarifRuleOutdated,
+			Level:  level,
+		}
+		switch {
+		case dependency.Error != "":
+			result.RuleID = sarifRuleError
+			result.Message.Text = fmt.Sprintf("Couldn't check %s for newer major versions: %s", dependency.Path, dependency.Error)
+		case dependency.MajorsBehind > 0:
+			result.Message.Text = fmt.Sprintf("%s %s is %d major version(s) behind its latest version, %s %s",
+				dependency.Path, dependency.Version, dependency.MajorsBehind, dependency.LatestPath, dependency.LatestVersion,
+			)
+		default:
+			continue
+		}
+
+		location := sarifLocation{PhysicalLocation: sarifPhysicalLocation{
+			ArtifactLocation: sarifArtifactLocation{URI: relativePath(filePath)},
+		}}
+		if line := lines[dependency.Path]; line > 0 {
+			location.PhysicalLocation.Region = &sarifRegion{StartLine: line}
+		}
+		result.Locations = []sarifLocation{location}
+		results = append(results, result)
+	}
+
+	sarif := sarifLog{
+		Schema:  sarifSchema,
+		Version: sarifVersion,
+		Runs: []sarifRun{{
+			Tool: sarifTool{Driver: sarifDriver{
+				Name:           "upgrade",
+				InformationURI: "https://github.com/nicheinc/upgrade",
+				Rules: []sarifRule{
+					{
+						ID:               sarifRuleOutdated,
+						ShortDescription: sarifMessage{Text: "Dependency is behind its latest major version"},
+						HelpURI:          "https://github.com/nicheinc/upgrade",
+					},
+					{
+						ID:               sarifRuleError,
+						ShortDescription: sarifMessage{Text: "Dependency couldn't be checked for newer major versions"},
+					},
+				},
+			}},
+			Results: results,
+		}},
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sarif)
+}
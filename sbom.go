@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/modfile"
+)
+
+// The subset of the CycloneDX 1.5 JSON format needed to describe the
+// dependencies changed by an upgrade.
+// See https://cyclonedx.org/docs/1.5/json/.
+type cycloneDXBOM struct {
+	BOMFormat    string               `json:"bomFormat"`
+	SpecVersion  string               `json:"specVersion"`
+	SerialNumber string               `json:"serialNumber"`
+	Version      int                  `json:"version"`
+	Metadata     cycloneDXMetadata    `json:"metadata"`
+	Components   []cycloneDXComponent `json:"components"`
+}
+
+type cycloneDXMetadata struct {
+	Timestamp string             `json:"timestamp"`
+	Tools     cycloneDXTools     `json:"tools"`
+	Component cycloneDXComponent `json:"component"`
+}
+
+type cycloneDXTools struct {
+	Components []cycloneDXComponent `json:"components"`
+}
+
+type cycloneDXComponent struct {
+	Type       string              `json:"type"`
+	BOMRef     string              `json:"bom-ref,omitempty"`
+	Name       string              `json:"name"`
+	Version    string              `json:"version,omitempty"`
+	PURL       string              `json:"purl,omitempty"`
+	Properties []cycloneDXProperty `json:"properties,omitempty"`
+}
+
+type cycloneDXProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// requirements returns the module requirements in the go.mod file, mapped
+// from module path to version
+func requirements(file *modfile.File) map[string]string {
+	required := map[string]string{}
+	for _, require := range file.Require {
+		required[require.Mod.Path] = require.Mod.Version
+	}
+	return required
+}
+
+// writeSBOM writes a CycloneDX fragment describing the requirements changed by
+// the upgrade: each upgraded dependency at its old and new versions, plus any
+// (typically transitive) requirements that were added, removed or changed as
+// a consequence. Each component's "upgrade:change" property says whether it
+// was "removed" or "added" by the upgrade.
+func writeSBOM(filename, mainPath string, upgrades []upgrade, before, after map[string]string) error {
+	var components []cycloneDXComponent
+	addComponent := func(path, version, change, reason string) {
+		component := cycloneDXComponent{
+			Type:    "library",
+			BOMRef:  purl(path, version),
+			Name:    path,
+			Version: version,
+			PURL:    purl(path, version),
+			Properties: []cycloneDXProperty{
+				{Name: "upgrade:change", Value: change},
+				{Name: "upgrade:reason", Value: reason},
+			},
+		}
+		components = append(components, component)
+	}
+
+	upgraded := map[string]bool{}
+	for _, upgrade := range upgrades {
+		if upgrade.oldVersion == "" || upgrade.newVersion == "" {
+			continue
+		}
+		upgraded[upgrade.oldPath] = true
+		upgraded[upgrade.newPath] = true
+		addComponent(upgrade.oldSource(), upgrade.oldVersion, "removed", "upgraded")
+		addComponent(upgrade.newSource(), upgrade.newVersion, "added", "upgraded")
+	}
+
+	var paths []string
+	for path := range before {
+		paths = append(paths, path)
+	}
+	for path := range after {
+		if _, ok := before[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if upgraded[path] || before[path] == after[path] {
+			continue
+		}
+		if version, ok := before[path]; ok {
+			addComponent(path, version, "removed", "requirement changed")
+		}
+		if version, ok := after[path]; ok {
+			addComponent(path, version, "added", "requirement changed")
+		}
+	}
+
+	bom := cycloneDXBOM{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + newUUID(),
+		Version:      1,
+		Metadata: cycloneDXMetadata{
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+			Tools: cycloneDXTools{
+				Components: []cycloneDXComponent{{
+					Type: "application",
+					Name: "upgrade",
+				}},
+			},
+			Component: cycloneDXComponent{
+				Type:   "application",
+				BOMRef: purl(mainPath, ""),
+				Name:   mainPath,
+				PURL:   purl(mainPath, ""),
+			},
+		},
+		Components: components,
+	}
+
+	out, err := json.MarshalIndent(bom, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding SBOM: %s", err)
+	}
+	if err := os.WriteFile(filename, append(out, '\n'), 0o644); err != nil {
+		return fmt.Errorf("error writing SBOM file %s: %s", filename, err)
+	}
+	return nil
+}
+
+// purl returns the package URL of the given Go module version.
+// See https://github.com/package-url/purl-spec.
+func purl(path, version string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	p := "pkg:golang/" + strings.Join(segments, "/")
+	if version != "" {
+		p += "@" + url.PathEscape(version)
+	}
+	return p
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/sync/errgroup"
+)
+
+// moduleStatus reports how far behind the latest major versions a module's
+// dependencies are, as of its last check
+type moduleStatus struct {
+	Path         string             `json:"path"`
+	Dir          string             `json:"dir"`
+	CheckedAt    time.Time          `json:"checkedAt"`
+	Error        string             `json:"error,omitempty"`
+	MajorsBehind int                `json:"majorsBehind"` // Total over all dependencies
+	Dependencies []dependencyStatus `json:"dependencies"`
+}
+
+type dependencyStatus struct {
+	Path          string `json:"path"`
+	Version       string `json:"version"`
+	Indirect      bool   `json:"indirect,omitempty"`
+	Denied        bool   `json:"denied,omitempty"` // By the -policy file
+	LatestPath    string `json:"latestPath,omitempty"`
+	LatestVersion string `json:"latestVersion,omitempty"`
+	// When the latest version was published, if the module proxy says
+	LatestPublished time.Time `json:"latestPublished,omitzero"`
+	MajorsBehind    int       `json:"majorsBehind"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// statusServer periodically checks a set of modules for available major
+// upgrades, and serves the results
+type statusServer struct {
+	dirs []string
+
+	lock     sync.RWMutex
+	statuses []moduleStatus // In the same order as dirs
+}
+
+// serve watches the given module directories (or, if none are given, all
+// modules within the module directory), checking them for available major
+// upgrades every interval, and serves the results over HTTP until the context
+// is cancelled. Nothing is modified.
+func serve(ctx context.Context, args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("addr", ":8080", "`address` to listen on")
+	interval := flags.Duration("interval", time.Hour, "how often to check for upgrades")
+	metrics := flags.Bool("metrics", false, "serve Prometheus metrics at /metrics")
+	flags.Parse(args)
+
+	dirs := flags.Args()
+	if len(dirs) == 0 {
+		var err error
+		dirs, err = findModules(*dir)
+		if err != nil {
+			log.Fatalf("Error finding modules in %s: %s", *dir, err)
+		}
+	}
+	if len(dirs) == 0 {
+		log.Fatalf("No modules found in %s", *dir)
+	}
+	if *interval <= 0 {
+		log.Fatalf("Invalid -interval %s: must be positive", *interval)
+	}
+
+	s := &statusServer{dirs: dirs}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /modules", s.handleModules)
+	mux.HandleFunc("GET /modules/{path...}", s.handleModule)
+	mux.HandleFunc("GET /renovate/{path...}", s.handleRenovate)
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	if *metrics {
+		mux.HandleFunc("GET /metrics", s.handleMetrics)
+	}
+
+	server := &http.Server{Addr: *addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		s.check(ctx)
+		ticker := time.NewTicker(*interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.check(ctx)
+			}
+		}
+	}()
+
+	fmt.Printf("Serving the status of %d module(s) on %s\n", len(dirs), *addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("Error serving HTTP: %s", err)
+	}
+}
+
+// check checks each module for available major upgrades, and replaces the
+// served statuses with the results
+func (s *statusServer) check(ctx context.Context) {
+	statuses := make([]moduleStatus, len(s.dirs))
+	for i, dir := range s.dirs {
+		statuses[i] = checkModule(ctx, dir)
+		if statuses[i].Error != "" {
+			warnf("error checking module %s: %s", dir, statuses[i].Error)
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	s.lock.Lock()
+	previous := s.statuses
+	s.statuses = statuses
+	s.lock.Unlock()
+
+	// Notify about major versions released since the previous check
+	if previous == nil {
+		return
+	}
+	for i, status := range statuses {
+		if detected := newUpgrades(previous[i], status); len(detected) > 0 {
+			notify(ctx, eventDetected, status.Path, status.Dir, detected)
+		}
+	}
+}
+
+// newUpgrades returns the upgrades available in the current status of a
+// module that weren't in its previous status
+func newUpgrades(previous, current moduleStatus) []upgrade {
+	latest := map[string]string{}
+	for _, dependency := range previous.Dependencies {
+		latest[dependency.Path] = dependency.LatestVersion
+	}
+
+	var upgrades []upgrade
+	for _, dependency := range current.Dependencies {
+		if dependency.Denied || dependency.LatestVersion == "" || dependency.LatestVersion == latest[dependency.Path] {
+			continue
+		}
+		upgrades = append(upgrades, upgrade{
+			oldPath:    dependency.Path,
+			newPath:    dependency.LatestPath,
+			oldVersion: dependency.Version,
+			newVersion: dependency.LatestVersion,
+		})
+	}
+	return upgrades
+}
+
+// checkModule checks the dependencies of the module in the given directory
+// for available major upgrades. The go.mod file is re-read on every check, so
+// that upgrades made since the last one are picked up. Indirect dependencies
+// are only checked with -indirect.
+func checkModule(ctx context.Context, dir string) moduleStatus {
+	status := moduleStatus{Dir: dir, CheckedAt: time.Now().UTC()}
+
+	filePath := filepath.Join(dir, "go.mod")
+	b, err := os.ReadFile(filePath)
+	if err != nil {
+		status.Error = fmt.Sprintf("error reading module file %s: %s", filePath, err)
+		return status
+	}
+	file, err := modfile.Parse(filePath, b, nil)
+	if err != nil {
+		status.Error = fmt.Sprintf("error parsing module file %s: %s", filePath, err)
+		return status
+	}
+	status.Path = file.Module.Mod.Path
+
+	var requires []*modfile.Require
+	for _, require := range file.Require {
+		if !require.Indirect || *indirect {
+			requires = append(requires, require)
+		}
+	}
+
+	status.Dependencies = make([]dependencyStatus, len(requires))
+	g := errgroup.Group{}
+	g.SetLimit(*jobs)
+	for i, require := range requires {
+		g.Go(func() error {
+			status.Dependencies[i] = checkDependency(ctx, require)
+			return nil
+		})
+	}
+	g.Wait()
+
+	for _, dependency := range status.Dependencies {
+		status.MajorsBehind += dependency.MajorsBehind
+	}
+	return status
+}
+
+// checkDependency finds the latest major version of a required module, and
+// how many major versions behind it the requirement is
+func checkDependency(ctx context.Context, require *modfile.Require) dependencyStatus {
+	status := dependencyStatus{
+		Path:     require.Mod.Path,
+		Version:  require.Mod.Version,
+		Indirect: require.Indirect,
+	}
+	if entry := policyFor(require.Mod.Path); entry != nil {
+		status.Denied = entry.Deny
+	}
+
+	version, err := getUpgradeVersion(ctx, require.Mod.Path)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	if version == "" {
+		return status
+	}
+	newPath, err := upgradePath(require.Mod.Path, version)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+
+	status.LatestPath = newPath
+	status.LatestVersion = version
+	// NOTE: The publish date is just informative, so failing to get it isn't
+	// an error
+	if published, err := publishTime(ctx, newPath, version); err == nil {
+		status.LatestPublished = published.UTC()
+	} else if *verbose {
+		fmt.Printf("Error getting publish time of %s@%s: %s\n", newPath, version, err)
+	}
+	status.MajorsBehind = majorNumber(version) - currentMajor(require.Mod.Path, require.Mod.Version)
+	return status
+}
+
+// currentMajor returns the major version number of a module requirement.
+// Versions v0 and v1 both count as 1, since neither has a major version suffix.
+func currentMajor(path, version string) int {
+	if _, pathMajor, ok := module.SplitPathVersion(path); ok && pathMajor != "" {
+		n, _ := pathMajorNumber(pathMajor)
+		return max(n, 1)
+	}
+	return max(majorNumber(version), 1)
+}
+
+func majorNumber(version string) int {
+	n, _ := strconv.Atoi(strings.TrimPrefix(semver.Major(version), "v"))
+	return n
+}
+
+func (s *statusServer) handleModules(w http.ResponseWriter, r *http.Request) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	writeJSON(w, http.StatusOK, s.statuses)
+}
+
+func (s *statusServer) handleModule(w http.ResponseWriter, r *http.Request) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	path := r.PathValue("path")
+	for _, status := range s.statuses {
+		if status.Path == path {
+			writeJSON(w, http.StatusOK, status)
+			return
+		}
+	}
+	writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown module: " + path})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// handleMetrics serves the statuses in the Prometheus text exposition format.
+// See https://prometheus.io/docs/instrumenting/exposition_formats/.
+func (s *statusServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	statuses := append([]moduleStatus(nil), s.statuses...)
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Dir < statuses[j].Dir })
+
+	var b strings.Builder
+	fmt.Fprintln(&b, "# HELP upgrade_module_majors_behind Total number of major versions the module's dependencies are behind.")
+	fmt.Fprintln(&b, "# TYPE upgrade_module_majors_behind gauge")
+	for _, status := range statuses {
+		fmt.Fprintf(&b, "upgrade_module_majors_behind{module=%s,dir=%s} %d\n",
+			metricLabel(status.Path), metricLabel(status.Dir), status.MajorsBehind,
+		)
+	}
+	fmt.Fprintln(&b, "# HELP upgrade_module_check_success Whether the last check of the module succeeded.")
+	fmt.Fprintln(&b, "# TYPE upgrade_module_check_success gauge")
+	for _, status := range statuses {
+		success := 1
+		if status.Error != "" {
+			success = 0
+		}
+		fmt.Fprintf(&b, "upgrade_module_check_success{module=%s,dir=%s} %d\n",
+			metricLabel(status.Path), metricLabel(status.Dir), success,
+		)
+	}
+	fmt.Fprintln(&b, "# HELP upgrade_module_last_check_timestamp_seconds Time of the last check of the module.")
+	fmt.Fprintln(&b, "# TYPE upgrade_module_last_check_timestamp_seconds gauge")
+	for _, status := range statuses {
+		fmt.Fprintf(&b, "upgrade_module_last_check_timestamp_seconds{module=%s,dir=%s} %d\n",
+			metricLabel(status.Path), metricLabel(status.Dir), status.CheckedAt.Unix(),
+		)
+	}
+	fmt.Fprintln(&b, "# HELP upgrade_dependency_majors_behind Number of major versions the dependency is behind.")
+	fmt.Fprintln(&b, "# TYPE upgrade_dependency_majors_behind gauge")
+	for _, status := range statuses {
+		for _, dependency := range status.Dependencies {
+			fmt.Fprintf(&b, "upgrade_dependency_majors_behind{module=%s,dependency=%s,version=%s,latest=%s} %d\n",
+				metricLabel(status.Path), metricLabel(dependency.Path), metricLabel(dependency.Version),
+				metricLabel(dependency.LatestVersion), dependency.MajorsBehind,
+			)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, b.String())
+}
+
+var metricLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func metricLabel(value string) string {
+	return `"` + metricLabelReplacer.Replace(value) + `"`
+}
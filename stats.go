@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runStats collects statistics about the run, which are printed as a summary
+// at the end of it
+type runStats struct {
+	lock sync.Mutex
+
+	start    time.Time
+	phases   []phaseStats
+	packages int // Packages scanned
+	files    int // Files scanned
+	modified int // Files modified
+	imports  int // Import specs rewritten
+
+	checksums   []string // Checksum verification results
+	vetFindings []string // New findings of go vet (with -vet)
+	modChanges  []string // Changes made to the go.mod file
+}
+
+type phaseStats struct {
+	name    string
+	elapsed time.Duration
+}
+
+var stats = runStats{start: time.Now()}
+
+// startPhase records the start of a phase of the run, returning a function
+// that records its end. For example:
+//
+//	defer stats.startPhase("load packages")()
+//
+// A phase that's run several times (e.g. loading each chunk of packages with
+// -chunk) is recorded once, with the total time taken.
+func (s *runStats) startPhase(name string) func() {
+	start := time.Now()
+	return func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		for i := range s.phases {
+			if s.phases[i].name == name {
+				s.phases[i].elapsed += time.Since(start)
+				return
+			}
+		}
+		s.phases = append(s.phases, phaseStats{name: name, elapsed: time.Since(start)})
+	}
+}
+
+func (s *runStats) add(field *int, n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	*field += n
+}
+
+func (s *runStats) addChecksum(path, version, status string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.checksums = append(s.checksums, fmt.Sprintf("%s %s %s", path, version, status))
+}
+
+func (s *runStats) addVetFinding(finding string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.vetFindings = append(s.vetFindings, finding)
+}
+
+func (s *runStats) setModChanges(changes []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.modChanges = changes
+}
+
+// printSummary prints the upgrades performed, the number of packages and
+// files processed, and the time taken by each phase of the run.
+func (s *runStats) printSummary(upgrades []upgrade) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var b strings.Builder
+	if len(upgrades) == 0 {
+		fmt.Fprintln(&b, "\tNo upgrades")
+	}
+	for _, upgrade := range upgrades {
+		switch {
+		case upgrade.oldVersion == "":
+			fmt.Fprintf(&b, "\t%s -> %s\n", upgrade.oldPath, upgrade.newPath)
+		case upgrade.newVersion == "":
+			// Dependencies replaced by a local module have no new version
+			fmt.Fprintf(&b, "\t%s %s -> %s\n", upgrade.oldPath, upgrade.oldVersion, upgrade.newPath)
+		default:
+			fmt.Fprintf(&b, "\t%s %s -> %s %s\n", upgrade.oldPath, upgrade.oldVersion, upgrade.newPath, upgrade.newVersion)
+		}
+	}
+	fmt.Fprintf(&b, "\tPackages scanned:  %d\n", s.packages)
+	fmt.Fprintf(&b, "\tFiles scanned:     %d\n", s.files)
+	fmt.Fprintf(&b, "\tFiles modified:    %d\n", s.modified)
+	fmt.Fprintf(&b, "\tImports rewritten: %d\n", s.imports)
+	for _, checksum := range s.checksums {
+		fmt.Fprintf(&b, "\tChecksum:          %s\n", checksum)
+	}
+	for _, change := range s.modChanges {
+		fmt.Fprintf(&b, "\tgo.mod change:     %s\n", change)
+	}
+	for _, finding := range s.vetFindings {
+		fmt.Fprintf(&b, "\tVet finding:       %s\n", finding)
+	}
+
+	var phases []string
+	for _, phase := range s.phases {
+		phases = append(phases, fmt.Sprintf("%s %s", phase.name, formatDuration(phase.elapsed)))
+	}
+	fmt.Fprintf(&b, "\tElapsed time:      %s (%s)\n", formatDuration(time.Since(s.start)), strings.Join(phases, ", "))
+
+	noticef("Summary", "%s", b.String())
+}
+
+func formatDuration(d time.Duration) string {
+	switch {
+	case d >= time.Second:
+		return d.Round(10 * time.Millisecond).String()
+	case d >= time.Millisecond:
+		return d.Round(time.Millisecond).String()
+	default:
+		return d.Round(time.Microsecond).String()
+	}
+}
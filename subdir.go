@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// Some modules publish each new major version from a subdirectory of the
+// repository named after it (e.g. v2/), rather than from a branch, so that
+// the major versions can be maintained side by side (see
+// https://go.dev/wiki/Modules#releasing-modules-v2-or-higher). With -subdir,
+// upgrading the module itself copies it to that subdirectory first, and then
+// upgrades the copy (its go.mod file's module path, and its imports of its own
+// packages), leaving the module as it is.
+
+// copyToMajorSubdir copies the module in the given directory to the
+// subdirectory of its next major version (or of the given one), and returns
+// the subdirectory's path
+func copyToMajorSubdir(dir, path, version string) string {
+	file := readModFile(dir)
+	modulePath := file.Module.Mod.Path
+	if path != "" && path != modulePath {
+		log.Fatalf("The -subdir flag can only be used when upgrading the module itself (%s)", modulePath)
+	}
+	if version != "" {
+		if !semver.IsValid(version) {
+			log.Fatalf("Invalid upgrade version: %s", version)
+		}
+		version = semver.Major(version)
+	}
+	newPath, err := upgradePath(modulePath, version)
+	if err != nil {
+		log.Fatalf("Error upgrading module path %s to %s: %s", modulePath, version, err)
+	}
+	_, pathMajor, _ := module.SplitPathVersion(newPath)
+	elem, ok := strings.CutPrefix(pathMajor, "/")
+	if !ok {
+		log.Fatalf("The -subdir flag can't be used with %s, whose major versions aren't path elements", newPath)
+	}
+	target := filepath.Join(dir, elem)
+	if _, err := os.Stat(target); err == nil {
+		log.Fatalf("Error copying module: %s already exists", target)
+	}
+
+	fmt.Printf("Copying %s to %s\n", modulePath, target)
+	if err := copyModule(dir, target); err != nil {
+		log.Fatalf("Error copying module to %s: %s", target, err)
+	}
+
+	// NOTE: Replacements by local directories are relative to the module
+	// directory, which is now one level deeper
+	copied := readModFile(target)
+	for _, replace := range copied.Replace {
+		if replace.New.Version != "" || filepath.IsAbs(replace.New.Path) {
+			continue
+		}
+		local := filepath.ToSlash(filepath.Join("..", replace.New.Path))
+		if err := copied.AddReplace(replace.Old.Path, replace.Old.Version, local, ""); err != nil {
+			log.Fatalf("Error moving the replacement of %s: %s", replace.Old.Path, err)
+		}
+	}
+	writeModFile(target, copied)
+	return target
+}
+
+// copyModule copies the files of the module in the given directory (except
+// for nested modules, and files ignored by git) to the target directory,
+// within it
+func copyModule(dir, target string) error {
+	ig, err := newIgnorer(dir)
+	if err != nil {
+		return err
+	}
+	nestedRoots, err := nestedModuleRoots(ig)
+	if err != nil {
+		return err
+	}
+	// The target directory is skipped like a nested module
+	abs, err := filepath.Abs(target)
+	if err != nil {
+		return err
+	}
+	nestedRoots = append(nestedRoots, abs)
+
+	return walkFiles(ig, func(filename string) error {
+		if inNestedModule(filename, nestedRoots) {
+			return nil
+		}
+		rel, err := filepath.Rel(ig.root, filename)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Join(target, rel)
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(name, b); err != nil {
+			return fmt.Errorf("error writing file %s: %s", name, err)
+		}
+		return os.Chmod(name, info.Mode().Perm())
+	})
+}
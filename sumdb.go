@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// verifyChecksums checks the new version of each upgraded dependency against
+// the checksum database, the same way the go command does when it adds a
+// module to a go.sum file: by downloading it from outside of any module (so
+// that no go.sum file vouches for it). Modules excluded from checksum
+// verification (by GOSUMDB=off, or GONOSUMDB/GOPRIVATE) are reported as
+// unverified. The result for each module is recorded for the summary.
+func verifyChecksums(ctx context.Context, upgrades []upgrade) error {
+	sumdb, noSumdb, err := sumdbSettings(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, upgrade := range upgrades {
+		// Nothing to verify when upgrading the current module
+		if upgrade.newVersion == "" {
+			continue
+		}
+
+		path, version := upgrade.newSource(), upgrade.newVersion
+		var status string
+		switch {
+		case sumdb == "off":
+			status = "not verified (GOSUMDB=off)"
+		case module.MatchPrefixPatterns(noSumdb, path):
+			status = "not verified (matches GONOSUMDB/GOPRIVATE)"
+		default:
+			downloaded, err := downloadModule(ctx, path, version)
+			if err != nil {
+				return fmt.Errorf("error verifying checksum of %s %s: %s", path, version, err)
+			}
+			status = fmt.Sprintf("verified by %s (%s)", strings.Fields(sumdb)[0], downloaded.Sum)
+		}
+
+		if *verbose {
+			fmt.Printf("%s %s: %s\n", path, version, status)
+		}
+		stats.addChecksum(path, version, status)
+	}
+	return nil
+}
+
+// sumdbSettings returns the GOSUMDB and GONOSUMDB settings (the latter
+// defaults to GOPRIVATE), as reported by 'go env'
+func sumdbSettings(ctx context.Context) (sumdb, noSumdb string, err error) {
+	cmd := exec.CommandContext(ctx, "go", "env", "GOSUMDB", "GONOSUMDB")
+	cmd.Dir = os.TempDir()
+	out, err := cmd.Output()
+	if err != nil {
+		return "", "", fmt.Errorf("error executing 'go env GOSUMDB GONOSUMDB' command: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	sumdb = strings.TrimSpace(lines[0])
+	if len(lines) > 1 {
+		noSumdb = strings.TrimSpace(lines[1])
+	}
+	if sumdb == "" {
+		sumdb = "off"
+	}
+	return sumdb, noSumdb, nil
+}
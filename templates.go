@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// The default templates of the commit message and pull request description
+// of each upgrade applied with -batch
+const (
+	defaultCommitTemplate = `Upgrade {{.Module}} to {{.NewModule}}
+
+Upgrades {{.Module}} {{.OldVersion}} to {{.NewModule}} {{.NewVersion}}.
+`
+	defaultPRTemplate = `Upgrades {{.Module}} {{.OldVersion}} to {{.NewModule}} {{.NewVersion}}.
+{{- if .ModChanges}}
+
+Changes to go.mod:
+{{range .ModChanges}}
+- {{.}}
+{{- end}}
+{{- end}}
+{{- if .VetFindings}}
+
+New go vet findings:
+{{range .VetFindings}}
+- ` + "`{{.}}`" + `
+{{- end}}
+{{- end}}
+`
+)
+
+var (
+	commitTemplate = template.Must(template.New("commit").Parse(defaultCommitTemplate))
+	prTemplate     = template.Must(template.New("pr").Parse(defaultPRTemplate))
+)
+
+// templateData is the data available to the commit message and pull request
+// description templates
+type templateData struct {
+	ctx     context.Context
+	upgrade upgrade
+
+	Module       string   // Old module path
+	NewModule    string   // New module path
+	OldVersion   string   // Old version
+	NewVersion   string   // New version
+	Branch       string   // Name of the branch the upgrade is committed to
+	FilesChanged []string // Paths of the files changed, relative to the repository root
+	VetFindings  []string // New findings of go vet, relative to the module directory (with -vet)
+	ModChanges   []string // Changes made to the go.mod file (e.g. "Updated requirement example.com/lib v1.2.0 -> v1.3.0")
+}
+
+// ReleaseNotes returns the release notes of the versions between the old and
+// new versions (see -notes). They're only looked up if a template uses them.
+func (d templateData) ReleaseNotes() string {
+	notes, err := releaseNotes(d.ctx, d.upgrade)
+	if err != nil {
+		warnf("error getting release notes for %s: %s", d.upgrade.newPath, err)
+		return ""
+	}
+	return strings.TrimSpace(formatReleaseNotes(d.upgrade, notes))
+}
+
+// loadTemplate parses the Go template (see https://pkg.go.dev/text/template)
+// in the given file
+func loadTemplate(name, filename string) (*template.Template, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading template file %s: %s", filename, err)
+	}
+	t, err := template.New(name).Option("missingkey=error").Parse(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing template file %s: %s", filename, err)
+	}
+	return t, nil
+}
+
+func executeTemplate(t *template.Template, data templateData) (string, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("error executing %s template: %s", t.Name(), err)
+	}
+	return b.String(), nil
+}
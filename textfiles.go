@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+// Build scripts, Dockerfiles and docs often refer to the packages of
+// dependencies too (e.g. 'go install example.com/lib/cmd/tool@v1.2.0'), and
+// silently break when only the imports are rewritten. With -text-file, the
+// references to upgraded modules in the non-Go files matching a glob pattern
+// are rewritten as well, in the same run, e.g.:
+//
+//	text-file:
+//	  - Dockerfile
+//	  - Makefile
+//	  - 'docs/*.md'
+//	  - '*.proto=option go_package = .*'
+//
+// Patterns without a slash match file names in any directory, like in a
+// .gitignore file. A pattern can be followed by '=' and a regular expression,
+// in which case only the references within its matches are rewritten. A
+// version following a reference (after an '@') is replaced by the new one.
+
+// textRule is a rule of the -text-file flag
+type textRule struct {
+	glob string
+	re   *regexp.Regexp // Nil to rewrite references anywhere in the file
+}
+
+// textRulesFlag is a flag of -text-file rules that can be given more than
+// once
+type textRulesFlag []textRule
+
+func (r *textRulesFlag) String() string {
+	var rules []string
+	for _, rule := range *r {
+		rules = append(rules, rule.String())
+	}
+	return strings.Join(rules, ", ")
+}
+
+func (r *textRulesFlag) Set(value string) error {
+	glob, expr, hasExpr := strings.Cut(value, "=")
+	if _, err := path.Match(glob, ""); err != nil || glob == "" {
+		return fmt.Errorf("invalid glob pattern %q", glob)
+	}
+	rule := textRule{glob: glob}
+	if hasExpr {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return err
+		}
+		rule.re = re
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+func (r textRule) String() string {
+	if r.re == nil {
+		return r.glob
+	}
+	return r.glob + "=" + r.re.String()
+}
+
+// matches reports whether the rule applies to the file at the given path,
+// relative to the module directory (with forward slashes)
+func (r textRule) matches(rel string) bool {
+	if !strings.Contains(r.glob, "/") {
+		rel = path.Base(rel)
+	}
+	ok, _ := path.Match(r.glob, rel)
+	return ok
+}
+
+// rewriteTextFiles rewrites the references to the upgraded modules in the
+// module's non-Go files that match the -text-file rules, returning the files
+// that were modified (which haven't been written to disk yet)
+func rewriteTextFiles(dir string, upgrades []upgrade) ([]file, error) {
+	if len(textRules) == 0 {
+		return nil, nil
+	}
+	ig, err := newIgnorer(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading ignore rules: %s", err)
+	}
+	nestedRoots, err := nestedModuleRoots(ig)
+	if err != nil {
+		return nil, err
+	}
+
+	var modified []file
+	err = walkFiles(ig, func(filename string) error {
+		switch filepath.Base(filename) {
+		case "go.mod", "go.sum", "go.work", "go.work.sum":
+			return nil
+		}
+		if filepath.Ext(filename) == ".go" {
+			return nil
+		}
+		if inNestedModule(filename, nestedRoots) {
+			return nil
+		}
+		rel, err := filepath.Rel(ig.root, filename)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		var rules []textRule
+		for _, rule := range textRules {
+			if rule.matches(rel) {
+				rules = append(rules, rule)
+			}
+		}
+		if len(rules) == 0 {
+			return nil
+		}
+
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			failures.add(failedRewrite, filename, fmt.Errorf("error reading file: %s", err))
+			return nil
+		}
+		out := string(content)
+		for _, rule := range rules {
+			if rule.re == nil {
+				out = replaceModuleReferences(out, upgrades)
+				continue
+			}
+			out = rule.re.ReplaceAllStringFunc(out, func(match string) string {
+				return replaceModuleReferences(match, upgrades)
+			})
+		}
+		if out == string(content) {
+			return nil
+		}
+		if *verbose {
+			fmt.Printf("Rewrote module references in %s\n", rel)
+		}
+		modified = append(modified, file{name: filename, content: []byte(out)})
+		return nil
+	})
+	return modified, err
+}
+
+// replaceModuleReferences replaces the references to the old paths of the
+// upgraded modules in the text (the module path itself, or the path of one of
+// its packages) with their new paths, along with the versions that follow
+// them (e.g. example.com/lib/cmd/tool@v1.2.0)
+func replaceModuleReferences(text string, upgrades []upgrade) string {
+	for _, upgrade := range upgrades {
+		if upgrade.oldPath != upgrade.newPath {
+			text = replaceModuleReference(text, upgrade)
+		}
+	}
+	return text
+}
+
+func replaceModuleReference(text string, upgrade upgrade) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(text, upgrade.oldPath)
+		if i < 0 {
+			b.WriteString(text)
+			return b.String()
+		}
+		end := i + len(upgrade.oldPath)
+		rest := text[end:]
+
+		// The path must be a whole path, rather than part of a longer one
+		// (e.g. example.com/library, or another major version, like
+		// example.com/lib/v2, given example.com/lib)
+		if (i > 0 && isPathChar(text[i-1], true)) || continuesPath(rest) || isMajorSuffix(rest) {
+			b.WriteString(text[:end])
+			text = rest
+			continue
+		}
+
+		b.WriteString(text[:i])
+		b.WriteString(upgrade.newPath)
+		// Package paths are kept, and versions are replaced
+		pkgEnd := 0
+		for pkgEnd < len(rest) && isPathChar(rest[pkgEnd], true) {
+			pkgEnd++
+		}
+		b.WriteString(rest[:pkgEnd])
+		rest = rest[pkgEnd:]
+		if version, ok := strings.CutPrefix(rest, "@"); ok && upgrade.newVersion != "" {
+			versionEnd := 0
+			for versionEnd < len(version) && isPathChar(version[versionEnd], false) {
+				versionEnd++
+			}
+			if semver.IsValid(version[:versionEnd]) {
+				b.WriteString("@" + upgrade.newVersion)
+				rest = version[versionEnd:]
+			}
+		}
+		text = rest
+	}
+}
+
+// isPathChar reports whether the character can be part of a module path (or,
+// if slash is false, of one of its elements)
+func isPathChar(c byte, slash bool) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	case c == '-', c == '.', c == '_', c == '~', c == '+':
+		return true
+	}
+	return slash && c == '/'
+}
+
+// continuesPath reports whether the text following a module path continues
+// its last element (a period ending a sentence doesn't)
+func continuesPath(rest string) bool {
+	if rest == "" || !isPathChar(rest[0], false) {
+		return false
+	}
+	return rest[0] != '.' || (len(rest) > 1 && isPathChar(rest[1], false))
+}
+
+// isMajorSuffix reports whether the text starts with a major version suffix
+// (e.g. /v2), as a path element of its own
+func isMajorSuffix(text string) bool {
+	elem, ok := strings.CutPrefix(text, "/v")
+	if !ok {
+		return false
+	}
+	n := 0
+	for n < len(elem) && '0' <= elem[n] && elem[n] <= '9' {
+		n++
+	}
+	return n > 0 && (n == len(elem) || !isPathChar(elem[n], false))
+}
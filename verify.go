@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// verifyMigration checks that no file of the module (or of the modules nested
+// in it) still imports the given module path, e.g. as a CI gate after a
+// manual or partial migration to a new major version. Every .go file is
+// parsed, regardless of its build constraints, so that files for other
+// platforms, tests and generated files are checked too (like when rewriting,
+// files ignored by git and testdata directories are skipped). The remaining
+// imports are printed, and the exit status is 1. Nothing is modified.
+func verifyMigration(dir, oldPath string) {
+	if oldPath == "" {
+		log.Fatalf("The verify target requires the module path to verify the migration from")
+	}
+	// NOTE: Imports are matched against the required modules as well, so
+	// that the packages of nested modules (e.g. example.com/lib/tools, given
+	// example.com/lib) aren't mistaken for the old module's
+	file := readModFile(dir)
+	modulePaths := []string{oldPath}
+	for _, require := range file.Require {
+		modulePaths = append(modulePaths, require.Mod.Path)
+	}
+	ig, err := newIgnorer(dir)
+	if err != nil {
+		log.Fatalf("Error reading ignore rules: %s", err)
+	}
+
+	type location struct {
+		filename   string
+		line, col  int
+		importPath string
+	}
+	var remaining []location
+	fset := token.NewFileSet()
+	err = walkFiles(ig, func(filename string) error {
+		if filepath.Ext(filename) != ".go" {
+			return nil
+		}
+		rel, err := filepath.Rel(ig.root, filename)
+		if err != nil {
+			return err
+		}
+		for _, elem := range strings.Split(filepath.ToSlash(rel), "/") {
+			if elem == "testdata" {
+				return nil
+			}
+		}
+
+		f, err := parser.ParseFile(fset, filename, nil, parser.ImportsOnly)
+		if err != nil {
+			return fmt.Errorf("error parsing file %s: %s", filename, err)
+		}
+		for _, spec := range f.Imports {
+			importPath, err := strconv.Unquote(spec.Path.Value)
+			if err != nil || matchModule(importPath, modulePaths) != oldPath {
+				continue
+			}
+			position := fset.Position(spec.Path.Pos())
+			remaining = append(remaining, location{
+				filename:   filename,
+				line:       position.Line,
+				col:        position.Column,
+				importPath: importPath,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Error finding imports: %s", err)
+	}
+
+	if len(remaining) == 0 {
+		fmt.Printf("No file imports %s\n", oldPath)
+		return
+	}
+	for _, loc := range remaining {
+		msg := fmt.Sprintf("imports %s", loc.importPath)
+		if *outputFormat == formatGHA {
+			fmt.Printf("::error%s,col=%d::%s\n", annotationLocation(loc.filename, loc.line), loc.col, escapeAnnotation(msg))
+			continue
+		}
+		fmt.Printf("%s:%d:%d: %s\n", relativePath(loc.filename), loc.line, loc.col, msg)
+	}
+	fmt.Printf("\n%d import(s) of %s remain\n", len(remaining), oldPath)
+	os.Exit(1)
+}
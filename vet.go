@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// With -vet, 'go vet' is run on the packages containing the rewritten files,
+// both before the files are written and once the upgrade is done, and the
+// findings that are new after the upgrade (e.g. a printf verb that no longer
+// matches the type of its argument) are reported as warnings, and included in
+// the summary. Only the rewritten packages are vetted, to keep it quick.
+
+// vetFindingsEnv is the environment variable that a -batch run sets to the
+// path of a file, to which each upgrade's run writes its new findings (one
+// per line), for the pull request description
+const vetFindingsEnv = "UPGRADE_VET_FINDINGS"
+
+// vetFinding is a finding of 'go vet', at a position relative to the module
+// directory
+type vetFinding struct {
+	file    string
+	line    int
+	message string
+}
+
+func (f vetFinding) String() string {
+	return fmt.Sprintf("%s:%d: %s", f.file, f.line, f.message)
+}
+
+var vetFindingRegexp = regexp.MustCompile(`^(?:vet: )?(.+?\.go):(\d+)(?::\d+)?: (.*)$`)
+
+// vetPackageDirs returns the directories of the packages containing the
+// files, relative to the module directory, as 'go vet' patterns
+func vetPackageDirs(dir string, files []file) ([]string, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error getting absolute path of module directory: %s", err)
+	}
+	var patterns []string
+	for _, f := range files {
+		rel, err := filepath.Rel(absDir, filepath.Dir(f.name))
+		if err != nil {
+			return nil, fmt.Errorf("error getting relative path of %s: %s", f.name, err)
+		}
+		pattern := "./" + filepath.ToSlash(rel)
+		if rel == "." {
+			pattern = "."
+		}
+		if !slices.Contains(patterns, pattern) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	slices.Sort(patterns)
+	return patterns, nil
+}
+
+// vetPackages runs 'go vet' on the packages in the module directory, and
+// returns its findings
+func vetPackages(ctx context.Context, dir string, patterns []string) ([]vetFinding, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error getting absolute path of module directory: %s", err)
+	}
+
+	cmd := exec.CommandContext(ctx, "go", append([]string{"vet"}, patterns...)...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+
+	// NOTE: 'go vet' fails when it has findings, so its output has to be
+	// checked to tell those apart from it failing to run at all
+	var findings []vetFinding
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "#"):
+			// Package header
+		case strings.HasPrefix(line, "\t") && len(findings) > 0:
+			// Continuation of the previous finding's message
+			findings[len(findings)-1].message += " " + strings.TrimSpace(line)
+		default:
+			match := vetFindingRegexp.FindStringSubmatch(line)
+			if match == nil {
+				continue
+			}
+			file := match[1]
+			if filepath.IsAbs(file) {
+				if rel, err := filepath.Rel(absDir, file); err == nil {
+					file = rel
+				}
+			}
+			lineNumber, _ := strconv.Atoi(match[2])
+			findings = append(findings, vetFinding{
+				file:    filepath.ToSlash(strings.TrimPrefix(file, "./")),
+				line:    lineNumber,
+				message: match[3],
+			})
+		}
+	}
+	var exitErr *exec.ExitError
+	if err != nil && (!errors.As(err, &exitErr) || len(findings) == 0) {
+		return nil, fmt.Errorf("error executing 'go vet' command: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return findings, nil
+}
+
+// newVetFindings returns the findings that weren't found before the upgrade.
+// Findings are compared by file and message, since rewriting a file's imports
+// can move its lines.
+func newVetFindings(before, after []vetFinding) []vetFinding {
+	seen := map[[2]string]int{}
+	for _, finding := range before {
+		seen[[2]string{finding.file, finding.message}]++
+	}
+	var findings []vetFinding
+	for _, finding := range after {
+		key := [2]string{finding.file, finding.message}
+		if seen[key] > 0 {
+			seen[key]--
+			continue
+		}
+		findings = append(findings, finding)
+	}
+	return findings
+}
+
+// reportVetFindings warns about the new findings, records them for the
+// summary, and (in a -batch run) writes them out for the pull request
+// description
+func reportVetFindings(dir string, findings []vetFinding) error {
+	var lines []string
+	for _, finding := range findings {
+		warnfAt(filepath.Join(dir, finding.file), finding.line, "go vet: %s", finding.message)
+		stats.addVetFinding(finding.String())
+		lines = append(lines, finding.String()+"\n")
+	}
+
+	filename := os.Getenv(vetFindingsEnv)
+	if filename == "" {
+		return nil
+	}
+	if err := os.WriteFile(filename, []byte(strings.Join(lines, "")), 0o644); err != nil {
+		return fmt.Errorf("error writing vet findings: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// checkDeprecations warns about each upgraded dependency whose module has
+// been deprecated by its authors (via a "Deprecated:" comment on the module
+// directive in the go.mod file of its latest version)
+func checkDeprecations(ctx context.Context, file *modfile.File, upgrades []upgrade) {
+	for _, upgrade := range upgrades {
+		// The current module can't be deprecated by its own upgrade
+		if upgrade.newVersion == "" {
+			continue
+		}
+
+		deprecated, err := moduleDeprecation(ctx, upgrade.newSource())
+		if err != nil {
+			warnf("error checking whether %s is deprecated: %s", upgrade.newSource(), err)
+			continue
+		}
+		if deprecated != "" {
+			warnfAt(file.Syntax.Name, requireLine(file, upgrade.newPath),
+				"%s is deprecated: %s", upgrade.newSource(), deprecated,
+			)
+		}
+	}
+}
+
+// moduleDeprecation returns the deprecation message of the given module, or an
+// empty string if it isn't deprecated. Modules fetched directly from version
+// control (rather than via a proxy) aren't checked.
+func moduleDeprecation(ctx context.Context, path string) (string, error) {
+	versions, err := listVersions(ctx, path)
+	if errors.Is(err, errDirect) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// NOTE: Like the go command, only the latest release is taken into
+	// account (or the latest pre-release, if there are no releases)
+	var release, prerelease string
+	for _, version := range versions {
+		if semver.Prerelease(version) == "" {
+			release = semver.Max(release, version)
+		} else {
+			prerelease = semver.Max(prerelease, version)
+		}
+	}
+	latest := release
+	if latest == "" {
+		latest = prerelease
+	}
+	if latest == "" {
+		return "", nil
+	}
+
+	b, err := proxyFetch(ctx, path, "@v/"+escapeVersion(latest)+".mod")
+	if err != nil {
+		return "", err
+	}
+	modFile, err := modfile.ParseLax(path+"@"+latest+"/go.mod", b, nil)
+	if err != nil {
+		return "", fmt.Errorf("error parsing go.mod file of %s %s: %s", path, latest, err)
+	}
+	if modFile.Module == nil {
+		return "", nil
+	}
+	return modFile.Module.Deprecated, nil
+}
+
+// checkDualMajors warns about dependencies that are required at more than one
+// major version (e.g. both example.com/dep and example.com/dep/v2), which is
+// typically left behind by an incomplete upgrade
+func checkDualMajors(file *modfile.File) {
+	byPrefix := map[string][]*modfile.Require{}
+	var prefixes []string
+	for _, require := range file.Require {
+		prefix, _, ok := module.SplitPathVersion(require.Mod.Path)
+		if !ok {
+			continue
+		}
+		if _, ok := byPrefix[prefix]; !ok {
+			prefixes = append(prefixes, prefix)
+		}
+		byPrefix[prefix] = append(byPrefix[prefix], require)
+	}
+
+	for _, prefix := range prefixes {
+		requires := byPrefix[prefix]
+		if len(requires) < 2 {
+			continue
+		}
+		for _, require := range requires {
+			var line int
+			if require.Syntax != nil {
+				line = require.Syntax.Start.Line
+			}
+			warnfAt(file.Syntax.Name, line, "%s %s is required alongside another major version of the same module",
+				require.Mod.Path, require.Mod.Version,
+			)
+		}
+	}
+}
+
+// requireLine returns the line of the go.mod file on which the given module is
+// required, or 0 if it isn't
+func requireLine(file *modfile.File, path string) int {
+	for _, require := range file.Require {
+		if require.Mod.Path == path && require.Syntax != nil {
+			return require.Syntax.Start.Line
+		}
+	}
+	return 0
+}
+
+// explainRemainingMajors explains why the old major version of an upgraded
+// dependency is still required after the upgrade (i.e. after 'go list' added
+// it back), with the chain of imports that needs it, as found by 'go mod why
+// -m'. If no package imports it, the modules that require it in the module
+// graph are listed instead. Old versions kept on purpose (with -keep-old)
+// aren't explained.
+func explainRemainingMajors(ctx context.Context, dir string, file *modfile.File, upgrades []upgrade) {
+	if *keepOld {
+		return
+	}
+	for _, upgrade := range upgrades {
+		if upgrade.oldVersion == "" || upgrade.oldPath == upgrade.newPath {
+			continue
+		}
+		line := requireLine(file, upgrade.oldPath)
+		if line == 0 {
+			continue
+		}
+
+		reason, err := whyModule(ctx, dir, upgrade.oldPath)
+		if err != nil {
+			warnf("error finding out why %s is still required: %s", upgrade.oldPath, err)
+			continue
+		}
+		warnfAt(file.Syntax.Name, line, "%s is still required after the upgrade to %s, %s",
+			upgrade.oldPath, upgrade.newPath, reason,
+		)
+	}
+}
+
+// whyModule returns the reason the module in the given directory needs the
+// given module: the shortest chain of imports from one of its packages to
+// one of the module's, or the modules that require it
+func whyModule(ctx context.Context, dir, path string) (string, error) {
+	cmd := exec.CommandContext(ctx, "go", "mod", "why", "-m", path)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("error executing 'go mod why' command: %s", err)
+	}
+
+	// The output is a "# path" header, followed by the chain of imports (one
+	// package per line), or by a note in parentheses if there isn't one
+	var chain []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "(") {
+			chain = append(chain, line)
+		}
+	}
+	if len(chain) > 0 {
+		return "since it's imported via " + strings.Join(chain, " -> "), nil
+	}
+
+	requirers, err := moduleRequirers(ctx, dir, path)
+	if err != nil {
+		return "", err
+	}
+	if len(requirers) == 0 {
+		return "though nothing seems to need it (try 'go mod tidy')", nil
+	}
+	return "since it's required by " + strings.Join(requirers, ", ") + " (though no package imports it)", nil
+}
+
+// moduleRequirers returns the modules (as path@version) that require the
+// given module in the module graph, other than the main module
+func moduleRequirers(ctx context.Context, dir, path string) ([]string, error) {
+	cmd := exec.CommandContext(ctx, "go", "mod", "graph")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("error executing 'go mod graph' command: %s", err)
+	}
+
+	var requirers []string
+	for _, line := range strings.Split(string(out), "\n") {
+		from, to, ok := strings.Cut(line, " ")
+		if !ok || !strings.Contains(from, "@") {
+			continue
+		}
+		if toPath, _, _ := strings.Cut(to, "@"); toPath == path && !slices.Contains(requirers, from) {
+			requirers = append(requirers, from)
+		}
+	}
+	return requirers, nil
+}
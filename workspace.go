@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+)
+
+// In a workspace (see 'go help work'), the build list is shared by all of its
+// modules, so upgrading a dependency in one of them while another still
+// requires the old major version leaves the workspace resolving both, with
+// diverging behavior. Once a module is upgraded, the other modules of its
+// workspace that still require the old major version of an upgraded
+// dependency are reported, and, if stdin is a terminal, the user is offered to
+// upgrade them too (by running this tool again for each of them).
+
+// checkWorkspace reports the other modules of the workspace of the module in
+// the given directory that still require the old major versions of the
+// upgraded dependencies, offering to upgrade them too
+func checkWorkspace(ctx context.Context, dir string, upgrades []upgrade) {
+	others, err := workspaceModules(ctx, dir)
+	if err != nil {
+		warnf("error checking the other modules of the workspace: %s", err)
+		return
+	}
+	for _, other := range others {
+		filename := filepath.Join(other, "go.mod")
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			warnf("error reading module file %s: %s", filename, err)
+			continue
+		}
+		otherFile, err := modfile.Parse(filename, b, nil)
+		if err != nil || otherFile.Module == nil {
+			warnf("error parsing module file %s: %v", filename, err)
+			continue
+		}
+
+		var pending []upgrade
+		for _, upgrade := range upgrades {
+			if upgrade.oldPath == upgrade.newPath {
+				continue
+			}
+			line := requireLine(otherFile, upgrade.oldPath)
+			if line == 0 {
+				continue
+			}
+			warnfAt(filename, line, "%s still requires %s, which was upgraded to %s in another module of the workspace, so the workspace resolves both",
+				otherFile.Module.Mod.Path, upgrade.oldPath, upgrade.newPath,
+			)
+			// NOTE: The upgrade of a module itself is resolved by the
+			// workspace, rather than published at a version yet
+			if upgrade.newVersion != "" {
+				pending = append(pending, upgrade)
+			}
+		}
+
+		if !stdinIsTerminal() {
+			continue
+		}
+		for _, upgrade := range pending {
+			if !confirm(fmt.Sprintf("Upgrade %s to %s in %s too?", upgrade.oldPath, upgrade.newPath, otherFile.Module.Mod.Path)) {
+				continue
+			}
+			if err := upgradeWorkspaceModule(ctx, other, upgrade); err != nil {
+				warnf("error upgrading %s in %s: %s", upgrade.oldPath, other, err)
+			}
+		}
+	}
+}
+
+// upgradeWorkspaceModule applies the upgrade to the module in the given
+// directory, by running this tool again there, with the same flags
+func upgradeWorkspaceModule(ctx context.Context, dir string, upgrade upgrade) error {
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error finding executable: %s", err)
+	}
+	fmt.Printf("\n==> %s\n", filepath.ToSlash(dir))
+	// NOTE: The flags that name output files are left out, since the
+	// run would overwrite this one's
+	args := append([]string{"-d", dir}, forwardedFlags("d", "f", "html", "sbom", "subdir")...)
+	args = append(args, upgrade.oldPath)
+	// NOTE: A new module path that isn't the old one's with another major
+	// version suffix (see resolveMovedVersion) is given explicitly
+	if derived, err := upgradePath(upgrade.oldPath, upgrade.newVersion); err != nil || derived != upgrade.newPath {
+		args = append(args, upgrade.newPath)
+	}
+	args = append(args, upgrade.newVersion)
+	cmd := exec.CommandContext(ctx, self, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), noJournalEnv+"=1")
+	if err := cmd.Run(); err != nil && !exitedUpToDate(err) {
+		return err
+	}
+	return nil
+}
+
+// workspaceModules returns the directories of the other modules of the
+// workspace that the module in the given directory is used by (according to
+// 'go env GOWORK'), or nil if it isn't in one
+func workspaceModules(ctx context.Context, dir string) ([]string, error) {
+	cmd := exec.CommandContext(ctx, "go", "env", "GOWORK")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("error executing 'go env GOWORK' command: %s", err)
+	}
+	workFile := strings.TrimSpace(string(out))
+	if workFile == "" || workFile == "off" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(workFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading workspace file: %s", err)
+	}
+	work, err := modfile.ParseWork(workFile, b, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing workspace file: %s", err)
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		others []string
+		used   bool
+	)
+	for _, use := range work.Use {
+		useDir := filepath.FromSlash(use.Path)
+		if !filepath.IsAbs(useDir) {
+			useDir = filepath.Join(filepath.Dir(workFile), useDir)
+		}
+		if samePath(useDir, absDir) {
+			used = true
+			continue
+		}
+		others = append(others, useDir)
+	}
+	if !used {
+		return nil, nil
+	}
+	return others, nil
+}
+
+// setWorkspace applies the -workspace flag: the path of the go.work file to
+// use (made absolute, as the go command requires), or "off" to disable
+// workspace mode. It's applied by setting GOWORK, so that every go command the
+// tool runs (including the ones loading packages, and resolving versions)
+// behaves as if the user had set it.
+func setWorkspace(value string) error {
+	if value != "off" {
+		if filepath.Ext(value) != ".work" {
+			return fmt.Errorf("%s must be a go.work file (ending in .work), or off", value)
+		}
+		abs, err := filepath.Abs(value)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(abs); err != nil {
+			return err
+		}
+		value = abs
+	}
+	return os.Setenv("GOWORK", value)
+}
+
+// moduleModeEnv returns the environment of the go commands that update the
+// module's go.mod, go.sum or vendor directory (e.g. 'go list -mod=mod' or 'go
+// mod vendor'), which workspace mode doesn't allow, and which are about the
+// module itself anyway
+func moduleModeEnv() []string {
+	return append(os.Environ(), "GOWORK=off")
+}